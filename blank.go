@@ -0,0 +1,40 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"image"
+)
+
+// blankMaxInk is the maximum proportion of dark pixels in a page
+// for it to be considered blank. It is low enough that a page with
+// just a short heading on it isn't considered blank.
+const blankMaxInk = 0.0001
+
+// blankMargin is the proportion of each edge of a page which is
+// ignored when checking whether it is blank, as any remaining
+// noise from the edge of the scan is likely to be there
+const blankMargin = 0.05
+
+// IsBlank returns whether a binarised image of a page is blank,
+// having almost no dark pixels away from its edges
+func IsBlank(img image.Image) bool {
+	b := img.Bounds()
+	mx, my := int(float64(b.Dx())*blankMargin), int(float64(b.Dy())*blankMargin)
+	inner := image.Rect(b.Min.X+mx, b.Min.Y+my, b.Max.X-mx, b.Max.Y-my)
+	if inner.Empty() {
+		return true
+	}
+
+	dark := 0
+	for y := inner.Min.Y; y < inner.Max.Y; y++ {
+		for x := inner.Min.X; x < inner.Max.X; x++ {
+			if grey(img.At(x, y)) < 128 {
+				dark++
+			}
+		}
+	}
+	return float64(dark)/float64(inner.Dx()*inner.Dy()) <= blankMaxInk
+}
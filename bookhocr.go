@@ -0,0 +1,213 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Renumber sets the ids of a page and all of its elements so that
+// they are unique within a book, based on the page number n
+// (counting from 1). The ids follow the same scheme as Tesseract,
+// e.g. line_3_12 for the 12th line of the 3rd page.
+func (p *HocrPage) Renumber(n int) {
+	p.Id = fmt.Sprintf("page_%d", n)
+	var nareas, npars, nlines, nwords int
+	for i := range p.Areas {
+		a := &p.Areas[i]
+		nareas++
+		a.Id = fmt.Sprintf("block_%d_%d", n, nareas)
+		for j := range a.Pars {
+			par := &a.Pars[j]
+			npars++
+			par.Id = fmt.Sprintf("par_%d_%d", n, npars)
+			for k := range par.Lines {
+				l := &par.Lines[k]
+				nlines++
+				l.Id = fmt.Sprintf("line_%d_%d", n, nlines)
+				for m := range l.Words {
+					nwords++
+					l.Words[m].Id = fmt.Sprintf("word_%d_%d", n, nwords)
+				}
+			}
+		}
+	}
+}
+
+// renumbered returns a copy of a page renumbered with Renumber,
+// leaving the original and its elements unchanged
+func (p HocrPage) renumbered(n int) HocrPage {
+	p.Areas = append([]HocrArea(nil), p.Areas...)
+	for i := range p.Areas {
+		a := &p.Areas[i]
+		a.Pars = append([]HocrPar(nil), a.Pars...)
+		for j := range a.Pars {
+			par := &a.Pars[j]
+			par.Lines = append([]HocrLine(nil), par.Lines...)
+			for k := range par.Lines {
+				l := &par.Lines[k]
+				l.Words = append([]HocrWord(nil), l.Words...)
+			}
+		}
+	}
+	p.Renumber(n)
+	return p
+}
+
+// bboxTitle returns an hOCR title attribute containing just a bbox
+func bboxTitle(b [4]int) string {
+	return fmt.Sprintf("bbox %d %d %d %d", b[0], b[1], b[2], b[3])
+}
+
+// ppagenoRe matches the physical page number property of an
+// ocr_page title
+var ppagenoRe = regexp.MustCompile(`ppageno [0-9]+`)
+
+const bookHocrHead = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"
+    "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+ <head>
+  <title>%s</title>
+  <meta http-equiv="Content-Type" content="text/html;charset=utf-8"/>
+  <meta name='ocr-system' content='rescribe bookpipeline'/>
+  <meta name='ocr-capabilities' content='ocr_page ocr_carea ocr_par ocr_line ocrx_word ocrp_wconf'/>
+  <meta name='ocr-number-of-pages' content='%d'/>
+%s </head>
+ <body>
+`
+
+// WriteBookHocr writes a set of hOCR pages as a single multi-page
+// hOCR document. The pages are renumbered so that all ids are
+// unique in the document, without changing pages itself, and any
+// page labels are recorded as the lpageno of each page.
+func WriteBookHocr(w io.Writer, title string, pages []HocrPage) error {
+	return WriteBookHocrWithMetadata(w, Metadata{Title: title}, pages)
+}
+
+// WriteBookHocrWithMetadata writes a multi-page hOCR document in the
+// same way as WriteBookHocr, describing the book with Dublin Core
+// meta tags in its head from the metadata m
+func WriteBookHocrWithMetadata(w io.Writer, m Metadata, pages []HocrPage) error {
+	bw := bufio.NewWriter(w)
+	e := html.EscapeString
+
+	var meta strings.Builder
+	dc := func(name, content string) {
+		if content != "" {
+			fmt.Fprintf(&meta, "  <meta name='DC.%s' content='%s'/>\n", name, e(content))
+		}
+	}
+	for _, a := range m.Authors {
+		dc("creator", a)
+	}
+	dc("date", m.Year)
+	dc("publisher", m.Publisher)
+	dc("language", m.Language)
+	dc("source", m.Source())
+
+	fmt.Fprintf(bw, bookHocrHead, e(m.Title), len(pages), meta.String())
+	for i := range pages {
+		pg := pages[i].renumbered(i + 1)
+		t := pg.Title
+		if t == "" {
+			t = bboxTitle(pg.Bbox)
+		}
+		if ppagenoRe.MatchString(t) {
+			t = ppagenoRe.ReplaceAllString(t, fmt.Sprintf("ppageno %d", i))
+		} else {
+			t += fmt.Sprintf("; ppageno %d", i)
+		}
+		if pg.Label != "" {
+			t += fmt.Sprintf("; lpageno \"%s\"", strings.ReplaceAll(pg.Label, "\"", ""))
+		}
+		fmt.Fprintf(bw, "  <div class='ocr_page' id='%s' title='%s'>\n", pg.Id, e(t))
+		for _, a := range pg.Areas {
+			fmt.Fprintf(bw, "   <div class='%s' id='%s' title='%s'>\n", e(a.Class), a.Id, e(orTitle(a.Title, a.Bbox)))
+			for _, par := range a.Pars {
+				lang := ""
+				if par.Lang != "" {
+					lang = fmt.Sprintf(" lang='%s'", e(par.Lang))
+				}
+				fmt.Fprintf(bw, "    <p class='ocr_par' id='%s'%s title='%s'>\n", par.Id, lang, e(orTitle(par.Title, par.Bbox)))
+				for _, l := range par.Lines {
+					fmt.Fprintf(bw, "     <span class='%s' id='%s' title='%s'>\n", e(l.Class), l.Id, e(orTitle(l.Title, l.Bbox)))
+					for _, word := range l.Words {
+						wt := word.Title
+						if wt == "" {
+							wt = fmt.Sprintf("%s; x_wconf %.0f", bboxTitle(word.Bbox), word.Conf)
+						}
+						fmt.Fprintf(bw, "      <span class='ocrx_word' id='%s' title='%s'>%s</span>\n", word.Id, e(wt), e(word.Text))
+					}
+					bw.WriteString("     </span>\n")
+				}
+				bw.WriteString("    </p>\n")
+			}
+			bw.WriteString("   </div>\n")
+		}
+		bw.WriteString("  </div>\n")
+	}
+	bw.WriteString(" </body>\n</html>\n")
+
+	return bw.Flush()
+}
+
+// orTitle returns title, or a title made from bbox if it is empty
+func orTitle(title string, bbox [4]int) string {
+	if title == "" {
+		return bboxTitle(bbox)
+	}
+	return title
+}
+
+// HocrWordJSON is the structure of each word in the JSON-lines
+// output of WriteWordsJSONL
+type HocrWordJSON struct {
+	Page int     `json:"page"`
+	Line string  `json:"line"`
+	Id   string  `json:"id"`
+	Text string  `json:"text"`
+	Bbox [4]int  `json:"bbox"`
+	Conf float64 `json:"conf"`
+	// Label is the printed label of the page, if it has one
+	Label string `json:"label,omitempty"`
+}
+
+// WriteWordsJSONL writes every word of a set of hOCR pages as a
+// line of JSON, with its page number (counting from 1) and label,
+// line id, bounding box and confidence. The pages are renumbered
+// in the same way as WriteBookHocr, so the ids match those in its
+// output.
+func WriteWordsJSONL(w io.Writer, pages []HocrPage) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	for i := range pages {
+		pg := pages[i].renumbered(i + 1)
+		for _, l := range pg.Lines() {
+			for _, word := range l.Words {
+				err := enc.Encode(HocrWordJSON{
+					Page:  i + 1,
+					Line:  l.Id,
+					Id:    word.Id,
+					Text:  word.Text,
+					Bbox:  word.Bbox,
+					Conf:  word.Conf,
+					Label: pg.Label,
+				})
+				if err != nil {
+					return fmt.Errorf("Error encoding word %s: %v", word.Id, err)
+				}
+			}
+		}
+	}
+	return bw.Flush()
+}
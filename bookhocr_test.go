@@ -0,0 +1,101 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteBookHocr(t *testing.T) {
+	pages := testPages(t)
+	orig := testPages(t)
+
+	var b bytes.Buffer
+	err := WriteBookHocrWithMetadata(&b, Metadata{Title: "Novum Organum", Authors: []string{"Francis Bacon"}, Year: "1620"}, pages)
+	if err != nil {
+		t.Fatalf("Error writing book hOCR: %v", err)
+	}
+	if !reflect.DeepEqual(pages, orig) {
+		t.Errorf("Expected pages to be unchanged by writing book hOCR")
+	}
+
+	s := b.String()
+	for _, want := range []string{
+		"<title>Novum Organum</title>",
+		"<meta name='ocr-number-of-pages' content='2'/>",
+		"<meta name='DC.creator' content='Francis Bacon'/>",
+		"<meta name='DC.date' content='1620'/>",
+		"<div class='ocr_page' id='page_1' title='image &#34;0001.png&#34;; bbox 0 0 1000 1500; ppageno 0'>",
+		"<div class='ocr_page' id='page_2' title='image &#34;0001.png&#34;; bbox 0 0 1000 1500; ppageno 1; lpageno &#34;iv&#34;'>",
+		"<span class='ocr_header' id='line_2_3' title='bbox 100 300 900 340'>",
+		"<span class='ocrx_word' id='word_2_1' title='bbox 100 100 300 140; x_wconf 95'>-</span>",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Expected %s in book hOCR", want)
+		}
+	}
+
+	// the output can be read back, with the pages in order
+	got := parseTestHocr(t, s)
+	if len(got) != 2 || got[1].Id != "page_2" || got[1].Words()[5].Id != "word_2_6" || got[1].Words()[5].Text != "vera" {
+		t.Errorf("Unexpected pages read from book hOCR %+v", got)
+	}
+
+	// titles are made from the bbox if a page has none
+	b.Reset()
+	err = WriteBookHocr(&b, "a<b", []HocrPage{{Bbox: [4]int{0, 0, 10, 20}}})
+	if err != nil {
+		t.Fatalf("Error writing book hOCR: %v", err)
+	}
+	for _, want := range []string{"<title>a&lt;b</title>", "<div class='ocr_page' id='page_1' title='bbox 0 0 10 20; ppageno 0'>"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected %s in book hOCR", want)
+		}
+	}
+}
+
+func TestWriteWordsJSONL(t *testing.T) {
+	pages := testPages(t)
+	orig := testPages(t)
+
+	var b bytes.Buffer
+	err := WriteWordsJSONL(&b, pages)
+	if err != nil {
+		t.Fatalf("Error writing words: %v", err)
+	}
+	if !reflect.DeepEqual(pages, orig) {
+		t.Errorf("Expected pages to be unchanged by writing words")
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 12 {
+		t.Fatalf("Expected 12 words, got %d", len(lines))
+	}
+	cases := []struct {
+		line int
+		want HocrWordJSON
+	}{
+		{0, HocrWordJSON{Page: 1, Line: "line_1_1", Id: "word_1_1", Text: "Novum", Bbox: [4]int{100, 100, 300, 140}, Conf: 95}},
+		{5, HocrWordJSON{Page: 1, Line: "line_1_3", Id: "word_1_6", Text: "vera", Bbox: [4]int{520, 300, 900, 340}, Conf: 75}},
+		{7, HocrWordJSON{Page: 2, Line: "line_2_1", Id: "word_2_2", Text: "Orga-", Bbox: [4]int{320, 100, 900, 140}, Conf: 40, Label: "iv"}},
+	}
+	for _, c := range cases {
+		var got HocrWordJSON
+		err = json.Unmarshal([]byte(lines[c.line]), &got)
+		if err != nil {
+			t.Fatalf("Error parsing line %d: %v", c.line, err)
+		}
+		if got != c.want {
+			t.Errorf("Line %d: expected %+v, got %+v", c.line, c.want, got)
+		}
+	}
+	if strings.Contains(lines[0], "label") {
+		t.Errorf("Expected no label for an unlabelled page, got %s", lines[0])
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// RunningKind is the type of a RunningLine
+type RunningKind int
+
+const (
+	RunningHeader RunningKind = iota
+	RunningFooter
+	PageNumber
+)
+
+// RunningLine is a line found to be a running header, running
+// footer or page number, rather than part of the main text.
+type RunningLine struct {
+	Page int // index of the page
+	Line int // index of the line in the page's Lines()
+	Kind RunningKind
+	Text string
+}
+
+// runningCandidates is the maximum number of lines at the top and
+// bottom of each page which are considered as possible running
+// headers or footers
+const runningCandidates = 2
+
+// runningMargin is the proportion of the page height at the top and
+// bottom in which running headers and footers are looked for
+const runningMargin = 0.2
+
+// runningWindow is the number of pages before and after a page
+// which are compared to it to find repeated lines. It is 2 so that
+// headers which alternate between recto and verso pages are found.
+const runningWindow = 2
+
+// runningSimilarity is the minimum similarity (from 0 to 1) for two
+// lines to be considered the same running header or footer, allowing
+// for some OCR errors
+const runningSimilarity = 0.8
+
+// runningMinLen is the minimum length of a normalised line for it to
+// be compared with other pages
+const runningMinLen = 4
+
+// romanRe matches a word made only of roman numerals
+var romanRe = regexp.MustCompile(`(?i)^[ivxlcdm]+$`)
+
+// normaliseRunning reduces a line to a form which is the same for
+// each instance of a running header or footer, by removing any page
+// number, punctuation, spaces and case.
+func normaliseRunning(s string) string {
+	words := strings.Fields(s)
+	if len(words) > 1 && romanRe.MatchString(strings.Trim(words[0], ".,;:-")) {
+		words = words[1:]
+	}
+	if len(words) > 1 && romanRe.MatchString(strings.Trim(words[len(words)-1], ".,;:-")) {
+		words = words[:len(words)-1]
+	}
+	var b strings.Builder
+	for _, r := range strings.Join(words, "") {
+		if unicode.IsLetter(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// similarity returns how similar two strings are, from 0 (entirely
+// different) to 1 (identical), based on their Levenshtein distance.
+func similarity(a, b string) float64 {
+	ar, br := []rune(a), []rune(b)
+	if len(ar) == 0 && len(br) == 0 {
+		return 1
+	}
+	prev := make([]int, len(br)+1)
+	cur := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return 1 - float64(prev[len(br)])/float64(max(len(ar), len(br)))
+}
+
+// pageNumberLine parses a line which only contains a page number,
+// in arabic or roman numerals, possibly surrounded by punctuation
+func pageNumberLine(s string) (pageNumber, bool) {
+	s = strings.TrimFunc(s, func(r rune) bool {
+		return unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r)
+	})
+	if len(strings.Fields(s)) != 1 {
+		return pageNumber{}, false
+	}
+	return parsePageNumber(s)
+}
+
+// consistentNumber returns whether a page number p on page n follows
+// on from a page number on any nearby page, so that words like "mix"
+// or years like "1742" on their own line aren't taken as page numbers
+func consistentNumber(p pageNumber, nums [][]pageNumber, n int) bool {
+	for i := max(0, n-labelWindow); i <= min(len(nums)-1, n+labelWindow); i++ {
+		if i == n {
+			continue
+		}
+		for _, q := range nums[i] {
+			if q.roman == p.roman && q.n-p.n == i-n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runningCandidate is a line near the top or bottom of a page
+type runningCandidate struct {
+	line int
+	norm string
+	text string
+}
+
+// pageCandidates returns the lines of a page which could be running
+// headers (top) or footers (bottom), nearest the edge first
+func pageCandidates(pg HocrPage) (top []runningCandidate, bottom []runningCandidate) {
+	lines := pg.Lines()
+	height := pg.Bbox[3] - pg.Bbox[1]
+
+	bytop := make([]int, len(lines))
+	for i := range bytop {
+		bytop[i] = i
+	}
+	bybottom := append([]int{}, bytop...)
+	sort.SliceStable(bytop, func(a, b int) bool {
+		return lines[bytop[a]].Bbox[1] < lines[bytop[b]].Bbox[1]
+	})
+	sort.SliceStable(bybottom, func(a, b int) bool {
+		return lines[bybottom[a]].Bbox[3] > lines[bybottom[b]].Bbox[3]
+	})
+
+	used := make(map[int]bool)
+	for _, i := range bytop {
+		if len(top) >= runningCandidates || (height > 0 && float64(lines[i].Bbox[1]-pg.Bbox[1]) > float64(height)*runningMargin) {
+			break
+		}
+		t := lines[i].Text()
+		top = append(top, runningCandidate{line: i, norm: normaliseRunning(t), text: t})
+		used[i] = true
+	}
+	for _, i := range bybottom {
+		if len(bottom) >= runningCandidates || (height > 0 && float64(pg.Bbox[3]-lines[i].Bbox[3]) > float64(height)*runningMargin) {
+			break
+		}
+		if used[i] {
+			continue
+		}
+		t := lines[i].Text()
+		bottom = append(bottom, runningCandidate{line: i, norm: normaliseRunning(t), text: t})
+	}
+	return top, bottom
+}
+
+// FindRunningLines finds running headers, running footers and page
+// numbers in a book. Page numbers are found by their content, only
+// if they follow on from a page number on a nearby page, and headers
+// and footers by comparing lines at the top and bottom of each page
+// with those on nearby pages.
+func FindRunningLines(pages []HocrPage) []RunningLine {
+	tops := make([][]runningCandidate, len(pages))
+	bottoms := make([][]runningCandidate, len(pages))
+	for i, pg := range pages {
+		tops[i], bottoms[i] = pageCandidates(pg)
+	}
+
+	nums := make([][]pageNumber, len(pages))
+	for i := range pages {
+		for _, cands := range [][]runningCandidate{tops[i], bottoms[i]} {
+			for _, c := range cands {
+				if p, ok := pageNumberLine(c.text); ok {
+					nums[i] = append(nums[i], p)
+				}
+			}
+		}
+	}
+
+	var found []RunningLine
+	check := func(cands [][]runningCandidate, kind RunningKind) {
+		for i, pgcands := range cands {
+			for _, c := range pgcands {
+				if p, ok := pageNumberLine(c.text); ok && consistentNumber(p, nums, i) {
+					found = append(found, RunningLine{Page: i, Line: c.line, Kind: PageNumber, Text: c.text})
+					continue
+				}
+				if len([]rune(c.norm)) < runningMinLen {
+					continue
+				}
+				if repeated(c.norm, cands, i) {
+					found = append(found, RunningLine{Page: i, Line: c.line, Kind: kind, Text: c.text})
+				}
+			}
+		}
+	}
+	check(tops, RunningHeader)
+	check(bottoms, RunningFooter)
+
+	return found
+}
+
+// repeated returns whether a normalised line is similar to any of
+// the candidates on the pages near page n
+func repeated(norm string, cands [][]runningCandidate, n int) bool {
+	for i := n - runningWindow; i <= n+runningWindow; i++ {
+		if i == n || i < 0 || i >= len(cands) {
+			continue
+		}
+		for _, c := range cands[i] {
+			if similarity(norm, c.norm) >= runningSimilarity {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CleanText returns the text of a book with any running headers,
+// footers and page numbers removed, words hyphenated across lines
+// and pages joined, and paragraphs separated by a blank line. Pages
+// with an average confidence below minconf are left out.
+func CleanText(pages []HocrPage, minconf float64) string {
+	skip := make(map[[2]int]bool)
+	for _, r := range FindRunningLines(pages) {
+		skip[[2]int{r.Page, r.Line}] = true
+	}
+
+	var pars []string
+	carry := ""
+	for i, pg := range pages {
+		if pg.AvgConf() < minconf {
+			continue
+		}
+		n := 0
+		var pgpars [][]string
+		for _, par := range pg.Pars() {
+			var lines []string
+			for _, l := range par.Lines {
+				if !skip[[2]int{i, n}] {
+					lines = append(lines, l.Text())
+				}
+				n++
+			}
+			if len(lines) > 0 {
+				pgpars = append(pgpars, lines)
+			}
+		}
+
+		for j, lines := range pgpars {
+			t := Dehyphenate(lines)
+			if t == "" {
+				continue
+			}
+			if carry != "" {
+				t = carry + t
+				carry = ""
+			}
+			if j == len(pgpars)-1 && EndsHyphenated(lines[len(lines)-1]) {
+				carry = strings.TrimRight(t, hyphens)
+				continue
+			}
+			pars = append(pars, t)
+		}
+	}
+	if carry != "" {
+		pars = append(pars, carry)
+	}
+
+	if len(pars) == 0 {
+		return ""
+	}
+	return strings.Join(pars, "\n\n") + "\n"
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// runningPage returns a page with a line at the top, middle and
+// bottom, each in its own paragraph, with every word having a
+// confidence of conf
+func runningPage(conf float64, top, middle, bottom string) HocrPage {
+	pg := HocrPage{Bbox: [4]int{0, 0, 1000, 1000}}
+	var pars []HocrPar
+	for i, y := range []int{20, 500, 960} {
+		t := []string{top, middle, bottom}[i]
+		var words []HocrWord
+		for _, w := range strings.Fields(t) {
+			words = append(words, HocrWord{Text: w, Bbox: [4]int{100, y, 200, y + 20}, Conf: conf})
+		}
+		l := HocrLine{Class: "ocr_line", Bbox: [4]int{100, y, 900, y + 20}, Words: words}
+		pars = append(pars, HocrPar{Bbox: l.Bbox, Lines: []HocrLine{l}})
+	}
+	pg.Areas = []HocrArea{{Class: "ocr_carea", Bbox: pg.Bbox, Pars: pars}}
+	return pg
+}
+
+// runningBook is a book with a running header, which is misread on
+// one page, and page numbers at the foot of the first three pages.
+// The lines "1742" and "mix" could be page numbers, but don't follow
+// on from the others.
+func runningBook() []HocrPage {
+	return []HocrPage{
+		runningPage(90, "NOVUM ORGANUM", "Of the interpretation", "12"),
+		runningPage(90, "NOVUM ORGANUM", "of nature, conti-", "- 13 -"),
+		runningPage(90, "NOVUM ORGANUM.", "nued here", "[14]"),
+		runningPage(90, "NOVUM ORGANVM", "Anno", "1742"),
+		runningPage(30, "NOVUM ORGANUM", "Finis", "mix"),
+	}
+}
+
+func TestPageNumberLine(t *testing.T) {
+	cases := []struct {
+		s  string
+		ok bool
+		p  pageNumber
+	}{
+		{"12", true, pageNumber{n: 12}},
+		{" - 13 - ", true, pageNumber{n: 13}},
+		{"[xiv]", true, pageNumber{n: 14, roman: true}},
+		{"XIV.", true, pageNumber{n: 14, roman: true, upper: true}},
+		{"1742", true, pageNumber{n: 1742}},
+		{"12345", false, pageNumber{}},
+		{"did", false, pageNumber{}},
+		{"civil", false, pageNumber{}},
+		{"mild", false, pageNumber{}},
+		{"iiii", false, pageNumber{}},
+		{"12 13", false, pageNumber{}},
+		{"", false, pageNumber{}},
+	}
+	for _, c := range cases {
+		p, ok := pageNumberLine(c.s)
+		if ok != c.ok || p != c.p {
+			t.Errorf("%q: expected %v %+v, got %v %+v", c.s, c.ok, c.p, ok, p)
+		}
+	}
+}
+
+func TestFindRunningLines(t *testing.T) {
+	var want []RunningLine
+	for i, h := range []string{"NOVUM ORGANUM", "NOVUM ORGANUM", "NOVUM ORGANUM.", "NOVUM ORGANVM", "NOVUM ORGANUM"} {
+		want = append(want, RunningLine{Page: i, Line: 0, Kind: RunningHeader, Text: h})
+	}
+	for i, n := range []string{"12", "- 13 -", "[14]"} {
+		want = append(want, RunningLine{Page: i, Line: 2, Kind: PageNumber, Text: n})
+	}
+	if got := FindRunningLines(runningBook()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	// roman page numbers are found too, but not if the numbers don't
+	// follow on from each other
+	cases := []struct {
+		nums []string
+		want int
+	}{
+		{[]string{"iv", "v", "vi"}, 3},
+		{[]string{"iv", "", "vi"}, 2},
+		{[]string{"iv", "vi", "v"}, 0},
+		{[]string{"iv", "5", "vii"}, 0},
+		{[]string{"mix", "civil", "did"}, 0},
+	}
+	for _, c := range cases {
+		var pages []HocrPage
+		for _, n := range c.nums {
+			pages = append(pages, runningPage(90, "", "text", n))
+		}
+		if got := FindRunningLines(pages); len(got) != c.want {
+			t.Errorf("%q: expected %d page numbers, got %+v", c.nums, c.want, got)
+		}
+	}
+}
+
+func TestCleanText(t *testing.T) {
+	cases := []struct {
+		minconf float64
+		want    string
+	}{
+		{0, "Of the interpretation\n\nof nature, continued here\n\nAnno\n\n1742\n\nFinis\n\nmix\n"},
+		{50, "Of the interpretation\n\nof nature, continued here\n\nAnno\n\n1742\n"},
+		{100, ""},
+	}
+	for _, c := range cases {
+		if got := CleanText(runningBook(), c.minconf); got != c.want {
+			t.Errorf("%.0f: expected %q, got %q", c.minconf, c.want, got)
+		}
+	}
+
+	// a word hyphenated at the end of the book is kept
+	pages := []HocrPage{runningPage(90, "", "", "the end is conti-")}
+	if got := CleanText(pages, 0); got != "the end is conti\n" {
+		t.Errorf("Unexpected text %q", got)
+	}
+}
@@ -16,6 +16,8 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"rescribe.xyz/bookpipeline"
@@ -23,7 +25,7 @@ import (
 	"rescribe.xyz/bookpipeline/internal/pipeline"
 )
 
-const usage = `Usage: bookpipeline [-v] [-c conn] [-np] [-nw] [-nop] [-na] [-t training] [-shutdown true/false] [-autostop secs]
+const usage = `Usage: bookpipeline [-v] [-c conn] [-np] [-nw] [-nop] [-na] [-t training] [-epub] [-bookhocr] [-illustrations] [-detectlabels] [-iiifbase url] [-iiifsearch url] [-linelevel] [-adaptive] [-thresholds t1,t2] [-earlyexit conf] [-deskew] [-skipblank] [-metric metric] [-wordlist file] [-shutdown true/false] [-autostop secs]
 
 Watches the preprocess, wipeonly, ocrpage and analyse queues for messages.
 When one is found this general process is followed:
@@ -79,6 +81,19 @@ type Pipeliner interface {
 	Log(v ...interface{})
 }
 
+// parseThresholds parses a comma separated list of thresholds
+func parseThresholds(s string) ([]float64, error) {
+	var thresholds []float64
+	for _, v := range strings.Split(s, ",") {
+		t, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return thresholds, fmt.Errorf("Error parsing threshold %s: %v", v, err)
+		}
+		thresholds = append(thresholds, t)
+	}
+	return thresholds, nil
+}
+
 func stopTimer(t *time.Timer) {
 	if !t.Stop() {
 		<-t.C
@@ -101,6 +116,22 @@ func main() {
 	autostop := flag.Int64("autostop", 300, "automatically stop process if no work has been available for this number of seconds (to disable autostop set to 0)")
 	autoshutdown := flag.Bool("shutdown", false, "automatically shut down host computer if there has been no work to do for the duration set with -autostop")
 	conntype := flag.String("c", "aws", "connection type ('aws' or 'local')")
+	epub := flag.Bool("epub", false, "create an EPUB ebook as part of analysis")
+	epubimgconf := flag.Float64("epubimgconf", 60, "include pages with a confidence below this in the EPUB as images rather than text")
+	adaptive := flag.Bool("adaptive", false, "try extra thresholds for pages whose best threshold is the highest or lowest tried")
+	linelevel := flag.Bool("linelevel", false, "create a composite of each page from the best version of each line from any threshold")
+	cleanconf := flag.Float64("cleanconf", 30, "leave pages with a confidence below this out of the clean text")
+	illustrations := flag.Bool("illustrations", false, "crop the illustrations found on each page from its colour original as part of analysis")
+	bookhocr := flag.Bool("bookhocr", false, "create a single hOCR file and a JSON-lines words file for each book as part of analysis")
+	detectlabels := flag.Bool("detectlabels", false, "label pages in outputs with the printed page numbers found in their running headers and footers, if they weren't given labels on upload")
+	iiifbase := flag.String("iiifbase", "", "create a IIIF manifest of each book as part of analysis, for its files published at this address followed by the book name")
+	iiifsearch := flag.String("iiifsearch", "", "address of an iiifsearch server to link to from IIIF manifests for searching the books")
+	thresholdlist := flag.String("thresholds", "0.1,0.2,0.4,0.5", "comma separated list of thresholds to binarise pages with, in order of preference")
+	metric := flag.String("metric", "conf", "metric to choose the best version of each page with: conf, charconf, words or dict, or a weighted combination like 'charconf:2,words:1,dict:1'")
+	wordlist := flag.String("wordlist", "", "file with one word per line to use for the dict metric")
+	deskew := flag.Bool("deskew", false, "correct the orientation and skew of each page before binarising it")
+	skipblank := flag.Bool("skipblank", false, "don't OCR pages found to be blank, including them in outputs as images only")
+	earlyexit := flag.Float64("earlyexit", 0, "only OCR further thresholds of a page, in order, while its confidence is below this (0 to OCR every threshold)")
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), usage)
@@ -116,10 +147,34 @@ func main() {
 		verboselog = log.New(n, "", 0)
 	}
 
+	thresholds, err := parseThresholds(*thresholdlist)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pagemetric, err := pipeline.LoadMetric(*metric, *wordlist)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	origPattern := regexp.MustCompile(`[0-9]{4}.jpg$`)
 	wipePattern := regexp.MustCompile(`[0-9]{4,6}(.bin)?.png$`)
 	ocredPattern := regexp.MustCompile(`.hocr$`)
 
+	analyseopts := pipeline.AnalyseOpts{
+		Epub:          *epub,
+		EpubImgCutoff: *epubimgconf,
+		BookHocr:      *bookhocr,
+		CleanMinConf:  *cleanconf,
+		LineLevel:     *linelevel,
+		Adaptive:      *adaptive,
+		Metric:        pagemetric,
+		Illustrations: *illustrations,
+		DetectLabels:  *detectlabels,
+		IIIFBase:      *iiifbase,
+		IIIFSearch:    *iiifsearch,
+	}
+
 	var ctx context.Context
 	ctx = context.Background()
 
@@ -133,7 +188,6 @@ func main() {
 		log.Fatalln("Unknown connection type")
 	}
 
-	var err error
 	if *conntype != "local" {
 		_, err = pipeline.GetMailSettings()
 		if err != nil {
@@ -197,7 +251,7 @@ func main() {
 			}
 			conn.Log("Message received on preprocess queue, processing", msg.Body)
 			stopTimer(stopIfQuiet)
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Preprocess([]float64{0.1, 0.2, 0.4, 0.5}, false), origPattern, conn.PreQueueId(), conn.OCRPageQueueId())
+			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Preprocess(conn, pipeline.PreprocessOpts{Thresholds: thresholds, EarlyExit: *earlyexit, Deskew: *deskew, SkipBlank: *skipblank}), origPattern, conn.PreQueueId(), conn.OCRPageQueueId())
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				conn.Log("Error during preprocess", err)
@@ -215,7 +269,7 @@ func main() {
 			}
 			conn.Log("Message received on preprocess (no wipe) queue, processing", msg.Body)
 			stopTimer(stopIfQuiet)
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Preprocess([]float64{0.1, 0.2, 0.4, 0.5}, true), origPattern, conn.PreQueueId(), conn.OCRPageQueueId())
+			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Preprocess(conn, pipeline.PreprocessOpts{Thresholds: thresholds, NoWipe: true, EarlyExit: *earlyexit, Deskew: *deskew, SkipBlank: *skipblank}), origPattern, conn.PreQueueId(), conn.OCRPageQueueId())
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				conn.Log("Error during preprocess (no wipe)", err)
@@ -233,7 +287,7 @@ func main() {
 			}
 			stopTimer(stopIfQuiet)
 			conn.Log("Message received on wipeonly queue, processing", msg.Body)
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Wipe, wipePattern, conn.WipeQueueId(), conn.OCRPageQueueId())
+			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Wipe(conn), wipePattern, conn.WipeQueueId(), conn.OCRPageQueueId())
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				conn.Log("Error during wipe", err)
@@ -271,7 +325,7 @@ func main() {
 			}
 			stopTimer(stopIfQuiet)
 			conn.Log("Message received on analyse queue, processing", msg.Body)
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Analyse(conn, false), ocredPattern, conn.AnalyseQueueId(), "")
+			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Analyse(conn, analyseopts), ocredPattern, conn.AnalyseQueueId(), conn.OCRPageQueueId())
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				conn.Log("Error during analysis", err)
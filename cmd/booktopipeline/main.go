@@ -13,13 +13,14 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"rescribe.xyz/bookpipeline"
 
 	"rescribe.xyz/bookpipeline/internal/pipeline"
 )
 
-const usage = `Usage: booktopipeline [-c conn] [-t training] [-prebinarised] [-notbinarised] [-nowipe] [-v] bookdir [bookname]
+const usage = `Usage: booktopipeline [-c conn] [-t training] [-prebinarised] [-notbinarised] [-nowipe] [-profile name] [-split] [-dupes action] [-quality thresholds.json] [-meta metadata.json] [-gbookid id] [-v] bookdir/book.pdf/manifest [bookname]
 
 Uploads the book in bookdir to the S3 'inprogress' bucket and adds it
 to the 'preprocess' or 'wipeonly' SQS queue. The queue to send to is
@@ -29,7 +30,66 @@ go to the 'preprocess' queue. The queue can be manually selected by
 using the flags -prebinarised (for the wipeonly queue) or
 -notbinarised (for the preprocess queue).
 
-If bookname is omitted the last part of the bookdir is used.
+TIFF, JPEG 2000 and WebP images are converted to JPEG, or to PNG if
+they only have black and white pixels, when they are uploaded, with
+each page of a multi-page TIFF becoming a separate image. The
+conversions are listed in conversions.json alongside the book.
+Converting JPEG 2000 images needs opj_decompress from OpenJPEG.
+
+The preprocessing profile, which sets the parameters used to
+binarise and wipe the pages, can be chosen with -profile.
+
+Images in bookdir and any subdirectories are uploaded in natural
+order of their paths, so that page2.jpg comes before page10.jpg.
+The order can instead be given by an order.csv file in bookdir,
+with a line for each image of its path and optionally its printed
+page label, like "plates/3.jpg,iv", or an equivalent order.json.
+The original file and label of each page are saved with the book
+in pages.json, and the labels are used in place of page numbers in
+the PDFs, EPUB, graph and text exports created.
+
+The quality of each image is checked before uploading, measuring
+its resolution, bit depth, JPEG compression, sharpness and contrast.
+Images with problems are reported, and the book isn't uploaded if
+any are so poor that the OCR would be useless. The thresholds for
+these can be changed with -quality, giving a JSON file with "warn"
+and "block" limits for any of "dpi", "height", "bitdepth",
+"jpegquality", "sharpness" and "contrast". A limit of 0 disables
+that check.
+
+Images of double page spreads can be split into separate pages
+before uploading with -split.
+
+Images which are near-duplicates of earlier ones, such as re-shoots
+of the same page, are reported before uploading. With -dupes drop
+they are left out, keeping the first copy of each page, and with
+-dupes none they aren't looked for.
+
+Bibliographic metadata for the book, which is included in the PDFs,
+EPUB and hOCR created and in its manifest, can be given with -meta,
+as a JSON file with any of "title", "authors" (a list), "year",
+"publisher", "place", "language" and "shelfmark". A metadata.json
+in bookdir is used if -meta isn't given. With -gbookid the metadata
+is fetched from Google Books, and any given in a file is added to
+it, replacing the same fields. It is saved with the book in
+metadata.json.
+
+A PDF can be given instead of bookdir, in which case the largest
+image on each page which can be decoded is extracted and uploaded,
+rotated to match the page. JPEG, JPEG 2000 (using opj_decompress),
+JBIG2 (using jbig2dec), CCITT fax and raw images are supported.
+Images which can't be decoded are skipped, and a report of what
+was extracted from each page is uploaded as pdfreport.json.
+
+A IIIF Presentation manifest, version 2 or 3, can also be given
+instead of bookdir, either as a web address or a .json file. The
+highest resolution image of each canvas is downloaded and uploaded
+in order, with the canvas labels as page labels, and the book's
+title, authors and other details are taken from the manifest's
+metadata as if given with -meta.
+
+If bookname is omitted the last part of the bookdir is used, without
+any .pdf suffix, or for a IIIF manifest the book's title.
 `
 
 // null writer to enable non-verbose logging to be discarded
@@ -48,6 +108,12 @@ func main() {
 	dobinarise := flag.Bool("notbinarised", false, "Not binarised: all preprocessing will be done including binarisation")
 	nowipe := flag.Bool("nowipe", false, "No wipe: Disable wiping as part of preprocessing")
 	training := flag.String("t", "", "Training to use (training filename without the .traineddata part)")
+	split := flag.Bool("split", false, "Split images of double page spreads into separate pages")
+	dupes := flag.String("dupes", "report", "What to do with near-duplicate images: 'report', 'drop' or 'none'")
+	quality := flag.String("quality", "", "JSON file of image quality thresholds to use instead of the defaults")
+	profile := flag.String("profile", pipeline.DefaultProfile, "Preprocessing profile to use: "+strings.Join(pipeline.ProfileNames(), ", "))
+	metafile := flag.String("meta", "", "JSON file of bibliographic metadata for the book")
+	gbookid := flag.String("gbookid", "", "Google Books id of the book, to get its metadata from")
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), usage)
@@ -64,10 +130,10 @@ func main() {
 	if flag.NArg() > 2 {
 		bookname = flag.Arg(1)
 	} else {
-		bookname = filepath.Base(bookdir)
+		bookname = strings.TrimSuffix(filepath.Base(bookdir), ".pdf")
 	}
 
-	var ctx context.Context
+	ctx := context.Background()
 
 	if *verbose {
 		verboselog = log.New(os.Stdout, "", log.LstdFlags)
@@ -103,25 +169,173 @@ func main() {
 		qid = conn.PreNoWipeQueueId()
 	}
 
-	verboselog.Println("Checking that all images are valid in", bookdir)
-	err = pipeline.CheckImages(ctx, bookdir)
+	if _, ok := pipeline.PreprocProfiles[*profile]; !ok {
+		log.Fatalln("Unknown preprocessing profile", *profile)
+	}
+
+	if *dupes != "report" && *dupes != "drop" && *dupes != "none" {
+		log.Fatalln("Unknown action for near-duplicate images", *dupes)
+	}
+
+	// temporary directories are removed by fatal as well as on
+	// return, as log.Fatal exits without running deferred calls
+	var tempdirs []string
+	removeTempdirs := func() {
+		for _, d := range tempdirs {
+			_ = os.RemoveAll(d)
+		}
+	}
+	defer removeTempdirs()
+	fatal := func(v ...interface{}) {
+		removeTempdirs()
+		log.Fatalln(v...)
+	}
+
+	if pipeline.IsIIIFManifest(bookdir) {
+		verboselog.Println("Downloading images from IIIF manifest", bookdir)
+		iiifdir, err := pipeline.DownloadIIIF(ctx, bookdir)
+		if iiifdir != "" {
+			tempdirs = append(tempdirs, filepath.Dir(iiifdir))
+		}
+		if err != nil {
+			fatal(err)
+		}
+		if flag.NArg() <= 2 {
+			bookname = filepath.Base(iiifdir)
+		}
+		bookdir = iiifdir
+	}
+
+	var meta bookpipeline.Metadata
+	if *gbookid != "" {
+		verboselog.Println("Getting metadata from Google Books for", *gbookid)
+		meta, err = pipeline.GoogleBooksMetadata(ctx, *gbookid)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if *metafile == "" {
+		if _, err := os.Stat(filepath.Join(bookdir, bookpipeline.MetadataFile)); err == nil {
+			*metafile = filepath.Join(bookdir, bookpipeline.MetadataFile)
+		}
+	}
+	if *metafile != "" {
+		err = pipeline.ReadMetadata(*metafile, &meta)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	var pdfreport []pipeline.PdfPageReport
+	if strings.HasSuffix(strings.ToLower(bookdir), ".pdf") {
+		verboselog.Println("Extracting images from PDF", bookdir)
+		pdfdir, report, err := pipeline.ExtractPdfImages(ctx, bookdir)
+		if pdfdir != "" {
+			tempdirs = append(tempdirs, filepath.Dir(pdfdir))
+		}
+		if err != nil {
+			fatal("Error extracting images from PDF:", err)
+		}
+		for _, r := range report {
+			if r.Image == "" {
+				fmt.Printf("No image could be extracted from %s\n", r)
+			} else {
+				verboselog.Println(r)
+			}
+		}
+		pdfreport = report
+		bookdir = pdfdir
+	}
+
+	thresholds := pipeline.DefaultQualityThresholds
+	if *quality != "" {
+		thresholds, err = pipeline.ReadQualityThresholds(*quality)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if *wipeonly {
+		// prebinarised images are expected to be bilevel
+		thresholds.Warn.BitDepth, thresholds.Block.BitDepth = 0, 0
+	}
+
+	verboselog.Println("Checking that all images are valid and of good enough quality in", bookdir)
+	report, err := pipeline.CheckImageQuality(ctx, bookdir, thresholds)
+	for _, q := range report {
+		if len(q.Warnings) > 0 && len(q.Blocks) == 0 {
+			fmt.Printf("Warning: %s\n", q)
+		}
+	}
 	if err != nil {
-		log.Fatalln(err)
+		fatal(err)
+	}
+
+	if *dupes != "none" {
+		verboselog.Println("Checking for near-duplicate images in", bookdir)
+		found, err := pipeline.FindDuplicates(ctx, bookdir, pipeline.DupMaxDistance)
+		if err != nil {
+			fatal(err)
+		}
+		for _, d := range found {
+			fmt.Printf("%s is a near-duplicate of %s (distance %d)\n", d.Name, d.Of, d.Distance)
+		}
+		if *dupes == "drop" && len(found) > 0 {
+			dupedir, err := pipeline.DropDuplicates(ctx, bookdir, found)
+			if err != nil {
+				fatal(err)
+			}
+			tempdirs = append(tempdirs, dupedir)
+			fmt.Printf("Dropped %d near-duplicate images\n", len(found))
+			bookdir = dupedir
+		}
+	}
+
+	if *split {
+		verboselog.Println("Splitting double page spreads in", bookdir)
+		splitdir, n, err := pipeline.SplitSpreads(ctx, bookdir)
+		if err != nil {
+			fatal(err)
+		}
+		tempdirs = append(tempdirs, splitdir)
+		fmt.Printf("Split %d double page spreads\n", n)
+		bookdir = splitdir
 	}
 
 	verboselog.Println("Checking that a book hasn't already been uploaded with that name")
 	list, err := conn.ListObjects(conn.WIPStorageId(), bookname)
 	if err != nil {
-		log.Fatalln(err)
+		fatal(err)
 	}
 	if len(list) > 0 {
-		log.Fatalf("Error: There is already a book in S3 named %s", bookname)
+		fatal("Error: There is already a book in S3 named", bookname)
 	}
 
 	verboselog.Println("Uploading all images are valid in", bookdir)
 	err = pipeline.UploadImages(ctx, bookdir, bookname, conn)
 	if err != nil {
-		log.Fatalln(err)
+		fatal(err)
+	}
+
+	if pdfreport != nil {
+		verboselog.Println("Saving PDF extraction report")
+		err = pipeline.UploadPdfReport(pdfreport, bookname, conn)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	if !meta.Empty() {
+		verboselog.Println("Saving metadata")
+		err = pipeline.UploadMetadata(meta, bookname, conn)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	verboselog.Println("Saving preprocessing profile", *profile)
+	err = pipeline.UploadProfile(*profile, bookname, conn)
+	if err != nil {
+		fatal(err)
 	}
 
 	if *training != "" {
@@ -129,7 +343,7 @@ func main() {
 	}
 	err = conn.AddToQueue(qid, bookname)
 	if err != nil {
-		log.Fatalln("Error adding book to queue:", err)
+		fatal("Error adding book to queue:", err)
 	}
 
 	var qname string
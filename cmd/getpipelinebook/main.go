@@ -17,13 +17,17 @@ import (
 	"rescribe.xyz/bookpipeline/internal/pipeline"
 )
 
-const usage = `Usage: getpipelinebook [-c conn] [-a] [-graph] [-pdf] [-png] [-v] bookname
+const usage = `Usage: getpipelinebook [-c conn] [-a] [-graph] [-pdf] [-png] [-epub] [-bookhocr] [-illustrations] [-v] bookname
 
 Downloads the pipeline results for a book.
 
 By default this downloads the best hOCR version for each page, the
-binarised and (if available) colour PDF, and the best, conf and
-graph.png analysis files.
+binarised and (if available) colour PDF, the EPUB and the single
+book hOCR and words files (if available), the clean text, any
+extracted illustrations, and the best, conf, graph.png, manifest
+and (if available) IIIF manifest analysis files. If there is a IIIF
+manifest the page images it shows are downloaded too, so that the
+book can be published with it.
 `
 
 // null writer to enable non-verbose logging to be discarded
@@ -41,6 +45,9 @@ func main() {
 	colourpdf := flag.Bool("colourpdf", false, "Only download colour PDF (can be used alongside -graph)")
 	pdf := flag.Bool("pdf", false, "Only download PDFs (can be used alongside -graph)")
 	png := flag.Bool("png", false, "Should only download best binarised png files")
+	epub := flag.Bool("epub", false, "Only download EPUB (can be used alongside -graph)")
+	bookhocr := flag.Bool("bookhocr", false, "Only download the single book hOCR and words files (can be used alongside -graph)")
+	illustrations := flag.Bool("illustrations", false, "Only download the extracted illustrations and the list of them (can be used alongside -graph)")
 	verbose := flag.Bool("v", false, "Verbose")
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), usage)
@@ -130,7 +137,31 @@ func main() {
 		pipeline.DownloadBestPngs(bookname, bookname, conn)
 	}
 
-	if *binarisedpdf || *colourpdf || *graph || *pdf {
+	if *epub {
+		verboselog.Println("Downloading EPUB")
+		err = pipeline.DownloadEpub(bookname, bookname, conn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *bookhocr {
+		verboselog.Println("Downloading book hOCR")
+		err = pipeline.DownloadBookHocr(bookname, bookname, conn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *illustrations {
+		verboselog.Println("Downloading illustrations")
+		err = pipeline.DownloadIllustrations(bookname, bookname, conn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *binarisedpdf || *colourpdf || *graph || *pdf || *epub || *bookhocr || *illustrations {
 		return
 	}
 
@@ -146,9 +177,41 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	verboselog.Println("Downloading EPUB")
+	err = pipeline.DownloadEpub(bookname, bookname, conn)
+	if err != nil {
+		verboselog.Println("No EPUB downloaded:", err)
+	}
+
+	verboselog.Println("Downloading book hOCR")
+	err = pipeline.DownloadBookHocr(bookname, bookname, conn)
+	if err != nil {
+		verboselog.Println("No book hOCR downloaded:", err)
+	}
+
+	verboselog.Println("Downloading clean text")
+	err = pipeline.DownloadCleanText(bookname, bookname, conn)
+	if err != nil {
+		verboselog.Println("No clean text downloaded:", err)
+	}
+
+	verboselog.Println("Downloading illustrations")
+	err = pipeline.DownloadIllustrations(bookname, bookname, conn)
+	if err != nil {
+		verboselog.Println("No illustrations downloaded:", err)
+	}
+
 	verboselog.Println("Downloading analyses")
 	err = pipeline.DownloadAnalyses(bookname, bookname, conn)
 	if err != nil {
 		log.Fatalln(err)
 	}
+
+	if _, err := os.Stat(filepath.Join(bookname, bookpipeline.IIIFManifestFile)); err == nil {
+		verboselog.Println("Downloading images for IIIF manifest")
+		err = pipeline.DownloadIIIFImages(bookname, bookname, conn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
 }
@@ -0,0 +1,48 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+// iiifsearch serves IIIF Content Search for books downloaded with
+// getpipelinebook.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"rescribe.xyz/bookpipeline/internal/pipeline"
+)
+
+const usage = `Usage: iiifsearch [-addr addr] -base url dir
+
+Serves IIIF Content Search for the books in dir, as downloaded with
+getpipelinebook, each in a directory named after the book containing
+its manifest.json and best hOCR files.
+
+A book is searched with a request to /bookname/search?q=words, which
+responds with the words found, as annotations of the canvases of the
+book's IIIF manifest. The IIIF manifests link to this when they are
+created by bookpipeline with -iiifsearch set to the address this is
+served at, and -base must be set to the same address as was used for
+-iiifbase.
+`
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	base := flag.String("base", "", "address the books are published at, as set with -iiifbase in bookpipeline")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || *base == "" {
+		flag.Usage()
+		return
+	}
+
+	s := &pipeline.IIIFSearch{Dir: flag.Arg(0), Base: *base}
+	log.Fatalln(http.ListenAndServe(*addr, s))
+}
@@ -147,8 +147,8 @@ func convertselect(bookdirectory, hocrfilename string, confthresh int) (string,
 		confline = scanner.Text()
 		if strings.Contains(confline, hocrfilename) {
 			substring := strings.Split(confline, "	")
-			if len(substring) != 2 {
-				log.Fatalf("Bailing as conf file %s doesn't seem to be formatted correctly (wants 2 fields separated by '  ')\n", confpath)
+			if len(substring) < 2 {
+				log.Fatalf("Bailing as conf file %s doesn't seem to be formatted correctly (wants at least 2 fields separated by '  ')\n", confpath)
 			}
 			confvalue, _ = strconv.Atoi(substring[1])
 		}
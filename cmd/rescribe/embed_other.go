@@ -6,7 +6,6 @@
 
 package main
 
-// if not one of the above platforms, we won't embed tesseract
-// or getgbook, so just create empty byte slices
+// if not one of the above platforms, we won't embed tesseract,
+// so just create an empty byte slice
 var tesszip []byte
-var gbookzip []byte
@@ -23,6 +23,8 @@ import (
 	"fyne.io/fyne/v2/storage"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
+	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/bookpipeline/internal/pipeline"
 )
 
 var progressPoints = map[float64]string{
@@ -251,7 +253,7 @@ func updateProgress(log string, progressBar *widget.ProgressBar) {
 
 // start sets up the gui to start the core process, and if all is well
 // it starts it
-func start(ctx context.Context, log *log.Logger, cmd string, tessdir string, gbookcmd string, dir string, training string, win fyne.Window, logarea *widget.Entry, progressBar *widget.ProgressBar, abortbtn *widget.Button, wipe bool, bigpdf bool, disableWidgets []fyne.Disableable) {
+func start(ctx context.Context, log *log.Logger, cmd string, tessdir string, dir string, training string, win fyne.Window, logarea *widget.Entry, progressBar *widget.ProgressBar, abortbtn *widget.Button, wipe bool, analyseopts pipeline.AnalyseOpts, docopts DocOpts, disableWidgets []fyne.Disableable) {
 	if dir == "" {
 		return
 	}
@@ -287,12 +289,12 @@ func start(ctx context.Context, log *log.Logger, cmd string, tessdir string, gbo
 
 	// Do this in a goroutine so the GUI remains responsive
 	go func() {
-		letsGo(ctx, log, cmd, tessdir, gbookcmd, dir, training, win, logarea, progressBar, abortbtn, wipe, bigpdf, disableWidgets)
+		letsGo(ctx, log, cmd, tessdir, dir, training, win, logarea, progressBar, abortbtn, wipe, analyseopts, docopts, disableWidgets)
 	}()
 }
 
 // letsGo starts the core process
-func letsGo(ctx context.Context, log *log.Logger, cmd string, tessdir string, gbookcmd string, dir string, training string, win fyne.Window, logarea *widget.Entry, progressBar *widget.ProgressBar, abortbtn *widget.Button, wipe bool, bigpdf bool, disableWidgets []fyne.Disableable) {
+func letsGo(ctx context.Context, log *log.Logger, cmd string, tessdir string, dir string, training string, win fyne.Window, logarea *widget.Entry, progressBar *widget.ProgressBar, abortbtn *widget.Button, wipe bool, analyseopts pipeline.AnalyseOpts, docopts DocOpts, disableWidgets []fyne.Disableable) {
 	bookdir := dir
 	savedir := dir
 	bookname := strings.ReplaceAll(filepath.Base(dir), " ", "_")
@@ -320,17 +322,6 @@ func letsGo(ctx context.Context, log *log.Logger, cmd string, tessdir string, gb
 	progressBar.SetValue(0.1)
 
 	if strings.HasPrefix(dir, "Google Book: ") {
-		if gbookcmd == "" {
-			msg := fmt.Sprintf("No getgbook found, can't download Google Book. Either set -gbookcmd on the command line, or use the official build which includes an embedded copy of getgbook.\n")
-			dialog.ShowError(errors.New(msg), win)
-			fmt.Fprintf(os.Stderr, msg)
-			progressBar.SetValue(0.0)
-			for _, v := range disableWidgets {
-				v.Enable()
-			}
-			abortbtn.Disable()
-			return
-		}
 		progressBar.SetValue(0.11)
 		start := len("Google Book: ")
 		bookname = dir[start : start+12]
@@ -340,9 +331,9 @@ func letsGo(ctx context.Context, log *log.Logger, cmd string, tessdir string, gb
 		savedir = bookdir
 
 		fmt.Printf("Downloading Google Book\n")
-		d, err := getGoogleBook(ctx, gbookcmd, bookname, bookdir)
+		d, err := getGoogleBook(ctx, bookname, bookdir)
 		if err != nil {
-			if !strings.HasSuffix(err.Error(), "signal: killed") {
+			if !errors.Is(err, context.Canceled) {
 				msg := fmt.Sprintf("Error downloading Google Book %s\n", bookname)
 				dialog.ShowError(errors.New(msg), win)
 				fmt.Fprintf(os.Stderr, msg)
@@ -361,10 +352,15 @@ func letsGo(ctx context.Context, log *log.Logger, cmd string, tessdir string, gb
 
 	if strings.HasSuffix(dir, ".pdf") && !f.IsDir() {
 		progressBar.SetValue(0.12)
-		bookdir, err = extractPdfImgs(ctx, bookdir)
+		var report []pipeline.PdfPageReport
+		pdfpath := bookdir
+		bookdir, report, err = pipeline.ExtractPdfImages(ctx, bookdir)
 		if err != nil {
+			if bookdir != "" {
+				_ = os.RemoveAll(filepath.Dir(bookdir))
+			}
 			if !strings.HasSuffix(err.Error(), "context canceled") {
-				msg := fmt.Sprintf("Error opening PDF %s: %v\n", bookdir, err)
+				msg := fmt.Sprintf("Error opening PDF %s: %v\n", pdfpath, err)
 				dialog.ShowError(errors.New(msg), win)
 				fmt.Fprintf(os.Stderr, msg)
 			}
@@ -377,19 +373,10 @@ func letsGo(ctx context.Context, log *log.Logger, cmd string, tessdir string, gb
 			return
 		}
 
-		// happens if extractPdfImgs recovers from a PDF panic,
-		// which will occur if we encounter an image we can't decode
-		if bookdir == "" {
-			msg := fmt.Sprintf("Error opening PDF\nThe format of this PDF is not supported, extract the images to .jpg manually into a\nfolder first, using a tool like the PDF image extractor at https://pdfcandy.com/extract-images.html.\n")
-			dialog.ShowError(errors.New(msg), win)
-			fmt.Fprintf(os.Stderr, msg)
-
-			progressBar.SetValue(0.0)
-			for _, v := range disableWidgets {
-				v.Enable()
+		for _, r := range report {
+			if r.Image == "" {
+				fmt.Fprintf(os.Stderr, "Warning: %s\n", r)
 			}
-			abortbtn.Disable()
-			return
 		}
 
 		savedir = strings.TrimSuffix(savedir, ".pdf")
@@ -402,7 +389,7 @@ func letsGo(ctx context.Context, log *log.Logger, cmd string, tessdir string, gb
 		training = training[start:end]
 	}
 
-	err = startProcess(ctx, log, cmd, bookdir, bookname, training, savedir, tessdir, wipe, bigpdf)
+	err = startProcess(ctx, log, cmd, bookdir, bookname, training, savedir, tessdir, wipe, pipeline.DefaultProfile, false, 0, analyseopts, docopts)
 	if err != nil && strings.HasSuffix(err.Error(), "context canceled") {
 		progressBar.SetValue(0.0)
 		return
@@ -410,7 +397,7 @@ func letsGo(ctx context.Context, log *log.Logger, cmd string, tessdir string, gb
 	if err != nil {
 		msg := fmt.Sprintf("Error during processing: %v\n", err)
 		if strings.HasSuffix(err.Error(), "No images found") && strings.HasSuffix(dir, ".pdf") && !f.IsDir() {
-			msg = fmt.Sprintf("Error opening PDF\nNo images found in the PDF. Most likely the format of this PDF is not supported,\nextract the images to .jpg manually into a folder first, using a tool like\nthe PDF image extractor at https://pdfcandy.com/extract-images.html.\n")
+			msg = fmt.Sprintf("Error opening PDF\nNo images could be extracted from any page of the PDF.\nThe reason for each page is given in the log.\n")
 		}
 		dialog.ShowError(errors.New(msg), win)
 		fmt.Fprintf(os.Stderr, msg)
@@ -435,7 +422,7 @@ func letsGo(ctx context.Context, log *log.Logger, cmd string, tessdir string, gb
 }
 
 // startGui starts the gui process
-func startGui(log *log.Logger, cmd string, gbookcmd string, training string, tessdir string) error {
+func startGui(log *log.Logger, cmd string, training string, tessdir string) error {
 	myApp := app.New()
 	myWindow := myApp.NewWindow("Rescribe OCR")
 
@@ -533,6 +520,16 @@ func startGui(log *log.Logger, cmd string, gbookcmd string, training string, tes
 	bigpdf := widget.NewCheck("Use highest image quality for searchable PDF (requires lots of RAM)", func(bool) {})
 	bigpdf.Checked = false
 
+	epub := widget.NewCheck("Create an EPUB ebook", func(bool) {})
+
+	docsLabel := widget.NewLabel("Editable documents")
+	docx := widget.NewCheck("DOCX", func(bool) {})
+	odt := widget.NewCheck("ODT", func(bool) {})
+	markdown := widget.NewCheck("Markdown", func(bool) {})
+	marked := widget.NewCheck("Marked text", func(bool) {})
+	tei := widget.NewCheck("TEI", func(bool) {})
+	highlight := widget.NewCheck("Highlight uncertain words", func(bool) {})
+
 	trainingLabel := widget.NewLabel("Language / Script")
 
 	trainingOpts := mkTrainingSelect([]string{training}, myWindow)
@@ -550,7 +547,7 @@ func startGui(log *log.Logger, cmd string, gbookcmd string, training string, tes
 
 	gobtn = widget.NewButtonWithIcon("Start OCR", theme.UploadIcon(), func() {})
 
-	disableWidgets := []fyne.Disableable{folderBtn, pdfBtn, gbookBtn, wipe, bigpdf, trainingOpts, gobtn}
+	disableWidgets := []fyne.Disableable{folderBtn, pdfBtn, gbookBtn, wipe, bigpdf, epub, docx, odt, markdown, marked, tei, highlight, trainingOpts, gobtn}
 
 	abortbtn = widget.NewButtonWithIcon("Abort", theme.CancelIcon(), func() {
 		fmt.Printf("\nAbort\n")
@@ -565,7 +562,23 @@ func startGui(log *log.Logger, cmd string, gbookcmd string, training string, tes
 	abortbtn.Disable()
 
 	gobtn.OnTapped = func() {
-		start(ctx, log, cmd, tessdir, gbookcmd, dir.Text, trainingOpts.Selected, myWindow, logarea, progressBar, abortbtn, !wipe.Checked, bigpdf.Checked, disableWidgets)
+		analyseopts := pipeline.AnalyseOpts{
+			FullPdf:       bigpdf.Checked,
+			Epub:          epub.Checked,
+			EpubImgCutoff: EpubImgCutoff,
+			CleanMinConf:  CleanMinConf,
+		}
+		docopts := DocOpts{
+			Docx:      docx.Checked,
+			Odt:       odt.Checked,
+			Markdown:  markdown.Checked,
+			Marked:    marked.Checked,
+			Tei:       tei.Checked,
+			Highlight: highlight.Checked,
+			Conf:      HighlightCutoff,
+			MarkStyle: bookpipeline.MarkBrackets,
+		}
+		start(ctx, log, cmd, tessdir, dir.Text, trainingOpts.Selected, myWindow, logarea, progressBar, abortbtn, !wipe.Checked, analyseopts, docopts, disableWidgets)
 	}
 
 	gobtn.Disable()
@@ -577,7 +590,9 @@ func startGui(log *log.Logger, cmd string, gbookcmd string, training string, tes
 
 	trainingBits := container.New(layout.NewBorderLayout(nil, nil, trainingLabel, nil), trainingLabel, trainingOpts)
 
-	startBox := container.NewVBox(choices, chosen, trainingBits, wipe, bigpdf, gobtn, abortbtn, progressBar)
+	docBits := container.New(layout.NewHBoxLayout(), docsLabel, docx, odt, markdown, marked, tei, highlight)
+
+	startBox := container.NewVBox(choices, chosen, trainingBits, wipe, bigpdf, epub, docBits, gobtn, abortbtn, progressBar)
 	startContent := container.NewBorder(startBox, nil, nil, nil, detail)
 
 	myWindow.SetContent(startContent)
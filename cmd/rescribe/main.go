@@ -13,12 +13,9 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"image"
-	"image/draw"
-	"image/jpeg"
-	"image/png"
 	"io"
 	"io/ioutil"
 	"log"
@@ -30,25 +27,67 @@ import (
 	"strings"
 	"time"
 
-	"golang.org/x/image/tiff"
 	"rescribe.xyz/bookpipeline"
 	"rescribe.xyz/bookpipeline/internal/pipeline"
-	"rescribe.xyz/pdf"
 	"rescribe.xyz/utils/pkg/hocr"
 )
 
-const usage = `Usage: rescribe [-v] [-gui] [-systess] [-tesscmd cmd] [-gbookcmd cmd] [-t training] bookdir/book.pdf [savedir]
+const usage = `Usage: rescribe [-v] [-gui] [-systess] [-tesscmd cmd] [-t training] [-epub] [-bookhocr] [-detectlabels] [-linelevel] [-adaptive] [-earlyexit conf] [-split] [-deskew] [-profile name] [-metric metric] [-wordlist file] [-formats docx,odt,md,marked,tei] [-highlight] [-markconf conf] [-markstyle style] bookdir/book.pdf/manifest/gbook [savedir]
 
 Process and OCR a book using the Rescribe pipeline on a local machine.
 
+The book can be a directory of images, a PDF, or a IIIF manifest,
+given as a web address or a .json file, in which case the images of
+its canvases are downloaded, along with its labels and metadata.
+It can also be a Google Book, given as its address or its id, in
+which case its images and metadata are downloaded into a directory
+named for the book inside savedir, or the current directory.
+
+JPEG 2000 images are decoded with the opj_decompress command from
+OpenJPEG, and JBIG2 images in PDFs with the jbig2dec command, neither
+of which is included with rescribe. Without opj_decompress a book of
+JPEG 2000 images can't be processed, and PDF pages whose images can't
+be decoded are skipped, with a warning naming the command needed.
+
 OCR results are saved into the bookdir directory unless savedir is
-specified.
+specified. For a IIIF manifest they are saved into a directory named
+for the book in the current directory, and for a Google Book into
+the directory it was downloaded to.
 `
 
 const QueueTimeoutSecs = 2 * 60
 const PauseBetweenChecks = 1 * time.Second
 const LogSaveTime = 1 * time.Minute
 
+// EpubImgCutoff is the confidence below which pages are included
+// in an EPUB as images rather than text
+const EpubImgCutoff = 60
+
+// CleanMinConf is the confidence below which pages are left out
+// of the clean text
+const CleanMinConf = 30
+
+// HighlightCutoff is the default confidence below which words are
+// highlighted in DOCX, ODT and Markdown documents, if requested, and
+// marked as uncertain in marked text and TEI documents
+const HighlightCutoff = 60
+
+// DocOpts are the editable document formats to create from the OCR
+// text, in addition to the plain text files
+type DocOpts struct {
+	Docx, Odt, Markdown bool
+	// Marked is plain text with uncertain words marked in MarkStyle
+	Marked bool
+	// Tei is a TEI Lite document with uncertain words marked
+	Tei bool
+	// Highlight sets whether low confidence words are highlighted
+	Highlight bool
+	// Conf is the confidence below which words are highlighted or
+	// marked as uncertain
+	Conf      float64
+	MarkStyle bookpipeline.MarkStyle
+}
+
 var thresholds = []float64{0.1, 0.2, 0.3}
 
 // null writer to enable non-verbose logging to be discarded
@@ -139,10 +178,8 @@ func unpackZip(b []byte, dir string) error {
 
 func main() {
 	deftesscmd := "tesseract"
-	defgbookcmd := "getgbook"
 	if runtime.GOOS == "windows" {
 		deftesscmd = "C:\\Program Files\\Tesseract-OCR\\tesseract.exe"
-		defgbookcmd = "getgbook.exe"
 	}
 
 	verbose := flag.Bool("v", false, "verbose")
@@ -154,10 +191,24 @@ These training files are included in rescribe, and are always available:
 - lat.traineddata (Latin, modern print)
 - rescribev9_fast.traineddata (Latin/English/French, printed ca 1500-1800)
 	`)
-	gbookcmd := flag.String("gbookcmd", defgbookcmd, "The getgbook executable to run. You may need to set this to the full path of getgbook.exe if you're on Windows.")
 	tesscmd := flag.String("tesscmd", deftesscmd, "The Tesseract executable to run. You may need to set this to the full path of Tesseract.exe if you're on Windows.")
 	wipe := flag.Bool("wipe", false, "Use wiper tool to remove noise like gutters from page before processing.")
 	fullpdf := flag.Bool("fullpdf", false, "Use highest image quality for searchable PDF (requires lots of RAM).")
+	epub := flag.Bool("epub", false, "Create an EPUB ebook of the OCR text.")
+	adaptive := flag.Bool("adaptive", false, "Try extra thresholds for pages whose best threshold is the highest or lowest tried.")
+	earlyexit := flag.Float64("earlyexit", 0, "Only OCR further thresholds of a page, in order, while its confidence is below this (0 to OCR every threshold).")
+	split := flag.Bool("split", false, "Split images of double page spreads into separate pages before processing.")
+	deskew := flag.Bool("deskew", false, "Correct the orientation and skew of each page before processing.")
+	profile := flag.String("profile", pipeline.DefaultProfile, "Preprocessing profile, setting how pages are binarised and wiped: "+strings.Join(pipeline.ProfileNames(), ", ")+".")
+	metric := flag.String("metric", "conf", "Metric to choose the best version of each page with: conf, charconf, words or dict, or a weighted combination like 'charconf:2,words:1,dict:1'.")
+	wordlist := flag.String("wordlist", "", "File with one word per line to use for the dict metric.")
+	linelevel := flag.Bool("linelevel", false, "Combine the best version of each line from every threshold, rather than choosing the best version of each whole page.")
+	bookhocr := flag.Bool("bookhocr", false, "Create a single hOCR file for the whole book, and a JSON-lines file of its words.")
+	detectlabels := flag.Bool("detectlabels", false, "Label pages in outputs with the printed page numbers found in their running headers and footers.")
+	formats := flag.String("formats", "", "Comma separated list of editable document formats to create, from docx, odt, md (Markdown), marked (plain text with uncertain words marked) and tei (TEI XML).")
+	highlight := flag.Bool("highlight", false, "Highlight words with a low OCR confidence in docx, odt and md documents.")
+	markconf := flag.Float64("markconf", HighlightCutoff, "Confidence below which words are highlighted, or marked as uncertain in marked and tei documents.")
+	markstyle := flag.String("markstyle", "brackets", "How uncertain words are marked in marked text documents: 'brackets' or 'tei' (<unclear> tags).")
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), usage)
@@ -170,6 +221,10 @@ These training files are included in rescribe, and are always available:
 		return
 	}
 
+	if _, ok := pipeline.PreprocProfiles[*profile]; !ok {
+		log.Fatalln("Unknown preprocessing profile", *profile)
+	}
+
 	var err error
 
 	var verboselog *log.Logger
@@ -180,6 +235,11 @@ These training files are included in rescribe, and are always available:
 		verboselog = log.New(n, "", 0)
 	}
 
+	docopts, err := parseDocOpts(*formats, *highlight, *markconf, *markstyle)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	tessdir := ""
 	trainingPath := *training
 	tessCommand := *tesscmd
@@ -209,28 +269,6 @@ These training files are included in rescribe, and are always available:
 		log.Fatalf("No tesseract executable found [tried %s], either set -tesscmd and -systess on the command line or use the official build which includes an embedded copy of Tesseract.", tessCommand)
 	}
 
-	gbookCommand := *gbookcmd
-	if len(gbookzip) > 0 {
-		err = unpackZip(gbookzip, tessdir)
-		if err != nil {
-			log.Fatalln("Error unpacking embedded getgbook zip:", err)
-		}
-		switch runtime.GOOS {
-		case "darwin":
-			gbookCommand = filepath.Join(tessdir, "getgbook")
-		case "linux":
-			gbookCommand = filepath.Join(tessdir, "getgbook")
-		case "windows":
-			gbookCommand = filepath.Join(tessdir, "getgbook.exe")
-		}
-	}
-
-	_, err = exec.LookPath(gbookCommand)
-	if err != nil {
-		log.Printf("No getgbook found [tried %s], google book downloading will be disabled, either set -gbookcmd on the command line or use the official build which includes an embedded getgbook.", gbookCommand)
-		gbookCommand = ""
-	}
-
 	tessdatadir := filepath.Join(tessdir, "tessdata")
 	err = os.MkdirAll(tessdatadir, 0755)
 	if err != nil {
@@ -284,7 +322,7 @@ These training files are included in rescribe, and are always available:
 	}
 
 	if flag.NArg() < 1 || *usegui {
-		err := startGui(verboselog, tessCommand, gbookCommand, trainingName, tessdir)
+		err := startGui(verboselog, tessCommand, trainingName, tessdir)
 		err = os.RemoveAll(tessdir)
 		if err != nil {
 			log.Printf("Error removing tesseract directory %s: %v", tessdir, err)
@@ -311,308 +349,165 @@ These training files are included in rescribe, and are always available:
 		savedir = flag.Arg(1)
 	}
 
-	ispdf := false
-
-	fi, err := os.Stat(bookdir)
-	if err != nil {
-		log.Fatalln("Error opening book file/dir:", err)
-	}
+	// extracted is set if the images were extracted from a PDF or
+	// downloaded to a temporary directory, which is removed at the end
+	extracted := false
 
 	var ctx context.Context
 	ctx = context.Background()
 
-	// TODO: support google book downloading, as done with the GUI
+	// a Google Book can be given by its address, or by its id if
+	// there is no file or directory with that name
+	var gbookid string
+	if _, err := os.Stat(bookdir); err != nil {
+		gbookid, _ = getBookIdFromUrl(bookdir)
+	}
 
-	// try opening as a PDF, and extracting
-	if !fi.IsDir() {
-		if flag.NArg() < 2 {
-			savedir = strings.TrimSuffix(bookdir, ".pdf")
+	if gbookid != "" {
+		basedir := "."
+		if flag.NArg() > 1 {
+			basedir = flag.Arg(1)
 		}
-
-		bookdir, err = extractPdfImgs(ctx, bookdir)
+		fmt.Printf("Downloading Google Book\n")
+		d, err := getGoogleBook(ctx, gbookid, basedir)
 		if err != nil {
-			log.Fatalln("Error opening file as PDF:", err)
-		}
-		// if this occurs then extractPdfImgs() will have recovered from
-		// a panic in the pdf package
-		if bookdir == "" {
-			log.Fatalln("Error opening file as PDF: image type not supported, you will need to extract images manually.")
-		}
-
-		bookname = strings.TrimSuffix(bookname, ".pdf")
-
-		ispdf = true
-	}
-
-	err = startProcess(ctx, verboselog, tessCommand, bookdir, bookname, trainingName, savedir, tessdir, !*wipe, *fullpdf)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	if !*systess {
-		err = os.RemoveAll(tessdir)
+			log.Fatalln(err)
+		}
+		bookdir = d
+		savedir = d
+		bookname = filepath.Base(d)
+	} else if pipeline.IsIIIFManifest(bookdir) {
+		fmt.Printf("Downloading images from IIIF manifest\n")
+		d, err := pipeline.DownloadIIIF(ctx, bookdir)
 		if err != nil {
-			log.Printf("Error removing tesseract directory %s: %v", tessdir, err)
+			if d != "" {
+				_ = os.RemoveAll(filepath.Dir(d))
+			}
+			log.Fatalln("Error downloading IIIF manifest:", err)
 		}
-	}
-
-	if ispdf {
-		os.RemoveAll(filepath.Clean(filepath.Join(bookdir, "..")))
-	}
-}
-
-// extractPdfImgs extracts all images embedded in a PDF to a
-// temporary directory, which is returned on success.
-func extractPdfImgs(ctx context.Context, path string) (string, error) {
-	defer func() {
-		// unfortunately the pdf library will panic if it sees an encoding
-		// it can't decode, so recover from that and give a warning
-		r := recover()
-		if r != nil {
-			fmt.Fprintf(os.Stderr, "Warning: Error extracting from PDF: %v\n", r)
+		bookname = filepath.Base(d)
+		if flag.NArg() < 2 {
+			savedir = bookname
 		}
-	}()
-
-	p, err := pdf.Open(path)
-	if err != nil {
-		return "", err
+		bookdir = d
+		extracted = true
 	}
 
-	bookname := strings.TrimSuffix(filepath.Base(path), ".pdf")
-
-	tempdir, err := ioutil.TempDir("", "bookpipeline")
-	if err != nil {
-		return "", fmt.Errorf("Error setting up temporary directory: %v", err)
-	}
-	tempdir = filepath.Join(tempdir, bookname)
-	err = os.Mkdir(tempdir, 0755)
+	fi, err := os.Stat(bookdir)
 	if err != nil {
-		return "", fmt.Errorf("Error setting up temporary directory: %v", err)
+		log.Fatalln("Error opening book file/dir:", err)
 	}
 
-	for pgnum := 1; pgnum <= p.NumPage(); pgnum++ {
-		select {
-		case <-ctx.Done():
-			return "", ctx.Err()
-		default:
-		}
-		if p.Page(pgnum).V.IsNull() {
-			continue
-		}
-		var rotate int64
-		for v := p.Page(pgnum).V; !v.IsNull(); v = v.Key("Parent") {
-			if r := v.Key("Rotate"); !r.IsNull() {
-				rotate = r.Int64()
-			}
-		}
-		res := p.Page(pgnum).Resources()
-		if res.Kind() != pdf.Dict {
-			continue
-		}
-		xobj := res.Key("XObject")
-		if xobj.Kind() != pdf.Dict {
-			continue
+	// try opening as a PDF, and extracting
+	if !fi.IsDir() {
+		if flag.NArg() < 2 {
+			savedir = strings.TrimSuffix(bookdir, ".pdf")
 		}
-		// BUG: for some PDFs this includes images multiple times for each page
-		for _, k := range xobj.Keys() {
-			obj := xobj.Key(k)
-			if obj.Kind() != pdf.Stream {
-				continue
-			}
 
-			fn := fmt.Sprintf("%04d-%s.jpg", pgnum, k)
-			path := filepath.Join(tempdir, fn)
-			w, err := os.Create(path)
-			defer w.Close()
-			if err != nil {
-				return tempdir, fmt.Errorf("Error creating file to extract PDF image: %v\n", err)
-			}
-			r := obj.Reader()
-			defer r.Close()
-			_, err = io.Copy(w, r)
-			if err != nil {
-				return tempdir, fmt.Errorf("Error writing extracted image %s from PDF: %v\n", fn, err)
-			}
-			w.Close()
-			r.Close()
-
-			err = rmIfNotImage(path)
-			if err != nil {
-				return tempdir, fmt.Errorf("Error removing extracted image %s from PDF: %v\n", fn, err)
+		var report []pipeline.PdfPageReport
+		bookdir, report, err = pipeline.ExtractPdfImages(ctx, bookdir)
+		if err != nil {
+			if bookdir != "" {
+				_ = os.RemoveAll(filepath.Dir(bookdir))
 			}
+			log.Fatalln("Error opening file as PDF:", err)
+		}
 
-			if rotate != 0 {
-				err = rotateImage(path, rotate)
-				if err != nil {
-					return tempdir, fmt.Errorf("Error rotating extracted image %s from PDF: %v\n", fn, err)
-				}
+		for _, r := range report {
+			if r.Image == "" {
+				fmt.Fprintf(os.Stderr, "Warning: %s\n", r)
 			}
 		}
-	}
-	// TODO: check for places where there are multiple images per page, and only keep largest ones where that's the case
-
-	select {
-	case <-ctx.Done():
-		return "", ctx.Err()
-	default:
-	}
 
-	return tempdir, nil
-}
+		bookname = strings.TrimSuffix(bookname, ".pdf")
 
-// rmIfNotImage attempts to decode a given file as an image. If it is
-// decode-able as PNG, then rename file extension from .jpg to .png,
-// if it is decode-able as TIFF then convert to PNG and rename file
-// extension appropriately, if it fails to be read as PNG, TIFF or
-// JPEG it will just be deleted.
-func rmIfNotImage(f string) error {
-	r, err := os.Open(f)
-	defer r.Close()
-	if err != nil {
-		return fmt.Errorf("Failed to open image %s: %v\n", f, err)
-	}
-	_, err = png.Decode(r)
-	r.Close()
-	if err == nil {
-		b := strings.TrimSuffix(f, ".jpg")
-		err = os.Rename(f, b+".png")
-		if err != nil {
-			return fmt.Errorf("Error renaming %s to %s: %v", f, b+".png", err)
-		}
-		return nil
+		extracted = true
 	}
 
-	r, err = os.Open(f)
-	defer r.Close()
+	pagemetric, err := pipeline.LoadMetric(*metric, *wordlist)
 	if err != nil {
-		return fmt.Errorf("Failed to open image %s: %v\n", f, err)
-	}
-	_, err = jpeg.Decode(r)
-	r.Close()
-	if err == nil {
-		return nil
+		log.Fatalln(err)
 	}
 
-	r, err = os.Open(f)
-	defer r.Close()
-	if err != nil {
-		return fmt.Errorf("Failed to open image %s: %v\n", f, err)
+	analyseopts := pipeline.AnalyseOpts{
+		FullPdf:       *fullpdf,
+		Epub:          *epub,
+		EpubImgCutoff: EpubImgCutoff,
+		BookHocr:      *bookhocr,
+		CleanMinConf:  CleanMinConf,
+		LineLevel:     *linelevel,
+		Adaptive:      *adaptive,
+		Metric:        pagemetric,
+		DetectLabels:  *detectlabels,
 	}
-	t, err := tiff.Decode(r)
-	if err == nil {
-		b := strings.TrimSuffix(f, ".jpg")
-		n, err := os.Create(b + ".png")
-		defer n.Close()
-		if err != nil {
-			return fmt.Errorf("Failed to create file to store new png %s from tiff %s: %v\n", b+".png", f, err)
-		}
-		err = png.Encode(n, t)
-		if err != nil {
-			return fmt.Errorf("Failed to encode tiff as png for %s: %v\n", f, err)
-		}
-		r.Close()
-		err = os.Remove(f)
+
+	pagedir := bookdir
+	if *split {
+		var n int
+		pagedir, n, err = pipeline.SplitSpreads(ctx, bookdir)
 		if err != nil {
-			return fmt.Errorf("Failed to remove original tiff %s: %v\n", f, err)
+			log.Fatalln("Error splitting double page spreads:", err)
 		}
-		return nil
+		fmt.Printf("Split %d double page spreads\n", n)
 	}
 
-	r.Close()
-	err = os.Remove(f)
+	err = startProcess(ctx, verboselog, tessCommand, pagedir, bookname, trainingName, savedir, tessdir, !*wipe, *profile, *deskew, *earlyexit, analyseopts, docopts)
 	if err != nil {
-		return fmt.Errorf("Failed to remove invalid image %s: %v", f, err)
+		log.Fatalln(err)
 	}
 
-	return nil
-}
-
-// rotateImage rotates an image at the given path by the given angle
-func rotateImage(path string, angle int64) error {
-	switch angle {
-	case 90:
-		// proceed with the rest of the function
-	case 180, 270:
-		// rotate the image again first, as many times as necessary.
-		// this is inefficient but easy.
-		err := rotateImage(path, angle-90)
+	if *split {
+		err = os.RemoveAll(pagedir)
 		if err != nil {
-			return fmt.Errorf("error with a rotation run: %w", err)
+			log.Printf("Error removing split pages directory %s: %v", pagedir, err)
 		}
-	default:
-		return fmt.Errorf("Rotation angle of %d is not supported", angle)
 	}
 
-	r, err := os.Open(path)
-	defer r.Close()
-	if err != nil {
-		return fmt.Errorf("Failed to open image: %w", err)
-	}
-	img, err := png.Decode(r)
-	if err != nil {
-		r.Close()
-		r, err = os.Open(path)
-		defer r.Close()
-		if err != nil {
-			return fmt.Errorf("Failed to open image: %w", err)
-		}
-		img, err = jpeg.Decode(r)
-	}
-	if err != nil {
-		r.Close()
-		r, err = os.Open(path)
-		defer r.Close()
+	if !*systess {
+		err = os.RemoveAll(tessdir)
 		if err != nil {
-			return fmt.Errorf("Failed to open image: %w", err)
+			log.Printf("Error removing tesseract directory %s: %v", tessdir, err)
 		}
-		img, err = tiff.Decode(r)
 	}
-	if err != nil {
-		return fmt.Errorf("Failed to decode image as png, jpeg or tiff: %w", err)
-	}
-
-	b := img.Bounds()
-
-	orig := image.NewRGBA(b)
-	draw.Draw(orig, b, img, b.Min, draw.Src)
 
-	newb := image.Rectangle{
-		Min: image.Point{X: 0, Y: 0},
-		Max: image.Point{X: b.Dy(), Y: b.Dx()},
+	if extracted {
+		os.RemoveAll(filepath.Clean(filepath.Join(bookdir, "..")))
 	}
-	new := image.NewRGBA(newb)
+}
 
-	for x := b.Min.X; x < b.Max.X; x++ {
-		desty := newb.Min.Y + x
-		for y := b.Max.Y; y > b.Min.Y; y-- {
-			destx := b.Dy() - y + newb.Min.X
-			new.SetRGBA(destx, desty, orig.RGBAAt(x, y))
+// parseDocOpts converts a comma separated list of document formats,
+// and the settings for marking uncertain words, into DocOpts
+func parseDocOpts(formats string, highlight bool, conf float64, markstyle string) (DocOpts, error) {
+	opts := DocOpts{Highlight: highlight, Conf: conf}
+	switch markstyle {
+	case "brackets":
+		opts.MarkStyle = bookpipeline.MarkBrackets
+	case "tei":
+		opts.MarkStyle = bookpipeline.MarkUnclear
+	default:
+		return opts, fmt.Errorf("Unknown mark style: %s", markstyle)
+	}
+	for _, f := range strings.Split(formats, ",") {
+		switch strings.ToLower(strings.TrimSpace(f)) {
+		case "":
+		case "docx":
+			opts.Docx = true
+		case "odt":
+			opts.Odt = true
+		case "md", "markdown":
+			opts.Markdown = true
+		case "marked":
+			opts.Marked = true
+		case "tei":
+			opts.Tei = true
+		default:
+			return opts, fmt.Errorf("Unknown document format: %s", f)
 		}
 	}
-
-	err = r.Close()
-	if err != nil {
-		return fmt.Errorf("Failed to close image: %w", err)
-	}
-	w, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("Failed to create rotated image: %w", err)
-	}
-	defer w.Close()
-
-	if !strings.HasSuffix(path, ".jpg") {
-		err = jpeg.Encode(w, new, nil)
-	} else {
-		err = png.Encode(w, new)
-	}
-	if err != nil {
-		return fmt.Errorf("Failed to encode rotated image: %w", err)
-	}
-
-	return nil
+	return opts, nil
 }
 
-func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, bookdir string, bookname string, trainingName string, savedir string, tessdir string, nowipe bool, fullpdf bool) error {
+func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, bookdir string, bookname string, trainingName string, savedir string, tessdir string, nowipe bool, profile string, deskew bool, earlyexit float64, analyseopts pipeline.AnalyseOpts, docopts DocOpts) error {
 	cmd := exec.Command(tessCommand, "--help")
 	pipeline.HideCmd(cmd)
 	_, err := cmd.Output()
@@ -642,14 +537,14 @@ func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, b
 
 	fmt.Printf("Copying book to pipeline\n")
 
-	err = uploadbook(ctx, bookdir, bookname, conn, nowipe)
+	err = uploadbook(ctx, bookdir, bookname, conn, nowipe, profile)
 	if err != nil {
 		_ = os.RemoveAll(tempdir)
 		return fmt.Errorf("Error uploading book: %v", err)
 	}
 
 	fmt.Printf("Processing book\n")
-	err = processbook(ctx, trainingName, tessCommand, conn, fullpdf)
+	err = processbook(ctx, trainingName, tessCommand, conn, deskew, earlyexit, analyseopts)
 	if err != nil {
 		_ = os.RemoveAll(tempdir)
 		return fmt.Errorf("Error processing book: %v", err)
@@ -660,7 +555,7 @@ func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, b
 	if err != nil {
 		return fmt.Errorf("Error creating save directory %s: %v", savedir, err)
 	}
-	err = downloadbook(savedir, bookname, conn)
+	err = downloadbook(savedir, bookname, conn, analyseopts)
 	if err != nil {
 		_ = os.RemoveAll(tempdir)
 		return fmt.Errorf("Error saving book: %v", err)
@@ -676,11 +571,26 @@ func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, b
 		return fmt.Errorf("Error looking for .hocr files: %v", err)
 	}
 
+	// leave out the single book hOCR file, if it was created, as
+	// only per-page files should be processed below
+	bookhocr := filepath.Join(savedir, bookname+".hocr")
+	for i, v := range hocrs {
+		if v == bookhocr {
+			hocrs = append(hocrs[:i], hocrs[i+1:]...)
+			break
+		}
+	}
+
 	err = addFullTxt(hocrs, bookname)
 	if err != nil {
 		log.Fatalf("Error creating full txt version: %v", err)
 	}
 
+	err = addDocs(hocrs, bookname, docopts)
+	if err != nil {
+		log.Fatalf("Error creating document versions: %v", err)
+	}
+
 	for _, v := range hocrs {
 		err = addTxtVersion(v)
 		if err != nil {
@@ -719,7 +629,7 @@ func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, b
 	pdfpath := filepath.Join(savedir, bookname+" searchable.pdf")
 
 	// If full size pdf is requested, replace colour.pdf with it
-	if fullpdf {
+	if analyseopts.FullPdf {
 		_ = os.Rename(fullsizepath, colourpath)
 	}
 
@@ -740,6 +650,10 @@ func startProcess(ctx context.Context, logger *log.Logger, tessCommand string, b
 	return nil
 }
 
+// binSuffix matches the threshold suffix of a page's hOCR, which
+// may be any threshold if extra ones were tried during analysis
+var binSuffix = regexp.MustCompile(`_bin[0-9]\.[0-9]+\.hocr$`)
+
 func addTxtVersion(hocrfn string) error {
 	dir := filepath.Dir(hocrfn)
 	err := os.MkdirAll(filepath.Join(dir, "text"), 0755)
@@ -752,10 +666,8 @@ func addTxtVersion(hocrfn string) error {
 		return fmt.Errorf("Error getting text from hocr file %s: %v", hocrfn, err)
 	}
 
-	basefn := filepath.Base(hocrfn)
-	for _, v := range thresholds {
-		basefn = strings.TrimSuffix(basefn, fmt.Sprintf("_bin%.1f.hocr", v))
-	}
+	basefn := strings.Replace(filepath.Base(hocrfn), ".composite.hocr", ".hocr", 1)
+	basefn = binSuffix.ReplaceAllString(basefn, "")
 	fn := filepath.Join(dir, "text", basefn+".txt")
 
 	err = ioutil.WriteFile(fn, []byte(t), 0644)
@@ -792,7 +704,103 @@ func addFullTxt(hocrs []string, bookname string) error {
 	return nil
 }
 
-func uploadbook(ctx context.Context, dir string, name string, conn Pipeliner, nowipe bool) error {
+// readManifest returns the printed page labels of the pages of a
+// book from its manifest in dir, by the name of each page's hOCR
+// file, and its metadata. Nothing is returned if there is no
+// manifest, as is the case for books processed before it was added.
+func readManifest(dir string) (map[string]string, bookpipeline.Metadata) {
+	labels := make(map[string]string)
+	var m bookpipeline.Manifest
+	b, err := ioutil.ReadFile(filepath.Join(dir, bookpipeline.ManifestFile))
+	if err != nil || json.Unmarshal(b, &m) != nil {
+		return labels, bookpipeline.Metadata{}
+	}
+	for _, pg := range m.Pages {
+		if pg.Label != "" {
+			labels[pg.Hocr] = pg.Label
+		}
+	}
+	if m.Metadata == nil {
+		return labels, bookpipeline.Metadata{}
+	}
+	return labels, *m.Metadata
+}
+
+// addDocs creates any editable document versions of the book
+// requested in docopts
+func addDocs(hocrs []string, bookname string, docopts DocOpts) error {
+	if len(hocrs) == 0 || !(docopts.Docx || docopts.Odt || docopts.Markdown || docopts.Marked || docopts.Tei) {
+		return nil
+	}
+
+	labels, meta := readManifest(filepath.Dir(hocrs[0]))
+	if meta.Title == "" {
+		meta.Title = bookname
+	}
+	var pages []bookpipeline.HocrPage
+	for _, v := range hocrs {
+		pg, err := bookpipeline.ReadHocrPage(v)
+		if err != nil {
+			return fmt.Errorf("Error reading hocr file %s: %v", v, err)
+		}
+		pg.Label = labels[filepath.Base(v)]
+		pages = append(pages, pg)
+	}
+
+	var highlight float64
+	if docopts.Highlight {
+		highlight = docopts.Conf
+	}
+
+	dir := filepath.Dir(hocrs[0])
+	base := filepath.Join(dir, bookname)
+	if docopts.Docx {
+		err := bookpipeline.WriteDocx(base+".docx", pages, highlight)
+		if err != nil {
+			return fmt.Errorf("Error creating DOCX: %v", err)
+		}
+	}
+	if docopts.Odt {
+		err := bookpipeline.WriteOdt(base+".odt", pages, highlight)
+		if err != nil {
+			return fmt.Errorf("Error creating ODT: %v", err)
+		}
+	}
+	if docopts.Markdown {
+		err := bookpipeline.WriteMarkdown(base+".md", pages, highlight)
+		if err != nil {
+			return fmt.Errorf("Error creating Markdown: %v", err)
+		}
+	}
+	if docopts.Marked {
+		fn := base + ".marked.txt"
+		t := bookpipeline.MarkedText(pages, docopts.Conf, docopts.MarkStyle)
+		err := ioutil.WriteFile(fn, []byte(t), 0644)
+		if err != nil {
+			return fmt.Errorf("Error creating marked text file %s: %v", fn, err)
+		}
+	}
+	if docopts.Tei {
+		fn := base + ".tei.xml"
+		f, err := os.Create(fn)
+		if err != nil {
+			return fmt.Errorf("Error creating TEI file %s: %v", fn, err)
+		}
+		defer f.Close()
+		err = bookpipeline.WriteTeiWithMetadata(f, meta, pages, docopts.Conf)
+		if err != nil {
+			return fmt.Errorf("Error writing TEI: %v", err)
+		}
+		err = f.Close()
+		if err != nil {
+			return fmt.Errorf("Error closing TEI file %s: %v", fn, err)
+		}
+	}
+
+	return nil
+}
+
+func uploadbook(ctx context.Context, dir string, name string, conn Pipeliner, nowipe bool, profile string) error {
 	_, err := os.Stat(dir)
 	if err != nil && !os.IsExist(err) {
 		return fmt.Errorf("Error: directory %s not found", dir)
@@ -805,6 +813,22 @@ func uploadbook(ctx context.Context, dir string, name string, conn Pipeliner, no
 	if err != nil {
 		return fmt.Errorf("Error saving images to process from %s: %v", dir, err)
 	}
+	err = pipeline.UploadProfile(profile, name, conn)
+	if err != nil {
+		return fmt.Errorf("Error saving preprocessing profile: %v", err)
+	}
+	metafn := filepath.Join(dir, bookpipeline.MetadataFile)
+	if _, err := os.Stat(metafn); err == nil {
+		var meta bookpipeline.Metadata
+		err = pipeline.ReadMetadata(metafn, &meta)
+		if err != nil {
+			return err
+		}
+		err = pipeline.UploadMetadata(meta, name, conn)
+		if err != nil {
+			return fmt.Errorf("Error saving metadata: %v", err)
+		}
+	}
 
 	qid := pipeline.DetectQueueType(dir, conn, nowipe)
 	fmt.Printf("Uploading to queue %s\n", qid)
@@ -817,7 +841,7 @@ func uploadbook(ctx context.Context, dir string, name string, conn Pipeliner, no
 	return nil
 }
 
-func downloadbook(dir string, name string, conn Pipeliner) error {
+func downloadbook(dir string, name string, conn Pipeliner, analyseopts pipeline.AnalyseOpts) error {
 	err := pipeline.DownloadBestPages(dir, name, conn)
 	if err != nil {
 		return fmt.Errorf("No images found")
@@ -833,6 +857,25 @@ func downloadbook(dir string, name string, conn Pipeliner) error {
 		return fmt.Errorf("Error downloading PDFs: %v", err)
 	}
 
+	if analyseopts.Epub {
+		err = pipeline.DownloadEpub(dir, name, conn)
+		if err != nil {
+			return fmt.Errorf("Error downloading EPUB: %v", err)
+		}
+	}
+
+	if analyseopts.BookHocr {
+		err = pipeline.DownloadBookHocr(dir, name, conn)
+		if err != nil {
+			return fmt.Errorf("Error downloading book hOCR: %v", err)
+		}
+	}
+
+	err = pipeline.DownloadCleanText(dir, name, conn)
+	if err != nil {
+		return fmt.Errorf("Error downloading clean text: %v", err)
+	}
+
 	err = pipeline.DownloadAnalyses(dir, name, conn)
 	if err != nil {
 		return fmt.Errorf("Error downloading analyses: %v", err)
@@ -841,7 +884,7 @@ func downloadbook(dir string, name string, conn Pipeliner) error {
 	return nil
 }
 
-func processbook(ctx context.Context, training string, tesscmd string, conn Pipeliner, fullpdf bool) error {
+func processbook(ctx context.Context, training string, tesscmd string, conn Pipeliner, deskew bool, earlyexit float64, analyseopts pipeline.AnalyseOpts) error {
 	origPattern := regexp.MustCompile(`[0-9]{4}.(jpg|png)$`)
 	wipePattern := regexp.MustCompile(`[0-9]{4,6}(.bin)?.(jpg|png)$`)
 	ocredPattern := regexp.MustCompile(`.hocr$`)
@@ -880,7 +923,7 @@ func processbook(ctx context.Context, training string, tesscmd string, conn Pipe
 			stopTimer(stopIfQuiet)
 			conn.Log("Message received on preprocess no wipe queue, processing", msg.Body)
 			fmt.Printf("  Preprocessing book (binarising only, no wiping)\n")
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Preprocess(thresholds, true), origPattern, conn.PreNoWipeQueueId(), conn.OCRPageQueueId())
+			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Preprocess(conn, pipeline.PreprocessOpts{Thresholds: thresholds, NoWipe: true, EarlyExit: earlyexit, Deskew: deskew, TessCmd: tesscmd}), origPattern, conn.PreNoWipeQueueId(), conn.OCRPageQueueId())
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				return fmt.Errorf("Error during preprocess (no wipe): %v", err)
@@ -899,7 +942,7 @@ func processbook(ctx context.Context, training string, tesscmd string, conn Pipe
 			stopTimer(stopIfQuiet)
 			conn.Log("Message received on preprocess queue, processing", msg.Body)
 			fmt.Printf("  Preprocessing book (binarising and wiping)\n")
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Preprocess(thresholds, false), origPattern, conn.PreQueueId(), conn.OCRPageQueueId())
+			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Preprocess(conn, pipeline.PreprocessOpts{Thresholds: thresholds, EarlyExit: earlyexit, Deskew: deskew, TessCmd: tesscmd}), origPattern, conn.PreQueueId(), conn.OCRPageQueueId())
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				return fmt.Errorf("Error during preprocess: %v", err)
@@ -918,7 +961,7 @@ func processbook(ctx context.Context, training string, tesscmd string, conn Pipe
 			stopTimer(stopIfQuiet)
 			conn.Log("Message received on wipeonly queue, processing", msg.Body)
 			fmt.Printf("  Preprocessing book (wiping only)\n")
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Wipe, wipePattern, conn.WipeQueueId(), conn.OCRPageQueueId())
+			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Wipe(conn), wipePattern, conn.WipeQueueId(), conn.OCRPageQueueId())
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				return fmt.Errorf("Error during wipe: %v", err)
@@ -957,7 +1000,7 @@ func processbook(ctx context.Context, training string, tesscmd string, conn Pipe
 			stopTimer(stopIfQuiet)
 			conn.Log("Message received on analyse queue, processing", msg.Body)
 			fmt.Printf("\n  Analysing OCR and compiling PDFs\n")
-			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Analyse(conn, fullpdf), ocredPattern, conn.AnalyseQueueId(), "")
+			err = pipeline.ProcessBook(ctx, msg, conn, pipeline.Analyse(conn, analyseopts), ocredPattern, conn.AnalyseQueueId(), conn.OCRPageQueueId())
 			resetTimer(stopIfQuiet, quietTime)
 			if err != nil {
 				return fmt.Errorf("Error during analysis: %v", err)
@@ -0,0 +1,142 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"sort"
+)
+
+// compositeOverlap is the minimum proportion of each of two lines'
+// areas which must overlap for them to be considered the same line
+const compositeOverlap = 0.5
+
+// compositeExtraConf is the minimum confidence for a line which is
+// only found in a variant other than the base to be added to a
+// composite page, to avoid adding noise which some thresholds pick
+// up as text
+const compositeExtraConf = 50
+
+// AvgConf returns the average word confidence of a line, or 0 if
+// it contains no words
+func (l HocrLine) AvgConf() float64 {
+	if len(l.Words) == 0 {
+		return 0
+	}
+	var total float64
+	for _, w := range l.Words {
+		total += w.Conf
+	}
+	return total / float64(len(l.Words))
+}
+
+// bboxArea returns the area of a bounding box
+func bboxArea(b [4]int) int {
+	w, h := b[2]-b[0], b[3]-b[1]
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+	return w * h
+}
+
+// bboxIntersection returns the area of the intersection of two
+// bounding boxes
+func bboxIntersection(a, b [4]int) int {
+	return bboxArea([4]int{max(a[0], b[0]), max(a[1], b[1]), min(a[2], b[2]), min(a[3], b[3])})
+}
+
+// sameLine returns whether two lines from different variants of a
+// page cover substantially the same area
+func sameLine(a, b [4]int) bool {
+	i := float64(bboxIntersection(a, b))
+	aa, ba := float64(bboxArea(a)), float64(bboxArea(b))
+	if aa == 0 || ba == 0 {
+		return false
+	}
+	return i/aa >= compositeOverlap && i/ba >= compositeOverlap
+}
+
+// CompositePage assembles a page from several OCR variants of it,
+// such as those from different binarisation thresholds. The
+// variant at index base provides the structure of the page, and
+// each of its lines is replaced with the line covering the same
+// area with the highest confidence in any variant. Confident lines
+// found only in other variants, such as a faint marginal note, are
+// added in a final area of the page, in order from top to bottom.
+func CompositePage(variants []HocrPage, base int) HocrPage {
+	var others [][]HocrLine
+	for i, v := range variants {
+		if i != base {
+			others = append(others, v.Lines())
+		}
+	}
+
+	// copy the base page structure so the variant isn't changed
+	pg := variants[base]
+	pg.Areas = append([]HocrArea{}, pg.Areas...)
+	var covered [][4]int
+	for i := range pg.Areas {
+		a := &pg.Areas[i]
+		a.Pars = append([]HocrPar{}, a.Pars...)
+		for j := range a.Pars {
+			par := &a.Pars[j]
+			par.Lines = append([]HocrLine{}, par.Lines...)
+			for k := range par.Lines {
+				l := &par.Lines[k]
+				best := *l
+				bestconf := l.AvgConf()
+				for _, lines := range others {
+					for _, o := range lines {
+						if sameLine(l.Bbox, o.Bbox) && o.AvgConf() > bestconf {
+							best = o
+							bestconf = o.AvgConf()
+						}
+					}
+				}
+				*l = best
+				covered = append(covered, l.Bbox)
+			}
+		}
+	}
+
+	var extras []HocrLine
+	for _, lines := range others {
+		for _, o := range lines {
+			if o.AvgConf() >= compositeExtraConf {
+				extras = append(extras, o)
+			}
+		}
+	}
+	sort.SliceStable(extras, func(i, j int) bool {
+		return extras[i].AvgConf() > extras[j].AvgConf()
+	})
+	var added []HocrLine
+	for _, o := range extras {
+		overlaps := false
+		for _, c := range covered {
+			if bboxIntersection(o.Bbox, c) > 0 {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			added = append(added, o)
+			covered = append(covered, o.Bbox)
+		}
+	}
+
+	if len(added) > 0 {
+		sort.SliceStable(added, func(i, j int) bool {
+			return added[i].Bbox[1] < added[j].Bbox[1]
+		})
+		a := HocrArea{Class: "ocr_carea", Bbox: added[0].Bbox}
+		for _, l := range added {
+			a.Pars = append(a.Pars, HocrPar{Bbox: l.Bbox, Lines: []HocrLine{l}})
+			a.Bbox = [4]int{min(a.Bbox[0], l.Bbox[0]), min(a.Bbox[1], l.Bbox[1]), max(a.Bbox[2], l.Bbox[2]), max(a.Bbox[3], l.Bbox[3])}
+		}
+		pg.Areas = append(pg.Areas, a)
+	}
+
+	return pg
+}
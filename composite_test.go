@@ -0,0 +1,84 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testLine returns a line with one word
+func testLine(text string, bbox [4]int, conf float64) HocrLine {
+	return HocrLine{Class: "ocr_line", Bbox: bbox, Words: []HocrWord{{Text: text, Bbox: bbox, Conf: conf}}}
+}
+
+func TestCompositePage(t *testing.T) {
+	base := parseTestHocr(t, testHocr)[0]
+	// a variant which reads the first line more confidently, and
+	// finds some extra lines
+	other := parseTestHocr(t, strings.Replace(strings.Replace(testHocr, "x_wconf 40", "x_wconf 99", 1), ">Novum<", ">Novvm<", 1))[0]
+	var pars []HocrPar
+	for _, l := range []HocrLine{
+		testLine("nota", [4]int{920, 500, 990, 540}, 80),
+		testLine("noise", [4]int{920, 600, 990, 640}, 20),
+		testLine("bene", [4]int{920, 400, 990, 440}, 60),
+		testLine("overlap", [4]int{100, 130, 900, 170}, 90),
+	} {
+		pars = append(pars, HocrPar{Bbox: l.Bbox, Lines: []HocrLine{l}})
+	}
+	other.Areas = append(other.Areas, HocrArea{Class: "ocr_carea", Bbox: [4]int{100, 130, 990, 640}, Pars: pars})
+
+	pg := CompositePage([]HocrPage{base, other}, 0)
+	if !reflect.DeepEqual(base, parseTestHocr(t, testHocr)[0]) {
+		t.Errorf("Expected base variant to be unchanged")
+	}
+
+	var got []string
+	for _, l := range pg.Lines() {
+		got = append(got, l.Text())
+	}
+	want := []string{"Novvm Orga-", "num sive", "indicia vera", "bene", "nota"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected lines %q, got %q", want, got)
+	}
+	if len(pg.Areas) != 2 || pg.Areas[1].Bbox != [4]int{920, 400, 990, 540} {
+		t.Errorf("Expected extra lines in a second area covering them, got %+v", pg.Areas)
+	}
+	if pg.Id != base.Id || pg.Bbox != base.Bbox || pg.Lines()[2].Class != "ocr_header" {
+		t.Errorf("Expected the structure of the base page to be kept")
+	}
+
+	// with the other variant as the base, nothing in the first is
+	// better, and the extra lines are all already covered
+	pg = CompositePage([]HocrPage{base, other}, 1)
+	if !reflect.DeepEqual(pg, other) {
+		t.Errorf("Expected the other variant, got %+v", pg)
+	}
+
+	pg = CompositePage([]HocrPage{base}, 0)
+	if !reflect.DeepEqual(pg, base) {
+		t.Errorf("Expected a single variant to be unchanged, got %+v", pg)
+	}
+}
+
+func TestSameLine(t *testing.T) {
+	cases := []struct {
+		a, b [4]int
+		want bool
+	}{
+		{[4]int{0, 0, 100, 20}, [4]int{0, 0, 100, 20}, true},
+		{[4]int{0, 0, 100, 20}, [4]int{5, 2, 105, 22}, true},
+		{[4]int{0, 0, 100, 20}, [4]int{0, 15, 100, 35}, false},
+		{[4]int{0, 0, 100, 20}, [4]int{0, 0, 300, 20}, false},
+		{[4]int{0, 0, 100, 20}, [4]int{200, 0, 300, 20}, false},
+		{[4]int{0, 0, 0, 0}, [4]int{0, 0, 0, 0}, false},
+	}
+	for _, c := range cases {
+		if got := sameLine(c.a, c.b); got != c.want {
+			t.Errorf("%v %v: expected %v, got %v", c.a, c.b, c.want, got)
+		}
+	}
+}
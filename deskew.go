@@ -0,0 +1,196 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// The range and precision of skew angles which FindSkew looks for,
+// in degrees
+const (
+	maxSkew       = 5
+	skewStep      = 0.5
+	skewFineStep  = 0.05
+	skewSampleDim = 1000
+)
+
+// grey returns the grey level of a colour, from 0 to 255
+func grey(c color.Color) uint8 {
+	return color.GrayModel.Convert(c).(color.Gray).Y
+}
+
+// otsu returns the threshold which best separates the values in a
+// histogram of grey levels into two classes, using Otsu's method
+func otsu(hist [256]int) uint8 {
+	var total, sum float64
+	for i, n := range hist {
+		total += float64(n)
+		sum += float64(i * n)
+	}
+	var best float64
+	var thresh uint8
+	var wb, sumb float64
+	for i, n := range hist {
+		wb += float64(n)
+		if wb == 0 {
+			continue
+		}
+		wf := total - wb
+		if wf == 0 {
+			break
+		}
+		sumb += float64(i * n)
+		mb := sumb / wb
+		mf := (sum - sumb) / wf
+		between := wb * wf * (mb - mf) * (mb - mf)
+		if between > best {
+			best = between
+			thresh = uint8(i)
+		}
+	}
+	return thresh
+}
+
+// darkPoints returns the coordinates of the dark pixels of an image,
+// sampled so that the larger dimension is at most skewSampleDim
+func darkPoints(img image.Image) [][2]float64 {
+	b := img.Bounds()
+	step := 1
+	if d := max(b.Dx(), b.Dy()); d > skewSampleDim {
+		step = (d + skewSampleDim - 1) / skewSampleDim
+	}
+
+	var hist [256]int
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			hist[grey(img.At(x, y))]++
+		}
+	}
+	t := otsu(hist)
+
+	var pts [][2]float64
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			if grey(img.At(x, y)) <= t {
+				pts = append(pts, [2]float64{float64((x - b.Min.X) / step), float64((y - b.Min.Y) / step)})
+			}
+		}
+	}
+	return pts
+}
+
+// skewScore returns how well lines of dark points line up
+// horizontally once rotated clockwise by angle degrees, as the sum
+// of the squared differences between the number of points in
+// adjacent rows, which is highest when lines of text are level
+func skewScore(pts [][2]float64, angle float64) float64 {
+	rad := angle * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+	rows := make(map[int]int)
+	minrow, maxrow := math.MaxInt, math.MinInt
+	for _, p := range pts {
+		r := int(math.Round(p[0]*sin + p[1]*cos))
+		rows[r]++
+		minrow = min(minrow, r)
+		maxrow = max(maxrow, r)
+	}
+	var score float64
+	for r := minrow; r < maxrow; r++ {
+		d := float64(rows[r+1] - rows[r])
+		score += d * d
+	}
+	return score
+}
+
+// FindSkew finds the small angle, in degrees clockwise, by which an
+// image of a page should be rotated so that its lines of text are
+// level, using the projection profile of its dark pixels. Angles of
+// up to 5 degrees either way are found, to the nearest 0.05 degrees.
+func FindSkew(img image.Image) float64 {
+	pts := darkPoints(img)
+	if len(pts) == 0 {
+		return 0
+	}
+
+	search := func(from, to, step float64, best float64) float64 {
+		bestscore := skewScore(pts, best)
+		for a := from; a <= to+step/2; a += step {
+			s := skewScore(pts, a)
+			if s > bestscore {
+				best, bestscore = a, s
+			}
+		}
+		return best
+	}
+
+	best := search(-maxSkew, maxSkew, skewStep, 0)
+	best = search(best-skewStep, best+skewStep, skewFineStep, best)
+	return math.Round(best/skewFineStep) * skewFineStep
+}
+
+// RotateImage rotates an image clockwise by angle degrees. Right
+// angles are rotated exactly, swapping the width and height when
+// needed. Other angles are rotated around the centre, enlarging
+// the image so that none of it is cut off, and filling the area
+// around it with white.
+func RotateImage(img image.Image, angle float64) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	switch math.Mod(math.Mod(angle, 360)+360, 360) {
+	case 0:
+		return img
+	case 90:
+		out := image.NewRGBA(image.Rect(0, 0, h, w))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				out.Set(h-1-y, x, img.At(b.Min.X+x, b.Min.Y+y))
+			}
+		}
+		return out
+	case 180:
+		out := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				out.Set(w-1-x, h-1-y, img.At(b.Min.X+x, b.Min.Y+y))
+			}
+		}
+		return out
+	case 270:
+		out := image.NewRGBA(image.Rect(0, 0, h, w))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				out.Set(y, w-1-x, img.At(b.Min.X+x, b.Min.Y+y))
+			}
+		}
+		return out
+	}
+
+	rad := angle * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+	outw := int(math.Ceil(math.Abs(float64(w)*cos) + math.Abs(float64(h)*sin)))
+	outh := int(math.Ceil(math.Abs(float64(w)*sin) + math.Abs(float64(h)*cos)))
+	out := image.NewRGBA(image.Rect(0, 0, outw, outh))
+	draw.Draw(out, out.Bounds(), image.White, image.Point{}, draw.Src)
+	cx, cy := float64(w)/2, float64(h)/2
+	ocx, ocy := float64(outw)/2, float64(outh)/2
+	for y := 0; y < outh; y++ {
+		for x := 0; x < outw; x++ {
+			// find the source pixel by rotating back anticlockwise
+			dx, dy := float64(x)-ocx, float64(y)-ocy
+			sx := int(math.Round(dx*cos + dy*sin + cx))
+			sy := int(math.Round(-dx*sin + dy*cos + cy))
+			if sx < 0 || sy < 0 || sx >= w || sy >= h {
+				continue
+			}
+			out.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// countDark returns the number of dark pixels in an image
+func countDark(img image.Image) int {
+	n := 0
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y < 128 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestRotateImage(t *testing.T) {
+	// a black page, so that any corner cut off loses dark pixels
+	page := image.NewRGBA(image.Rect(0, 0, 400, 600))
+	draw.Draw(page, page.Bounds(), image.Black, image.Point{}, draw.Src)
+
+	cases := []struct {
+		angle float64
+		w, h  int
+	}{
+		{0, 400, 600},
+		{90, 600, 400},
+		{180, 400, 600},
+		{-90, 600, 400},
+		{30, 647, 720},
+		{-2, 421, 614},
+	}
+	for _, c := range cases {
+		img := RotateImage(page, c.angle)
+		b := img.Bounds()
+		if b.Dx() != c.w || b.Dy() != c.h {
+			t.Errorf("Expected rotating by %.0f to give %dx%d, got %dx%d", c.angle, c.w, c.h, b.Dx(), b.Dy())
+		}
+		// allow for the rounding of pixels along the edges
+		if n, want := countDark(img), 400*600; n < want*99/100 || n > want*101/100 {
+			t.Errorf("Expected rotating by %.0f to keep about %d dark pixels, got %d", c.angle, want, n)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+const docxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>
+</Types>
+`
+
+const docxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>
+</Relationships>
+`
+
+// WriteDocx writes the text of a set of hOCR pages to a DOCX file,
+// with each hOCR paragraph as a paragraph and a page break between
+// pages. Words with a confidence lower than highlight are
+// highlighted; set highlight to 0 to disable this.
+func WriteDocx(path string, pages []HocrPage, highlight float64) error {
+	var s strings.Builder
+	s.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+<w:body>
+`)
+	for i, pg := range pages {
+		if i > 0 {
+			s.WriteString("<w:p><w:r><w:br w:type=\"page\"/></w:r></w:p>\n")
+		}
+		for _, par := range pg.Pars() {
+			runs := docRuns(par.DehyphenatedWords(), highlight)
+			if len(runs) == 0 {
+				continue
+			}
+			s.WriteString("<w:p>")
+			for _, r := range runs {
+				s.WriteString("<w:r>")
+				if r.highlight {
+					s.WriteString("<w:rPr><w:highlight w:val=\"yellow\"/></w:rPr>")
+				}
+				fmt.Fprintf(&s, "<w:t xml:space=\"preserve\">%s</w:t></w:r>", html.EscapeString(r.text))
+			}
+			s.WriteString("</w:p>\n")
+		}
+	}
+	s.WriteString("</w:body>\n</w:document>\n")
+
+	files := []zipFile{
+		{"[Content_Types].xml", []byte(docxContentTypes)},
+		{"_rels/.rels", []byte(docxRels)},
+		{"word/document.xml", []byte(s.String())},
+	}
+	return writeZip(path, "", files)
+}
@@ -0,0 +1,314 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// epubPagesPerChapter is the number of pages included in each
+// chapter (xhtml file) of an EPUB
+const epubPagesPerChapter = 20
+
+// epubImgHeight is the height in pixels that page images are
+// scaled to when included in an EPUB
+const epubImgHeight = 1500
+
+type epubPage struct {
+	id, label string
+}
+
+type epubChapter struct {
+	body  strings.Builder
+	pages []epubPage
+}
+
+type epubImage struct {
+	name string
+	data []byte
+}
+
+// Epub builds a reflowable EPUB 3 book from hOCR pages. It is used
+// in the same way as Fpdf: call Setup, then AddPage for each page
+// in order, then Save.
+type Epub struct {
+	name     string // used for the identifier
+	title    string
+	lang     string
+	meta     Metadata
+	chapters []*epubChapter
+	images   []epubImage
+	npages   int
+	// carry holds the start of a paragraph whose last word was
+	// hyphenated across a page break, so it can be joined with
+	// the first paragraph of the next page
+	carry string
+}
+
+// Setup prepares a new EPUB with a title and a language code (which
+// defaults to "en" if empty).
+func (e *Epub) Setup(title string, lang string) error {
+	if lang == "" {
+		lang = "en"
+	}
+	e.name = title
+	e.title = title
+	e.lang = lang
+	e.chapters = []*epubChapter{}
+	e.images = []epubImage{}
+	e.npages = 0
+	e.carry = ""
+	e.meta = Metadata{}
+	return nil
+}
+
+// SetMetadata records the bibliographic details of a book in the
+// EPUB, using its title and language in place of those given to
+// Setup if they are known
+func (e *Epub) SetMetadata(m Metadata) {
+	e.meta = m
+	if m.Title != "" {
+		e.title = m.Title
+	}
+	if m.Language != "" {
+		e.lang = m.Language
+	}
+}
+
+// AddPage adds a page to the EPUB from an hOCR file. If useimg is
+// set then the image at imgpath is included in place of the text,
+// which is useful for pages with too low a confidence for the text
+// to be worth reading.
+func (e *Epub) AddPage(imgpath, hocrpath string, useimg bool) error {
+	return e.AddLabelledPage(imgpath, hocrpath, useimg, "")
+}
+
+// AddLabelledPage adds a page to the EPUB in the same way as AddPage,
+// using label as its printed page label in the page list, rather than
+// its number.
+func (e *Epub) AddLabelledPage(imgpath, hocrpath string, useimg bool, label string) error {
+	e.npages++
+	if (e.npages-1)%epubPagesPerChapter == 0 {
+		e.chapters = append(e.chapters, &epubChapter{})
+	}
+	ch := e.chapters[len(e.chapters)-1]
+
+	pgid := fmt.Sprintf("page%04d", e.npages)
+	if label == "" {
+		label = fmt.Sprintf("%d", e.npages)
+	}
+	ch.pages = append(ch.pages, epubPage{id: pgid, label: label})
+	label = html.EscapeString(label)
+
+	if useimg {
+		e.flushCarry(ch)
+		fmt.Fprintf(&ch.body, "<div epub:type=\"pagebreak\" role=\"doc-pagebreak\" id=\"%s\" title=\"%s\"></div>\n", pgid, label)
+		name, err := e.addImage(imgpath, pgid)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&ch.body, "<p class=\"pageimg\"><img src=\"%s\" alt=\"Page %s\"/></p>\n", name, label)
+		return nil
+	}
+
+	pg, err := ReadHocrPage(hocrpath)
+	if err != nil {
+		return err
+	}
+
+	pars := pg.Pars()
+	fmt.Fprintf(&ch.body, "<div epub:type=\"pagebreak\" role=\"doc-pagebreak\" id=\"%s\" title=\"%s\"></div>\n", pgid, label)
+	first := true
+	for i, par := range pars {
+		t := par.Text(true)
+		if t == "" {
+			continue
+		}
+		if first && e.carry != "" {
+			t = e.carry + t
+			e.carry = ""
+		}
+		first = false
+		if i == len(pars)-1 && EndsHyphenated(par.Lines[len(par.Lines)-1].Text()) {
+			e.carry = strings.TrimRight(t, hyphens)
+			continue
+		}
+		fmt.Fprintf(&ch.body, "<p>%s</p>\n", html.EscapeString(t))
+	}
+
+	return nil
+}
+
+// flushCarry writes any carried over text as its own paragraph
+func (e *Epub) flushCarry(ch *epubChapter) {
+	if e.carry == "" {
+		return
+	}
+	fmt.Fprintf(&ch.body, "<p>%s</p>\n", html.EscapeString(e.carry))
+	e.carry = ""
+}
+
+// addImage scales an image down and stores it as a JPEG to be
+// included in the EPUB, returning its name
+func (e *Epub) addImage(imgpath string, id string) (string, error) {
+	f, err := os.Open(imgpath)
+	if err != nil {
+		return "", fmt.Errorf("Could not open file %s: %v", imgpath, err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return "", fmt.Errorf("Could not decode image %s: %v", imgpath, err)
+	}
+
+	b := img.Bounds()
+	if b.Dy() > epubImgHeight {
+		r := image.Rect(0, 0, b.Dx()*epubImgHeight/b.Dy(), epubImgHeight)
+		smimg := image.NewRGBA(r)
+		draw.ApproxBiLinear.Scale(smimg, r, img, b, draw.Over, nil)
+		img = smimg
+	}
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpeg.DefaultQuality})
+	if err != nil {
+		return "", fmt.Errorf("Could not encode image %s: %v", imgpath, err)
+	}
+
+	name := "img/" + id + ".jpg"
+	e.images = append(e.images, epubImage{name: name, data: buf.Bytes()})
+	return name, nil
+}
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+const epubCss = `body { font-family: serif; }
+p { text-indent: 1em; margin: 0; }
+p.pageimg { text-indent: 0; text-align: center; margin: 1em 0; }
+p.pageimg img { max-width: 100%; max-height: 95vh; }
+`
+
+const xhtmlHead = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="%s" xml:lang="%s">
+<head>
+<meta charset="UTF-8"/>
+<title>%s</title>
+<link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+`
+
+// chapterName returns the file name of a chapter
+func chapterName(i int) string {
+	return fmt.Sprintf("chapter%03d.xhtml", i+1)
+}
+
+// nav creates the EPUB navigation document, containing a table of
+// contents and a page list
+func (e *Epub) nav() string {
+	var s strings.Builder
+	t := html.EscapeString(e.title)
+	fmt.Fprintf(&s, xhtmlHead, e.lang, e.lang, t)
+	s.WriteString("<nav epub:type=\"toc\" id=\"toc\">\n<h1>Contents</h1>\n<ol>\n")
+	for i, ch := range e.chapters {
+		first := ch.pages[0].label
+		last := ch.pages[len(ch.pages)-1].label
+		fmt.Fprintf(&s, "<li><a href=\"%s\">Pages %s–%s</a></li>\n", chapterName(i), html.EscapeString(first), html.EscapeString(last))
+	}
+	s.WriteString("</ol>\n</nav>\n")
+	s.WriteString("<nav epub:type=\"page-list\" id=\"page-list\" hidden=\"\">\n<ol>\n")
+	for i, ch := range e.chapters {
+		for _, pg := range ch.pages {
+			fmt.Fprintf(&s, "<li><a href=\"%s#%s\">%s</a></li>\n", chapterName(i), pg.id, html.EscapeString(pg.label))
+		}
+	}
+	s.WriteString("</ol>\n</nav>\n</body>\n</html>\n")
+	return s.String()
+}
+
+// opf creates the EPUB package document
+func (e *Epub) opf() string {
+	var s strings.Builder
+	t := html.EscapeString(e.title)
+	s.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+`)
+	fmt.Fprintf(&s, "<dc:identifier id=\"bookid\">urn:rescribe:%s</dc:identifier>\n", html.EscapeString(e.name))
+	fmt.Fprintf(&s, "<dc:title>%s</dc:title>\n", t)
+	fmt.Fprintf(&s, "<dc:language>%s</dc:language>\n", html.EscapeString(e.lang))
+	for _, a := range e.meta.Authors {
+		fmt.Fprintf(&s, "<dc:creator>%s</dc:creator>\n", html.EscapeString(a))
+	}
+	if e.meta.Year != "" {
+		fmt.Fprintf(&s, "<dc:date>%s</dc:date>\n", html.EscapeString(e.meta.Year))
+	}
+	if e.meta.Publisher != "" {
+		fmt.Fprintf(&s, "<dc:publisher>%s</dc:publisher>\n", html.EscapeString(e.meta.Publisher))
+	}
+	if src := e.meta.Source(); src != "" {
+		fmt.Fprintf(&s, "<dc:source>%s</dc:source>\n", html.EscapeString(src))
+	}
+	fmt.Fprintf(&s, "<meta property=\"dcterms:modified\">%s</meta>\n", time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+	s.WriteString("</metadata>\n<manifest>\n")
+	s.WriteString("<item id=\"nav\" href=\"nav.xhtml\" media-type=\"application/xhtml+xml\" properties=\"nav\"/>\n")
+	s.WriteString("<item id=\"css\" href=\"style.css\" media-type=\"text/css\"/>\n")
+	for i := range e.chapters {
+		fmt.Fprintf(&s, "<item id=\"chapter%03d\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", i+1, chapterName(i))
+	}
+	for i, img := range e.images {
+		fmt.Fprintf(&s, "<item id=\"img%04d\" href=\"%s\" media-type=\"image/jpeg\"/>\n", i+1, img.name)
+	}
+	s.WriteString("</manifest>\n<spine>\n")
+	for i := range e.chapters {
+		fmt.Fprintf(&s, "<itemref idref=\"chapter%03d\"/>\n", i+1)
+	}
+	s.WriteString("</spine>\n</package>\n")
+	return s.String()
+}
+
+// Save writes the EPUB to the file at path
+func (e *Epub) Save(path string) error {
+	if len(e.chapters) == 0 {
+		return fmt.Errorf("No pages added to EPUB")
+	}
+	if e.carry != "" {
+		e.flushCarry(e.chapters[len(e.chapters)-1])
+	}
+
+	files := []zipFile{
+		{"META-INF/container.xml", []byte(epubContainer)},
+		{"OEBPS/content.opf", []byte(e.opf())},
+		{"OEBPS/nav.xhtml", []byte(e.nav())},
+		{"OEBPS/style.css", []byte(epubCss)},
+	}
+	t := html.EscapeString(e.title)
+	for i, ch := range e.chapters {
+		s := fmt.Sprintf(xhtmlHead, e.lang, e.lang, t) + ch.body.String() + "</body>\n</html>\n"
+		files = append(files, zipFile{"OEBPS/" + chapterName(i), []byte(s)})
+	}
+	for _, img := range e.images {
+		files = append(files, zipFile{"OEBPS/" + img.name, img.data})
+	}
+
+	return writeZip(path, "application/epub+zip", files)
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"archive/zip"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readZip returns the contents of each file in a zip archive, and
+// the names of the files in order
+func readZip(t *testing.T, path string) (map[string]string, []string) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("Error opening %s: %v", path, err)
+	}
+	defer z.Close()
+	files := make(map[string]string)
+	var names []string
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("Error opening %s in %s: %v", f.Name, path, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("Error reading %s in %s: %v", f.Name, path, err)
+		}
+		files[f.Name] = string(b)
+		names = append(names, f.Name)
+	}
+	return files, names
+}
+
+func TestEpub(t *testing.T) {
+	dir := t.TempDir()
+	// the last paragraph of the first page is hyphenated across
+	// the page break, and continues on the third
+	pg1 := writeTestHocr(t, dir, "0001.hocr", strings.Replace(testHocr, ">vera<", ">con-<", 1))
+	pg3 := writeTestHocr(t, dir, "0003.hocr", strings.Replace(testHocr, ">Novum<", ">tinuo<", 1))
+	imgfn := filepath.Join(dir, "0002.png")
+	f, err := os.Create(imgfn)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, image.NewGray(image.Rect(0, 0, 300, 3000)))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+
+	e := new(Epub)
+	err = e.Setup("Book", "")
+	if err != nil {
+		t.Fatalf("Error setting up EPUB: %v", err)
+	}
+	e.SetMetadata(Metadata{Title: "Novum Organum & more", Authors: []string{"Francis Bacon"}, Year: "1620", Language: "la"})
+	for _, p := range []struct {
+		img, hocr string
+		useimg    bool
+		label     string
+	}{
+		{"", pg1, false, "i"},
+		{imgfn, "", true, "plate"},
+		{"", pg3, false, ""},
+	} {
+		err = e.AddLabelledPage(p.img, p.hocr, p.useimg, p.label)
+		if err != nil {
+			t.Fatalf("Error adding page: %v", err)
+		}
+	}
+	fn := filepath.Join(dir, "book.epub")
+	err = e.Save(fn)
+	if err != nil {
+		t.Fatalf("Error saving EPUB: %v", err)
+	}
+
+	files, names := readZip(t, fn)
+	if names[0] != "mimetype" || files["mimetype"] != "application/epub+zip" {
+		t.Errorf("Expected mimetype first, got %s", names[0])
+	}
+	for _, n := range []string{"META-INF/container.xml", "OEBPS/content.opf", "OEBPS/nav.xhtml", "OEBPS/style.css", "OEBPS/chapter001.xhtml", "OEBPS/img/page0002.jpg"} {
+		if _, ok := files[n]; !ok {
+			t.Errorf("Expected %s in EPUB", n)
+		}
+	}
+
+	opf := files["OEBPS/content.opf"]
+	for _, s := range []string{"<dc:title>Novum Organum &amp; more</dc:title>", "<dc:language>la</dc:language>",
+		"<dc:creator>Francis Bacon</dc:creator>", "<dc:date>1620</dc:date>", "urn:rescribe:Book"} {
+		if !strings.Contains(opf, s) {
+			t.Errorf("Expected %s in package document", s)
+		}
+	}
+
+	nav := files["OEBPS/nav.xhtml"]
+	for _, s := range []string{"Pages i–3", `href="chapter001.xhtml#page0002">plate<`, `href="chapter001.xhtml#page0003">3<`} {
+		if !strings.Contains(nav, s) {
+			t.Errorf("Expected %s in navigation document", s)
+		}
+	}
+
+	ch := files["OEBPS/chapter001.xhtml"]
+	for _, s := range []string{"<p>Novum Organum sive</p>", `<img src="img/page0002.jpg" alt="Page plate"/>`,
+		"<p>indicia con</p>", "<p>tinuo Organum sive</p>"} {
+		if !strings.Contains(ch, s) {
+			t.Errorf("Expected %s in chapter", s)
+		}
+	}
+	if strings.Contains(ch, "con-") {
+		t.Errorf("Expected hyphen at the end of the first page to be removed")
+	}
+
+	// the image is scaled down to the height used in EPUBs
+	img, _, err := image.Decode(strings.NewReader(files["OEBPS/img/page0002.jpg"]))
+	if err != nil {
+		t.Fatalf("Error decoding EPUB image: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 150 || b.Dy() != epubImgHeight {
+		t.Errorf("Expected image to be scaled to 150x%d, got %v", epubImgHeight, b)
+	}
+
+	err = new(Epub).Save(filepath.Join(dir, "empty.epub"))
+	if err == nil {
+		t.Errorf("Expected an error saving an EPUB without pages")
+	}
+}
@@ -26,10 +26,25 @@ const yticknum = 40
 type Conf struct {
 	Path, Code string
 	Conf       float64
+	// Score is used to choose the best variant of a page, and is
+	// the same as Conf unless another PageMetric is used
+	Score float64
+	// Label is the printed page label, used in graphs if set
+	Label string
 }
 
 type GraphConf struct {
 	Pgnum, Conf float64
+	Label       string
+}
+
+// tickLabel returns the label of a page in a graph, which is its
+// printed page label if it has one, or otherwise its number
+func (c GraphConf) tickLabel() string {
+	if c.Label != "" {
+		return c.Label
+	}
+	return fmt.Sprintf("%.0f", c.Pgnum)
 }
 
 // createLine creates a horizontal line with a particular y value for
@@ -85,6 +100,7 @@ func GraphOpts(confs map[string]*Conf, bookname string, xaxis string, guidelines
 		var c GraphConf
 		c.Pgnum = pgnum
 		c.Conf = conf.Conf
+		c.Label = conf.Label
 		graphconf = append(graphconf, c)
 	}
 
@@ -96,6 +112,7 @@ func GraphOpts(confs map[string]*Conf, bookname string, xaxis string, guidelines
 			var c GraphConf
 			c.Pgnum = i
 			c.Conf = conf.Conf
+			c.Label = conf.Label
 			graphconf = append(graphconf, c)
 			i++
 		}
@@ -115,12 +132,12 @@ func GraphOpts(confs map[string]*Conf, bookname string, xaxis string, guidelines
 		xvalues = append(xvalues, c.Pgnum)
 		yvalues = append(yvalues, c.Conf)
 		if i%tickevery == 0 {
-			ticks = append(ticks, chart.Tick{Value: c.Pgnum, Label: fmt.Sprintf("%.0f", c.Pgnum)})
+			ticks = append(ticks, chart.Tick{Value: c.Pgnum, Label: c.tickLabel()})
 		}
 	}
 	// Make last tick the final page
 	final := graphconf[len(graphconf)-1]
-	ticks[len(ticks)-1] = chart.Tick{Value: final.Pgnum, Label: fmt.Sprintf("%.0f", final.Pgnum)}
+	ticks[len(ticks)-1] = chart.Tick{Value: final.Pgnum, Label: final.tickLabel()}
 	for i := 0; i <= yticknum; i++ {
 		n := float64(i*100) / yticknum
 		yticks = append(yticks, chart.Tick{Value: n, Label: fmt.Sprintf("%.1f", n)})
@@ -173,7 +190,7 @@ func GraphOpts(confs map[string]*Conf, bookname string, xaxis string, guidelines
 	var annotations []chart.Value2
 	for _, c := range graphconf {
 		if !guidelines || (c.Conf > highconf || c.Conf < lowconf) {
-			annotations = append(annotations, chart.Value2{Label: fmt.Sprintf("%.0f", c.Pgnum), XValue: c.Pgnum, YValue: c.Conf})
+			annotations = append(annotations, chart.Value2{Label: c.tickLabel(), XValue: c.Pgnum, YValue: c.Conf})
 		}
 	}
 	annotations = append(annotations, chart.Value2{Label: fmt.Sprintf("%.0f", lowconf), XValue: xvalues[len(xvalues)-1], YValue: lowconf})
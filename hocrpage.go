@@ -0,0 +1,368 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"rescribe.xyz/utils/pkg/hocr"
+)
+
+// HocrPage is the structure of a page of hOCR, keeping the area,
+// paragraph and line hierarchy which hocr.Parse flattens.
+type HocrPage struct {
+	Id, Title string
+	Bbox      [4]int
+	Areas     []HocrArea
+	// Label is the printed page label, such as "iv" or "12", which
+	// isn't part of the hOCR but can be set for use in outputs
+	Label string
+}
+
+// HocrArea is a content area of a page, such as a block of text
+// (ocr_carea) or an image (ocr_photo).
+type HocrArea struct {
+	Class, Id, Title string
+	Bbox             [4]int
+	Pars             []HocrPar
+}
+
+// HocrPar is a paragraph of text
+type HocrPar struct {
+	Id, Lang, Title string
+	Bbox            [4]int
+	Lines           []HocrLine
+}
+
+// HocrLine is a line of text. Class will usually be ocr_line, but
+// can also be e.g. ocr_header or ocr_caption.
+type HocrLine struct {
+	Class, Id, Title string
+	Bbox             [4]int
+	Words            []HocrWord
+}
+
+// HocrWord is a word, with its confidence as reported by x_wconf,
+// and the confidence of each of its characters if they are given,
+// by x_confs or by the x_conf of ocrx_cinfo elements
+type HocrWord struct {
+	Id, Text, Title string
+	Bbox            [4]int
+	Conf            float64
+	CharConfs       []float64
+}
+
+// hocrNode is a generic element used to decode any hOCR document
+type hocrNode struct {
+	Class string     `xml:"class,attr"`
+	Id    string     `xml:"id,attr"`
+	Title string     `xml:"title,attr"`
+	Lang  string     `xml:"lang,attr"`
+	Nodes []hocrNode `xml:",any"`
+	Text  string     `xml:",chardata"`
+}
+
+// text returns all character data inside a node, including that
+// of any child elements (like <strong> or <em>)
+func (n hocrNode) text() string {
+	s := n.Text
+	for _, c := range n.Nodes {
+		s += c.text()
+	}
+	return s
+}
+
+// titleConf parses the x_wconf value of an hOCR title attribute
+func titleConf(title string) (float64, error) {
+	for _, p := range strings.Split(title, ";") {
+		f := strings.Fields(p)
+		if len(f) == 2 && f[0] == "x_wconf" {
+			return strconv.ParseFloat(f[1], 64)
+		}
+	}
+	return 0, fmt.Errorf("No x_wconf found in title '%s'", title)
+}
+
+// titleFloats parses the numbers of a property of an hOCR title
+// attribute, such as x_confs, returning nil if it isn't found
+func titleFloats(title string, name string) []float64 {
+	for _, p := range strings.Split(title, ";") {
+		f := strings.Fields(p)
+		if len(f) < 2 || f[0] != name {
+			continue
+		}
+		var nums []float64
+		for _, s := range f[1:] {
+			n, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil
+			}
+			nums = append(nums, n)
+		}
+		return nums
+	}
+	return nil
+}
+
+// charConfs returns the confidences of the characters of a word,
+// from its x_confs property or the x_conf of each ocrx_cinfo
+// element inside it, or nil if there are none
+func (n hocrNode) charConfs() []float64 {
+	if c := titleFloats(n.Title, "x_confs"); c != nil {
+		return c
+	}
+	var confs []float64
+	var walk func(n hocrNode)
+	walk = func(n hocrNode) {
+		for _, c := range n.Nodes {
+			if c.Class == "ocrx_cinfo" {
+				if conf := titleFloats(c.Title, "x_conf"); len(conf) == 1 {
+					confs = append(confs, conf[0])
+				}
+				continue
+			}
+			walk(c)
+		}
+	}
+	walk(n)
+	return confs
+}
+
+// isLineClass returns whether an hOCR class is one of the
+// line-level classes
+func isLineClass(class string) bool {
+	switch class {
+	case "ocr_line", "ocr_header", "ocr_caption", "ocr_textfloat":
+		return true
+	}
+	return false
+}
+
+// ParseHocrPages parses an hOCR document into a slice of pages.
+// Any elements missing from the page > area > paragraph > line
+// hierarchy are implied, so a line directly inside a page is
+// still found.
+func ParseHocrPages(b []byte) ([]HocrPage, error) {
+	var root hocrNode
+	d := xml.NewDecoder(bytes.NewReader(b))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	err := d.Decode(&root)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing hOCR: %v", err)
+	}
+
+	var pages []HocrPage
+	var walk func(n hocrNode)
+	walk = func(n hocrNode) {
+		bbox, _ := hocr.BoxCoords(n.Title)
+		switch {
+		case n.Class == "ocr_page":
+			pages = append(pages, HocrPage{Id: n.Id, Title: n.Title, Bbox: bbox})
+		case n.Class == "ocr_carea" || n.Class == "ocr_photo" || n.Class == "ocr_separator":
+			if len(pages) == 0 {
+				pages = append(pages, HocrPage{})
+			}
+			pg := &pages[len(pages)-1]
+			pg.Areas = append(pg.Areas, HocrArea{Class: n.Class, Id: n.Id, Title: n.Title, Bbox: bbox})
+		case n.Class == "ocr_par":
+			pg := impliedArea(&pages)
+			pg.Pars = append(pg.Pars, HocrPar{Id: n.Id, Lang: n.Lang, Title: n.Title, Bbox: bbox})
+		case isLineClass(n.Class):
+			par := impliedPar(&pages)
+			par.Lines = append(par.Lines, HocrLine{Class: n.Class, Id: n.Id, Title: n.Title, Bbox: bbox})
+		case n.Class == "ocrx_word":
+			par := impliedPar(&pages)
+			if len(par.Lines) == 0 {
+				par.Lines = append(par.Lines, HocrLine{Class: "ocr_line"})
+			}
+			line := &par.Lines[len(par.Lines)-1]
+			conf, _ := titleConf(n.Title)
+			text := strings.TrimSpace(n.text())
+			if text != "" {
+				line.Words = append(line.Words, HocrWord{Id: n.Id, Text: text, Title: n.Title, Bbox: bbox, Conf: conf, CharConfs: n.charConfs()})
+			}
+			return
+		}
+		for _, c := range n.Nodes {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	return pages, nil
+}
+
+// impliedArea returns the last area of the last page, creating
+// them if necessary
+func impliedArea(pages *[]HocrPage) *HocrArea {
+	if len(*pages) == 0 {
+		*pages = append(*pages, HocrPage{})
+	}
+	pg := &(*pages)[len(*pages)-1]
+	if len(pg.Areas) == 0 || pg.Areas[len(pg.Areas)-1].Class != "ocr_carea" {
+		pg.Areas = append(pg.Areas, HocrArea{Class: "ocr_carea"})
+	}
+	return &pg.Areas[len(pg.Areas)-1]
+}
+
+// impliedPar returns the last paragraph of the last area of the
+// last page, creating them if necessary
+func impliedPar(pages *[]HocrPage) *HocrPar {
+	a := impliedArea(pages)
+	if len(a.Pars) == 0 {
+		a.Pars = append(a.Pars, HocrPar{})
+	}
+	return &a.Pars[len(a.Pars)-1]
+}
+
+// ReadHocrPage reads the first page from an hOCR file
+func ReadHocrPage(path string) (HocrPage, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return HocrPage{}, fmt.Errorf("Could not read file %s: %v", path, err)
+	}
+	pages, err := ParseHocrPages(b)
+	if err != nil {
+		return HocrPage{}, fmt.Errorf("Could not parse hOCR in file %s: %v", path, err)
+	}
+	if len(pages) == 0 {
+		return HocrPage{}, fmt.Errorf("No pages found in hOCR file %s", path)
+	}
+	return pages[0], nil
+}
+
+// Pars returns all paragraphs of a page, in order
+func (p HocrPage) Pars() []HocrPar {
+	var pars []HocrPar
+	for _, a := range p.Areas {
+		pars = append(pars, a.Pars...)
+	}
+	return pars
+}
+
+// Lines returns all lines of a page, in order
+func (p HocrPage) Lines() []HocrLine {
+	var lines []HocrLine
+	for _, par := range p.Pars() {
+		lines = append(lines, par.Lines...)
+	}
+	return lines
+}
+
+// Words returns all words of a page, in order
+func (p HocrPage) Words() []HocrWord {
+	var words []HocrWord
+	for _, l := range p.Lines() {
+		words = append(words, l.Words...)
+	}
+	return words
+}
+
+// AvgConf returns the average word confidence of a page, or 0
+// if it contains no words
+func (p HocrPage) AvgConf() float64 {
+	words := p.Words()
+	if len(words) == 0 {
+		return 0
+	}
+	var total float64
+	for _, w := range words {
+		total += w.Conf
+	}
+	return total / float64(len(words))
+}
+
+// Text returns the words of a line separated by spaces
+func (l HocrLine) Text() string {
+	var s []string
+	for _, w := range l.Words {
+		s = append(s, w.Text)
+	}
+	return strings.Join(s, " ")
+}
+
+// hyphens are the characters which are treated as marking a word
+// broken across lines
+const hyphens = "-¬⸗"
+
+// EndsHyphenated returns whether a line ends with a hyphen which
+// splits a word across to the next line
+func EndsHyphenated(s string) bool {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 {
+		return false
+	}
+	for _, h := range hyphens {
+		if strings.HasSuffix(s, string(h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dehyphenate joins a set of lines into one string, joining any
+// words that were hyphenated across lines and separating other
+// lines with a space.
+func Dehyphenate(lines []string) string {
+	var s string
+	for i, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		if i < len(lines)-1 && EndsHyphenated(l) {
+			s += strings.TrimRight(l, hyphens)
+			continue
+		}
+		s += l
+		if i < len(lines)-1 {
+			s += " "
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+// Text returns the text of a paragraph, with each line separated
+// by a space, and dehyphenated if requested.
+func (p HocrPar) Text(dehyphenate bool) string {
+	var lines []string
+	for _, l := range p.Lines {
+		lines = append(lines, l.Text())
+	}
+	if dehyphenate {
+		return Dehyphenate(lines)
+	}
+	return strings.Join(lines, " ")
+}
+
+// DehyphenatedWords returns the words of a paragraph, with any word
+// hyphenated across lines joined into one. The confidence of a
+// joined word is the lower of its parts.
+func (p HocrPar) DehyphenatedWords() []HocrWord {
+	var words []HocrWord
+	join := false
+	for _, l := range p.Lines {
+		for i, w := range l.Words {
+			if join && i == 0 && len(words) > 0 {
+				prev := &words[len(words)-1]
+				prev.Text = strings.TrimRight(prev.Text, hyphens) + w.Text
+				if w.Conf < prev.Conf {
+					prev.Conf = w.Conf
+				}
+				continue
+			}
+			words = append(words, w)
+		}
+		join = len(l.Words) > 0 && EndsHyphenated(l.Text())
+	}
+	return words
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testHocr is a page of hOCR with two paragraphs, the first of which
+// has a word hyphenated across its lines
+const testHocr = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+ <body>
+  <div class="ocr_page" id="page_1" title="image &quot;0001.png&quot;; bbox 0 0 1000 1500; ppageno 0">
+   <div class="ocr_carea" id="block_1_1" title="bbox 100 100 900 400">
+    <p class="ocr_par" id="par_1_1" lang="lat" title="bbox 100 100 900 220">
+     <span class="ocr_line" id="line_1_1" title="bbox 100 100 900 140">
+      <span class="ocrx_word" id="word_1_1" title="bbox 100 100 300 140; x_wconf 95">Novum</span>
+      <span class="ocrx_word" id="word_1_2" title="bbox 320 100 900 140; x_wconf 40">Orga-</span>
+     </span>
+     <span class="ocr_line" id="line_1_2" title="bbox 100 180 500 220">
+      <span class="ocrx_word" id="word_1_3" title="bbox 100 180 300 220; x_wconf 90">num</span>
+      <span class="ocrx_word" id="word_1_4" title="bbox 320 180 500 220; x_wconf 85"><strong>sive</strong></span>
+     </span>
+    </p>
+    <p class="ocr_par" id="par_1_2" lang="lat" title="bbox 100 300 900 340">
+     <span class="ocr_header" id="line_1_3" title="bbox 100 300 900 340">
+      <span class="ocrx_word" id="word_1_5" title="bbox 100 300 500 340; x_wconf 70">indicia</span>
+      <span class="ocrx_word" id="word_1_6" title="bbox 520 300 900 340; x_wconf 75">vera</span>
+     </span>
+    </p>
+   </div>
+  </div>
+ </body>
+</html>
+`
+
+// writeTestHocr writes hOCR to a file named name in dir, returning
+// its path
+func writeTestHocr(t *testing.T, dir string, name string, hocr string) string {
+	fn := filepath.Join(dir, name)
+	err := ioutil.WriteFile(fn, []byte(hocr), 0644)
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", fn, err)
+	}
+	return fn
+}
+
+// parseTestHocr parses hOCR, failing the test if it can't be
+func parseTestHocr(t *testing.T, hocr string) []HocrPage {
+	pages, err := ParseHocrPages([]byte(hocr))
+	if err != nil {
+		t.Fatalf("Error parsing hOCR: %v", err)
+	}
+	return pages
+}
+
+func TestParseHocrPages(t *testing.T) {
+	pages := parseTestHocr(t, testHocr)
+	if len(pages) != 1 {
+		t.Fatalf("Expected 1 page, got %d", len(pages))
+	}
+	pg := pages[0]
+	if pg.Id != "page_1" || pg.Bbox != [4]int{0, 0, 1000, 1500} {
+		t.Errorf("Unexpected page %s %v", pg.Id, pg.Bbox)
+	}
+	if len(pg.Areas) != 1 || len(pg.Pars()) != 2 || len(pg.Lines()) != 3 {
+		t.Fatalf("Expected 1 area, 2 paragraphs and 3 lines, got %d, %d and %d", len(pg.Areas), len(pg.Pars()), len(pg.Lines()))
+	}
+	if l := pg.Lines()[2]; l.Class != "ocr_header" || l.Text() != "indicia vera" {
+		t.Errorf("Unexpected header line %+v", l)
+	}
+	want := HocrWord{Id: "word_1_4", Text: "sive", Title: "bbox 320 180 500 220; x_wconf 85", Bbox: [4]int{320, 180, 500, 220}, Conf: 85}
+	if w := pg.Words()[3]; !reflect.DeepEqual(w, want) {
+		t.Errorf("Expected word %+v, got %+v", want, w)
+	}
+	if pg.Pars()[0].Lang != "lat" {
+		t.Errorf("Expected paragraph language lat, got %s", pg.Pars()[0].Lang)
+	}
+	if c := pg.AvgConf(); c != 75.83333333333333 {
+		t.Errorf("Unexpected average confidence %f", c)
+	}
+
+	// elements missing from the hierarchy are implied
+	implied := parseTestHocr(t, `<html><body><div class="ocr_page" title="bbox 0 0 10 10">
+		<span class="ocrx_word" title="bbox 1 1 2 2; x_wconf 50">lone</span>
+		<span class="ocrx_word" title="bbox 1 1 2 2; x_wconf 60"> </span></div></body></html>`)
+	if len(implied) != 1 || len(implied[0].Lines()) != 1 || implied[0].Lines()[0].Text() != "lone" {
+		t.Errorf("Expected a single implied line containing 'lone', got %+v", implied)
+	}
+
+	// character confidences are taken from x_confs or ocrx_cinfo
+	chars := parseTestHocr(t, `<html><body><div class="ocr_page" title="bbox 0 0 10 10">
+		<span class="ocrx_word" title="bbox 1 1 2 2; x_wconf 70; x_confs 90 80 40">one</span>
+		<span class="ocrx_word" title="bbox 1 1 2 2; x_wconf 60"><span class="ocrx_cinfo" title="x_bboxes 1 1 2 2; x_conf 95.5">t</span><span class="ocrx_cinfo" title="x_bboxes 1 1 2 2; x_conf 20">w</span><span class="ocrx_cinfo" title="x_bboxes 1 1 2 2; x_conf 64">o</span></span>
+		<span class="ocrx_word" title="bbox 1 1 2 2; x_wconf 50">three</span></div></body></html>`)[0].Words()
+	for i, want := range [][]float64{{90, 80, 40}, {95.5, 20, 64}, nil} {
+		if !reflect.DeepEqual(chars[i].CharConfs, want) {
+			t.Errorf("Expected character confidences %v for %s, got %v", want, chars[i].Text, chars[i].CharConfs)
+		}
+	}
+	if chars[1].Text != "two" {
+		t.Errorf("Expected word made of ocrx_cinfo elements to be two, got %s", chars[1].Text)
+	}
+
+	_, err := ParseHocrPages([]byte("<html><body><div"))
+	if err == nil {
+		t.Errorf("Expected an error parsing broken hOCR")
+	}
+}
+
+func TestDehyphenate(t *testing.T) {
+	cases := []struct {
+		lines []string
+		want  string
+	}{
+		{[]string{"one two", "three"}, "one two three"},
+		{[]string{"Orga-", "num sive"}, "Organum sive"},
+		{[]string{"Orga¬", "num"}, "Organum"},
+		{[]string{"Orga⸗", "num"}, "Organum"},
+		{[]string{"word", "", "  after  "}, "word after"},
+		{[]string{"ends with -"}, "ends with -"},
+		{[]string{"last line hyph-"}, "last line hyph-"},
+		{nil, ""},
+	}
+	for _, c := range cases {
+		if got := Dehyphenate(c.lines); got != c.want {
+			t.Errorf("%q: expected %q, got %q", c.lines, c.want, got)
+		}
+	}
+
+	par := parseTestHocr(t, testHocr)[0].Pars()[0]
+	if s := par.Text(true); s != "Novum Organum sive" {
+		t.Errorf("Unexpected dehyphenated paragraph %q", s)
+	}
+	if s := par.Text(false); s != "Novum Orga- num sive" {
+		t.Errorf("Unexpected paragraph %q", s)
+	}
+	words := par.DehyphenatedWords()
+	if len(words) != 3 || words[1].Text != "Organum" || words[1].Conf != 40 {
+		t.Errorf("Unexpected dehyphenated words %+v", words)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// IIIFManifestFile is the name of the IIIF manifest of a book
+const IIIFManifestFile = "iiif.json"
+
+const (
+	iiifPresentationContext = "http://iiif.io/api/presentation/3/context.json"
+	iiifSearchContext       = "http://iiif.io/api/search/2/context.json"
+)
+
+// IIIFBook describes a book to be published as a IIIF Presentation
+// 3 manifest
+type IIIFBook struct {
+	// Base is the address the book's files are published at, which
+	// the ids of its canvases and annotations are made from
+	Base string
+	// Search is the address of a IIIF Content Search service for
+	// the book, if there is one
+	Search   string
+	Title    string
+	Metadata Metadata
+	Pages    []HocrPage
+	// Images are the file names of the image of each page, which
+	// are published at Base
+	Images []string
+	// Sizes are the sizes of the images, if known, which can differ
+	// from the pages' hOCR when a colour image is shown
+	Sizes []image.Point
+}
+
+// iiifLang is a IIIF language map
+type iiifLang map[string][]string
+
+// iiifText returns a language map of a string in no particular
+// language
+func iiifText(s string) iiifLang {
+	return iiifLang{"none": {s}}
+}
+
+type iiifLabelValue struct {
+	Label iiifLang `json:"label"`
+	Value iiifLang `json:"value"`
+}
+
+type iiifService struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type iiifBody struct {
+	Id       string `json:"id,omitempty"`
+	Type     string `json:"type"`
+	Format   string `json:"format"`
+	Value    string `json:"value,omitempty"`
+	Language string `json:"language,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+}
+
+type iiifAnnotation struct {
+	Id         string   `json:"id"`
+	Type       string   `json:"type"`
+	Motivation string   `json:"motivation"`
+	Body       iiifBody `json:"body"`
+	Target     string   `json:"target"`
+}
+
+type iiifAnnotationPage struct {
+	Id    string           `json:"id"`
+	Type  string           `json:"type"`
+	Items []iiifAnnotation `json:"items"`
+}
+
+type iiifCanvas struct {
+	Id          string               `json:"id"`
+	Type        string               `json:"type"`
+	Label       iiifLang             `json:"label"`
+	Width       int                  `json:"width"`
+	Height      int                  `json:"height"`
+	Items       []iiifAnnotationPage `json:"items"`
+	Annotations []iiifAnnotationPage `json:"annotations,omitempty"`
+}
+
+type iiifManifest struct {
+	Context  []string         `json:"@context"`
+	Id       string           `json:"id"`
+	Type     string           `json:"type"`
+	Label    iiifLang         `json:"label"`
+	Metadata []iiifLabelValue `json:"metadata,omitempty"`
+	Service  []iiifService    `json:"service,omitempty"`
+	Items    []iiifCanvas     `json:"items"`
+}
+
+// IIIFCanvasId returns the id of the canvas of the page at index i
+// of a book published at base
+func IIIFCanvasId(base string, i int) string {
+	return fmt.Sprintf("%s/canvas/%d", base, i+1)
+}
+
+// IIIFWordId returns the id of the annotation of the word at index
+// w of the page at index i of a book published at base
+func IIIFWordId(base string, i int, w int) string {
+	return fmt.Sprintf("%s/words/%d", IIIFCanvasId(base, i), w+1)
+}
+
+// iiifTarget returns the part of a canvas covered by bbox
+func iiifTarget(canvas string, bbox [4]int) string {
+	return fmt.Sprintf("%s#xywh=%d,%d,%d,%d", canvas, bbox[0], bbox[1], bbox[2]-bbox[0], bbox[3]-bbox[1])
+}
+
+// iiifImageFormat returns the media type of an image file name
+func iiifImageFormat(fn string) string {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".png":
+		return "image/png"
+	case ".tif", ".tiff":
+		return "image/tiff"
+	}
+	return "image/jpeg"
+}
+
+// iiifMetadata returns the label and value pairs describing a book
+func iiifMetadata(m Metadata) []iiifLabelValue {
+	var md []iiifLabelValue
+	for _, f := range []struct{ label, value string }{
+		{"Author", m.Author()},
+		{"Published", m.Imprint()},
+		{"Language", m.Language},
+		{"Source", m.Source()},
+	} {
+		if f.value != "" {
+			md = append(md, iiifLabelValue{Label: iiifLang{"en": {f.label}}, Value: iiifText(f.value)})
+		}
+	}
+	return md
+}
+
+// iiifCanvasFor returns the canvas of a page, painted with its
+// image and annotated with the text of each line and word. The
+// canvas has the size of the hOCR, so that the text and any search
+// results line up with it, and the image is scaled to fill it if
+// its size is given and is different.
+func iiifCanvasFor(base string, i int, pg HocrPage, img string, size image.Point) iiifCanvas {
+	id := IIIFCanvasId(base, i)
+	w, h := pg.Bbox[2]-pg.Bbox[0], pg.Bbox[3]-pg.Bbox[1]
+	imgw, imgh := w, h
+	if size.X > 0 && size.Y > 0 {
+		imgw, imgh = size.X, size.Y
+	}
+	c := iiifCanvas{
+		Id:     id,
+		Type:   "Canvas",
+		Label:  iiifText(pageLabel(pg, i)),
+		Width:  w,
+		Height: h,
+		Items: []iiifAnnotationPage{{
+			Id:   id + "/painting",
+			Type: "AnnotationPage",
+			Items: []iiifAnnotation{{
+				Id:         id + "/painting/1",
+				Type:       "Annotation",
+				Motivation: "painting",
+				Body:       iiifBody{Id: base + "/" + img, Type: "Image", Format: iiifImageFormat(img), Width: imgw, Height: imgh},
+				Target:     id,
+			}},
+		}},
+	}
+
+	lines := iiifAnnotationPage{Id: id + "/lines", Type: "AnnotationPage", Items: []iiifAnnotation{}}
+	words := iiifAnnotationPage{Id: id + "/words", Type: "AnnotationPage", Items: []iiifAnnotation{}}
+	for _, par := range pg.Pars() {
+		for _, l := range par.Lines {
+			lines.Items = append(lines.Items, iiifAnnotation{
+				Id:         fmt.Sprintf("%s/%d", lines.Id, len(lines.Items)+1),
+				Type:       "Annotation",
+				Motivation: "supplementing",
+				Body:       iiifBody{Type: "TextualBody", Format: "text/plain", Value: l.Text(), Language: par.Lang},
+				Target:     iiifTarget(id, l.Bbox),
+			})
+			for _, wd := range l.Words {
+				words.Items = append(words.Items, iiifAnnotation{
+					Id:         IIIFWordId(base, i, len(words.Items)),
+					Type:       "Annotation",
+					Motivation: "supplementing",
+					Body:       iiifBody{Type: "TextualBody", Format: "text/plain", Value: wd.Text, Language: par.Lang},
+					Target:     iiifTarget(id, wd.Bbox),
+				})
+			}
+		}
+	}
+	c.Annotations = []iiifAnnotationPage{lines, words}
+	return c
+}
+
+// WriteIIIFManifest writes a IIIF Presentation 3 manifest of a book,
+// with a canvas for each page showing its image, annotated with the
+// text of its lines and words, and a link to its search service
+func WriteIIIFManifest(w io.Writer, b IIIFBook) error {
+	if len(b.Images) != len(b.Pages) {
+		return fmt.Errorf("Error writing IIIF manifest: %d images for %d pages", len(b.Images), len(b.Pages))
+	}
+	if b.Sizes != nil && len(b.Sizes) != len(b.Images) {
+		return fmt.Errorf("Error writing IIIF manifest: %d sizes for %d images", len(b.Sizes), len(b.Images))
+	}
+	base := strings.TrimSuffix(b.Base, "/")
+	title := b.Metadata.Title
+	if title == "" {
+		title = b.Title
+	}
+
+	m := iiifManifest{
+		Context:  []string{iiifPresentationContext},
+		Id:       base + "/" + IIIFManifestFile,
+		Type:     "Manifest",
+		Label:    iiifText(title),
+		Metadata: iiifMetadata(b.Metadata),
+		Items:    []iiifCanvas{},
+	}
+	if b.Search != "" {
+		m.Context = []string{iiifSearchContext, iiifPresentationContext}
+		m.Service = []iiifService{{Id: b.Search, Type: "SearchService2"}}
+	}
+	for i, pg := range b.Pages {
+		var size image.Point
+		if b.Sizes != nil {
+			size = b.Sizes[i]
+		}
+		m.Items = append(m.Items, iiifCanvasFor(base, i, pg, b.Images[i], size))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(m)
+	if err != nil {
+		return fmt.Errorf("Error writing IIIF manifest: %v", err)
+	}
+	return nil
+}
+
+type iiifSelector struct {
+	Type   string `json:"type"`
+	Prefix string `json:"prefix"`
+	Exact  string `json:"exact"`
+	Suffix string `json:"suffix"`
+}
+
+type iiifSpecificResource struct {
+	Type     string         `json:"type"`
+	Source   iiifService    `json:"source"`
+	Selector []iiifSelector `json:"selector"`
+}
+
+type iiifHighlight struct {
+	Id         string               `json:"id"`
+	Type       string               `json:"type"`
+	Motivation string               `json:"motivation"`
+	Target     iiifSpecificResource `json:"target"`
+}
+
+type iiifHighlightPage struct {
+	Type  string          `json:"type"`
+	Items []iiifHighlight `json:"items"`
+}
+
+type iiifSearchResults struct {
+	Context     string              `json:"@context"`
+	Id          string              `json:"id"`
+	Type        string              `json:"type"`
+	Items       []iiifAnnotation    `json:"items"`
+	Annotations []iiifHighlightPage `json:"annotations,omitempty"`
+}
+
+// searchTerm normalises a word for searching, lowercasing it and
+// removing any punctuation around it
+func searchTerm(s string) string {
+	return strings.ToLower(strings.TrimFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}))
+}
+
+// WriteIIIFSearch writes the IIIF Content Search 2 results of
+// searching for any of the words in q in the pages of a book
+// published at base, as an annotation page with id. Each hit is the
+// annotation of the word found, targeting its place on the canvas,
+// and is highlighted with the words either side of it in its line.
+func WriteIIIFSearch(w io.Writer, id string, base string, pages []HocrPage, q string) error {
+	base = strings.TrimSuffix(base, "/")
+	terms := make(map[string]bool)
+	for _, t := range strings.Fields(q) {
+		if t = searchTerm(t); t != "" {
+			terms[t] = true
+		}
+	}
+
+	r := iiifSearchResults{Context: iiifSearchContext, Id: id, Type: "AnnotationPage", Items: []iiifAnnotation{}}
+	hl := iiifHighlightPage{Type: "AnnotationPage"}
+	for i, pg := range pages {
+		canvas := IIIFCanvasId(base, i)
+		n := 0
+		for _, par := range pg.Pars() {
+			for _, l := range par.Lines {
+				for j, wd := range l.Words {
+					n++
+					if !terms[searchTerm(wd.Text)] {
+						continue
+					}
+					a := iiifAnnotation{
+						Id:         IIIFWordId(base, i, n-1),
+						Type:       "Annotation",
+						Motivation: "supplementing",
+						Body:       iiifBody{Type: "TextualBody", Format: "text/plain", Value: wd.Text, Language: par.Lang},
+						Target:     iiifTarget(canvas, wd.Bbox),
+					}
+					r.Items = append(r.Items, a)
+
+					var prefix, suffix string
+					if j > 0 {
+						prefix = HocrLine{Words: l.Words[:j]}.Text() + " "
+					}
+					if j < len(l.Words)-1 {
+						suffix = " " + HocrLine{Words: l.Words[j+1:]}.Text()
+					}
+					hl.Items = append(hl.Items, iiifHighlight{
+						Id:         fmt.Sprintf("%s#hit%d", id, len(hl.Items)+1),
+						Type:       "Annotation",
+						Motivation: "highlighting",
+						Target: iiifSpecificResource{
+							Type:     "SpecificResource",
+							Source:   iiifService{Id: a.Id, Type: "Annotation"},
+							Selector: []iiifSelector{{Type: "TextQuoteSelector", Prefix: prefix, Exact: wd.Text, Suffix: suffix}},
+						},
+					})
+				}
+			}
+		}
+	}
+	if len(hl.Items) > 0 {
+		r.Annotations = []iiifHighlightPage{hl}
+	}
+
+	err := json.NewEncoder(w).Encode(r)
+	if err != nil {
+		return fmt.Errorf("Error writing search results: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"image"
+	"image/draw"
+)
+
+// illusMinArea is the minimum proportion of the area of a page that
+// an image region must cover to be considered an illustration, as
+// Tesseract often marks small specks and ornaments as images
+const illusMinArea = 0.01
+
+// Illustration is an illustration region found on a page, which is
+// saved as a separate image cropped from the colour original
+type Illustration struct {
+	Image string `json:"image"` // file name of the cropped image
+	Page  string `json:"page"`  // page name, e.g. 0001
+	Hocr  string `json:"hocr"`  // hOCR file the region was found in
+	// Bbox is the region in the coordinates of the colour original,
+	// as x0, y0, x1, y1
+	Bbox [4]int `json:"bbox"`
+}
+
+// IllustrationsFile is the name of the file the list of a book's
+// Illustrations is saved in
+const IllustrationsFile = "illustrations.json"
+
+// FindIllustrations returns the bounding boxes of the image regions
+// (ocr_photo areas) of a page which are large enough to be
+// illustrations rather than specks of dirt
+func FindIllustrations(pg HocrPage) [][4]int {
+	pw, ph := pg.Bbox[2]-pg.Bbox[0], pg.Bbox[3]-pg.Bbox[1]
+	var boxes [][4]int
+	for _, a := range pg.Areas {
+		if a.Class != "ocr_photo" {
+			continue
+		}
+		w, h := a.Bbox[2]-a.Bbox[0], a.Bbox[3]-a.Bbox[1]
+		if w <= 0 || h <= 0 {
+			continue
+		}
+		if pw > 0 && ph > 0 && float64(w*h) < float64(pw*ph)*illusMinArea {
+			continue
+		}
+		boxes = append(boxes, a.Bbox)
+	}
+	return boxes
+}
+
+// ScaleBox scales a bounding box in the coordinates of a page of
+// width pagew, such as from hOCR, to an image of the page of width
+// imgw, clamping it to the image bounds b
+func ScaleBox(box [4]int, pagew int, imgw int, b image.Rectangle) image.Rectangle {
+	scale := 1.0
+	if pagew > 0 {
+		scale = float64(imgw) / float64(pagew)
+	}
+	r := image.Rect(int(float64(box[0])*scale), int(float64(box[1])*scale), int(float64(box[2])*scale), int(float64(box[3])*scale))
+	return r.Add(b.Min).Intersect(b)
+}
+
+// CropImage returns the part of an image within r
+func CropImage(img image.Image, r image.Rectangle) image.Image {
+	out := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(out, out.Bounds(), img, r.Min, draw.Src)
+	return out
+}
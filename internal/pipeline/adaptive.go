@@ -0,0 +1,160 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// The range of thresholds which adaptive threshold search will try.
+// Below adaptiveStep the finer adaptiveFineStep is used, as small
+// changes to low thresholds make more of a difference, so that
+// thresholds below the lowest default of 0.1 can be tried.
+const (
+	adaptiveMin      = 0.05
+	adaptiveMax      = 0.9
+	adaptiveStep     = 0.1
+	adaptiveFineStep = 0.05
+)
+
+// variantThreshold returns the binarisation threshold of a variant
+// from its code, e.g. 0.2 for "_bin0.2.hocr"
+func variantThreshold(code string) (float64, error) {
+	t := strings.TrimSuffix(strings.TrimPrefix(code, "_bin"), ".hocr")
+	return strconv.ParseFloat(t, 64)
+}
+
+// roundThreshold rounds a threshold to the two decimal places at
+// most used in file names, to avoid floating point errors
+func roundThreshold(t float64) float64 {
+	return math.Round(t*100) / 100
+}
+
+// thresholdName returns a threshold as it is written in file names,
+// e.g. "0.2" for 0.2 and "0.05" for 0.05
+func thresholdName(t float64) string {
+	s := strconv.FormatFloat(roundThreshold(t), 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// edgeThresholds finds pages whose most confident variant has the
+// lowest or highest threshold tried for it, and returns the next
+// threshold beyond it to try for each of those pages, by page name.
+// The paths in empty are variants in which no words were found, so
+// their thresholds count as having been tried, but never as best.
+func edgeThresholds(confs map[string][]*bookpipeline.Conf, empty []string) map[string]float64 {
+	emptyts := make(map[string][]float64)
+	for _, path := range empty {
+		base := filepath.Base(path)
+		codestart := strings.Index(base, "_bin")
+		t, err := variantThreshold(base[codestart:])
+		if err != nil {
+			continue
+		}
+		emptyts[base[:codestart]] = append(emptyts[base[:codestart]], t)
+	}
+
+	extra := make(map[string]float64)
+	for name, variants := range confs {
+		ts := append([]float64{}, emptyts[name]...)
+		var best *bookpipeline.Conf
+		var bestt float64
+		for _, c := range variants {
+			t, err := variantThreshold(c.Code)
+			if err != nil {
+				continue
+			}
+			ts = append(ts, t)
+			if best == nil || c.Score > best.Score {
+				best = c
+				bestt = t
+			}
+		}
+		if len(ts) < 2 {
+			continue
+		}
+		sort.Float64s(ts)
+		lowest, highest := ts[0], ts[len(ts)-1]
+		lower := roundThreshold(lowest - adaptiveStep)
+		if lower < adaptiveStep {
+			lower = roundThreshold(lowest - adaptiveFineStep)
+		}
+		switch {
+		case bestt == highest && roundThreshold(highest+adaptiveStep) <= adaptiveMax:
+			extra[name] = roundThreshold(highest + adaptiveStep)
+		case bestt == lowest && lower >= adaptiveMin:
+			extra[name] = lower
+		}
+	}
+	return extra
+}
+
+// mkExtraVariants preprocesses an extra threshold variant of each
+// page whose best variant is at the edge of the thresholds tried,
+// using the settings the book was originally preprocessed with. The
+// paths of the new binarised images are returned. If the book's
+// preprocessing settings can't be found, for example because it was
+// only wiped, no variants are created.
+func mkExtraVariants(ctx context.Context, conn Downloader, savedir string, confs map[string][]*bookpipeline.Conf, empty []string, logger *log.Logger) ([]string, error) {
+	extra := edgeThresholds(confs, empty)
+	if len(extra) == 0 {
+		return nil, nil
+	}
+
+	bookname, err := filepath.Rel(os.TempDir(), savedir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to do filepath.Rel of %s to %s: %s", os.TempDir(), savedir, err)
+	}
+
+	var settings PreprocSettings
+	err = downloadJSON(conn, savedir, bookname, PreprocSettingsFile, &settings)
+	if err != nil {
+		logger.Println("No preprocessing settings found, so not trying any extra thresholds:", err)
+		return nil, nil
+	}
+
+	var names []string
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var done []string
+	for _, name := range names {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		logger.Printf("Best threshold for %s is at the edge of those tried, so trying %s\n", name, thresholdName(extra[name]))
+		orig, err := downloadColour(conn, savedir, bookname, name+".jpg")
+		if err != nil {
+			logger.Println("Failed to download original image; skipping page", name)
+			continue
+		}
+		d, err := preProcMulti(orig, []float64{extra[name]}, settings.Wipe, settings.profile())
+		_ = os.Remove(orig)
+		if err != nil {
+			return nil, fmt.Errorf("Error preprocessing %s: %s", orig, err)
+		}
+		done = append(done, d...)
+	}
+
+	return done, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"rescribe.xyz/bookpipeline"
+	"testing"
+)
+
+func Test_edgeThresholds(t *testing.T) {
+	conf := func(code string, c float64) *bookpipeline.Conf {
+		return &bookpipeline.Conf{Path: "/tmp/b/0001" + code, Code: code, Conf: c, Score: c}
+	}
+
+	cases := []struct {
+		name  string
+		confs []*bookpipeline.Conf
+		empty []string
+		want  float64 // 0 for no extra threshold
+	}{
+		{"middle", []*bookpipeline.Conf{conf("_bin0.1.hocr", 50), conf("_bin0.2.hocr", 80), conf("_bin0.3.hocr", 60)}, nil, 0},
+		{"highest", []*bookpipeline.Conf{conf("_bin0.1.hocr", 50), conf("_bin0.2.hocr", 60), conf("_bin0.3.hocr", 80)}, nil, 0.4},
+		{"lowest", []*bookpipeline.Conf{conf("_bin0.2.hocr", 80), conf("_bin0.3.hocr", 60)}, nil, 0.1},
+		{"belowdefaults", []*bookpipeline.Conf{conf("_bin0.1.hocr", 80), conf("_bin0.2.hocr", 60)}, nil, 0.05},
+		{"finestep", []*bookpipeline.Conf{conf("_bin0.15.hocr", 80), conf("_bin0.2.hocr", 60)}, nil, 0.1},
+		{"atmin", []*bookpipeline.Conf{conf("_bin0.05.hocr", 80), conf("_bin0.1.hocr", 60)}, nil, 0},
+		{"atmax", []*bookpipeline.Conf{conf("_bin0.8.hocr", 60), conf("_bin0.9.hocr", 80)}, nil, 0},
+		{"emptytried", []*bookpipeline.Conf{conf("_bin0.2.hocr", 60), conf("_bin0.3.hocr", 80)}, []string{"/tmp/b/0001_bin0.4.hocr"}, 0},
+		{"single", []*bookpipeline.Conf{conf("_bin0.3.hocr", 80)}, nil, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			extra := edgeThresholds(map[string][]*bookpipeline.Conf{"0001": c.confs}, c.empty)
+			got, ok := extra["0001"]
+			if c.want == 0 && ok {
+				t.Fatalf("Expected no extra threshold, got %g", got)
+			}
+			if c.want != 0 && got != c.want {
+				t.Fatalf("Expected extra threshold %g, got %g", c.want, got)
+			}
+		})
+	}
+}
+
+func Test_thresholdName(t *testing.T) {
+	cases := []struct {
+		t    float64
+		want string
+	}{
+		{0.2, "0.2"},
+		{0.1 + 0.2, "0.3"},
+		{0.05, "0.05"},
+		{0.3 - 0.25, "0.05"},
+		{0, "0.0"},
+		{1, "1.0"},
+	}
+	for _, c := range cases {
+		name := thresholdName(c.t)
+		if name != c.want {
+			t.Errorf("%v: expected %s, got %s", c.t, c.want, name)
+		}
+		if !variantPattern.MatchString("0001_bin"+name+".hocr") || !binPattern.MatchString("0001_bin"+name+".png") {
+			t.Errorf("Expected variant named with %s to be matched", name)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// BlankFile is the name of the file the hOCR file names of pages
+// found to be blank in preprocessing are saved in, one per line
+const BlankFile = "blank"
+
+// isBlankFile returns whether the binarised image at path is blank
+func isBlankFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("Failed to open image %s: %v", path, err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return false, fmt.Errorf("Failed to decode image %s: %v", path, err)
+	}
+	return bookpipeline.IsBlank(img), nil
+}
+
+// writeBlankHocr writes an hOCR file with no words in it for the
+// image at path, alongside it, returning its path
+func writeBlankHocr(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open image %s: %v", path, err)
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("Failed to decode image %s: %v", path, err)
+	}
+
+	fn := strings.TrimSuffix(path, filepath.Ext(path)) + ".hocr"
+	out, err := os.Create(fn)
+	if err != nil {
+		return "", fmt.Errorf("Error creating file %s: %v", fn, err)
+	}
+	defer out.Close()
+	pg := bookpipeline.HocrPage{Bbox: [4]int{0, 0, cfg.Width, cfg.Height}}
+	err = bookpipeline.WriteBookHocr(out, filepath.Base(path), []bookpipeline.HocrPage{pg})
+	if err != nil {
+		return "", fmt.Errorf("Error writing file %s: %v", fn, err)
+	}
+	return fn, out.Close()
+}
+
+// readBlanks reads a list of blank pages saved in BlankFile
+func readBlanks(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	blanks := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if l := strings.TrimSpace(s.Text()); l != "" {
+			blanks[l] = true
+		}
+	}
+	return blanks, s.Err()
+}
+
+// imageOnlyPages returns a Conf for each page which only has
+// variants with no words in them, which are listed in empty, so
+// that the page can still be included in outputs as an image. The
+// first variant of each page is used.
+func imageOnlyPages(empty []string, confs map[string][]*bookpipeline.Conf) map[string]*bookpipeline.Conf {
+	sorted := append([]string{}, empty...)
+	sort.Strings(sorted)
+	pages := make(map[string]*bookpipeline.Conf)
+	for _, path := range sorted {
+		base := filepath.Base(path)
+		codestart := strings.Index(base, "_bin")
+		if codestart == -1 {
+			continue
+		}
+		name := base[:codestart]
+		if len(confs[name]) > 0 || pages[name] != nil {
+			continue
+		}
+		pages[name] = &bookpipeline.Conf{Path: path, Code: base[codestart:]}
+	}
+	return pages
+}
+
+// mkManifest lists each of the best pages of a book in order, with
+// whether they are image-only or were found to be blank, and their
+// printed page labels
+func mkManifest(bookname string, pgs []string, bestconfs map[string]*bookpipeline.Conf, imageonly map[string]*bookpipeline.Conf, blanks map[string]bool, labels map[string]string) bookpipeline.Manifest {
+	m := bookpipeline.Manifest{Book: bookname, Pages: []bookpipeline.ManifestPage{}}
+	confs := make(map[string]*bookpipeline.Conf)
+	for _, c := range bestconfs {
+		confs[c.Path] = c
+	}
+	for _, pg := range pgs {
+		base := filepath.Base(pg)
+		nosuffix := strings.TrimSuffix(base, ".hocr")
+		name := strings.SplitN(base, "_bin", 2)[0]
+		p := bookpipeline.ManifestPage{
+			Name:      name,
+			Hocr:      base,
+			Image:     strings.TrimSuffix(nosuffix, compositeSuffix) + ".png",
+			ImageOnly: imageonly[name] != nil,
+			Blank:     blanks[base],
+			Label:     labels[base],
+		}
+		if c := confs[pg]; c != nil {
+			p.Conf = c.Conf
+		}
+		m.Pages = append(m.Pages, p)
+	}
+	return m
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"rescribe.xyz/bookpipeline"
+	"testing"
+)
+
+func Test_writeBlankHocr(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "0001_bin0.1.png")
+	img := image.NewGray(image.Rect(0, 0, 300, 400))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, img)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+
+	blank, err := isBlankFile(fn)
+	if err != nil {
+		t.Fatalf("Error checking whether page is blank: %v", err)
+	}
+	if !blank {
+		t.Errorf("White page not found to be blank")
+	}
+
+	for y := 100; y < 300; y++ {
+		for x := 50; x < 250; x += 4 {
+			img.Set(x, y, color.Black)
+		}
+	}
+	if bookpipeline.IsBlank(img) {
+		t.Errorf("Page with text found to be blank")
+	}
+
+	hocrfn, err := writeBlankHocr(fn)
+	if err != nil {
+		t.Fatalf("Error writing blank hOCR: %v", err)
+	}
+	if hocrfn != filepath.Join(dir, "0001_bin0.1.hocr") {
+		t.Errorf("Unexpected hOCR file name %s", hocrfn)
+	}
+	pg, err := bookpipeline.ReadHocrPage(hocrfn)
+	if err != nil {
+		t.Fatalf("Error reading blank hOCR: %v", err)
+	}
+	if pg.Bbox != [4]int{0, 0, 300, 400} {
+		t.Errorf("Unexpected page bbox %v", pg.Bbox)
+	}
+	if len(pg.Words()) != 0 {
+		t.Errorf("Blank hOCR has %d words", len(pg.Words()))
+	}
+}
+
+func Test_imageOnlyPages(t *testing.T) {
+	confs := map[string][]*bookpipeline.Conf{
+		"0001": {{Path: "/tmp/b/0001_bin0.2.hocr", Code: "_bin0.2.hocr", Conf: 80}},
+	}
+	empty := []string{
+		"/tmp/b/0001_bin0.1.hocr",
+		"/tmp/b/0002_bin0.2.hocr",
+		"/tmp/b/0002_bin0.1.hocr",
+	}
+
+	pages := imageOnlyPages(empty, confs)
+	if len(pages) != 1 {
+		t.Fatalf("Expected 1 image only page, got %d", len(pages))
+	}
+	if c := pages["0002"]; c == nil || c.Path != "/tmp/b/0002_bin0.1.hocr" {
+		t.Errorf("Unexpected image only page for 0002: %v", c)
+	}
+
+	bestconfs := map[string]*bookpipeline.Conf{"0001": confs["0001"][0], "0002": pages["0002"]}
+	pgs := []string{"/tmp/b/0001_bin0.2.hocr", "/tmp/b/0002_bin0.1.hocr"}
+	m := mkManifest("b", pgs, bestconfs, pages, map[string]bool{"0002_bin0.1.hocr": true}, map[string]string{"0001_bin0.2.hocr": "iv"})
+	want := []bookpipeline.ManifestPage{
+		{Name: "0001", Hocr: "0001_bin0.2.hocr", Image: "0001_bin0.2.png", Conf: 80, Label: "iv"},
+		{Name: "0002", Hocr: "0002_bin0.1.hocr", Image: "0002_bin0.1.png", ImageOnly: true, Blank: true},
+	}
+	if len(m.Pages) != len(want) {
+		t.Fatalf("Expected %d manifest pages, got %d", len(want), len(m.Pages))
+	}
+	for i := range want {
+		if m.Pages[i] != want[i] {
+			t.Errorf("Manifest page %d: expected %+v, got %+v", i, want[i], m.Pages[i])
+		}
+	}
+}
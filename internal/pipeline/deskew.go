@@ -0,0 +1,137 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// osdMinConf is the minimum confidence of Tesseract's orientation
+// detection for a page to be rotated, as lower confidences are
+// often wrong
+const osdMinConf = 2
+
+// minSkew is the smallest skew angle, in degrees, which is corrected
+const minSkew = 0.1
+
+// AnglesFile is the name of the file the orientation and skew
+// corrections of each page are saved in, one page per line as
+// 'name<tab>rotation<tab>skew', in degrees clockwise
+const AnglesFile = "angles"
+
+// deskewedSuffix is added to the name of a page's image for the
+// copy corrected by deskew, which is uploaded alongside the original
+const deskewedSuffix = "_deskewed"
+
+var osdRotateRe = regexp.MustCompile(`Rotate: ([0-9]+)`)
+var osdConfRe = regexp.MustCompile(`Orientation confidence: ([0-9.]+)`)
+
+// detectOrientation uses Tesseract's orientation and script
+// detection to find the rotation in degrees clockwise needed to
+// make a page upright, which is 0, 90, 180 or 270, and the
+// confidence of the detection
+func detectOrientation(tesscmd string, path string) (int, float64, error) {
+	if tesscmd == "" {
+		tesscmd = "tesseract"
+	}
+	cmd := exec.Command(tesscmd, path, "-", "--psm", "0")
+	HideCmd(cmd)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return 0, 0, fmt.Errorf("Error detecting orientation of %s: %s\nStderr: %s", path, err, stderr.String())
+	}
+
+	m := osdRotateRe.FindStringSubmatch(stdout.String())
+	if m == nil {
+		return 0, 0, fmt.Errorf("No orientation found for %s", path)
+	}
+	rotate, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Error parsing rotation of %s: %v", path, err)
+	}
+	var conf float64
+	m = osdConfRe.FindStringSubmatch(stdout.String())
+	if m != nil {
+		conf, _ = strconv.ParseFloat(m[1], 64)
+	}
+	return rotate, conf, nil
+}
+
+// deskewedName returns the name of the corrected copy of an image
+func deskewedName(fn string) string {
+	ext := filepath.Ext(fn)
+	return strings.TrimSuffix(fn, ext) + deskewedSuffix + ext
+}
+
+// deskew corrects the orientation and skew of the image at path,
+// saving the corrected image over that local copy, and returns the
+// angles it was rotated by. If orientation detection fails, for example
+// because Tesseract doesn't have the osd training, only the skew is
+// corrected.
+func deskew(tesscmd string, path string, logger *log.Logger) (int, float64, error) {
+	rotate, conf, err := detectOrientation(tesscmd, path)
+	if err != nil {
+		logger.Println("Orientation detection failed, so only correcting skew:", err)
+		rotate = 0
+	}
+	if conf < osdMinConf {
+		rotate = 0
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to open image %s: %v", path, err)
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to decode image %s: %v", path, err)
+	}
+
+	if rotate != 0 {
+		img = bookpipeline.RotateImage(img, float64(rotate))
+	}
+	skew := bookpipeline.FindSkew(img)
+	if skew > -minSkew && skew < minSkew {
+		skew = 0
+	}
+	if skew != 0 {
+		img = bookpipeline.RotateImage(img, skew)
+	}
+	if rotate == 0 && skew == 0 {
+		return 0, 0, nil
+	}
+
+	f, err = os.Create(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to create image %s: %v", path, err)
+	}
+	defer f.Close()
+	if strings.ToLower(filepath.Ext(path)) == ".png" {
+		err = png.Encode(f, img)
+	} else {
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: 95})
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to encode image %s: %v", path, err)
+	}
+	return rotate, skew, f.Close()
+}
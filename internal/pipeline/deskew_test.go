@@ -0,0 +1,138 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"rescribe.xyz/bookpipeline"
+	"runtime"
+	"testing"
+)
+
+// fakeOsd creates a script which prints Tesseract style orientation
+// detection output, to be used in place of tesseract
+func fakeOsd(t *testing.T, dir string, rotate string, conf string) string {
+	fn := filepath.Join(dir, "osd-"+rotate+"-"+conf)
+	s := "#!/bin/sh\necho 'Page number: 0'\necho 'Orientation in degrees: " + rotate + "'\necho 'Rotate: " + rotate + "'\necho 'Orientation confidence: " + conf + "'\n"
+	err := ioutil.WriteFile(fn, []byte(s), 0755)
+	if err != nil {
+		t.Fatalf("Could not create fake osd script: %v", err)
+	}
+	return fn
+}
+
+func Test_deskew(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake tesseract scripts need a unix shell")
+	}
+
+	dir := t.TempDir()
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	// lines of 'text' on a page
+	page := image.NewRGBA(image.Rect(0, 0, 1000, 1400))
+	draw.Draw(page, page.Bounds(), image.White, image.Point{}, draw.Src)
+	for y := 100; y < 1300; y += 30 {
+		for x := 100; x < 900; x++ {
+			if (x/20)%5 == 4 {
+				continue
+			}
+			for d := 0; d < 10; d++ {
+				page.Set(x, y+d, color.Black)
+			}
+		}
+	}
+
+	cases := []struct {
+		name    string
+		tesscmd string
+		rotate  float64 // rotation applied to the page
+		skew    float64 // skew applied to the page
+		wantrot int
+	}{
+		{"straight", "false", 0, 0, 0},
+		{"skewed", "false", 0, 2, 0},
+		{"upsidedown", fakeOsd(t, dir, "180", "5.2"), 180, -1.5, 180},
+		{"unsure", fakeOsd(t, dir, "90", "0.4"), 0, 0, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := filepath.Join(dir, c.name+".png")
+			f, err := os.Create(fn)
+			if err != nil {
+				t.Fatalf("Could not create image: %v", err)
+			}
+			img := bookpipeline.RotateImage(bookpipeline.RotateImage(page, c.skew), c.rotate)
+			err = png.Encode(f, img)
+			f.Close()
+			if err != nil {
+				t.Fatalf("Could not encode image: %v", err)
+			}
+
+			rotate, skew, err := deskew(c.tesscmd, fn, vlog)
+			if err != nil {
+				t.Fatalf("Error deskewing: %v\nLog: %s", err, slog.log)
+			}
+			if rotate != c.wantrot {
+				t.Errorf("Expected rotation %d, got %d", c.wantrot, rotate)
+			}
+			if math.Abs(skew+c.skew) > 0.2 {
+				t.Errorf("Expected skew of about %.2f, got %.2f", -c.skew, skew)
+			}
+		})
+	}
+}
+
+func Test_downloadColour(t *testing.T) {
+	cases := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{"original", []string{"0001.jpg"}, "0001.jpg"},
+		{"png", []string{"0001.png"}, "0001.png"},
+		{"deskewed", []string{"0001.jpg", "0001_deskewed.jpg"}, "0001_deskewed.jpg"},
+		{"deskewedpng", []string{"0001.png", "0001_deskewed.png"}, "0001_deskewed.png"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q := &fakeQueue{dir: t.TempDir(), logger: log.New(ioutil.Discard, "", 0)}
+			files := make(map[string]string)
+			for _, f := range c.files {
+				files[f] = f
+			}
+			writeFiles(t, filepath.Join(q.dir, "wip", "Book"), files)
+			savedir := t.TempDir()
+
+			fn, err := downloadColour(q, savedir, "Book", "0001.jpg")
+			if err != nil {
+				t.Fatalf("Error downloading colour image: %v", err)
+			}
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				t.Fatalf("Error reading %s: %v", fn, err)
+			}
+			if string(b) != c.want {
+				t.Errorf("Expected %s to be downloaded, got %s", c.want, b)
+			}
+		})
+	}
+
+	q := &fakeQueue{dir: t.TempDir(), logger: log.New(ioutil.Discard, "", 0)}
+	_, err := downloadColour(q, t.TempDir(), "Book", "0001.jpg")
+	if err == nil {
+		t.Errorf("Expected an error downloading a missing image")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// DupMaxDistance is the default maximum distance between the
+// perceptual hashes of two images for them to be considered
+// near-duplicates
+const DupMaxDistance = 12
+
+// Duplicate is an image which is a near-duplicate of an earlier one
+type Duplicate struct {
+	Name     string // path of the duplicate, relative to the directory
+	Of       string // path of the earlier image it duplicates
+	Distance int    // distance between the perceptual hashes
+}
+
+// isPageImage returns whether a file name has a suffix of an image
+// format which can be uploaded
+func isPageImage(name string) bool {
+	lsuffix := strings.ToLower(filepath.Ext(name))
+	_, convert := convertFormats[lsuffix]
+	return lsuffix == ".jpg" || lsuffix == ".jpeg" || lsuffix == ".png" || convert
+}
+
+// FindDuplicates finds the images in a directory which are
+// near-duplicates of an earlier image, such as re-shoots of the same
+// page, by comparing their perceptual hashes. Images are compared in
+// the order they would be uploaded by UploadImages, and each
+// duplicate is reported against the first image it is close to.
+func FindDuplicates(ctx context.Context, dir string, maxdist int) ([]Duplicate, error) {
+	order, _, err := imageOrder(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	var hashes []bookpipeline.PageHash
+	var dupes []Duplicate
+	for _, o := range order {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		path := filepath.Join(dir, filepath.FromSlash(o.File))
+		var h bookpipeline.PageHash
+		err = decodePages(path, func(n int, img image.Image) error {
+			// only the first page of a multi-page TIFF is compared
+			if n == 1 {
+				h = bookpipeline.PerceptualHash(img)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Decoding image %s failed: %v", path, err)
+		}
+
+		for i := range hashes {
+			if d := h.Distance(hashes[i]); d <= maxdist {
+				dupes = append(dupes, Duplicate{Name: o.File, Of: names[i], Distance: d})
+				break
+			}
+		}
+		names = append(names, o.File)
+		hashes = append(hashes, h)
+	}
+
+	return dupes, nil
+}
+
+// DropDuplicates copies the images in a directory to a new temporary
+// directory, leaving out the duplicates, so that only the first copy
+// of each page is uploaded. Subdirectories and any order file are
+// kept. The new directory should be removed once it is no longer
+// needed.
+func DropDuplicates(ctx context.Context, dir string, dupes []Duplicate) (string, error) {
+	order, ordered, err := imageOrder(dir)
+	if err != nil {
+		return "", err
+	}
+
+	drop := make(map[string]bool)
+	for _, d := range dupes {
+		drop[d.Name] = true
+	}
+
+	outdir, err := ioutil.TempDir("", "bookpipeline")
+	if err != nil {
+		return "", fmt.Errorf("Error creating temporary directory: %v", err)
+	}
+
+	var kept []PageOrder
+	for _, o := range order {
+		select {
+		case <-ctx.Done():
+			_ = os.RemoveAll(outdir)
+			return "", ctx.Err()
+		default:
+		}
+		if drop[o.File] {
+			continue
+		}
+		err = copyFile(filepath.Join(dir, filepath.FromSlash(o.File)), filepath.Join(outdir, filepath.FromSlash(o.File)))
+		if err != nil {
+			_ = os.RemoveAll(outdir)
+			return "", err
+		}
+		kept = append(kept, o)
+	}
+
+	if ordered {
+		err = writeOrderFile(outdir, kept)
+		if err != nil {
+			_ = os.RemoveAll(outdir)
+			return "", err
+		}
+	}
+
+	return outdir, nil
+}
+
+// copyFile copies the file at src to dst, creating the directory
+// of dst if needed
+func copyFile(src string, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %s: %v", filepath.Dir(dst), err)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Failed to open file %s: %v", src, err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("Failed to create file %s: %v", dst, err)
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return fmt.Errorf("Failed to copy file %s: %v", src, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// reshoot returns a darker copy of an image, shifted slightly, as
+// if the page had been photographed again
+func reshoot(img image.Image) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(min(b.Max.X-1, x+3), min(b.Max.Y-1, y+2)).RGBA()
+			out.Set(x, y, color.RGBA{uint8(r >> 8 * 8 / 10), uint8(g >> 8 * 8 / 10), uint8(bl >> 8 * 8 / 10), 255})
+		}
+	}
+	return out
+}
+
+// figureImage returns an image of a page of text with a block
+// illustration in the middle
+func figureImage(w, h int, fig image.Rectangle) image.Image {
+	img := textImage(w, h, [][2]int{{50, w - 50}}).(*image.RGBA)
+	draw.Draw(img, fig, image.NewUniform(color.Gray{60}), image.Point{}, draw.Src)
+	return img
+}
+
+func Test_FindDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	one := textImage(600, 800, [][2]int{{50, 550}})
+	two := figureImage(600, 800, image.Rect(150, 200, 450, 500))
+	imgs := []struct {
+		name string
+		img  image.Image
+	}{
+		{"01.png", one},
+		{"02.png", two},
+		{"03.png", textImage(600, 800, [][2]int{{50, 280}, {320, 550}})},
+		{"04.jpg", reshoot(two)},
+		{"05.png", figureImage(600, 800, image.Rect(50, 450, 300, 750))},
+	}
+	for _, i := range imgs {
+		f, err := os.Create(filepath.Join(dir, i.name))
+		if err != nil {
+			t.Fatalf("Could not create image: %v", err)
+		}
+		if filepath.Ext(i.name) == ".jpg" {
+			err = jpeg.Encode(f, i.img, nil)
+		} else {
+			err = png.Encode(f, i.img)
+		}
+		f.Close()
+		if err != nil {
+			t.Fatalf("Could not encode image: %v", err)
+		}
+	}
+
+	dupes, err := FindDuplicates(context.Background(), dir, DupMaxDistance)
+	if err != nil {
+		t.Fatalf("Error finding duplicates: %v", err)
+	}
+	if len(dupes) != 1 || dupes[0].Name != "04.jpg" || dupes[0].Of != "02.png" {
+		t.Fatalf("Expected 04.jpg to be found as a duplicate of 02.png, got %+v", dupes)
+	}
+
+	outdir, err := DropDuplicates(context.Background(), dir, dupes)
+	if err != nil {
+		t.Fatalf("Error dropping duplicates: %v", err)
+	}
+	defer os.RemoveAll(outdir)
+	files, err := ioutil.ReadDir(outdir)
+	if err != nil {
+		t.Fatalf("Could not read directory %s: %v", outdir, err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	want := []string{"01.png", "02.png", "03.png", "05.png"}
+	if len(names) != len(want) {
+		t.Fatalf("Expected %v after dropping duplicates, got %v", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("Expected %v after dropping duplicates, got %v", want, names)
+		}
+	}
+}
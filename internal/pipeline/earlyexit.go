@@ -0,0 +1,129 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/utils/pkg/hocr"
+)
+
+// nextThreshold returns the threshold after cur in thresholds, which
+// are in order of preference, and whether there is one
+func nextThreshold(thresholds []float64, cur float64) (float64, bool) {
+	for i, t := range thresholds {
+		if roundThreshold(t) == roundThreshold(cur) && i+1 < len(thresholds) {
+			return thresholds[i+1], true
+		}
+	}
+	return 0, false
+}
+
+// earlyExit reads the hOCR of OCRed page variants from in and sends
+// them to out. If the book was preprocessed with an early exit
+// cutoff and a variant's confidence is below it, the page is first
+// binarised with the next threshold in order of preference, which
+// is uploaded and queued for OCR. This is done before the hOCR is
+// uploaded so that the book can't be found to be fully OCRed before
+// the new variant exists.
+func earlyExit(ctx context.Context, in chan string, out chan string, conn Pipeliner, bookname string, training string, errc chan error, logger *log.Logger) {
+	var settings *PreprocSettings
+	for path := range in {
+		select {
+		case <-ctx.Done():
+			for range in {
+			} // consume the rest of the receiving channel so it isn't blocked
+			errc <- ctx.Err()
+			return
+		default:
+		}
+
+		savedir := filepath.Dir(path)
+		if settings == nil {
+			settings = new(PreprocSettings)
+			err := downloadJSON(conn, savedir, bookname, PreprocSettingsFile, settings)
+			if err != nil {
+				logger.Println("No preprocessing settings found, so OCRing every variant:", err)
+			}
+		}
+		if settings.EarlyExit <= 0 {
+			out <- path
+			continue
+		}
+
+		err := queueNextVariant(conn, savedir, bookname, training, path, *settings, logger)
+		if err != nil {
+			for range in {
+			} // consume the rest of the receiving channel so it isn't blocked
+			errc <- err
+			return
+		}
+		out <- path
+	}
+	close(out)
+}
+
+// queueNextVariant binarises a page with the threshold after that of
+// the hOCR variant at path, and uploads and queues it for OCR, unless
+// the variant's confidence is at least settings.EarlyExit or there
+// are no more thresholds to try.
+func queueNextVariant(conn Pipeliner, savedir string, bookname string, training string, path string, settings PreprocSettings, logger *log.Logger) error {
+	base := filepath.Base(path)
+	codestart := strings.Index(base, "_bin")
+	if codestart == -1 {
+		return nil
+	}
+	name := base[:codestart]
+	cur, err := variantThreshold(base[codestart:])
+	if err != nil {
+		return nil
+	}
+
+	avg, err := hocr.GetAvgConf(path)
+	if err != nil && err.Error() != "No words found" {
+		return fmt.Errorf("Error retrieving confidence for %s: %s", path, err)
+	}
+	if avg >= settings.EarlyExit {
+		logger.Printf("Confidence of %s is %.1f, so not trying any more thresholds\n", base, avg)
+		return nil
+	}
+
+	next, ok := nextThreshold(settings.Thresholds, cur)
+	if !ok {
+		return nil
+	}
+	logger.Printf("Confidence of %s is %.1f, so trying threshold %s\n", base, avg, thresholdName(next))
+
+	orig, err := downloadColour(conn, savedir, bookname, name+".jpg")
+	if err != nil {
+		return fmt.Errorf("Failed to download original image of %s: %s", name, err)
+	}
+	done, err := preProcMulti(orig, []float64{next}, settings.Wipe, settings.profile())
+	_ = os.Remove(orig)
+	if err != nil {
+		return fmt.Errorf("Error preprocessing %s: %s", orig, err)
+	}
+
+	for _, p := range done {
+		key := bookname + "/" + filepath.Base(p)
+		err = conn.Upload(conn.WIPStorageId(), key, p)
+		if err != nil {
+			return fmt.Errorf("Error uploading %s: %s", p, err)
+		}
+		_ = os.Remove(p)
+		logger.Println("Adding", key, training, "to queue", conn.OCRPageQueueId())
+		err = conn.AddToQueue(conn.OCRPageQueueId(), key+" "+training)
+		if err != nil {
+			return fmt.Errorf("Error adding to queue %s: %s", key, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const earlyExitHocr = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+ <body>
+  <div class="ocr_page" id="page_1" title="bbox 0 0 100 100">
+   <div class="ocr_carea" id="block_1_1" title="bbox 10 10 90 20">
+    <p class="ocr_par" id="par_1_1" title="bbox 10 10 90 20">
+     <span class="ocr_line" id="line_1_1" title="bbox 10 10 90 20">%s</span>
+    </p>
+   </div>
+  </div>
+ </body>
+</html>
+`
+
+// fakeQueue is a connection which stores files in a directory and
+// records the messages added to queues, for testing pipeline stages
+type fakeQueue struct {
+	Pipeliner
+	dir    string
+	queued []string
+	logger *log.Logger
+}
+
+func (q *fakeQueue) WIPStorageId() string   { return "wip" }
+func (q *fakeQueue) OCRPageQueueId() string { return "ocrpage" }
+func (q *fakeQueue) GetLogger() *log.Logger { return q.logger }
+func (q *fakeQueue) Log(v ...interface{})   { q.logger.Println(v...) }
+
+func (q *fakeQueue) AddToQueue(url string, msg string) error {
+	q.queued = append(q.queued, url+" "+msg)
+	return nil
+}
+
+func (q *fakeQueue) Download(bucket string, key string, fn string) error {
+	b, err := ioutil.ReadFile(filepath.Join(q.dir, bucket, key))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, b, 0644)
+}
+
+func (q *fakeQueue) Upload(bucket string, key string, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(q.dir, bucket, key)
+	err = os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, b, 0644)
+}
+
+func Test_nextThreshold(t *testing.T) {
+	order := []float64{0.2, 0.1, 0.4, 0.5}
+	cases := []struct {
+		cur  float64
+		next float64
+		ok   bool
+	}{
+		{0.2, 0.1, true},
+		{0.1, 0.4, true},
+		{0.4, 0.5, true},
+		{0.5, 0, false},
+		{0.3, 0, false},
+	}
+
+	for _, c := range cases {
+		next, ok := nextThreshold(order, c.cur)
+		if next != c.next || ok != c.ok {
+			t.Errorf("nextThreshold of %.1f: expected %.1f, %v, got %.1f, %v", c.cur, c.next, c.ok, next, ok)
+		}
+	}
+}
+
+func Test_earlyExit(t *testing.T) {
+	word := func(conf int) string {
+		return fmt.Sprintf(`<span class="ocrx_word" id="word_1_1" title="bbox 10 10 90 20; x_wconf %d">word</span>`, conf)
+	}
+
+	cases := []struct {
+		name     string
+		settings *PreprocSettings
+		hocr     map[string]string
+		queued   []string
+	}{
+		{"nosettings", nil, map[string]string{"0001_bin0.2.hocr": word(10)}, nil},
+		{"noearlyexit", &PreprocSettings{Thresholds: []float64{0.2, 0.1}}, map[string]string{"0001_bin0.2.hocr": word(10)}, nil},
+		{"confident", &PreprocSettings{Thresholds: []float64{0.2, 0.1}, EarlyExit: 70}, map[string]string{"0001_bin0.2.hocr": word(80)}, nil},
+		{"unconfident", &PreprocSettings{Thresholds: []float64{0.2, 0.1}, EarlyExit: 70}, map[string]string{"0001_bin0.2.hocr": word(50)},
+			[]string{"ocrpage book/0001_bin0.1.png training"}},
+		{"nowords", &PreprocSettings{Thresholds: []float64{0.2, 0.1}, EarlyExit: 70}, map[string]string{"0001_bin0.2.hocr": ""},
+			[]string{"ocrpage book/0001_bin0.1.png training"}},
+		{"finethreshold", &PreprocSettings{Thresholds: []float64{0.1, 0.05}, EarlyExit: 70}, map[string]string{"0001_bin0.1.hocr": word(50)},
+			[]string{"ocrpage book/0001_bin0.05.png training"}},
+		{"lastthreshold", &PreprocSettings{Thresholds: []float64{0.2, 0.1}, EarlyExit: 70}, map[string]string{"0001_bin0.1.hocr": word(50)}, nil},
+		{"unknownthreshold", &PreprocSettings{Thresholds: []float64{0.2, 0.1}, EarlyExit: 70}, map[string]string{"0001_bin0.3.hocr": word(50)}, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var slog StrLog
+			q := &fakeQueue{dir: t.TempDir(), logger: log.New(&slog, "", 0)}
+			savedir := t.TempDir()
+
+			wip := filepath.Join(q.dir, "wip", "book")
+			err := os.MkdirAll(wip, 0755)
+			if err != nil {
+				t.Fatalf("Could not create storage directory: %v", err)
+			}
+			if c.settings != nil {
+				err = writeJSON(filepath.Join(wip, PreprocSettingsFile), c.settings)
+				if err != nil {
+					t.Fatalf("Could not write settings: %v", err)
+				}
+			}
+			f, err := os.Create(filepath.Join(wip, "0001.jpg"))
+			if err != nil {
+				t.Fatalf("Could not create image: %v", err)
+			}
+			err = jpeg.Encode(f, image.NewGray(image.Rect(0, 0, 100, 100)), nil)
+			f.Close()
+			if err != nil {
+				t.Fatalf("Could not encode image: %v", err)
+			}
+
+			in := make(chan string)
+			out := make(chan string)
+			errc := make(chan error, 1)
+			go earlyExit(context.Background(), in, out, q, "book", "training", errc, q.logger)
+
+			var want []string
+			go func() {
+				for name, h := range c.hocr {
+					fn := filepath.Join(savedir, name)
+					err := ioutil.WriteFile(fn, []byte(fmt.Sprintf(earlyExitHocr, h)), 0644)
+					if err != nil {
+						errc <- err
+						break
+					}
+					want = append(want, fn)
+					in <- fn
+				}
+				close(in)
+			}()
+
+			var got []string
+			for p := range out {
+				got = append(got, p)
+			}
+			select {
+			case err = <-errc:
+				t.Fatalf("Error in earlyExit: %v\nLog: %s", err, slog.log)
+			default:
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected %v to be passed on, got %v", want, got)
+			}
+			if !reflect.DeepEqual(q.queued, c.queued) {
+				t.Errorf("Expected %v to be queued, got %v\nLog: %s", c.queued, q.queued, slog.log)
+			}
+			for _, msg := range q.queued {
+				key := msg[len("ocrpage ") : len(msg)-len(" training")]
+				if _, err := os.Stat(filepath.Join(q.dir, "wip", key)); err != nil {
+					t.Errorf("Expected %s to be uploaded: %v", key, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// convertFormats are the image formats which are accepted by
+// CheckImages and UploadImages but aren't used directly by the
+// pipeline, by lower case suffix. They are converted once, when
+// uploaded, to JPEG at jpegQuality, or to PNG if they are bilevel,
+// as such images have already been binarised. Each page of a
+// multi-page TIFF is converted to a separate image.
+var convertFormats = map[string]string{
+	".tif":  "tiff",
+	".tiff": "tiff",
+	".jp2":  "jpeg2000",
+	".j2k":  "jpeg2000",
+	".webp": "webp",
+}
+
+// jpegQuality is the quality images are saved with when they are
+// converted to JPEG
+const jpegQuality = 95
+
+// jp2Cmd is the OpenJPEG command used to decode JPEG 2000 images,
+// as there is no Go decoder for them
+const jp2Cmd = "opj_decompress"
+
+// findCmd returns an error naming cmd if it isn't installed, as it
+// is needed to decode images in the given format. The commands
+// aren't included with rescribe, so this is reported to the user.
+func findCmd(cmd string, format string) error {
+	_, err := exec.LookPath(cmd)
+	if err != nil {
+		return fmt.Errorf("%s images need %s to decode them, which isn't installed", format, cmd)
+	}
+	return nil
+}
+
+// ConversionsFile is the name of the file the conversions made by
+// UploadImages are listed in
+const ConversionsFile = "conversions.json"
+
+// Conversion records an image which was converted to another format
+// when it was uploaded
+type Conversion struct {
+	Original string `json:"original"`       // path of the original file, relative to the book's directory
+	Page     int    `json:"page,omitempty"` // page of a multi-page TIFF, from 1
+	Uploaded string `json:"uploaded"`       // name of the uploaded image
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+// tiffPageOffsets returns the offsets of the image file directories
+// of a TIFF, one for each page
+func tiffPageOffsets(b []byte) ([]uint32, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("TIFF is too short")
+	}
+	var order binary.ByteOrder
+	switch string(b[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("Invalid TIFF byte order")
+	}
+
+	var offsets []uint32
+	seen := make(map[uint32]bool)
+	off := order.Uint32(b[4:8])
+	for off != 0 && !seen[off] {
+		if int(off)+2 > len(b) {
+			return nil, fmt.Errorf("Invalid TIFF directory offset %d", off)
+		}
+		seen[off] = true
+		offsets = append(offsets, off)
+		n := int(order.Uint16(b[off : off+2]))
+		next := int(off) + 2 + n*12
+		if next+4 > len(b) {
+			break
+		}
+		off = order.Uint32(b[next : next+4])
+	}
+	return offsets, nil
+}
+
+// tiffPages calls fn with each page of a TIFF in turn, so that
+// only one is in memory at once. This is done by pointing the header
+// at each image file directory in turn, as the tiff package only
+// decodes the first.
+func tiffPages(path string, fn func(n int, img image.Image) error) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read image %s: %v", path, err)
+	}
+	offsets, err := tiffPageOffsets(b)
+	if err != nil {
+		return fmt.Errorf("Failed to read pages of %s: %v", path, err)
+	}
+	order := binary.ByteOrder(binary.LittleEndian)
+	if string(b[0:2]) == "MM" {
+		order = binary.BigEndian
+	}
+
+	for i, off := range offsets {
+		order.PutUint32(b[4:8], off)
+		img, err := tiff.Decode(bytes.NewReader(b))
+		if err != nil {
+			return fmt.Errorf("Failed to decode page %d of %s: %v", i+1, path, err)
+		}
+		err = fn(i+1, img)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeJp2 decodes a JPEG 2000 image using jp2Cmd
+func decodeJp2(path string) (image.Image, error) {
+	err := findCmd(jp2Cmd, "JPEG 2000")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "bookpipeline")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out.png")
+	cmd := exec.Command(jp2Cmd, "-i", path, "-o", out)
+	HideCmd(cmd)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding JPEG 2000 image %s with %s: %v\nStderr: %s", path, jp2Cmd, err, stderr.String())
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open decoded image %s: %v", out, err)
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// decodePages calls fn with each page of an image in turn, which
+// is just the one except for multi-page TIFFs
+func decodePages(path string, fn func(n int, img image.Image) error) error {
+	switch convertFormats[strings.ToLower(filepath.Ext(path))] {
+	case "tiff":
+		return tiffPages(path, fn)
+	case "jpeg2000":
+		img, err := decodeJp2(path)
+		if err != nil {
+			return err
+		}
+		return fn(1, img)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+	return fn(1, img)
+}
+
+// isBilevel returns whether an image only has black and white pixels
+func isBilevel(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray, *image.Paletted:
+	default:
+		return false
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			g := color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y
+			if g != 0 && g != 255 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// convertImage converts each page of an image in one of the
+// convertFormats to JPEG, or PNG if it is bilevel, saving them in
+// outdir, and returns their paths. If there is more than one page,
+// as in a multi-page TIFF, each is given a _pNNN suffix.
+func convertImage(path string, outdir string) ([]string, error) {
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	var fns []string
+	err := decodePages(path, func(n int, img image.Image) error {
+		ext := ".jpg"
+		if isBilevel(img) {
+			ext = ".png"
+		}
+		fn := filepath.Join(outdir, fmt.Sprintf("%s_p%03d%s", base, n, ext))
+		f, err := os.Create(fn)
+		if err != nil {
+			return fmt.Errorf("Failed to create file %s: %v", fn, err)
+		}
+		if ext == ".png" {
+			err = png.Encode(f, img)
+		} else {
+			err = jpeg.Encode(f, img, &jpeg.Options{Quality: jpegQuality})
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to encode image %s: %v", fn, err)
+		}
+		fns = append(fns, fn)
+		return nil
+	})
+	if err != nil {
+		return fns, fmt.Errorf("Decoding image %s failed: %v", path, err)
+	}
+
+	if len(fns) == 1 {
+		fn := filepath.Join(outdir, base+filepath.Ext(fns[0]))
+		err = os.Rename(fns[0], fn)
+		if err != nil {
+			return fns, fmt.Errorf("Failed to rename %s to %s: %v", fns[0], fn, err)
+		}
+		fns[0] = fn
+	}
+	return fns, nil
+}
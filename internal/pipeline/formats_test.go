@@ -0,0 +1,169 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"rescribe.xyz/bookpipeline"
+	"strings"
+	"testing"
+)
+
+// greyTiff returns an uncompressed 8 bit greyscale TIFF with a page
+// of each of the given grey levels
+func greyTiff(w, h int, greys []uint8) []byte {
+	le := binary.LittleEndian
+	b := []byte{'I', 'I', 42, 0, 0, 0, 0, 0}
+	prevnext := 4
+	for _, g := range greys {
+		data := len(b)
+		for i := 0; i < w*h; i++ {
+			b = append(b, g)
+		}
+		if len(b)%2 == 1 {
+			b = append(b, 0)
+		}
+		ifd := len(b)
+		le.PutUint32(b[prevnext:], uint32(ifd))
+		entries := [][3]uint32{
+			{256, 3, uint32(w)},     // ImageWidth
+			{257, 3, uint32(h)},     // ImageLength
+			{258, 3, 8},             // BitsPerSample
+			{259, 3, 1},             // Compression: none
+			{262, 3, 1},             // PhotometricInterpretation: black is zero
+			{273, 4, uint32(data)},  // StripOffsets
+			{278, 3, uint32(h)},     // RowsPerStrip
+			{279, 4, uint32(w * h)}, // StripByteCounts
+		}
+		b = le.AppendUint16(b, uint16(len(entries)))
+		for _, e := range entries {
+			b = le.AppendUint16(b, uint16(e[0]))
+			b = le.AppendUint16(b, uint16(e[1]))
+			b = le.AppendUint32(b, 1)
+			if e[1] == 3 {
+				b = le.AppendUint16(b, uint16(e[2]))
+				b = le.AppendUint16(b, 0)
+			} else {
+				b = le.AppendUint32(b, e[2])
+			}
+		}
+		prevnext = len(b)
+		b = le.AppendUint32(b, 0)
+	}
+	return b
+}
+
+func Test_convertImage(t *testing.T) {
+	cases := []struct {
+		name  string
+		greys []uint8
+		want  []string
+	}{
+		{"single.tif", []uint8{128}, []string{"single.jpg"}},
+		{"multi.tiff", []uint8{128, 255, 64}, []string{"multi_p001.jpg", "multi_p002.png", "multi_p003.jpg"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			outdir := t.TempDir()
+			fn := filepath.Join(dir, c.name)
+			err := ioutil.WriteFile(fn, greyTiff(20, 30, c.greys), 0644)
+			if err != nil {
+				t.Fatalf("Could not write TIFF: %v", err)
+			}
+
+			err = CheckImages(context.Background(), dir)
+			if err != nil {
+				t.Fatalf("Error checking TIFF: %v", err)
+			}
+
+			fns, err := convertImage(fn, outdir)
+			if err != nil {
+				t.Fatalf("Error converting TIFF: %v", err)
+			}
+			if len(fns) != len(c.want) {
+				t.Fatalf("Expected %v, got %v", c.want, fns)
+			}
+			for i := range c.want {
+				if filepath.Base(fns[i]) != c.want[i] {
+					t.Errorf("Expected %v, got %v", c.want, fns)
+				}
+				f, err := os.Open(fns[i])
+				if err != nil {
+					t.Fatalf("Could not open converted image %s: %v", fns[i], err)
+				}
+				_, _, err = image.Decode(f)
+				f.Close()
+				if err != nil {
+					t.Errorf("Error decoding converted image %s: %v", fns[i], err)
+				}
+			}
+		})
+	}
+}
+
+func Test_UploadImagesConversions(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := &bookpipeline.LocalConn{Logger: vlog}
+	err := conn.Init()
+	if err != nil {
+		t.Fatalf("Could not initialise local connection: %v", err)
+	}
+
+	dir := t.TempDir()
+	err = ioutil.WriteFile(filepath.Join(dir, "a.tif"), greyTiff(20, 30, []uint8{128, 0}), 0644)
+	if err != nil {
+		t.Fatalf("Could not write TIFF: %v", err)
+	}
+
+	err = UploadImages(context.Background(), dir, "conversiontest", conn)
+	if err != nil {
+		t.Fatalf("Error in UploadImages: %v\nLog: %s", err, slog.log)
+	}
+
+	fn := filepath.Join(t.TempDir(), ConversionsFile)
+	err = conn.Download(conn.WIPStorageId(), "conversiontest/"+ConversionsFile, fn)
+	if err != nil {
+		t.Fatalf("Could not download conversions list: %v", err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Could not read conversions list: %v", err)
+	}
+	var convs []Conversion
+	err = json.Unmarshal(b, &convs)
+	if err != nil {
+		t.Fatalf("Could not parse conversions list: %v", err)
+	}
+	want := []Conversion{
+		{Original: "a.tif", Page: 1, Uploaded: "a_0000.jpg", From: "tiff", To: "jpg"},
+		{Original: "a.tif", Page: 2, Uploaded: "a_0001.png", From: "tiff", To: "png"},
+	}
+	if len(convs) != len(want) {
+		t.Fatalf("Expected conversions %v, got %v", want, convs)
+	}
+	for i := range want {
+		if convs[i] != want[i] {
+			t.Errorf("Expected conversions %v, got %v", want, convs)
+		}
+	}
+}
+
+func Test_findCmd(t *testing.T) {
+	err := findCmd("bookpipeline-missing-decoder", "JBIG2")
+	if err == nil || !strings.Contains(err.Error(), "bookpipeline-missing-decoder") {
+		t.Errorf("Expected an error naming the missing command, got %v", err)
+	}
+}
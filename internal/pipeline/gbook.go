@@ -0,0 +1,237 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// googleBooksUrl is the address of Google Books, which the pages of
+// a book and their images are listed from
+var googleBooksUrl = "https://books.google.com/books"
+
+// gbookTries is the number of times a request to Google Books is
+// made before giving up, as it often fails requests temporarily,
+// particularly when many are made in a row
+const gbookTries = 5
+
+// gbookRetryWait is the time to wait before the first retry of a
+// failed request, which is increased for each further retry
+var gbookRetryWait = 2 * time.Second
+
+// gbookImageWidth is the width in pixels requested for page images,
+// which Google Books limits to the largest size it has
+const gbookImageWidth = 2500
+
+// gbookPage is a page of a book as listed by Google Books, with an
+// id like "PA12", and the address of its image, if it was included
+type gbookPage struct {
+	Pid string `json:"pid"`
+	Src string `json:"src"`
+}
+
+// gbookGet requests an address from Google Books, trying it again
+// after a pause if it fails
+func gbookGet(ctx context.Context, client *http.Client, u string) (*http.Response, error) {
+	var err error
+	for i := 0; i < gbookTries; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(gbookRetryWait * time.Duration(i)):
+			}
+		}
+
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Error downloading %s: %v", u, err)
+		}
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		resp.Body.Close()
+		err = fmt.Errorf("%s", resp.Status)
+		if resp.StatusCode == http.StatusNotFound {
+			break
+		}
+	}
+	return nil, fmt.Errorf("Error downloading %s: %v", u, err)
+}
+
+// gbookPages lists the pages of a book around page pid, or from its
+// start if pid is empty
+func gbookPages(ctx context.Context, client *http.Client, id string, pid string) ([]gbookPage, error) {
+	q := url.Values{}
+	q.Set("id", id)
+	if pid == "" {
+		q.Set("printsec", "frontcover")
+	} else {
+		q.Set("pg", pid)
+	}
+	q.Set("jscmd", "click3")
+	u := googleBooksUrl + "?" + q.Encode()
+
+	resp, err := gbookGet(ctx, client, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var v struct {
+		Page []gbookPage `json:"page"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing list of pages %s: %v", u, err)
+	}
+	return v.Page, nil
+}
+
+// gbookImageUrl returns the address of a page image at the width
+// we want
+func gbookImageUrl(src string) string {
+	u, err := url.Parse(src)
+	if err != nil {
+		return src
+	}
+	q := u.Query()
+	q.Set("w", strconv.Itoa(gbookImageWidth))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// gbookLabel returns the printed page label given by the id of a
+// page, for pages numbered in the book: those like "PA12", which is
+// page 12, and "PR3", which is page iii of the preliminaries
+func gbookLabel(pid string) string {
+	if len(pid) < 3 {
+		return ""
+	}
+	n, err := strconv.Atoi(pid[2:])
+	if err != nil || n < 1 {
+		return ""
+	}
+	switch pid[:2] {
+	case "PA":
+		return strconv.Itoa(n)
+	case "PR":
+		return bookpipeline.ToRoman(n)
+	}
+	return ""
+}
+
+// savedPage returns the name of a page image already saved in dir
+// named base, if there is one
+func savedPage(dir string, base string) string {
+	matches, _ := filepath.Glob(filepath.Join(dir, base+".*"))
+	for _, m := range matches {
+		if isPageImage(m) {
+			return filepath.Base(m)
+		}
+	}
+	return ""
+}
+
+// DownloadGoogleBook downloads the images of every page of a Google
+// Book which is available into dir, naming them in order, like
+// 0001.jpg, and saves an order file giving the printed page number
+// of each page which Google Books gives one for. Any page images
+// already in dir are kept, so an interrupted download can be resumed
+// by calling it again with the same directory. Pages which Google
+// Books doesn't make available are skipped; it is only an error if
+// there are none.
+func DownloadGoogleBook(ctx context.Context, id string, dir string) error {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return fmt.Errorf("Error setting up cookies: %v", err)
+	}
+	client := &http.Client{Jar: jar}
+
+	pages, err := gbookPages(ctx, client, id, "")
+	if err != nil {
+		return err
+	}
+	if len(pages) == 0 {
+		return fmt.Errorf("No pages found for Google Book %s", id)
+	}
+	srcs := make(map[string]string)
+	for _, pg := range pages {
+		if pg.Src != "" {
+			srcs[pg.Pid] = pg.Src
+		}
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating directory %s: %v", dir, err)
+	}
+
+	var order []PageOrder
+	for i, pg := range pages {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		base := fmt.Sprintf("%04d", i+1)
+		name := savedPage(dir, base)
+		if name == "" {
+			// the first list only gives images for the first few pages,
+			// so ask for the page to get its image, and those after it
+			if srcs[pg.Pid] == "" {
+				more, err := gbookPages(ctx, client, id, pg.Pid)
+				if err != nil {
+					return err
+				}
+				for _, p := range more {
+					if p.Src != "" {
+						srcs[p.Pid] = p.Src
+					}
+				}
+			}
+			if srcs[pg.Pid] == "" {
+				continue
+			}
+
+			resp, err := gbookGet(ctx, client, gbookImageUrl(srcs[pg.Pid]))
+			if err != nil {
+				return err
+			}
+			name, err = saveResponseImage(resp, dir, base)
+			resp.Body.Close()
+			if err != nil {
+				return err
+			}
+		}
+		order = append(order, PageOrder{File: name, Label: gbookLabel(pg.Pid)})
+	}
+
+	if len(order) == 0 {
+		return fmt.Errorf("No pages of Google Book %s are available", id)
+	}
+	return writeOrderFile(dir, order)
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gbookServer starts a stand-in for Google Books, serving a book
+// whose first list of pages only includes the images of the first
+// two, with a page which is never available, and an image which
+// fails the first time it is requested. The pages whose images are
+// requested are recorded.
+func gbookServer(t *testing.T, requested *[]string) *httptest.Server {
+	png, err := ioutil.ReadFile("testdata/good/1.png")
+	if err != nil {
+		t.Fatalf("Could not read test image: %v", err)
+	}
+	pids := []string{"PP1", "PR3", "PA1", "PA2", "PA3", "PT1"}
+	unavailable := map[string]bool{"PA2": true}
+	failed := make(map[string]bool)
+	var mu sync.Mutex
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		q := r.URL.Query()
+		if q.Get("id") != "BOOKID123456" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/books":
+			// list every page, with images for the page asked for
+			// (or the first page) and the one after it
+			start := 0
+			for i, pid := range pids {
+				if pid == q.Get("pg") {
+					start = i
+				}
+			}
+			var pages []gbookPage
+			for i, pid := range pids {
+				pg := gbookPage{Pid: pid}
+				if (i == start || i == start+1) && !unavailable[pid] {
+					pg.Src = srv.URL + "/content?id=BOOKID123456&pg=" + pid + "&img=1&w=800"
+				}
+				pages = append(pages, pg)
+			}
+			json.NewEncoder(w).Encode(map[string][]gbookPage{"page": pages})
+		case "/content":
+			pid := q.Get("pg")
+			*requested = append(*requested, pid)
+			if q.Get("w") != "2500" {
+				http.Error(w, "wrong width", http.StatusBadRequest)
+				return
+			}
+			if pid == "PA1" && !failed[pid] {
+				failed[pid] = true
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(png)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return srv
+}
+
+func Test_DownloadGoogleBook(t *testing.T) {
+	var requested []string
+	srv := gbookServer(t, &requested)
+	defer srv.Close()
+	origurl, origwait := googleBooksUrl, gbookRetryWait
+	googleBooksUrl = srv.URL + "/books"
+	gbookRetryWait = time.Millisecond
+	defer func() { googleBooksUrl, gbookRetryWait = origurl, origwait }()
+
+	dir := filepath.Join(t.TempDir(), "book")
+
+	// a cancelled download stops before any images are saved
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := DownloadGoogleBook(ctx, "BOOKID123456", dir)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected cancellation error, got %v", err)
+	}
+
+	// pretend the download was interrupted after the second page
+	writeFiles(t, dir, map[string]string{"0002.png": "already downloaded"})
+
+	err = DownloadGoogleBook(context.Background(), "BOOKID123456", dir)
+	if err != nil {
+		t.Fatalf("Error downloading Google Book: %v", err)
+	}
+
+	want := []string{"PP1", "PA1", "PA1", "PA3", "PT1"}
+	if !reflect.DeepEqual(requested, want) {
+		t.Errorf("Expected images %v to be requested, got %v", want, requested)
+	}
+
+	order, ordered, err := imageOrder(dir)
+	if err != nil || !ordered {
+		t.Fatalf("Error getting order of images, ordered %v: %v", ordered, err)
+	}
+	wantorder := []PageOrder{
+		{File: "0001.png"},
+		{File: "0002.png", Label: "iii"},
+		{File: "0003.png", Label: "1"},
+		{File: "0005.png", Label: "3"},
+		{File: "0006.png"},
+	}
+	if !reflect.DeepEqual(order, wantorder) {
+		t.Errorf("Expected order %v, got %v", wantorder, order)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "0002.png"))
+	if err != nil || string(b) != "already downloaded" {
+		t.Errorf("Expected page already downloaded to be kept, got %q: %v", b, err)
+	}
+
+	err = DownloadGoogleBook(context.Background(), "NOTABOOK1234", dir)
+	if err == nil {
+		t.Errorf("Expected an error for a book which isn't found")
+	}
+}
@@ -6,10 +6,14 @@ package pipeline
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"rescribe.xyz/bookpipeline"
 )
 
 func DownloadBestPages(dir string, name string, conn Downloader) error {
@@ -85,19 +89,132 @@ func DownloadPdfs(dir string, name string, conn Downloader) error {
 	return nil
 }
 
+func DownloadEpub(dir string, name string, conn Downloader) error {
+	key := filepath.Join(name, name+".epub")
+	fn := filepath.Join(dir, name+".epub")
+	err := conn.Download(conn.WIPStorageId(), key, fn)
+	if err != nil {
+		_ = os.Remove(fn)
+		return fmt.Errorf("Failed to download EPUB %s: %v", key, err)
+	}
+	return nil
+}
+
+func DownloadBookHocr(dir string, name string, conn Downloader) error {
+	for _, suffix := range []string{".hocr", ".words.jsonl"} {
+		key := filepath.Join(name, name+suffix)
+		fn := filepath.Join(dir, name+suffix)
+		err := conn.Download(conn.WIPStorageId(), key, fn)
+		if err != nil {
+			_ = os.Remove(fn)
+			return fmt.Errorf("Failed to download %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func DownloadCleanText(dir string, name string, conn Downloader) error {
+	key := filepath.Join(name, name+".clean.txt")
+	fn := filepath.Join(dir, name+".clean.txt")
+	err := conn.Download(conn.WIPStorageId(), key, fn)
+	if err != nil {
+		_ = os.Remove(fn)
+		return fmt.Errorf("Failed to download clean text %s: %v", key, err)
+	}
+	return nil
+}
+
+func DownloadIllustrations(dir string, name string, conn Downloader) error {
+	key := filepath.Join(name, bookpipeline.IllustrationsFile)
+	fn := filepath.Join(dir, bookpipeline.IllustrationsFile)
+	err := conn.Download(conn.WIPStorageId(), key, fn)
+	if err != nil {
+		return fmt.Errorf("Failed to download illustrations list %s: %v", key, err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return fmt.Errorf("Failed to read illustrations list %s: %v", fn, err)
+	}
+	var illus []bookpipeline.Illustration
+	err = json.Unmarshal(b, &illus)
+	if err != nil {
+		return fmt.Errorf("Failed to parse illustrations list %s: %v", fn, err)
+	}
+	for _, i := range illus {
+		key = filepath.Join(name, i.Image)
+		fn = filepath.Join(dir, i.Image)
+		conn.Log("Downloading file", key)
+		err = conn.Download(conn.WIPStorageId(), key, fn)
+		if err != nil {
+			return fmt.Errorf("Failed to download file %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
 func DownloadAnalyses(dir string, name string, conn Downloader) error {
-	for _, a := range []string{"conf", "graph.png"} {
+	for _, a := range []string{"conf", "graph.png", bookpipeline.ManifestFile, bookpipeline.IIIFManifestFile} {
 		key := filepath.Join(name, a)
 		fn := filepath.Join(dir, a)
 		err := conn.Download(conn.WIPStorageId(), key, fn)
-		// ignore errors with graph.png, as it will not exist in the case of a 1 page book
-		if err != nil && a != "graph.png" {
+		// ignore errors with graph.png, as it will not exist in the case of a 1 page book,
+		// with the manifest, as it will not exist for books processed before it was added,
+		// and with the IIIF manifest, as it is only created if requested
+		if err != nil && a == bookpipeline.IIIFManifestFile {
+			_ = os.Remove(fn)
+		}
+		if err != nil && a != "graph.png" && a != bookpipeline.ManifestFile && a != bookpipeline.IIIFManifestFile {
 			return fmt.Errorf("Failed to download analysis file %s: %v", key, err)
 		}
 	}
 	return nil
 }
 
+// DownloadIIIFImages downloads the images shown in a book's IIIF
+// manifest, which should already have been downloaded to dir, so
+// that the manifest can be published along with them
+func DownloadIIIFImages(dir string, name string, conn Downloader) error {
+	fn := filepath.Join(dir, bookpipeline.IIIFManifestFile)
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return fmt.Errorf("Failed to read IIIF manifest %s: %v", fn, err)
+	}
+	var m struct {
+		Id    string `json:"id"`
+		Items []struct {
+			Items []struct {
+				Items []struct {
+					Body struct {
+						Id string `json:"id"`
+					} `json:"body"`
+				} `json:"items"`
+			} `json:"items"`
+		} `json:"items"`
+	}
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return fmt.Errorf("Failed to parse IIIF manifest %s: %v", fn, err)
+	}
+	base := strings.TrimSuffix(m.Id, bookpipeline.IIIFManifestFile)
+	for _, c := range m.Items {
+		for _, p := range c.Items {
+			for _, a := range p.Items {
+				img := strings.TrimPrefix(a.Body.Id, base)
+				if img == a.Body.Id || img == "" {
+					return fmt.Errorf("Image %s isn't published with IIIF manifest %s", a.Body.Id, m.Id)
+				}
+				key := filepath.Join(name, img)
+				conn.Log("Downloading file", key)
+				err = conn.Download(conn.WIPStorageId(), key, filepath.Join(dir, img))
+				if err != nil {
+					return fmt.Errorf("Failed to download file %s: %v", key, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func DownloadAll(dir string, name string, conn DownloadLister) error {
 	objs, err := conn.ListObjects(conn.WIPStorageId(), name)
 	if err != nil {
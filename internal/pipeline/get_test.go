@@ -0,0 +1,67 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+func Test_DownloadIIIFImages(t *testing.T) {
+	canvas := func(img string) string {
+		return `{"items": [{"items": [{"body": {"id": "` + img + `"}}]}]}`
+	}
+	cases := []struct {
+		name   string
+		images []string
+		err    bool
+	}{
+		{"published", []string{"https://example.org/books/Book/0001_bin0.2.png", "https://example.org/books/Book/0002.jpg"}, false},
+		{"missing", []string{"https://example.org/books/Book/0001_bin0.2.png", "https://example.org/books/Book/0003.jpg"}, true},
+		{"elsewhere", []string{"https://example.org/books/Book/0001_bin0.2.png", "https://example.com/0002.jpg"}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q := &fakeQueue{dir: t.TempDir(), logger: log.New(ioutil.Discard, "", 0)}
+			writeFiles(t, filepath.Join(q.dir, "wip", "Book"), map[string]string{
+				"0001_bin0.2.png": "binarised",
+				"0002.jpg":        "colour",
+			})
+			var items []string
+			for _, img := range c.images {
+				items = append(items, canvas(img))
+			}
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{
+				bookpipeline.IIIFManifestFile: `{"id": "https://example.org/books/Book/` + bookpipeline.IIIFManifestFile + `", "items": [` + strings.Join(items, ", ") + `]}`,
+			})
+
+			err := DownloadIIIFImages(dir, "Book", q)
+			if c.err {
+				if err == nil {
+					t.Fatalf("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error downloading images: %v", err)
+			}
+			for img, want := range map[string]string{"0001_bin0.2.png": "binarised", "0002.jpg": "colour"} {
+				b, err := ioutil.ReadFile(filepath.Join(dir, img))
+				if err != nil {
+					t.Fatalf("Expected %s to be downloaded: %v", img, err)
+				}
+				if string(b) != want {
+					t.Errorf("Unexpected contents of %s: %s", img, b)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,445 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// iiifManifest holds the parts of a IIIF Presentation manifest which
+// are needed to get a book's images and metadata. Both version 2,
+// with canvases in sequences, and version 3, with canvases as items,
+// are supported.
+type iiifManifest struct {
+	Label     json.RawMessage `json:"label"`
+	Metadata  []iiifMetadata  `json:"metadata"`
+	Sequences []struct {
+		Canvases []iiifCanvas `json:"canvases"`
+	} `json:"sequences"`
+	Items []iiifCanvas `json:"items"`
+}
+
+// iiifMetadata is a label and value pair describing a manifest
+type iiifMetadata struct {
+	Label json.RawMessage `json:"label"`
+	Value json.RawMessage `json:"value"`
+}
+
+// iiifCanvas is a page of a book. In version 2 its image is in
+// Images, and in version 3 it is the body of the first annotation
+// of the first annotation page in Items.
+type iiifCanvas struct {
+	Label  json.RawMessage `json:"label"`
+	Images []struct {
+		Resource iiifResource `json:"resource"`
+	} `json:"images"`
+	Items []struct {
+		Items []struct {
+			Body iiifResource `json:"body"`
+		} `json:"items"`
+	} `json:"items"`
+}
+
+// iiifResource is an image, which may be served by a IIIF Image API
+// service, or a choice of images in Items
+type iiifResource struct {
+	Id      string          `json:"@id"`
+	Id3     string          `json:"id"`
+	Type    string          `json:"type"`
+	Service json.RawMessage `json:"service"`
+	Items   []iiifResource  `json:"items"`
+}
+
+// iiifService is a service of a resource, such as a IIIF Image API
+// service
+type iiifService struct {
+	Context json.RawMessage `json:"@context"`
+	Id      string          `json:"@id"`
+	Id3     string          `json:"id"`
+	Type    string          `json:"@type"`
+	Type3   string          `json:"type"`
+	Profile json.RawMessage `json:"profile"`
+}
+
+// htmlTagRe matches the HTML tags which can be used in IIIF values
+var htmlTagRe = regexp.MustCompile(`<[^>]*>`)
+
+// yearRe matches a year in a date
+var yearRe = regexp.MustCompile(`[0-9]{4}`)
+
+// IsIIIFManifest returns whether a book to be uploaded is a IIIF
+// manifest, rather than a directory or PDF, which is the case if it
+// is a web address or a JSON file
+func IsIIIFManifest(path string) bool {
+	l := strings.ToLower(path)
+	return strings.HasPrefix(l, "http://") || strings.HasPrefix(l, "https://") || strings.HasSuffix(l, ".json")
+}
+
+// iiifTexts returns the strings in a IIIF label or value, which can
+// be a string, a list, a value object with a language in version 2,
+// or a map of languages to lists of strings in version 3. If there
+// is a choice of languages English is preferred.
+func iiifTexts(raw json.RawMessage) []string {
+	if len(raw) == 0 {
+		return nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		s = strings.TrimSpace(htmlTagRe.ReplaceAllString(s, ""))
+		if s == "" {
+			return nil
+		}
+		return []string{s}
+	}
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) == nil {
+		// version 2 values can be given in several languages, of
+		// which only one is used
+		bylang := make(map[string][]string)
+		var langs []string
+		for _, v := range list {
+			var obj struct {
+				Language string `json:"@language"`
+			}
+			_ = json.Unmarshal(v, &obj)
+			if _, ok := bylang[obj.Language]; !ok {
+				langs = append(langs, obj.Language)
+			}
+			bylang[obj.Language] = append(bylang[obj.Language], iiifTexts(v)...)
+		}
+		if t, ok := bylang["en"]; ok {
+			return t
+		}
+		if len(langs) == 0 {
+			return nil
+		}
+		return bylang[langs[0]]
+	}
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(raw, &obj) != nil {
+		return nil
+	}
+	if v, ok := obj["@value"]; ok {
+		return iiifTexts(v)
+	}
+	var langs []string
+	for l := range obj {
+		langs = append(langs, l)
+	}
+	sort.Strings(langs)
+	for _, l := range append([]string{"en", "none"}, langs...) {
+		if v, ok := obj[l]; ok {
+			return iiifTexts(v)
+		}
+	}
+	return nil
+}
+
+// iiifText returns the text of a IIIF label or value, with multiple
+// values separated by semicolons
+func iiifText(raw json.RawMessage) string {
+	return strings.Join(iiifTexts(raw), "; ")
+}
+
+// canvases returns the canvases of a manifest, in order
+func (m iiifManifest) canvases() []iiifCanvas {
+	if len(m.Items) > 0 {
+		return m.Items
+	}
+	if len(m.Sequences) > 0 {
+		return m.Sequences[0].Canvases
+	}
+	return nil
+}
+
+// image returns the image of a canvas
+func (c iiifCanvas) image() (iiifResource, bool) {
+	if len(c.Images) > 0 {
+		return c.Images[0].Resource, true
+	}
+	if len(c.Items) > 0 && len(c.Items[0].Items) > 0 {
+		r := c.Items[0].Items[0].Body
+		if r.Type == "Choice" && len(r.Items) > 0 {
+			r = r.Items[0]
+		}
+		return r, true
+	}
+	return iiifResource{}, false
+}
+
+// url returns the address of the highest resolution version of an
+// image, using the IIIF Image API if it has an image service, or
+// otherwise its own address
+func (r iiifResource) url() string {
+	var services []iiifService
+	if json.Unmarshal(r.Service, &services) != nil {
+		var s iiifService
+		if json.Unmarshal(r.Service, &s) == nil {
+			services = []iiifService{s}
+		}
+	}
+	for _, s := range services {
+		id := strings.TrimSuffix(s.Id+s.Id3, "/")
+		if id == "" {
+			continue
+		}
+		desc := string(s.Context) + s.Type + s.Type3 + string(s.Profile)
+		switch {
+		case strings.Contains(desc, "ImageService3") || strings.Contains(desc, "image/3"):
+			return id + "/full/max/0/default.jpg"
+		case strings.Contains(desc, "ImageService2") || strings.Contains(desc, "image/2"):
+			return id + "/full/full/0/default.jpg"
+		case strings.Contains(desc, "ImageService1") || strings.Contains(desc, "image/1"):
+			return id + "/full/full/0/native.jpg"
+		}
+	}
+	if r.Id != "" {
+		return r.Id
+	}
+	return r.Id3
+}
+
+// metadata returns the bibliographic metadata of the book described
+// by a manifest, from its label and the metadata pairs which have
+// familiar labels
+func (m iiifManifest) metadata() bookpipeline.Metadata {
+	var meta bookpipeline.Metadata
+	for _, md := range m.Metadata {
+		label := strings.ToLower(iiifText(md.Label))
+		values := iiifTexts(md.Value)
+		if len(values) == 0 {
+			continue
+		}
+		v := strings.Join(values, "; ")
+		switch {
+		case strings.Contains(label, "title"):
+			if meta.Title == "" {
+				meta.Title = v
+			}
+		case strings.Contains(label, "author") || strings.Contains(label, "creator"):
+			meta.Authors = append(meta.Authors, values...)
+		case strings.Contains(label, "date") || strings.Contains(label, "year") || strings.Contains(label, "published"):
+			if y := yearRe.FindString(v); y != "" {
+				meta.Year = y
+			} else {
+				meta.Year = v
+			}
+		case strings.Contains(label, "publisher") || strings.Contains(label, "printer"):
+			meta.Publisher = v
+		case strings.Contains(label, "place"):
+			meta.Place = v
+		case strings.Contains(label, "language"):
+			meta.Language = v
+		case strings.Contains(label, "shelfmark") || strings.Contains(label, "call number") || strings.Contains(label, "signatur"):
+			meta.Shelfmark = v
+		}
+	}
+	if meta.Title == "" {
+		meta.Title = iiifText(m.Label)
+	}
+	return meta
+}
+
+// maxNameLength is the longest name of a book which is made from its
+// title
+const maxNameLength = 64
+
+// iiifBookname returns a name for a book from its title, with only
+// letters, numbers, dashes and underscores
+func iiifBookname(title string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_':
+			return r
+		case unicode.IsSpace(r):
+			return '_'
+		}
+		return -1
+	}, title)
+	if r := []rune(name); len(r) > maxNameLength {
+		name = string(r[:maxNameLength])
+	}
+	name = strings.Trim(name, "_")
+	if name == "" {
+		return "iiif"
+	}
+	return name
+}
+
+// readIIIFManifest reads a IIIF manifest from a web address or file
+func readIIIFManifest(ctx context.Context, manifest string) (iiifManifest, error) {
+	var m iiifManifest
+	var r io.Reader
+	l := strings.ToLower(manifest)
+	if strings.HasPrefix(l, "http://") || strings.HasPrefix(l, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifest, nil)
+		if err != nil {
+			return m, fmt.Errorf("Error downloading IIIF manifest %s: %v", manifest, err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return m, fmt.Errorf("Error downloading IIIF manifest %s: %v", manifest, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return m, fmt.Errorf("Error downloading IIIF manifest %s: %s", manifest, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(manifest)
+		if err != nil {
+			return m, fmt.Errorf("Error opening IIIF manifest %s: %v", manifest, err)
+		}
+		defer f.Close()
+		r = f
+	}
+	err := json.NewDecoder(r).Decode(&m)
+	if err != nil {
+		return m, fmt.Errorf("Error parsing IIIF manifest %s: %v", manifest, err)
+	}
+	return m, nil
+}
+
+// imageExts are the extensions to save images of each type with
+var imageExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/tiff": ".tif",
+	"image/jp2":  ".jp2",
+	"image/webp": ".webp",
+}
+
+// downloadImage downloads an image to a file named base with an
+// extension for its type, returning the file's name
+func downloadImage(ctx context.Context, url string, dir string, base string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("Error downloading image %s: %v", url, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error downloading image %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error downloading image %s: %s", url, resp.Status)
+	}
+	return saveResponseImage(resp, dir, base)
+}
+
+// saveResponseImage saves the image in the body of a response to a file
+// named base with an extension for its type, returning the file's
+// name. The image is only given its name once it has been saved in
+// full, so an interrupted download won't leave a partial image.
+func saveResponseImage(resp *http.Response, dir string, base string) (string, error) {
+	url := resp.Request.URL
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	ext, ok := imageExts[mt]
+	if !ok {
+		ext = strings.ToLower(path.Ext(url.Path))
+		if !isPageImage("image" + ext) {
+			ext = ".jpg"
+		}
+	}
+
+	name := base + ext
+	part := filepath.Join(dir, name+".part")
+	f, err := os.Create(part)
+	if err != nil {
+		return "", fmt.Errorf("Error creating file %s: %v", name, err)
+	}
+	defer os.Remove(part)
+	defer f.Close()
+	_, err = io.Copy(f, resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("Error downloading image %s: %v", url, err)
+	}
+	err = f.Close()
+	if err != nil {
+		return "", fmt.Errorf("Error closing file %s: %v", name, err)
+	}
+	err = os.Rename(part, filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("Error renaming %s: %v", part, err)
+	}
+	return name, nil
+}
+
+// DownloadIIIF downloads the highest resolution image of each canvas
+// of a IIIF Presentation manifest, from a web address or file, to a
+// directory named for the book inside a new temporary directory,
+// and returns the directory. The canvases' labels are saved as page
+// labels in an order file, and the book's metadata in MetadataFile,
+// so that they are used when the directory is uploaded. The parent
+// of the returned directory should be removed once it is no longer
+// needed.
+func DownloadIIIF(ctx context.Context, manifest string) (string, error) {
+	m, err := readIIIFManifest(ctx, manifest)
+	if err != nil {
+		return "", err
+	}
+	canvases := m.canvases()
+	if len(canvases) == 0 {
+		return "", fmt.Errorf("No canvases found in IIIF manifest %s", manifest)
+	}
+	meta := m.metadata()
+
+	tempdir, err := ioutil.TempDir("", "bookpipeline")
+	if err != nil {
+		return "", fmt.Errorf("Error setting up temporary directory: %v", err)
+	}
+	dir := filepath.Join(tempdir, iiifBookname(meta.Title))
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		_ = os.RemoveAll(tempdir)
+		return "", fmt.Errorf("Error setting up temporary directory: %v", err)
+	}
+
+	var order []PageOrder
+	for i, c := range canvases {
+		select {
+		case <-ctx.Done():
+			return dir, ctx.Err()
+		default:
+		}
+		img, ok := c.image()
+		url := img.url()
+		if !ok || url == "" {
+			return dir, fmt.Errorf("No image found for canvas %d of IIIF manifest %s", i+1, manifest)
+		}
+		name, err := downloadImage(ctx, url, dir, fmt.Sprintf("%04d", i+1))
+		if err != nil {
+			return dir, err
+		}
+		order = append(order, PageOrder{File: name, Label: iiifText(c.Label)})
+	}
+
+	err = writeOrderFile(dir, order)
+	if err != nil {
+		return dir, err
+	}
+	if !meta.Empty() {
+		err = writeJSON(filepath.Join(dir, bookpipeline.MetadataFile), meta)
+		if err != nil {
+			return dir, err
+		}
+	}
+	return dir, nil
+}
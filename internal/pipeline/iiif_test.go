@@ -0,0 +1,193 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+const iiifManifest3 = `{
+  "@context": "http://iiif.io/api/presentation/3/context.json",
+  "id": "%[1]s/manifest3.json",
+  "type": "Manifest",
+  "label": {"en": ["The Anatomy of Melancholy"]},
+  "metadata": [
+    {"label": {"en": ["Author"]}, "value": {"none": ["Robert Burton"]}},
+    {"label": {"en": ["Date"]}, "value": {"en": ["[1621?]"]}},
+    {"label": {"en": ["Shelfmark"]}, "value": {"none": ["<span>Douce B 123</span>"]}}
+  ],
+  "items": [
+    {"id": "%[1]s/canvas/1", "type": "Canvas", "label": {"none": ["i"]},
+     "items": [{"type": "AnnotationPage", "items": [{"type": "Annotation", "motivation": "painting",
+       "body": {"id": "%[1]s/iiif/p1/full/200,/0/default.jpg", "type": "Image", "format": "image/jpeg",
+         "service": [{"id": "%[1]s/iiif/p1", "type": "ImageService3", "profile": "level1"}]}}]}]},
+    {"id": "%[1]s/canvas/2", "type": "Canvas", "label": {"en": ["Title page"]},
+     "items": [{"type": "AnnotationPage", "items": [{"type": "Annotation", "motivation": "painting",
+       "body": {"id": "%[1]s/plate.png", "type": "Image", "format": "image/png"}}]}]}
+  ]
+}`
+
+const iiifManifest2 = `{
+  "@context": "http://iiif.io/api/presentation/2/context.json",
+  "@id": "%[1]s/manifest2.json",
+  "@type": "sc:Manifest",
+  "label": "Sylva sylvarum",
+  "metadata": [
+    {"label": "Title", "value": [{"@value": "Sylva sylvarum, or, A naturall historie", "@language": "en"},
+      {"@value": "Sylva sylvarum", "@language": "la"}]},
+    {"label": "Creator", "value": ["Francis Bacon", "William Rawley"]},
+    {"label": "Place of publication", "value": "London"}
+  ],
+  "sequences": [{"canvases": [
+    {"@id": "%[1]s/canvas/1", "label": "1", "images": [{"resource": {"@id": "%[1]s/iiif/p1/full/full/0/default.jpg",
+      "service": {"@context": "http://iiif.io/api/image/2/context.json", "@id": "%[1]s/iiif/p1", "profile": "http://iiif.io/api/image/2/level1.json"}}}]},
+    {"@id": "%[1]s/canvas/2", "label": "2", "images": [{"resource": {"@id": "%[1]s/iiif/p2/full/full/0/default.jpg",
+      "service": {"@context": "http://iiif.io/api/image/2/context.json", "@id": "%[1]s/iiif/p2/"}}}]}
+  ]}]
+}`
+
+// iiifServer starts a stand-in for a IIIF server, serving the sample
+// manifests and images, and recording the paths of images requested
+func iiifServer(t *testing.T, requested *[]string) *httptest.Server {
+	var jpg bytes.Buffer
+	err := jpeg.Encode(&jpg, image.NewGray(image.Rect(0, 0, 20, 30)), nil)
+	if err != nil {
+		t.Fatalf("Could not encode JPEG: %v", err)
+	}
+	png, err := ioutil.ReadFile("testdata/good/1.png")
+	if err != nil {
+		t.Fatalf("Could not read test image: %v", err)
+	}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/manifest3.json":
+			fmt.Fprintf(w, iiifManifest3, srv.URL)
+		case r.URL.Path == "/manifest2.json":
+			fmt.Fprintf(w, iiifManifest2, srv.URL)
+		case r.URL.Path == "/plate.png":
+			*requested = append(*requested, r.URL.Path)
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(png)
+		case strings.HasPrefix(r.URL.Path, "/iiif/"):
+			*requested = append(*requested, r.URL.Path)
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(jpg.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return srv
+}
+
+func Test_DownloadIIIF(t *testing.T) {
+	cases := []struct {
+		manifest  string
+		name      string
+		requested []string
+		order     []PageOrder
+		meta      bookpipeline.Metadata
+	}{
+		{"manifest3.json", "The_Anatomy_of_Melancholy",
+			[]string{"/iiif/p1/full/max/0/default.jpg", "/plate.png"},
+			[]PageOrder{{File: "0001.jpg", Label: "i"}, {File: "0002.png", Label: "Title page"}},
+			bookpipeline.Metadata{Title: "The Anatomy of Melancholy", Authors: []string{"Robert Burton"}, Year: "1621", Shelfmark: "Douce B 123"}},
+		{"manifest2.json", "Sylva_sylvarum_or_A_naturall_historie",
+			[]string{"/iiif/p1/full/full/0/default.jpg", "/iiif/p2/full/full/0/default.jpg"},
+			[]PageOrder{{File: "0001.jpg", Label: "1"}, {File: "0002.jpg", Label: "2"}},
+			bookpipeline.Metadata{Title: "Sylva sylvarum, or, A naturall historie", Authors: []string{"Francis Bacon", "William Rawley"}, Place: "London"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.manifest, func(t *testing.T) {
+			var requested []string
+			srv := iiifServer(t, &requested)
+			defer srv.Close()
+
+			// read the manifest from a file as well as from the server
+			b, err := http.Get(srv.URL + "/" + c.manifest)
+			if err != nil {
+				t.Fatalf("Could not get manifest: %v", err)
+			}
+			body, _ := ioutil.ReadAll(b.Body)
+			b.Body.Close()
+			fn := filepath.Join(t.TempDir(), c.manifest)
+			writeFiles(t, filepath.Dir(fn), map[string]string{c.manifest: string(body)})
+
+			for _, manifest := range []string{srv.URL + "/" + c.manifest, fn} {
+				requested = nil
+				if !IsIIIFManifest(manifest) {
+					t.Errorf("%s not recognised as a IIIF manifest", manifest)
+				}
+				dir, err := DownloadIIIF(context.Background(), manifest)
+				if dir != "" {
+					defer os.RemoveAll(filepath.Dir(dir))
+				}
+				if err != nil {
+					t.Fatalf("Error downloading IIIF manifest %s: %v", manifest, err)
+				}
+				if filepath.Base(dir) != c.name {
+					t.Errorf("Expected directory named %s, got %s", c.name, dir)
+				}
+				if !reflect.DeepEqual(requested, c.requested) {
+					t.Errorf("Expected images %v to be requested, got %v", c.requested, requested)
+				}
+
+				order, ordered, err := imageOrder(dir)
+				if err != nil || !ordered {
+					t.Fatalf("Error getting order of images, ordered %v: %v", ordered, err)
+				}
+				if !reflect.DeepEqual(order, c.order) {
+					t.Errorf("Expected order %v, got %v", c.order, order)
+				}
+
+				var meta bookpipeline.Metadata
+				err = ReadMetadata(filepath.Join(dir, bookpipeline.MetadataFile), &meta)
+				if err != nil {
+					t.Fatalf("Error reading metadata: %v", err)
+				}
+				if !reflect.DeepEqual(meta, c.meta) {
+					t.Errorf("Expected metadata %+v, got %+v", c.meta, meta)
+				}
+			}
+		})
+	}
+}
+
+func Test_iiifTexts(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want []string
+	}{
+		{`"plain"`, []string{"plain"}},
+		{`{"fr": ["Titre"], "en": ["Title", "Subtitle"]}`, []string{"Title", "Subtitle"}},
+		{`{"de": ["Titel"]}`, []string{"Titel"}},
+		{`[{"@value": "Titel", "@language": "de"}, {"@value": "Titre", "@language": "fr"}]`, []string{"Titel"}},
+		{`{"@value": "value <b>bold</b>"}`, []string{"value bold"}},
+		{`null`, nil},
+	}
+	for _, c := range cases {
+		got := iiifTexts(json.RawMessage(c.raw))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.raw, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// IIIFSearch is a IIIF Content Search service for books saved in a
+// directory, as downloaded by getpipelinebook, each in a directory
+// named after the book containing its manifest and best hOCR files.
+// A book is searched with a request to /bookname/search?q=words.
+type IIIFSearch struct {
+	// Dir is the directory containing the books
+	Dir string
+	// Base is the address the books are published at, which must
+	// be the same as the IIIFBase they were analysed with so that
+	// results refer to the canvases of their IIIF manifests
+	Base string
+
+	mu    sync.Mutex
+	books map[string][]bookpipeline.HocrPage
+}
+
+// iiifBookBase returns the address a book's files are published at
+func iiifBookBase(base string, bookname string) string {
+	return strings.TrimSuffix(base, "/") + "/" + bookname
+}
+
+// pages returns the best hOCR of each page of a book, reading it
+// the first time the book is searched
+func (s *IIIFSearch) pages(bookname string) ([]bookpipeline.HocrPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pages, ok := s.books[bookname]; ok {
+		return pages, nil
+	}
+
+	dir := filepath.Join(s.Dir, bookname)
+	b, err := ioutil.ReadFile(filepath.Join(dir, bookpipeline.ManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading manifest of %s: %v", bookname, err)
+	}
+	var m bookpipeline.Manifest
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing manifest of %s: %v", bookname, err)
+	}
+
+	var pgs []string
+	for _, pg := range m.Pages {
+		pgs = append(pgs, filepath.Join(dir, pg.Hocr))
+	}
+	pages, err := readHocrPages(pgs)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.books == nil {
+		s.books = make(map[string][]bookpipeline.HocrPage)
+	}
+	s.books[bookname] = pages
+	return pages, nil
+}
+
+func (s *IIIFSearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(p) != 2 || p[1] != "search" || p[0] == "" || p[0] == "." || p[0] == ".." {
+		http.NotFound(w, r)
+		return
+	}
+	bookname := p[0]
+
+	pages, err := s.pages(bookname)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	id := scheme + "://" + r.Host + r.URL.RequestURI()
+	w.Header().Set("Content-Type", "application/ld+json;profile=\"http://iiif.io/api/search/2/context.json\"")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	err = bookpipeline.WriteIIIFSearch(w, id, iiifBookBase(s.Base, bookname), pages, r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
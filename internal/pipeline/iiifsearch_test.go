@@ -0,0 +1,211 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+const iiifTestHocr = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+ <body>
+  <div class="ocr_page" id="page_1" title="bbox 0 0 1000 1500">
+   <div class="ocr_carea" id="block_1_1" title="bbox 100 100 900 300">
+    <p class="ocr_par" id="par_1_1" lang="lat" title="bbox 100 100 900 300">
+     <span class="ocr_line" id="line_1_1" title="bbox 100 100 900 140">
+      <span class="ocrx_word" id="word_1_1" title="bbox 100 100 300 140; x_wconf 90">%s</span>
+      <span class="ocrx_word" id="word_1_2" title="bbox 320 100 600 140; x_wconf 90">%s</span>
+      <span class="ocrx_word" id="word_1_3" title="bbox 620 100 900 140; x_wconf 90">%s</span>
+     </span>
+    </p>
+   </div>
+  </div>
+ </body>
+</html>
+`
+
+// iiifSearchResults is the part of a IIIF Content Search response
+// checked by the tests
+type iiifSearchResults struct {
+	Items []struct {
+		Id     string
+		Body   struct{ Value string }
+		Target string
+	}
+	Annotations []struct {
+		Items []struct {
+			Target struct {
+				Source   struct{ Id string }
+				Selector []struct{ Prefix, Exact, Suffix string }
+			}
+		}
+	}
+}
+
+// iiifCanvases is the part of a IIIF manifest checked by the tests
+type iiifCanvases struct {
+	Service []struct{ Id, Type string }
+	Items   []struct {
+		Id     string
+		Label  map[string][]string
+		Width  int
+		Height int
+		Items  []struct {
+			Items []struct {
+				Body struct {
+					Id            string
+					Width, Height int
+				}
+			}
+		}
+		Annotations []struct {
+			Id    string
+			Items []struct {
+				Id   string
+				Body struct{ Value string }
+			}
+		}
+	}
+}
+
+func Test_IIIFSearch(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Book/0001_bin0.2.hocr": fmt.Sprintf(iiifTestHocr, "Novum", "Organum,", "sive"),
+		"Book/0002_bin0.1.hocr": fmt.Sprintf(iiifTestHocr, "indicia", "vera", "organum"),
+		"Book/" + bookpipeline.ManifestFile: `{"book": "Book", "pages": [
+			{"name": "0001", "hocr": "0001_bin0.2.hocr", "image": "0001_bin0.2.png"},
+			{"name": "0002", "hocr": "0002_bin0.1.hocr", "image": "0002_bin0.1.png"}]}`,
+	})
+	base := "https://example.org/books/"
+
+	pgs := []string{filepath.Join(dir, "Book", "0001_bin0.2.hocr"), filepath.Join(dir, "Book", "0002_bin0.1.hocr")}
+	pages, err := readHocrPages(pgs)
+	if err != nil {
+		t.Fatalf("Error reading hOCR: %v", err)
+	}
+	pages[1].Label = "ii"
+	binimgs := []pageimg{{hocr: "0001_bin0.2.hocr", img: "0001_bin0.2.png"}, {hocr: "0002_bin0.1.hocr", img: "0002_bin0.1.png"}}
+	opts := AnalyseOpts{IIIFBase: base, IIIFSearch: "https://example.org/search"}
+	fn, err := mkIIIF(t.TempDir(), "Book", bookpipeline.Metadata{}, pages, binimgs, map[string]string{"0002_bin0.1.hocr": "0002.jpg"}, map[string]image.Point{"0002_bin0.1.hocr": {X: 2000, Y: 3100}}, opts)
+	if err != nil {
+		t.Fatalf("Error creating IIIF manifest: %v", err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Error reading IIIF manifest: %v", err)
+	}
+	var m iiifCanvases
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		t.Fatalf("Error parsing IIIF manifest: %v", err)
+	}
+	if len(m.Service) != 1 || m.Service[0].Id != "https://example.org/search/Book/search" || m.Service[0].Type != "SearchService2" {
+		t.Errorf("Unexpected search service %+v", m.Service)
+	}
+	if len(m.Items) != 2 {
+		t.Fatalf("Expected 2 canvases, got %d", len(m.Items))
+	}
+	// the canvases have the size of the hOCR, with the colour image
+	// scaled to fit
+	for i, want := range []struct {
+		label, img string
+		w, h       int
+	}{
+		{"1", "https://example.org/books/Book/0001_bin0.2.png", 1000, 1500},
+		{"ii", "https://example.org/books/Book/0002.jpg", 2000, 3100},
+	} {
+		c := m.Items[i]
+		if c.Label["none"][0] != want.label {
+			t.Errorf("Expected canvas %d to be labelled %s, got %v", i, want.label, c.Label)
+		}
+		if c.Items[0].Items[0].Body.Id != want.img {
+			t.Errorf("Expected canvas %d to show %s, got %s", i, want.img, c.Items[0].Items[0].Body.Id)
+		}
+		if c.Width != 1000 || c.Height != 1500 {
+			t.Errorf("Expected canvas %d to be 1000x1500, got %dx%d", i, c.Width, c.Height)
+		}
+		if body := c.Items[0].Items[0].Body; body.Width != want.w || body.Height != want.h {
+			t.Errorf("Expected image of canvas %d to be %dx%d, got %dx%d", i, want.w, want.h, body.Width, body.Height)
+		}
+		if len(c.Annotations) != 2 || len(c.Annotations[0].Items) != 1 || len(c.Annotations[1].Items) != 3 {
+			t.Errorf("Expected canvas %d to be annotated with 1 line and 3 words, got %+v", i, c.Annotations)
+		}
+	}
+
+	s := &IIIFSearch{Dir: dir, Base: base}
+	cases := []struct {
+		path   string
+		status int
+		ids    []string
+	}{
+		{"/Book/search?q=organum", http.StatusOK, []string{
+			"https://example.org/books/Book/canvas/1/words/2",
+			"https://example.org/books/Book/canvas/2/words/3",
+		}},
+		{"/Book/search?q=Sive+VERA", http.StatusOK, []string{
+			"https://example.org/books/Book/canvas/1/words/3",
+			"https://example.org/books/Book/canvas/2/words/2",
+		}},
+		{"/Book/search?q=absent", http.StatusOK, nil},
+		{"/Book/search", http.StatusOK, nil},
+		{"/Other/search?q=organum", http.StatusNotFound, nil},
+		{"/Book/manifest.json", http.StatusNotFound, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.org"+c.path, nil))
+			if w.Code != c.status {
+				t.Fatalf("Expected status %d, got %d", c.status, w.Code)
+			}
+			if c.status != http.StatusOK {
+				return
+			}
+			var r iiifSearchResults
+			err := json.Unmarshal(w.Body.Bytes(), &r)
+			if err != nil {
+				t.Fatalf("Error parsing search results: %v", err)
+			}
+			if len(r.Items) != len(c.ids) {
+				t.Fatalf("Expected %d hits, got %+v", len(c.ids), r.Items)
+			}
+			for i, id := range c.ids {
+				if r.Items[i].Id != id {
+					t.Errorf("Expected hit %s, got %s", id, r.Items[i].Id)
+				}
+				if r.Annotations[0].Items[i].Target.Source.Id != id {
+					t.Errorf("Expected highlight of %s, got %s", id, r.Annotations[0].Items[i].Target.Source.Id)
+				}
+			}
+		})
+	}
+
+	// check the details of a hit against the manifest
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.org/Book/search?q=organum", nil))
+	var r iiifSearchResults
+	_ = json.Unmarshal(w.Body.Bytes(), &r)
+	hit := r.Items[0]
+	if hit.Target != m.Items[0].Id+"#xywh=320,100,280,40" || hit.Body.Value != "Organum," {
+		t.Errorf("Unexpected hit %+v", hit)
+	}
+	if word := m.Items[0].Annotations[1].Items[1]; word.Id != hit.Id || word.Body.Value != hit.Body.Value {
+		t.Errorf("Hit %+v doesn't match word %+v in IIIF manifest", hit, word)
+	}
+	sel := r.Annotations[0].Items[0].Target.Selector[0]
+	if sel.Prefix != "Novum " || sel.Exact != "Organum," || sel.Suffix != " sive" {
+		t.Errorf("Unexpected highlight %+v", sel)
+	}
+}
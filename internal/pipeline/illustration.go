@@ -0,0 +1,94 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// mkIllustrations crops the illustrations found in the hOCR of each
+// page from its colour original, returning the paths of the cropped
+// images followed by IllustrationsFile, which lists them with their
+// coordinates and pages. The pages slice has the parsed hOCR of each
+// of the pageimgs.
+func mkIllustrations(ctx context.Context, conn Downloader, savedir string, bookname string, pgs []pageimg, pages []bookpipeline.HocrPage, logger *log.Logger) ([]string, error) {
+	var done []string
+	illus := []bookpipeline.Illustration{}
+	for i, pg := range pgs {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		if i >= len(pages) {
+			break
+		}
+		boxes := bookpipeline.FindIllustrations(pages[i])
+		if len(boxes) == 0 {
+			continue
+		}
+
+		logger.Println("Downloading colour page to extract illustrations from", pg.img)
+		imgpath, err := downloadColour(conn, savedir, bookname, pg.img)
+		if err != nil {
+			logger.Println("Download failed; skipping illustrations on page", pg.img)
+			continue
+		}
+		f, err := os.Open(imgpath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open image %s: %v", imgpath, err)
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		_ = os.Remove(imgpath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode image %s: %v", imgpath, err)
+		}
+
+		name := strings.SplitN(pg.hocr, "_bin", 2)[0]
+		pagew := pages[i].Bbox[2] - pages[i].Bbox[0]
+		for n, box := range boxes {
+			r := bookpipeline.ScaleBox(box, pagew, img.Bounds().Dx(), img.Bounds())
+			if r.Empty() {
+				continue
+			}
+			fn := filepath.Join(savedir, fmt.Sprintf("%s_illus%d.jpg", name, n+1))
+			out, err := os.Create(fn)
+			if err != nil {
+				return nil, fmt.Errorf("Error creating file %s: %v", fn, err)
+			}
+			err = jpeg.Encode(out, bookpipeline.CropImage(img, r), &jpeg.Options{Quality: 95})
+			out.Close()
+			if err != nil {
+				return nil, fmt.Errorf("Failed to encode image %s: %v", fn, err)
+			}
+			done = append(done, fn)
+			r = r.Sub(img.Bounds().Min)
+			illus = append(illus, bookpipeline.Illustration{
+				Image: filepath.Base(fn),
+				Page:  name,
+				Hocr:  pg.hocr,
+				Bbox:  [4]int{r.Min.X, r.Min.Y, r.Max.X, r.Max.Y},
+			})
+		}
+	}
+
+	fn := filepath.Join(savedir, bookpipeline.IllustrationsFile)
+	err := writeJSON(fn, illus)
+	if err != nil {
+		return nil, err
+	}
+	return append(done, fn), nil
+}
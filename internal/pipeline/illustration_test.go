@@ -0,0 +1,104 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"rescribe.xyz/bookpipeline"
+	"testing"
+)
+
+func Test_mkIllustrations(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := &bookpipeline.LocalConn{Logger: vlog}
+	err := conn.Init()
+	if err != nil {
+		t.Fatalf("Could not initialise local connection: %v", err)
+	}
+
+	bookname := "illustest"
+	dir := t.TempDir()
+	// the colour original is twice the size of the binarised page
+	// the hOCR was made from
+	img := image.NewRGBA(image.Rect(0, 0, 400, 600))
+	fn := filepath.Join(dir, "0001.jpg")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = jpeg.Encode(f, img, nil)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+	err = conn.Upload(conn.WIPStorageId(), bookname+"/0001.jpg", fn)
+	if err != nil {
+		t.Fatalf("Could not upload image: %v", err)
+	}
+
+	savedir := filepath.Join(os.TempDir(), bookname)
+	err = os.MkdirAll(savedir, 0700)
+	if err != nil {
+		t.Fatalf("Could not create directory %s: %v", savedir, err)
+	}
+	defer os.RemoveAll(savedir)
+
+	pgs := []pageimg{{hocr: "0001_bin0.2.hocr", img: "0001.jpg"}, {hocr: "0002_bin0.2.hocr", img: "0002.jpg"}}
+	pages := []bookpipeline.HocrPage{
+		{Bbox: [4]int{0, 0, 200, 300}, Areas: []bookpipeline.HocrArea{
+			{Class: "ocr_carea", Bbox: [4]int{10, 10, 190, 50}},
+			{Class: "ocr_photo", Bbox: [4]int{20, 60, 120, 160}},
+			{Class: "ocr_photo", Bbox: [4]int{150, 250, 152, 252}},
+		}},
+		{Bbox: [4]int{0, 0, 200, 300}},
+	}
+
+	fns, err := mkIllustrations(context.Background(), conn, savedir, bookname, pgs, pages, vlog)
+	if err != nil {
+		t.Fatalf("Error extracting illustrations: %v\nLog: %s", err, slog.log)
+	}
+	if len(fns) != 2 {
+		t.Fatalf("Expected 1 illustration and the list, got %v", fns)
+	}
+	if filepath.Base(fns[0]) != "0001_illus1.jpg" {
+		t.Errorf("Unexpected illustration name %s", fns[0])
+	}
+
+	f, err = os.Open(fns[0])
+	if err != nil {
+		t.Fatalf("Could not open illustration: %v", err)
+	}
+	cfg, err := jpeg.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not decode illustration: %v", err)
+	}
+	if cfg.Width != 200 || cfg.Height != 200 {
+		t.Errorf("Expected illustration of 200x200, got %dx%d", cfg.Width, cfg.Height)
+	}
+
+	b, err := ioutil.ReadFile(fns[1])
+	if err != nil {
+		t.Fatalf("Could not read illustrations list: %v", err)
+	}
+	var illus []bookpipeline.Illustration
+	err = json.Unmarshal(b, &illus)
+	if err != nil {
+		t.Fatalf("Could not parse illustrations list: %v", err)
+	}
+	want := bookpipeline.Illustration{Image: "0001_illus1.jpg", Page: "0001", Hocr: "0001_bin0.2.hocr", Bbox: [4]int{40, 120, 240, 320}}
+	if len(illus) != 1 || illus[0] != want {
+		t.Errorf("Expected illustrations list %v, got %v", []bookpipeline.Illustration{want}, illus)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// googleBooksApi is the address of the Google Books volumes API,
+// which the id of a book is added to to get its metadata
+var googleBooksApi = "https://www.googleapis.com/books/v1/volumes/"
+
+// ReadMetadata reads book metadata from the JSON file at path into
+// m, replacing the fields it sets and keeping any others, so that it
+// can be used to add to or correct metadata from Google Books
+func ReadMetadata(path string, m *bookpipeline.Metadata) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error reading metadata %s: %v", path, err)
+	}
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return fmt.Errorf("Error parsing metadata %s: %v", path, err)
+	}
+	return nil
+}
+
+// GoogleBooksMetadata gets the metadata of a book from Google Books
+func GoogleBooksMetadata(ctx context.Context, id string) (bookpipeline.Metadata, error) {
+	m := bookpipeline.Metadata{GoogleBooksId: id}
+	url := googleBooksApi + id
+
+	// designed to be unmarshalled by encoding/json's Unmarshal()
+	type bookInfo struct {
+		VolumeInfo struct {
+			Title         string
+			Authors       []string
+			Publisher     string
+			PublishedDate string
+			Language      string
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return m, fmt.Errorf("Error downloading metadata %s: %v", url, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return m, fmt.Errorf("Error downloading metadata %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return m, fmt.Errorf("Error downloading metadata %s: %s", url, resp.Status)
+	}
+
+	var v bookInfo
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	if err != nil {
+		return m, fmt.Errorf("Error parsing metadata %s: %v", url, err)
+	}
+
+	m.Title = v.VolumeInfo.Title
+	m.Authors = v.VolumeInfo.Authors
+	m.Publisher = v.VolumeInfo.Publisher
+	m.Language = v.VolumeInfo.Language
+	// the date can be a full date, like 2005-03-01, but is usually
+	// just a year for older books
+	m.Year = strings.SplitN(v.VolumeInfo.PublishedDate, "-", 2)[0]
+
+	return m, nil
+}
+
+// UploadMetadata saves the metadata of a book alongside it
+func UploadMetadata(m bookpipeline.Metadata, bookname string, conn Uploader) error {
+	dir, err := ioutil.TempDir("", "bookpipeline")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, bookpipeline.MetadataFile)
+	err = writeJSON(fn, m)
+	if err != nil {
+		return err
+	}
+	err = conn.Upload(conn.WIPStorageId(), bookname+"/"+bookpipeline.MetadataFile, fn)
+	if err != nil {
+		return fmt.Errorf("Failed to upload %s: %v", fn, err)
+	}
+	return nil
+}
+
+// downloadMetadata gets the metadata saved with a book, returning
+// empty metadata if there is none
+func downloadMetadata(conn Downloader, savedir string, bookname string) (bookpipeline.Metadata, error) {
+	var m bookpipeline.Metadata
+	fn := filepath.Join(savedir, bookpipeline.MetadataFile)
+	err := conn.Download(conn.WIPStorageId(), bookname+"/"+bookpipeline.MetadataFile, fn)
+	if err != nil {
+		return m, err
+	}
+	defer os.Remove(fn)
+	err = ReadMetadata(fn, &m)
+	return m, err
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+func Test_GoogleBooksMetadata(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/volumes/QjQepCuN8JYC" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"id": "QjQepCuN8JYC", "volumeInfo": {"title": "Novum Organum",
+			"authors": ["Francis Bacon"], "publisher": "Joannem Billium",
+			"publishedDate": "1620-01-01", "language": "la"}}`))
+	}))
+	defer srv.Close()
+	orig := googleBooksApi
+	googleBooksApi = srv.URL + "/volumes/"
+	defer func() { googleBooksApi = orig }()
+
+	m, err := GoogleBooksMetadata(context.Background(), "QjQepCuN8JYC")
+	if err != nil {
+		t.Fatalf("Error getting metadata: %v", err)
+	}
+	want := bookpipeline.Metadata{Title: "Novum Organum", Authors: []string{"Francis Bacon"}, Year: "1620",
+		Publisher: "Joannem Billium", Language: "la", GoogleBooksId: "QjQepCuN8JYC"}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("Expected %+v, got %+v", want, m)
+	}
+
+	_, err = GoogleBooksMetadata(context.Background(), "notabookxxxx")
+	if err == nil {
+		t.Errorf("Expected an error for a book which isn't found")
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		bookpipeline.MetadataFile: `{"place": "London", "shelfmark": "C.45.d.12", "year": "1620"}`,
+	})
+	err = ReadMetadata(filepath.Join(dir, bookpipeline.MetadataFile), &m)
+	if err != nil {
+		t.Fatalf("Error reading metadata: %v", err)
+	}
+	want.Place = "London"
+	want.Shelfmark = "C.45.d.12"
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("Expected %+v, got %+v", want, m)
+	}
+	if i := m.Imprint(); i != "London: Joannem Billium, 1620" {
+		t.Errorf("Unexpected imprint %s", i)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"os"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// LoadMetric returns the page metric named by metric, as parsed by
+// bookpipeline.ParseMetric, reading the word list for the dict
+// metric from the file wordlist if it is set. The default "conf"
+// metric is returned as nil, so that pages are chosen by their
+// confidence as normal.
+func LoadMetric(metric string, wordlist string) (bookpipeline.PageMetric, error) {
+	var words map[string]bool
+	if wordlist != "" {
+		f, err := os.Open(wordlist)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening word list %s: %v", wordlist, err)
+		}
+		words, err = bookpipeline.ReadWordList(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if metric == "conf" {
+		return nil, nil
+	}
+	return bookpipeline.ParseMetric(metric, words)
+}
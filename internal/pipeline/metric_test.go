@@ -0,0 +1,52 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func Test_LoadMetric(t *testing.T) {
+	wordlist := filepath.Join(t.TempDir(), "words.txt")
+	err := ioutil.WriteFile(wordlist, []byte("novum\norganum\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write word list: %v", err)
+	}
+
+	cases := []struct {
+		metric   string
+		wordlist string
+		want     string // "" for no metric
+		err      bool
+	}{
+		{"conf", "", "", false},
+		{"conf", wordlist, "", false},
+		{"charconf", "", "charconf", false},
+		{"dict", wordlist, "dict", false},
+		{"charconf:2,dict:1", wordlist, "charconf:2,dict:1", false},
+		{"dict", "", "", true},
+		{"dict", filepath.Join(t.TempDir(), "missing.txt"), "", true},
+		{"conf", filepath.Join(t.TempDir(), "missing.txt"), "", true},
+		{"unknown", "", "", true},
+	}
+	for _, c := range cases {
+		m, err := LoadMetric(c.metric, c.wordlist)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s %s: expected an error", c.metric, c.wordlist)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", c.metric, c.wordlist, err)
+			continue
+		}
+		if (m == nil && c.want != "") || (m != nil && m.String() != c.want) {
+			t.Errorf("%s %s: expected metric %q, got %v", c.metric, c.wordlist, c.want, m)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// OrderFiles are the names of the files which can give the order of
+// a book's pages, and optionally their printed labels, alongside its
+// images. The CSV form has a line for each image of its path and
+// label, like "plates/3.jpg,iv", and the JSON form is a list of
+// PageOrder. Paths are relative to the directory of images, with
+// forward slashes.
+var OrderFiles = []string{"order.csv", "order.json"}
+
+// PagesFile is the name of the file which records the original file
+// of each page uploaded by UploadImages, and its label
+const PagesFile = "pages.json"
+
+// PageOrder is an image in the order of a book's pages
+type PageOrder struct {
+	File  string `json:"file"`            // path relative to the book's directory
+	Label string `json:"label,omitempty"` // printed page label, e.g. "iv" or "12"
+}
+
+// UploadedPage records the original file a page was uploaded from
+type UploadedPage struct {
+	Original string `json:"original"`       // path relative to the book's directory
+	Page     int    `json:"page,omitempty"` // page of a multi-page TIFF, from 1
+	Uploaded string `json:"uploaded"`       // name of the uploaded image
+	Label    string `json:"label,omitempty"`
+}
+
+// digitPrefix returns the leading digits of a string
+func digitPrefix(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+// naturalLess returns whether a sorts before b, comparing runs of
+// digits by their numeric value, so that "page2.jpg" sorts before
+// "page10.jpg"
+func naturalLess(a, b string) bool {
+	origa, origb := a, b
+	for a != "" && b != "" {
+		da, db := digitPrefix(a), digitPrefix(b)
+		if da != "" && db != "" {
+			na, nb := strings.TrimLeft(da, "0"), strings.TrimLeft(db, "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		ra, sa := utf8.DecodeRuneInString(a)
+		rb, sb := utf8.DecodeRuneInString(b)
+		if ra != rb {
+			return ra < rb
+		}
+		a, b = a[sa:], b[sb:]
+	}
+	if a != "" || b != "" {
+		return a == ""
+	}
+	// only differ in leading zeros
+	return origa < origb
+}
+
+// pageSeq returns the sequence number UploadImages gave a page, from
+// the name of one of its files, like 12 for "page10_0012_bin0.2.hocr",
+// and whether it has one
+func pageSeq(name string) (int, bool) {
+	base := filepath.Base(name)
+	end := strings.Index(base, "_bin")
+	if end == -1 {
+		end = strings.Index(base, ".")
+	}
+	if end == -1 {
+		end = len(base)
+	}
+	start := end
+	for start > 0 && base[start-1] >= '0' && base[start-1] <= '9' {
+		start--
+	}
+	n, err := strconv.Atoi(base[start:end])
+	return n, err == nil
+}
+
+// sortPages sorts the files of a book's pages into the order they
+// were uploaded in, by their sequence numbers rather than their
+// names, which start with the name of the original image
+func sortPages(pgs []string) {
+	sort.SliceStable(pgs, func(i, j int) bool {
+		a, aok := pageSeq(pgs[i])
+		b, bok := pageSeq(pgs[j])
+		if aok && bok && a != b {
+			return a < b
+		}
+		if aok != bok {
+			return aok
+		}
+		return pgs[i] < pgs[j]
+	})
+}
+
+// readOrderFile reads the order file in a directory, if there is one
+func readOrderFile(dir string) ([]PageOrder, error) {
+	for _, name := range OrderFiles {
+		fn := filepath.Join(dir, name)
+		f, err := os.Open(fn)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open order file %s: %v", fn, err)
+		}
+		defer f.Close()
+
+		var order []PageOrder
+		if filepath.Ext(name) == ".json" {
+			err = json.NewDecoder(f).Decode(&order)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to decode order file %s: %v", fn, err)
+			}
+			return order, nil
+		}
+
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+		records, err := r.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read order file %s: %v", fn, err)
+		}
+		for i, rec := range records {
+			if len(rec) == 0 || rec[0] == "" || (i == 0 && strings.EqualFold(rec[0], "file")) {
+				continue
+			}
+			o := PageOrder{File: rec[0]}
+			if len(rec) > 1 {
+				o.Label = rec[1]
+			}
+			order = append(order, o)
+		}
+		return order, nil
+	}
+	return nil, nil
+}
+
+// writeOrderFile saves the order of the pages in a directory as
+// JSON, so that it is kept when the images are copied elsewhere
+func writeOrderFile(dir string, order []PageOrder) error {
+	return writeJSON(filepath.Join(dir, "order.json"), order)
+}
+
+// imageOrder returns the page images in a directory in the order
+// they are uploaded, and whether that came from an order file. If
+// there is an order file every image must be listed in it, so that
+// none are silently left out. Otherwise all images in the directory
+// and any subdirectories are used (except those which start with a
+// "."), sorted naturally by their path.
+func imageOrder(dir string) ([]PageOrder, bool, error) {
+	var found []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !isPageImage(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		found = append(found, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to read directory %s: %v", dir, err)
+	}
+
+	order, err := readOrderFile(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	if order == nil {
+		sort.SliceStable(found, func(i, j int) bool { return naturalLess(found[i], found[j]) })
+		for _, f := range found {
+			order = append(order, PageOrder{File: f})
+		}
+		return order, false, nil
+	}
+
+	exists := make(map[string]bool)
+	for _, f := range found {
+		exists[f] = true
+	}
+	listed := make(map[string]bool)
+	for i, o := range order {
+		o.File = strings.TrimPrefix(filepath.ToSlash(o.File), "./")
+		order[i] = o
+		if !exists[o.File] {
+			return nil, true, fmt.Errorf("Image %s in order file not found in %s", o.File, dir)
+		}
+		if listed[o.File] {
+			return nil, true, fmt.Errorf("Image %s is in order file more than once", o.File)
+		}
+		listed[o.File] = true
+	}
+	var unlisted []string
+	for _, f := range found {
+		if !listed[f] {
+			unlisted = append(unlisted, f)
+		}
+	}
+	if len(unlisted) > 0 {
+		return nil, true, fmt.Errorf("Images not in order file: %s", strings.Join(unlisted, ", "))
+	}
+	return order, true, nil
+}
@@ -0,0 +1,259 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+func Test_naturalLess(t *testing.T) {
+	names := []string{"page10.jpg", "page2.jpg", "Page3.jpg", "page02a.jpg", "page1.jpg", "vol2/page1.jpg", "vol10/page1.jpg", "vol2/page10.jpg", "page01.jpg"}
+	want := []string{"Page3.jpg", "page01.jpg", "page1.jpg", "page2.jpg", "page02a.jpg", "page10.jpg", "vol2/page1.jpg", "vol2/page10.jpg", "vol10/page1.jpg"}
+	sort.Slice(names, func(i, j int) bool { return naturalLess(names[i], names[j]) })
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, names)
+		}
+	}
+}
+
+// writeFiles creates files with the given contents in dir, making
+// any subdirectories needed
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for n, c := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(n))
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			t.Fatalf("Could not create directory: %v", err)
+		}
+		err = ioutil.WriteFile(fn, []byte(c), 0644)
+		if err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+	}
+}
+
+func Test_imageOrder(t *testing.T) {
+	images := map[string]string{
+		"page10.jpg":      "",
+		"page2.jpg":       "",
+		"plates/1.png":    "",
+		".hidden/3.jpg":   "",
+		"notes.txt":       "",
+		".DS_Store":       "",
+		"plates/.tmp.jpg": "",
+	}
+	cases := []struct {
+		name  string
+		order map[string]string
+		want  []PageOrder
+		err   string
+	}{
+		{"natural", nil, []PageOrder{{File: "page2.jpg"}, {File: "page10.jpg"}, {File: "plates/1.png"}}, ""},
+		{"csv", map[string]string{"order.csv": "file,label\nplates/1.png,frontispiece\npage2.jpg, 1\n./page10.jpg\n"},
+			[]PageOrder{{File: "plates/1.png", Label: "frontispiece"}, {File: "page2.jpg", Label: "1"}, {File: "page10.jpg"}}, ""},
+		{"json", map[string]string{"order.json": `[{"file": "page10.jpg", "label": "ii"}, {"file": "page2.jpg"}, {"file": "plates/1.png"}]`},
+			[]PageOrder{{File: "page10.jpg", Label: "ii"}, {File: "page2.jpg"}, {File: "plates/1.png"}}, ""},
+		{"missing", map[string]string{"order.csv": "page2.jpg\npage3.jpg\n"}, nil, "Image page3.jpg in order file not found"},
+		{"unlisted", map[string]string{"order.csv": "page2.jpg\npage10.jpg\n"}, nil, "Images not in order file: plates/1.png"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, images)
+			writeFiles(t, dir, c.order)
+
+			order, ordered, err := imageOrder(dir)
+			if c.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+					t.Fatalf("Expected error '%s', got '%v'", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error getting image order: %v", err)
+			}
+			if ordered != (c.order != nil) {
+				t.Errorf("Expected order file to be found %v, got %v", c.order != nil, ordered)
+			}
+			if len(order) != len(c.want) {
+				t.Fatalf("Expected %v, got %v", c.want, order)
+			}
+			for i := range c.want {
+				if order[i] != c.want[i] {
+					t.Fatalf("Expected %v, got %v", c.want, order)
+				}
+			}
+		})
+	}
+}
+
+func Test_UploadImagesPages(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := &bookpipeline.LocalConn{Logger: vlog}
+	err := conn.Init()
+	if err != nil {
+		t.Fatalf("Could not initialise local connection: %v", err)
+	}
+
+	good, err := ioutil.ReadFile("testdata/good/1.png")
+	if err != nil {
+		t.Fatalf("Could not read test image: %v", err)
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"page10.png":      string(good),
+		"page 2.png":      string(good),
+		"front/cover.png": string(good),
+		"order.csv":       "front/cover.png,cover\npage 2.png,1\npage10.png,2\n",
+	})
+
+	err = UploadImages(context.Background(), dir, "pagestest", conn)
+	if err != nil {
+		t.Fatalf("Error in UploadImages: %v\nLog: %s", err, slog.log)
+	}
+
+	fn := filepath.Join(t.TempDir(), PagesFile)
+	err = conn.Download(conn.WIPStorageId(), "pagestest/"+PagesFile, fn)
+	if err != nil {
+		t.Fatalf("Could not download pages list: %v", err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Could not read pages list: %v", err)
+	}
+	var pages []UploadedPage
+	err = json.Unmarshal(b, &pages)
+	if err != nil {
+		t.Fatalf("Could not parse pages list: %v", err)
+	}
+	want := []UploadedPage{
+		{Original: "front/cover.png", Uploaded: "cover_0000.png", Label: "cover"},
+		{Original: "page 2.png", Uploaded: "page_2_0001.png", Label: "1"},
+		{Original: "page10.png", Uploaded: "page10_0002.png", Label: "2"},
+	}
+	if len(pages) != len(want) {
+		t.Fatalf("Expected pages %v, got %v", want, pages)
+	}
+	for i := range want {
+		if pages[i] != want[i] {
+			t.Errorf("Expected pages %v, got %v", want, pages)
+		}
+	}
+}
+
+func Test_sortPages(t *testing.T) {
+	pgs := []string{
+		"/tmp/b/page10_0002_bin0.2.hocr",
+		"/tmp/b/page_2_0001_bin0.1.hocr",
+		"/tmp/b/0010_bin0.1.composite.hocr",
+		"/tmp/b/cover_0000_bin0.3.hocr",
+		"/tmp/b/unnumbered.hocr",
+		"/tmp/b/0009.hocr",
+	}
+	sortPages(pgs)
+	want := []string{
+		"/tmp/b/cover_0000_bin0.3.hocr",
+		"/tmp/b/page_2_0001_bin0.1.hocr",
+		"/tmp/b/page10_0002_bin0.2.hocr",
+		"/tmp/b/0009.hocr",
+		"/tmp/b/0010_bin0.1.composite.hocr",
+		"/tmp/b/unnumbered.hocr",
+	}
+	if !reflect.DeepEqual(pgs, want) {
+		t.Errorf("Expected %v, got %v", want, pgs)
+	}
+}
+
+func Test_AnalysePageOrder(t *testing.T) {
+	var slog StrLog
+	q := &fakeQueue{dir: t.TempDir(), logger: log.New(&slog, "", 0)}
+	bookname := "analyseordertest"
+	savedir := filepath.Join(os.TempDir(), bookname)
+	err := os.MkdirAll(savedir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory %s: %v", savedir, err)
+	}
+	defer os.RemoveAll(savedir)
+
+	good, err := ioutil.ReadFile("testdata/good/1.png")
+	if err != nil {
+		t.Fatalf("Could not read test image: %v", err)
+	}
+	// the names UploadImages gives the pages in the order of
+	// Test_UploadImagesPages, which sort differently by name
+	names := []string{"cover_0000", "page_2_0001", "page10_0002"}
+	files := map[string]string{PagesFile: `[{"original": "front/cover.png", "uploaded": "cover_0000.png", "label": "cover"},
+		{"original": "page 2.png", "uploaded": "page_2_0001.png", "label": "1"},
+		{"original": "page10.png", "uploaded": "page10_0002.png", "label": "2"}]`}
+	var hocrs []string
+	for _, n := range names {
+		files[n+"_bin0.2.png"] = string(good)
+		files[n+".png"] = string(good)
+		fn := filepath.Join(savedir, n+"_bin0.2.hocr")
+		err = ioutil.WriteFile(fn, []byte(fmt.Sprintf(iiifTestHocr, n, "page", "text")), 0644)
+		if err != nil {
+			t.Fatalf("Could not write hOCR: %v", err)
+		}
+		hocrs = append(hocrs, fn)
+	}
+	writeFiles(t, filepath.Join(q.dir, "wip", bookname), files)
+
+	toanalyse := make(chan string)
+	up := make(chan string)
+	errc := make(chan error, 1)
+	go Analyse(q, AnalyseOpts{})(context.Background(), toanalyse, up, errc, q.logger)
+	go func() {
+		// send the pages in the reverse of their order
+		for i := len(hocrs) - 1; i >= 0; i-- {
+			toanalyse <- hocrs[i]
+		}
+		close(toanalyse)
+	}()
+
+	done := false
+	for !done {
+		select {
+		case _, ok := <-up:
+			done = !ok
+		case err = <-errc:
+			t.Fatalf("Error in Analyse: %v\nLog: %s", err, slog.log)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(savedir, bookpipeline.ManifestFile))
+	if err != nil {
+		t.Fatalf("Could not read manifest: %v\nLog: %s", err, slog.log)
+	}
+	var m bookpipeline.Manifest
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		t.Fatalf("Could not parse manifest: %v", err)
+	}
+	var got []string
+	for _, pg := range m.Pages {
+		got = append(got, pg.Name+" "+pg.Label)
+	}
+	want := []string{"cover_0000 cover", "page_2_0001 1", "page10_0002 2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected pages %v in manifest, got %v", want, got)
+	}
+
+}
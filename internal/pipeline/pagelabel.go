@@ -0,0 +1,65 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// readUploadedLabels reads the labels given to pages when they were
+// uploaded from a PagesFile, returning them by the name of the page,
+// which is the name of its uploaded image without its extension
+func readUploadedLabels(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var pages []UploadedPage
+	err = json.NewDecoder(f).Decode(&pages)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode %s: %v", path, err)
+	}
+	labels := make(map[string]string)
+	for _, p := range pages {
+		if p.Label != "" {
+			labels[strings.TrimSuffix(p.Uploaded, filepath.Ext(p.Uploaded))] = p.Label
+		}
+	}
+	return labels, nil
+}
+
+// pageLabels sets the printed page label of each of the best hOCR
+// pages, pgs, whose contents are pages, returning them by the name
+// of each hOCR file. Labels given when the pages were uploaded are
+// used, and if detect is set those of any other pages are detected
+// from their running headers and footers.
+func pageLabels(pgs []string, pages []bookpipeline.HocrPage, uploaded map[string]string, detect bool) map[string]string {
+	var detected []string
+	if detect {
+		detected = bookpipeline.DetectPageLabels(pages)
+	}
+	labels := make(map[string]string)
+	for i, pg := range pgs {
+		base := filepath.Base(pg)
+		name := strings.SplitN(base, "_bin", 2)[0]
+		l := uploaded[name]
+		if l == "" && detected != nil {
+			l = detected[i]
+		}
+		if l == "" {
+			continue
+		}
+		pages[i].Label = l
+		labels[base] = l
+	}
+	return labels
+}
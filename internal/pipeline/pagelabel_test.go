@@ -0,0 +1,76 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// numberedPage returns a page with a line of body text, and a footer
+// of num if it isn't empty
+func numberedPage(num string) bookpipeline.HocrPage {
+	lines := []bookpipeline.HocrLine{
+		{Bbox: [4]int{100, 500, 900, 540}, Words: []bookpipeline.HocrWord{{Text: "Some"}, {Text: "body"}, {Text: "text"}}},
+	}
+	if num != "" {
+		lines = append(lines, bookpipeline.HocrLine{Bbox: [4]int{480, 1440, 520, 1470}, Words: []bookpipeline.HocrWord{{Text: num}}})
+	}
+	return bookpipeline.HocrPage{
+		Bbox:  [4]int{0, 0, 1000, 1500},
+		Areas: []bookpipeline.HocrArea{{Class: "ocr_carea", Pars: []bookpipeline.HocrPar{{Lines: lines}}}},
+	}
+}
+
+func Test_pageLabels(t *testing.T) {
+	nums := []string{"iii", "iv", "", "1", "2", "3"}
+	var pgs []string
+	for i := range nums {
+		pgs = append(pgs, fmt.Sprintf("/tmp/b/%04d_bin0.2.hocr", i+1))
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		PagesFile: `[{"original": "cover.jpg", "uploaded": "0001.jpg", "label": "cover"},
+			{"original": "2.jpg", "uploaded": "0002.jpg"},
+			{"original": "plate.tif", "page": 1, "uploaded": "0003.png", "label": "frontispiece"}]`,
+	})
+	uploaded, err := readUploadedLabels(filepath.Join(dir, PagesFile))
+	if err != nil {
+		t.Fatalf("Error reading uploaded labels: %v", err)
+	}
+	if len(uploaded) != 2 || uploaded["0001"] != "cover" || uploaded["0003"] != "frontispiece" {
+		t.Fatalf("Unexpected uploaded labels: %v", uploaded)
+	}
+
+	cases := []struct {
+		name   string
+		detect bool
+		want   []string
+	}{
+		{"uploaded", false, []string{"cover", "", "frontispiece", "", "", ""}},
+		{"detected", true, []string{"cover", "iv", "frontispiece", "1", "2", "3"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var pages []bookpipeline.HocrPage
+			for _, n := range nums {
+				pages = append(pages, numberedPage(n))
+			}
+			labels := pageLabels(pgs, pages, uploaded, c.detect)
+			for i, want := range c.want {
+				if pages[i].Label != want {
+					t.Errorf("Page %d: expected label '%s', got '%s'", i+1, want, pages[i].Label)
+				}
+				if labels[filepath.Base(pgs[i])] != want {
+					t.Errorf("Page %d: expected label '%s' for %s, got %v", i+1, want, pgs[i], labels)
+				}
+			}
+		})
+	}
+}
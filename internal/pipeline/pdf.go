@@ -0,0 +1,249 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+	"rescribe.xyz/pdf"
+)
+
+// pdfImage is an image XObject of a PDF page
+type pdfImage struct {
+	name          string
+	obj           pdf.Value
+	width, height int64
+}
+
+// pageImages returns the image XObjects of a PDF page
+func pageImages(pg pdf.Page) []pdfImage {
+	res := pg.Resources()
+	if res.Kind() != pdf.Dict {
+		return nil
+	}
+	xobj := res.Key("XObject")
+	if xobj.Kind() != pdf.Dict {
+		return nil
+	}
+	var imgs []pdfImage
+	for _, k := range xobj.Keys() {
+		obj := xobj.Key(k)
+		if obj.Kind() != pdf.Stream {
+			continue
+		}
+		if s := obj.Key("Subtype"); !s.IsNull() && s.Name() != "Image" {
+			continue
+		}
+		imgs = append(imgs, pdfImage{name: k, obj: obj, width: obj.Key("Width").Int64(), height: obj.Key("Height").Int64()})
+	}
+	return imgs
+}
+
+// sortBySize sorts images by the number of pixels, largest first,
+// as pages sometimes include small images such as logos, or the same
+// image several times at different resolutions, alongside the scan
+func sortBySize(imgs []pdfImage) {
+	sort.SliceStable(imgs, func(i, j int) bool {
+		return imgs[i].width*imgs[i].height > imgs[j].width*imgs[j].height
+	})
+}
+
+// pageRotation returns the clockwise rotation of a PDF page in
+// degrees, which may be inherited from its parents
+func pageRotation(pg pdf.Page) int {
+	for v := pg.V; !v.IsNull(); v = v.Key("Parent") {
+		if r := v.Key("Rotate"); !r.IsNull() {
+			return int(((r.Int64() % 360) + 360) % 360)
+		}
+	}
+	return 0
+}
+
+// saveImage saves an image extracted from a PDF in dir, named for
+// the page number, as a JPEG if it was one and otherwise as a PNG,
+// rotating it clockwise by rotate degrees. JPEGs which don't need
+// rotating are saved unchanged from their original bytes jpg.
+func saveImage(img image.Image, jpg []byte, dir string, pgnum int, rotate int) (string, error) {
+	ext := ".png"
+	if jpg != nil {
+		ext = ".jpg"
+	}
+	fn := filepath.Join(dir, fmt.Sprintf("%04d%s", pgnum, ext))
+
+	if jpg != nil && rotate == 0 {
+		err := ioutil.WriteFile(fn, jpg, 0644)
+		if err != nil {
+			return "", fmt.Errorf("Error writing file %s: %v", fn, err)
+		}
+		return fn, nil
+	}
+
+	if rotate != 0 {
+		img = bookpipeline.RotateImage(img, float64(rotate))
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return "", fmt.Errorf("Error creating file %s: %v", fn, err)
+	}
+	defer f.Close()
+	if ext == ".jpg" {
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(f, img)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to encode image %s: %v", fn, err)
+	}
+	return fn, f.Close()
+}
+
+// PdfReportFile is the name of the file the report of the images
+// extracted from a PDF is saved in alongside the book
+const PdfReportFile = "pdfreport.json"
+
+// PdfPageReport describes the image extracted from a page of a PDF,
+// and any images on it which couldn't be extracted and why
+type PdfPageReport struct {
+	Page     int      `json:"page"`
+	Image    string   `json:"image,omitempty"`    // file name, if one was extracted
+	Encoding string   `json:"encoding,omitempty"` // encoding of the extracted image, e.g. DCTDecode
+	Rotate   int      `json:"rotate,omitempty"`   // clockwise rotation applied
+	Skipped  []string `json:"skipped,omitempty"`  // problems with images which weren't extracted
+}
+
+// String describes what happened to a page, for warning users of
+// pages which no image could be extracted from
+func (r PdfPageReport) String() string {
+	s := fmt.Sprintf("page %d: ", r.Page)
+	if r.Image == "" {
+		s += "no image extracted"
+	} else {
+		s += fmt.Sprintf("extracted %s (%s)", r.Image, r.Encoding)
+	}
+	if len(r.Skipped) > 0 {
+		s += "; skipped " + strings.Join(r.Skipped, "; ")
+	}
+	return s
+}
+
+// extractPage extracts the largest image which can be decoded from
+// a page of a PDF into dir. Images which can't be decoded, including
+// those which make the pdf package panic, are skipped and noted in
+// the report, so that one bad image doesn't stop the whole book.
+func extractPage(pg pdf.Page, pgnum int, dir string) (rep PdfPageReport, err error) {
+	rep.Page = pgnum
+	defer func() {
+		if r := recover(); r != nil {
+			rep.Skipped = append(rep.Skipped, fmt.Sprintf("page could not be read: %v", r))
+		}
+	}()
+
+	if pg.V.IsNull() {
+		rep.Skipped = append(rep.Skipped, "page could not be read")
+		return rep, nil
+	}
+	imgs := pageImages(pg)
+	if len(imgs) == 0 {
+		rep.Skipped = append(rep.Skipped, "no raster images on page")
+		return rep, nil
+	}
+	sortBySize(imgs)
+
+	for _, i := range imgs {
+		img, encoding, jpg, err := decodePdfImage(i.obj)
+		if err != nil {
+			rep.Skipped = append(rep.Skipped, fmt.Sprintf("%s (%s, %dx%d): %v", i.name, encoding, i.width, i.height, err))
+			continue
+		}
+		rep.Rotate = pageRotation(pg)
+		fn, err := saveImage(img, jpg, dir, pgnum, rep.Rotate)
+		if err != nil {
+			return rep, err
+		}
+		rep.Image = filepath.Base(fn)
+		rep.Encoding = encoding
+		return rep, nil
+	}
+	return rep, nil
+}
+
+// ExtractPdfImages extracts the largest image which can be decoded
+// on each page of a PDF to a directory named for the book inside a
+// new temporary directory, rotated to match the page, and returns
+// the directory and a report of what was extracted from each page.
+// The parent of the returned directory should be removed once it is
+// no longer needed.
+func ExtractPdfImages(ctx context.Context, path string) (dir string, report []PdfPageReport, err error) {
+	defer func() {
+		// the pdf package panics on some malformed PDFs
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Error reading PDF: %v", r)
+		}
+	}()
+
+	p, err := pdf.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	bookname := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	tempdir, err := ioutil.TempDir("", "bookpipeline")
+	if err != nil {
+		return "", nil, fmt.Errorf("Error setting up temporary directory: %v", err)
+	}
+	dir = filepath.Join(tempdir, bookname)
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		_ = os.RemoveAll(tempdir)
+		return "", nil, fmt.Errorf("Error setting up temporary directory: %v", err)
+	}
+
+	for pgnum := 1; pgnum <= p.NumPage(); pgnum++ {
+		select {
+		case <-ctx.Done():
+			return dir, report, ctx.Err()
+		default:
+		}
+		rep, err := extractPage(p.Page(pgnum), pgnum, dir)
+		report = append(report, rep)
+		if err != nil {
+			return dir, report, err
+		}
+	}
+
+	return dir, report, nil
+}
+
+// UploadPdfReport saves the report of the images extracted from a
+// PDF alongside the book
+func UploadPdfReport(report []PdfPageReport, bookname string, conn Uploader) error {
+	dir, err := ioutil.TempDir("", "bookpipeline")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, PdfReportFile)
+	err = writeJSON(fn, report)
+	if err != nil {
+		return err
+	}
+	err = conn.Upload(conn.WIPStorageId(), bookname+"/"+PdfReportFile, fn)
+	if err != nil {
+		return fmt.Errorf("Failed to upload %s: %v", fn, err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_sortBySize(t *testing.T) {
+	imgs := []pdfImage{
+		{name: "logo", width: 100, height: 50},
+		{name: "scan", width: 2000, height: 3000},
+		{name: "thumb", width: 200, height: 300},
+	}
+	sortBySize(imgs)
+	want := []string{"scan", "thumb", "logo"}
+	for i := range want {
+		if imgs[i].name != want[i] {
+			t.Errorf("Expected image %d to be %s, got %s", i, want[i], imgs[i].name)
+		}
+	}
+}
+
+func Test_rawPdfImage(t *testing.T) {
+	cases := []struct {
+		name   string
+		b      []byte
+		w, h   int
+		bpc    int
+		cs     pdfColourSpace
+		invert bool
+		want   []color.RGBA
+	}{
+		{"gray1", []byte{0xa0}, 3, 1, 1, pdfColourSpace{n: 1}, false,
+			[]color.RGBA{{255, 255, 255, 255}, {0, 0, 0, 255}, {255, 255, 255, 255}}},
+		{"gray1inverted", []byte{0xa0}, 3, 1, 1, pdfColourSpace{n: 1}, true,
+			[]color.RGBA{{0, 0, 0, 255}, {255, 255, 255, 255}, {0, 0, 0, 255}}},
+		{"rgb8", []byte{255, 0, 0, 0, 0, 255}, 2, 1, 8, pdfColourSpace{n: 3}, false,
+			[]color.RGBA{{255, 0, 0, 255}, {0, 0, 255, 255}}},
+		{"indexed2", []byte{0x24}, 3, 1, 2, pdfColourSpace{n: 1, base: &pdfColourSpace{n: 3}, lookup: []byte{0, 0, 0, 10, 20, 30, 200, 100, 0}}, false,
+			[]color.RGBA{{0, 0, 0, 255}, {200, 100, 0, 255}, {10, 20, 30, 255}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			img, err := rawPdfImage(c.b, c.w, c.h, c.bpc, c.cs, c.invert)
+			if err != nil {
+				t.Fatalf("Error converting image: %v", err)
+			}
+			for x, want := range c.want {
+				got := color.RGBAModel.Convert(img.At(x, 0)).(color.RGBA)
+				if got != want {
+					t.Errorf("Pixel %d: expected %v, got %v", x, want, got)
+				}
+			}
+		})
+	}
+
+	_, err := rawPdfImage([]byte{0}, 10, 10, 8, pdfColourSpace{n: 1}, false)
+	if err == nil {
+		t.Errorf("Expected an error for too little image data")
+	}
+}
+
+func Test_saveImage(t *testing.T) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 30, 20)), nil)
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+	b := buf.Bytes()
+
+	cases := []struct {
+		rotate int
+		w, h   int
+	}{
+		{0, 30, 20},
+		{90, 20, 30},
+		{180, 30, 20},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		img, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Could not decode image: %v", err)
+		}
+		fn, err := saveImage(img, b, dir, 3, c.rotate)
+		if err != nil {
+			t.Fatalf("Error saving image rotated by %d: %v", c.rotate, err)
+		}
+		if fn != filepath.Join(dir, "0003.jpg") {
+			t.Errorf("Unexpected file name %s", fn)
+		}
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatalf("Could not open saved image: %v", err)
+		}
+		cfg, err := jpeg.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Could not decode saved image: %v", err)
+		}
+		if cfg.Width != c.w || cfg.Height != c.h {
+			t.Errorf("Image rotated by %d: expected %dx%d, got %dx%d", c.rotate, c.w, c.h, cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func Test_decodeCcitt(t *testing.T) {
+	// a Group 4 row of 2 white, 2 black and 4 white pixels
+	b := []byte{0x2f, 0xc0}
+	normal := []byte{255, 255, 0, 0, 255, 255, 255, 255}
+	inverted := []byte{0, 0, 255, 255, 0, 0, 0, 0}
+
+	cases := []struct {
+		name     string
+		blackIs1 bool
+		invert   bool
+		want     []byte
+	}{
+		{"default", false, false, normal},
+		{"decodeinverted", false, true, inverted},
+		{"blackis1", true, false, inverted},
+		{"blackis1decodeinverted", true, true, normal},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := ccittParms{group4: true, w: 8, h: 1, blackIs1: c.blackIs1}
+			img, err := decodeCcitt(b, p, c.invert)
+			if err != nil {
+				t.Fatalf("Error decoding image: %v", err)
+			}
+			if !bytes.Equal(img.Pix, c.want) {
+				t.Errorf("Expected pixels %v, got %v", c.want, img.Pix)
+			}
+		})
+	}
+}
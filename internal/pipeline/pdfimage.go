@@ -0,0 +1,395 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/image/ccitt"
+	"rescribe.xyz/pdf"
+)
+
+// jbig2Cmd is the command used to decode JBIG2 images, as there is
+// no Go decoder for them
+const jbig2Cmd = "jbig2dec"
+
+// imageFilters are the PDF filters which encode a whole image, rather
+// than just compressing its pixels, and which the pdf package leaves
+// for us to decode
+var imageFilters = map[string]bool{
+	"DCTDecode":      true,
+	"JPXDecode":      true,
+	"CCITTFaxDecode": true,
+	"JBIG2Decode":    true,
+}
+
+// streamFilters returns the names of the filters of a PDF stream,
+// in the order they are applied when decoding
+func streamFilters(v pdf.Value) []string {
+	f := v.Key("Filter")
+	switch f.Kind() {
+	case pdf.Name:
+		return []string{f.Name()}
+	case pdf.Array:
+		var names []string
+		for i := 0; i < f.Len(); i++ {
+			names = append(names, f.Index(i).Name())
+		}
+		return names
+	}
+	return nil
+}
+
+// lastDecodeParms returns the parameters of the last filter of a
+// PDF stream, which is the one an image is encoded with
+func lastDecodeParms(v pdf.Value) pdf.Value {
+	p := v.Key("DecodeParms")
+	if p.Kind() == pdf.Array && p.Len() > 0 {
+		return p.Index(p.Len() - 1)
+	}
+	return p
+}
+
+// readStream reads a PDF stream, with any compression filters the
+// pdf package supports removed. The pdf package panics on filters
+// it doesn't support, so that is turned into an error.
+func readStream(v pdf.Value) (b []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			b, err = nil, fmt.Errorf("Unsupported stream: %v", r)
+		}
+	}()
+	r := v.Reader()
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// decodeInverted returns whether an image's Decode array inverts
+// its samples, as is often done for bilevel images
+func decodeInverted(v pdf.Value) bool {
+	d := v.Key("Decode")
+	return d.Kind() == pdf.Array && d.Len() >= 2 && d.Index(0).Float64() > d.Index(1).Float64()
+}
+
+// invertGray inverts a greyscale image in place
+func invertGray(img *image.Gray) {
+	for i := range img.Pix {
+		img.Pix[i] = 255 - img.Pix[i]
+	}
+}
+
+// pdfColourSpace is a colour space of raw image samples
+type pdfColourSpace struct {
+	n      int             // components per pixel
+	cmyk   bool            // components are CMYK
+	base   *pdfColourSpace // base of an indexed colour space
+	lookup []byte          // colour table of an indexed colour space
+}
+
+// parseColourSpace parses the colour spaces which can be converted
+// to RGB without colour management
+func parseColourSpace(v pdf.Value) (pdfColourSpace, error) {
+	name := v.Name()
+	if v.Kind() == pdf.Array && v.Len() > 0 {
+		name = v.Index(0).Name()
+	}
+	switch name {
+	case "DeviceGray", "CalGray", "G":
+		return pdfColourSpace{n: 1}, nil
+	case "DeviceRGB", "CalRGB", "RGB":
+		return pdfColourSpace{n: 3}, nil
+	case "DeviceCMYK", "CMYK":
+		return pdfColourSpace{n: 4, cmyk: true}, nil
+	case "ICCBased":
+		if v.Kind() != pdf.Array || v.Len() < 2 {
+			break
+		}
+		n := int(v.Index(1).Key("N").Int64())
+		if n == 1 || n == 3 || n == 4 {
+			return pdfColourSpace{n: n, cmyk: n == 4}, nil
+		}
+	case "Indexed", "I":
+		if v.Kind() != pdf.Array || v.Len() < 4 {
+			break
+		}
+		base, err := parseColourSpace(v.Index(1))
+		if err != nil {
+			return base, err
+		}
+		if base.base != nil {
+			break
+		}
+		t := v.Index(3)
+		var lookup []byte
+		if t.Kind() == pdf.Stream {
+			lookup, err = readStream(t)
+			if err != nil {
+				return base, err
+			}
+		} else {
+			lookup = []byte(t.RawString())
+		}
+		return pdfColourSpace{n: 1, base: &base, lookup: lookup}, nil
+	}
+	return pdfColourSpace{}, fmt.Errorf("Unsupported colour space %s", name)
+}
+
+// colour converts 8 bit components of a colour space to a colour
+func (cs pdfColourSpace) colour(c []uint8) color.Color {
+	switch {
+	case cs.n == 1:
+		return color.Gray{c[0]}
+	case cs.cmyk:
+		return color.CMYK{c[0], c[1], c[2], c[3]}
+	default:
+		return color.RGBA{c[0], c[1], c[2], 255}
+	}
+}
+
+// rawPdfImage converts raw image samples, packed into rows of whole
+// bytes, into an image
+func rawPdfImage(b []byte, w int, h int, bpc int, cs pdfColourSpace, invert bool) (image.Image, error) {
+	if bpc != 1 && bpc != 2 && bpc != 4 && bpc != 8 && bpc != 16 {
+		return nil, fmt.Errorf("Unsupported bits per component %d", bpc)
+	}
+	stride := (w*cs.n*bpc + 7) / 8
+	if len(b) < stride*h {
+		return nil, fmt.Errorf("Image data too short, %d bytes for %dx%d", len(b), w, h)
+	}
+	maxval := (1 << bpc) - 1
+
+	sample := func(row []byte, i int) int {
+		switch bpc {
+		case 8:
+			return int(row[i])
+		case 16:
+			return int(row[i*2])<<8 | int(row[i*2+1])
+		}
+		bit := i * bpc
+		return int(row[bit/8]>>(8-bpc-bit%8)) & maxval
+	}
+	scale := func(s int) uint8 {
+		v := uint8(s * 255 / maxval)
+		if invert {
+			v = 255 - v
+		}
+		return v
+	}
+
+	var img image.Image
+	var set func(x, y int, c color.Color)
+	switch {
+	case cs.base != nil:
+		out := image.NewRGBA(image.Rect(0, 0, w, h))
+		img, set = out, out.Set
+	case cs.n == 1:
+		out := image.NewGray(image.Rect(0, 0, w, h))
+		img, set = out, out.Set
+	case cs.cmyk:
+		out := image.NewCMYK(image.Rect(0, 0, w, h))
+		img, set = out, out.Set
+	default:
+		out := image.NewRGBA(image.Rect(0, 0, w, h))
+		img, set = out, out.Set
+	}
+
+	c := make([]uint8, 4)
+	for y := 0; y < h; y++ {
+		row := b[y*stride : (y+1)*stride]
+		for x := 0; x < w; x++ {
+			if cs.base != nil {
+				i := sample(row, x) * cs.base.n
+				if i+cs.base.n > len(cs.lookup) {
+					return nil, fmt.Errorf("Colour index %d out of range", sample(row, x))
+				}
+				copy(c, cs.lookup[i:i+cs.base.n])
+				set(x, y, cs.base.colour(c))
+				continue
+			}
+			for i := 0; i < cs.n; i++ {
+				c[i] = scale(sample(row, x*cs.n+i))
+			}
+			set(x, y, cs.colour(c))
+		}
+	}
+	return img, nil
+}
+
+// decodeJbig2 decodes a JBIG2 image embedded in a PDF using
+// jbig2Cmd, with the shared globals segment if there is one
+func decodeJbig2(b []byte, globals []byte) (image.Image, error) {
+	err := findCmd(jbig2Cmd, "JBIG2")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "bookpipeline")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"-e", "-t", "png", "-o", filepath.Join(dir, "out.png")}
+	if len(globals) > 0 {
+		fn := filepath.Join(dir, "globals.jb2")
+		err = ioutil.WriteFile(fn, globals, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Error writing file %s: %v", fn, err)
+		}
+		args = append(args, fn)
+	}
+	fn := filepath.Join(dir, "page.jb2")
+	err = ioutil.WriteFile(fn, b, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error writing file %s: %v", fn, err)
+	}
+	args = append(args, fn)
+
+	cmd := exec.Command(jbig2Cmd, args...)
+	HideCmd(cmd)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding JBIG2 image with %s: %v\nStderr: %s", jbig2Cmd, err, stderr.String())
+	}
+
+	f, err := os.Open(filepath.Join(dir, "out.png"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open decoded image: %v", err)
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// ccittParms are the parameters of a CCITT fax encoded image
+type ccittParms struct {
+	group4   bool // Group 4 rather than Group 3 encoding
+	w, h     int
+	align    bool // rows start on byte boundaries
+	blackIs1 bool // 1 bits are black rather than white
+}
+
+// parseCcittParms reads the parameters of a CCITT fax encoded image
+// of width w and height h from its DecodeParms
+func parseCcittParms(parms pdf.Value, w int, h int) ccittParms {
+	p := ccittParms{
+		group4:   parms.Key("K").Int64() < 0,
+		w:        w,
+		h:        h,
+		align:    parms.Key("EncodedByteAlign").Bool(),
+		blackIs1: parms.Key("BlackIs1").Bool(),
+	}
+	if c := parms.Key("Columns"); !c.IsNull() {
+		p.w = int(c.Int64())
+	}
+	if r := parms.Key("Rows"); !r.IsNull() && r.Int64() > 0 {
+		p.h = int(r.Int64())
+	}
+	return p
+}
+
+// decodeCcitt decodes a CCITT fax encoded image, inverting it if
+// either BlackIs1 or its Decode array invert it, but not both
+func decodeCcitt(b []byte, p ccittParms, invert bool) (*image.Gray, error) {
+	sf := ccitt.Group3
+	if p.group4 {
+		sf = ccitt.Group4
+	}
+	img := image.NewGray(image.Rect(0, 0, p.w, p.h))
+	opts := &ccitt.Options{Align: p.align}
+	err := ccitt.DecodeIntoGray(img, bytes.NewReader(b), ccitt.MSB, sf, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding CCITT image: %v", err)
+	}
+	// the decoder shows black runs as black, but with BlackIs1 they
+	// are 1 bits, which are painted white unless Decode inverts them
+	if p.blackIs1 != invert {
+		invertGray(img)
+	}
+	return img, nil
+}
+
+// decodePdfImage decodes an image XObject, returning the image and
+// the name of its encoding. If it is a JPEG, its original bytes are
+// also returned, so that it can be saved without recompressing it.
+func decodePdfImage(obj pdf.Value) (image.Image, string, []byte, error) {
+	filters := streamFilters(obj)
+	encoding := "raw"
+	if len(filters) > 0 && imageFilters[filters[len(filters)-1]] {
+		encoding = filters[len(filters)-1]
+	}
+
+	b, err := readStream(obj)
+	if err != nil {
+		return nil, encoding, nil, err
+	}
+
+	w, h := int(obj.Key("Width").Int64()), int(obj.Key("Height").Int64())
+	invert := decodeInverted(obj)
+	parms := lastDecodeParms(obj)
+
+	switch encoding {
+	case "DCTDecode":
+		img, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, encoding, nil, fmt.Errorf("Error decoding JPEG image: %v", err)
+		}
+		return img, encoding, b, nil
+	case "JPXDecode":
+		dir, err := ioutil.TempDir("", "bookpipeline")
+		if err != nil {
+			return nil, encoding, nil, fmt.Errorf("Error creating temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		fn := filepath.Join(dir, "img.jp2")
+		err = ioutil.WriteFile(fn, b, 0644)
+		if err != nil {
+			return nil, encoding, nil, fmt.Errorf("Error writing file %s: %v", fn, err)
+		}
+		img, err := decodeJp2(fn)
+		return img, encoding, nil, err
+	case "JBIG2Decode":
+		var globals []byte
+		if g := parms.Key("JBIG2Globals"); g.Kind() == pdf.Stream {
+			globals, err = readStream(g)
+			if err != nil {
+				return nil, encoding, nil, err
+			}
+		}
+		img, err := decodeJbig2(b, globals)
+		return img, encoding, nil, err
+	case "CCITTFaxDecode":
+		img, err := decodeCcitt(b, parseCcittParms(parms, w, h), invert)
+		if err != nil {
+			return nil, encoding, nil, err
+		}
+		return img, encoding, nil, nil
+	}
+
+	if len(filters) > 0 {
+		encoding = filters[len(filters)-1]
+	}
+	bpc := int(obj.Key("BitsPerComponent").Int64())
+	var cs pdfColourSpace
+	if obj.Key("ImageMask").Bool() {
+		// stencil masks paint black where samples are 0
+		bpc, cs = 1, pdfColourSpace{n: 1}
+	} else {
+		cs, err = parseColourSpace(obj.Key("ColorSpace"))
+		if err != nil {
+			return nil, encoding, nil, err
+		}
+	}
+	img, err := rawPdfImage(b, w, h, bpc, cs, invert && cs.base == nil)
+	return img, encoding, nil, err
+}
@@ -13,6 +13,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"image"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/smtp"
@@ -20,12 +22,10 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strings"
 	"time"
 
 	"rescribe.xyz/bookpipeline"
-	"rescribe.xyz/preproc"
 	"rescribe.xyz/utils/pkg/hocr"
 )
 
@@ -110,6 +110,7 @@ type MinPipeliner interface {
 
 type pageimg struct {
 	hocr, img string
+	label     string // printed page label, if known
 }
 
 type mailSettings struct {
@@ -199,10 +200,13 @@ func up(ctx context.Context, c chan string, done chan bool, conn Uploader, bookn
 // upAndQueue reads file names from a channel and uploads them with
 // the bookname/ prefix, removing the local copy of each file
 // once it has been successfully uploaded. Each done file name is
-// added to the toQueue once it has been uploaded. The done channel
+// added to the toQueue once it has been uploaded, unless queueMatch
+// is set and it doesn't match, or an hOCR file for it has already
+// been uploaded, as for blank pages. The done channel
 // is then written to to signal completion. If an error occurs it
 // is sent to the errc channel and the function returns early.
-func upAndQueue(ctx context.Context, c chan string, done chan bool, toQueue string, conn UploadQueuer, bookname string, training string, errc chan error, logger *log.Logger) {
+func upAndQueue(ctx context.Context, c chan string, done chan bool, toQueue string, conn UploadQueuer, bookname string, training string, queueMatch *regexp.Regexp, errc chan error, logger *log.Logger) {
+	hocrs := make(map[string]bool)
 	for path := range c {
 		select {
 		case <-ctx.Done():
@@ -229,6 +233,18 @@ func upAndQueue(ctx context.Context, c chan string, done chan bool, toQueue stri
 			errc <- err
 			return
 		}
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		if ext == ".hocr" {
+			hocrs[base] = true
+		}
+		if queueMatch != nil && !queueMatch.MatchString(name) {
+			continue
+		}
+		if ext != ".hocr" && hocrs[base] {
+			logger.Println("Not queueing", key, "as it already has an hOCR file")
+			continue
+		}
 		logger.Println("Adding", key, training, "to queue", toQueue)
 		err = conn.AddToQueue(toQueue, key+" "+training)
 		if err != nil {
@@ -242,9 +258,42 @@ func upAndQueue(ctx context.Context, c chan string, done chan bool, toQueue stri
 	done <- true
 }
 
-func Preprocess(thresholds []float64, nowipe bool) func(context.Context, chan string, chan string, chan error, *log.Logger) {
+// PreprocessOpts are options for the Preprocess stage
+type PreprocessOpts struct {
+	// Thresholds to binarise each page with, in order of preference
+	Thresholds []float64
+	// NoWipe disables wiping of the binarised pages
+	NoWipe bool
+	// EarlyExit, if above 0, means only the first threshold is
+	// used, and the others are only tried in order by OcrPage while
+	// a page's confidence is below EarlyExit
+	EarlyExit float64
+	// Deskew corrects the orientation and skew of each page before
+	// it is binarised, uploading the corrected image alongside the
+	// original and recording the angles in AnglesFile
+	Deskew bool
+	// TessCmd is the Tesseract command used to detect orientation,
+	// or "tesseract" if empty
+	TessCmd string
+	// SkipBlank detects blank pages, which are not OCRed but given
+	// an empty hOCR file and listed in BlankFile, so that they are
+	// still included as image-only pages in all outputs
+	SkipBlank bool
+}
+
+// Preprocess binarises, and optionally wipes, each page, using the
+// preprocessing profile chosen for the book
+func Preprocess(conn Downloader, opts PreprocessOpts) func(context.Context, chan string, chan string, chan error, *log.Logger) {
 	return func(ctx context.Context, pre chan string, up chan string, errc chan error, logger *log.Logger) {
+		savedir := ""
+		var profile PreprocProfile
+		var angles strings.Builder
+		var blanks strings.Builder
 		for path := range pre {
+			if savedir == "" {
+				savedir = filepath.Dir(path)
+				profile = bookProfile(conn, savedir, logger)
+			}
 			select {
 			case <-ctx.Done():
 				for range pre {
@@ -253,47 +302,152 @@ func Preprocess(thresholds []float64, nowipe bool) func(context.Context, chan st
 				return
 			default:
 			}
+			corrected := false
+			if opts.Deskew {
+				logger.Println("Correcting orientation and skew of", path)
+				rotate, skew, err := deskew(opts.TessCmd, path, logger)
+				if err != nil {
+					for range pre {
+					} // consume the rest of the receiving channel so it isn't blocked
+					errc <- err
+					return
+				}
+				fmt.Fprintf(&angles, "%s\t%d\t%.2f\n", filepath.Base(path), rotate, skew)
+				corrected = rotate != 0 || skew != 0
+			}
 			logger.Println("Preprocessing", path)
-			done, err := preproc.PreProcMulti(path, thresholds, "binary", 0, !nowipe, 5, 30, 120, 30)
+			ts := opts.Thresholds
+			if opts.EarlyExit > 0 && len(ts) > 0 {
+				ts = ts[:1]
+			}
+			done, err := preProcMulti(path, ts, !opts.NoWipe, profile)
 			if err != nil {
 				for range pre {
 				} // consume the rest of the receiving channel so it isn't blocked
 				errc <- err
 				return
 			}
-			_ = os.Remove(path)
+			if corrected {
+				// upload the corrected image alongside the original,
+				// which is left untouched, so that colour outputs
+				// match the OCR
+				fn := deskewedName(path)
+				err = os.Rename(path, fn)
+				if err != nil {
+					for range pre {
+					} // consume the rest of the receiving channel so it isn't blocked
+					errc <- fmt.Errorf("Error renaming %s: %v", path, err)
+					return
+				}
+				up <- fn
+			} else {
+				_ = os.Remove(path)
+			}
+			if opts.SkipBlank && len(done) > 0 {
+				blank, err := isBlankFile(done[0])
+				if err != nil {
+					for range pre {
+					} // consume the rest of the receiving channel so it isn't blocked
+					errc <- err
+					return
+				}
+				if blank {
+					logger.Println("Page is blank, so not OCRing it:", path)
+					hocr, err := writeBlankHocr(done[0])
+					if err != nil {
+						for range pre {
+						} // consume the rest of the receiving channel so it isn't blocked
+						errc <- err
+						return
+					}
+					// the hOCR is uploaded first so that the page
+					// image isn't queued for OCR
+					up <- hocr
+					for _, p := range done[1:] {
+						_ = os.Remove(p)
+					}
+					done = done[:1]
+					fmt.Fprintf(&blanks, "%s\n", filepath.Base(hocr))
+				}
+			}
 			for _, p := range done {
 				up <- p
 			}
 		}
+		if savedir != "" {
+			fn := filepath.Join(savedir, PreprocSettingsFile)
+			err := writeJSON(fn, PreprocSettings{Thresholds: opts.Thresholds, Wipe: !opts.NoWipe, EarlyExit: opts.EarlyExit, Profile: profile})
+			if err != nil {
+				errc <- err
+				return
+			}
+			up <- fn
+		}
+		if opts.Deskew && savedir != "" {
+			fn := filepath.Join(savedir, AnglesFile)
+			err := ioutil.WriteFile(fn, []byte(angles.String()), 0644)
+			if err != nil {
+				errc <- fmt.Errorf("Error writing file %s: %v", fn, err)
+				return
+			}
+			up <- fn
+		}
+		if opts.SkipBlank && savedir != "" {
+			fn := filepath.Join(savedir, BlankFile)
+			err := ioutil.WriteFile(fn, []byte(blanks.String()), 0644)
+			if err != nil {
+				errc <- fmt.Errorf("Error writing file %s: %v", fn, err)
+				return
+			}
+			up <- fn
+		}
 		close(up)
 	}
 }
 
-func Wipe(ctx context.Context, towipe chan string, up chan string, errc chan error, logger *log.Logger) {
-	for path := range towipe {
-		select {
-		case <-ctx.Done():
-			for range towipe {
-			} // consume the rest of the receiving channel so it isn't blocked
-			errc <- ctx.Err()
-			return
-		default:
+// Wipe wipes each already binarised page, using the preprocessing
+// profile chosen for the book
+func Wipe(conn Downloader) func(context.Context, chan string, chan string, chan error, *log.Logger) {
+	return func(ctx context.Context, towipe chan string, up chan string, errc chan error, logger *log.Logger) {
+		savedir := ""
+		var profile PreprocProfile
+		for path := range towipe {
+			if savedir == "" {
+				savedir = filepath.Dir(path)
+				profile = bookProfile(conn, savedir, logger)
+			}
+			select {
+			case <-ctx.Done():
+				for range towipe {
+				} // consume the rest of the receiving channel so it isn't blocked
+				errc <- ctx.Err()
+				return
+			default:
+			}
+			logger.Println("Wiping", path)
+			s := strings.Split(path, ".")
+			base := strings.Join(s[:len(s)-1], "")
+			outpath := base + "_bin0.0.png"
+			err := wipeFile(path, outpath, profile)
+			if err != nil {
+				for range towipe {
+				} // consume the rest of the receiving channel so it isn't blocked
+				errc <- err
+				return
+			}
+			up <- outpath
 		}
-		logger.Println("Wiping", path)
-		s := strings.Split(path, ".")
-		base := strings.Join(s[:len(s)-1], "")
-		outpath := base + "_bin0.0.png"
-		err := preproc.WipeFile(path, outpath, 5, 0.03, 30, 120, 0.005, 30)
-		if err != nil {
-			for range towipe {
-			} // consume the rest of the receiving channel so it isn't blocked
-			errc <- err
-			return
+		if savedir != "" {
+			fn := filepath.Join(savedir, PreprocSettingsFile)
+			err := writeJSON(fn, PreprocSettings{Wipe: true, Profile: profile})
+			if err != nil {
+				errc <- err
+				return
+			}
+			up <- fn
 		}
-		up <- outpath
+		close(up)
 	}
-	close(up)
 }
 
 func Ocr(training string, tesscmd string) func(context.Context, chan string, chan string, chan error, *log.Logger) {
@@ -330,10 +484,68 @@ func Ocr(training string, tesscmd string) func(context.Context, chan string, cha
 	}
 }
 
-func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string, chan string, chan error, *log.Logger) {
+// AnalyseOpts are the settings for optional outputs of Analyse
+type AnalyseOpts struct {
+	// FullPdf creates an extra PDF with full size colour images
+	FullPdf bool
+	// Epub creates an EPUB ebook from the best hOCR of each page
+	Epub bool
+	// EpubImgCutoff is the confidence below which a page is
+	// included in the EPUB as an image rather than as text
+	EpubImgCutoff float64
+	// BookHocr creates a single hOCR file for the whole book from
+	// the best hOCR of each page, and a JSON-lines file of its words
+	BookHocr bool
+	// CleanMinConf is the average confidence below which a page is
+	// left out of the clean text file
+	CleanMinConf float64
+	// LineLevel creates a composite hOCR for each page from the
+	// best version of each line in any threshold variant, which is
+	// then used as the best version of the page
+	LineLevel bool
+	// Adaptive preprocesses extra threshold variants of any page
+	// whose best variant is at the edge of the thresholds tried,
+	// sending them to be OCRed, in which case the book will be
+	// analysed again once they are done rather than any outputs
+	// being created now
+	Adaptive bool
+	// Metric is used to score each variant of a page to choose the
+	// best one, rather than the average word confidence, if set
+	Metric bookpipeline.PageMetric
+	// Illustrations crops the image regions found on each page from
+	// its colour original, listing them in IllustrationsFile
+	Illustrations bool
+	// DetectLabels finds the printed page number of each page from
+	// its running headers and footers, to label it with in outputs,
+	// for pages which weren't given a label when they were uploaded
+	DetectLabels bool
+	// IIIFBase is the address books' files will be published at,
+	// each in a directory named after the book, which if set
+	// creates a IIIF manifest of the book using it
+	IIIFBase string
+	// IIIFSearch is the address of a IIIF Content Search service,
+	// such as the iiifsearch command, which the IIIF manifest links
+	// to for searching the book
+	IIIFSearch string
+}
+
+// binPattern matches a binarised page image
+var binPattern = regexp.MustCompile(`_bin[0-9]\.[0-9]+\.png$`)
+
+// variantPattern matches the hOCR of a single threshold variant of
+// a page, as opposed to composite pages or whole book hOCR files
+var variantPattern = regexp.MustCompile(`_bin[0-9]\.[0-9]+\.hocr$`)
+
+// compositeSuffix is added to the name of the best variant of a
+// page to name the composite hOCR created from it, so that the
+// variant's binarised image can be found by removing it
+const compositeSuffix = ".composite"
+
+func Analyse(conn Downloader, opts AnalyseOpts) func(context.Context, chan string, chan string, chan error, *log.Logger) {
 	return func(ctx context.Context, toanalyse chan string, up chan string, errc chan error, logger *log.Logger) {
 		confs := make(map[string][]*bookpipeline.Conf)
 		bestconfs := make(map[string]*bookpipeline.Conf)
+		var empty []string
 		savedir := ""
 
 		for path := range toanalyse {
@@ -348,9 +560,14 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			if savedir == "" {
 				savedir = filepath.Dir(path)
 			}
+			if !variantPattern.MatchString(path) {
+				logger.Println("Skipping hOCR which isn't a page variant", path)
+				continue
+			}
 			logger.Println("Calculating confidence for", path)
 			avg, err := hocr.GetAvgConf(path)
 			if err != nil && err.Error() == "No words found" {
+				empty = append(empty, path)
 				continue
 			}
 			if err != nil {
@@ -366,9 +583,36 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			c.Path = path
 			c.Code = base[codestart:]
 			c.Conf = avg
+			c.Score = avg
 			confs[name] = append(confs[name], &c)
 		}
 
+		if opts.Metric != nil {
+			logger.Println("Scoring pages with metric", opts.Metric)
+			for _, conf := range confs {
+				err := scoreVariants(conf, opts.Metric)
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+		}
+
+		if opts.Adaptive {
+			done, err := mkExtraVariants(ctx, conn, savedir, confs, empty, logger)
+			if err != nil {
+				errc <- err
+				return
+			}
+			if len(done) > 0 {
+				for _, fn := range done {
+					up <- fn
+				}
+				close(up)
+				return
+			}
+		}
+
 		fn := filepath.Join(savedir, "conf")
 		logger.Println("Saving confidences in file", fn)
 		f, err := os.Create(fn)
@@ -385,15 +629,47 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 		default:
 		}
 
+		if opts.Metric != nil {
+			_, err = fmt.Fprintf(f, "# metric %s\n", opts.Metric)
+			if err != nil {
+				errc <- fmt.Errorf("Error writing confidences file: %s", err)
+				return
+			}
+		}
+
 		logger.Println("Finding best confidence for each page, and saving all confidences")
 		for base, conf := range confs {
 			var best float64
 			for _, c := range conf {
-				if c.Conf > best {
-					best = c.Conf
+				if bestconfs[base] == nil || c.Score > best {
+					best = c.Score
 					bestconfs[base] = c
 				}
-				_, err = fmt.Fprintf(f, "%s\t%02.f\n", c.Path, c.Conf)
+				err = writeConf(f, c, opts.Metric != nil)
+				if err != nil {
+					errc <- fmt.Errorf("Error writing confidences file: %s", err)
+					return
+				}
+			}
+		}
+
+		// composites are only uploaded at the end, as up removes the
+		// local copy which is needed to create the other outputs
+		var composites []string
+		if opts.LineLevel {
+			logger.Println("Creating composite pages from the best lines of each variant")
+			for base, conf := range confs {
+				if len(conf) < 2 {
+					continue
+				}
+				c, err := mkComposite(conf, bestconfs[base], opts.Metric)
+				if err != nil {
+					errc <- err
+					return
+				}
+				bestconfs[base] = c
+				composites = append(composites, c.Path)
+				err = writeConf(f, c, opts.Metric != nil)
 				if err != nil {
 					errc <- fmt.Errorf("Error writing confidences file: %s", err)
 					return
@@ -403,6 +679,14 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 		f.Close()
 		up <- fn
 
+		// pages with no words in any variant, such as blank pages,
+		// are still included in outputs as images
+		imageonly := imageOnlyPages(empty, confs)
+		for name, c := range imageonly {
+			logger.Println("No words found in", name, "so including it as an image only")
+			bestconfs[name] = c
+		}
+
 		select {
 		case <-ctx.Done():
 			errc <- ctx.Err()
@@ -428,7 +712,7 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 		for _, conf := range bestconfs {
 			pgs = append(pgs, conf.Path)
 		}
-		sort.Strings(pgs)
+		sortPages(pgs)
 
 		select {
 		case <-ctx.Done():
@@ -443,18 +727,68 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			errc <- fmt.Errorf("Failed to do filepath.Rel of %s to %s: %s", os.TempDir(), savedir, err)
 			return
 		}
+		logger.Println("Reading best hOCR of each page")
+		pages, err := readHocrPages(pgs)
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		var uploaded map[string]string
+		err = conn.Download(conn.WIPStorageId(), bookname+"/"+PagesFile, filepath.Join(savedir, PagesFile))
+		if err == nil {
+			uploaded, err = readUploadedLabels(filepath.Join(savedir, PagesFile))
+			_ = os.Remove(filepath.Join(savedir, PagesFile))
+		}
+		if err != nil {
+			logger.Println("No list of uploaded pages found, so no page labels were given:", err)
+		}
+		labels := pageLabels(pgs, pages, uploaded, opts.DetectLabels)
+		for _, c := range bestconfs {
+			c.Label = labels[filepath.Base(c.Path)]
+		}
+
+		meta, err := downloadMetadata(conn, savedir, bookname)
+		if err != nil {
+			logger.Println("No metadata found for the book:", err)
+		}
+
+		logger.Println("Creating manifest")
+		var blanks map[string]bool
+		err = conn.Download(conn.WIPStorageId(), bookname+"/"+BlankFile, filepath.Join(savedir, BlankFile))
+		if err == nil {
+			blanks, err = readBlanks(filepath.Join(savedir, BlankFile))
+			_ = os.Remove(filepath.Join(savedir, BlankFile))
+		}
+		if err != nil {
+			logger.Println("No list of blank pages found, so assuming there are none:", err)
+		}
+		fn = filepath.Join(savedir, bookpipeline.ManifestFile)
+		manifest := mkManifest(bookname, pgs, bestconfs, imageonly, blanks, labels)
+		if !meta.Empty() {
+			manifest.Metadata = &meta
+		}
+		err = writeJSON(fn, manifest)
+		if err != nil {
+			errc <- err
+			return
+		}
+		up <- fn
+
 		colourpdf := new(bookpipeline.Fpdf)
 		err = colourpdf.Setup()
 		if err != nil {
 			errc <- fmt.Errorf("Failed to set up PDF: %s", err)
 			return
 		}
+		colourpdf.SetMetadata(meta)
 		binarisedpdf := new(bookpipeline.Fpdf)
 		err = binarisedpdf.Setup()
 		if err != nil {
 			errc <- fmt.Errorf("Failed to set up PDF: %s", err)
 			return
 		}
+		binarisedpdf.SetMetadata(meta)
 		binhascontent, colourhascontent := false, false
 
 		select {
@@ -478,8 +812,8 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 				fn = nosuffix + ".jpg"
 			}
 
-			binimgs = append(binimgs, pageimg{hocr: base, img: nosuffix + ".png"})
-			colourimgs = append(colourimgs, pageimg{hocr: base, img: fn})
+			binimgs = append(binimgs, pageimg{hocr: base, img: strings.TrimSuffix(nosuffix, compositeSuffix) + ".png", label: labels[base]})
+			colourimgs = append(colourimgs, pageimg{hocr: base, img: fn, label: labels[base]})
 		}
 
 		for _, pg := range binimgs {
@@ -495,7 +829,7 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			if err != nil {
 				logger.Println("Download failed; skipping page", pg.img)
 			} else {
-				err = binarisedpdf.AddPage(filepath.Join(savedir, pg.img), filepath.Join(savedir, pg.hocr), true)
+				err = binarisedpdf.AddLabelledPage(filepath.Join(savedir, pg.img), filepath.Join(savedir, pg.hocr), true, pg.label)
 				if err != nil {
 					errc <- fmt.Errorf("Failed to add page %s to PDF: %s", pg.img, err)
 					return
@@ -526,6 +860,10 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			up <- fn
 		}
 
+		// colourfns are the colour images found for each page, and
+		// coloursizes their sizes
+		colourfns := make(map[string]string)
+		coloursizes := make(map[string]image.Point)
 		for _, pg := range colourimgs {
 			select {
 			case <-ctx.Done():
@@ -535,28 +873,27 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			}
 
 			logger.Println("Downloading colour page to add to PDF", pg.img)
-			colourfn := pg.img
-			err = conn.Download(conn.WIPStorageId(), bookname+"/"+colourfn, filepath.Join(savedir, colourfn))
+			colourpath, err := downloadColour(conn, savedir, bookname, pg.img)
 			if err != nil {
-				colourfn = strings.Replace(pg.img, ".jpg", ".png", 1)
-				logger.Println("Download failed; trying", colourfn)
-				err = conn.Download(conn.WIPStorageId(), bookname+"/"+colourfn, filepath.Join(savedir, colourfn))
-				if err != nil {
-					logger.Println("Download failed; skipping page", pg.img)
-				}
+				logger.Println("Download failed; skipping page", pg.img)
+				continue
 			}
-			if err == nil {
-				err = colourpdf.AddPage(filepath.Join(savedir, colourfn), filepath.Join(savedir, pg.hocr), true)
-				if err != nil {
-					errc <- fmt.Errorf("Failed to add page %s to PDF: %s", pg.img, err)
-					return
-				}
-				colourhascontent = true
-				err = os.Remove(filepath.Join(savedir, colourfn))
-				if err != nil {
-					errc <- err
-					return
-				}
+			err = colourpdf.AddLabelledPage(colourpath, filepath.Join(savedir, pg.hocr), true, pg.label)
+			if err != nil {
+				errc <- fmt.Errorf("Failed to add page %s to PDF: %s", pg.img, err)
+				return
+			}
+			colourhascontent = true
+			colourfns[pg.hocr] = filepath.Base(colourpath)
+			coloursizes[pg.hocr], err = imageSize(colourpath)
+			if err != nil {
+				errc <- err
+				return
+			}
+			err = os.Remove(colourpath)
+			if err != nil {
+				errc <- err
+				return
 			}
 		}
 
@@ -577,13 +914,14 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			up <- fn
 		}
 
-		if mkfullpdf {
+		if opts.FullPdf {
 			fullsizepdf := new(bookpipeline.Fpdf)
 			err = fullsizepdf.Setup()
 			if err != nil {
 				errc <- fmt.Errorf("Failed to set up PDF: %s", err)
 				return
 			}
+			fullsizepdf.SetMetadata(meta)
 			for _, pg := range colourimgs {
 				select {
 				case <-ctx.Done():
@@ -593,27 +931,20 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 				}
 
 				logger.Println("Downloading colour page to add to PDF", pg.img)
-				colourfn := pg.img
-				err = conn.Download(conn.WIPStorageId(), bookname+"/"+colourfn, filepath.Join(savedir, colourfn))
+				colourpath, err := downloadColour(conn, savedir, bookname, pg.img)
 				if err != nil {
-					colourfn = strings.Replace(pg.img, ".jpg", ".png", 1)
-					logger.Println("Download failed; trying", colourfn)
-					err = conn.Download(conn.WIPStorageId(), bookname+"/"+colourfn, filepath.Join(savedir, colourfn))
-					if err != nil {
-						logger.Println("Download failed; skipping page", pg.img)
-					}
+					logger.Println("Download failed; skipping page", pg.img)
+					continue
 				}
-				if err == nil {
-					err = fullsizepdf.AddPage(filepath.Join(savedir, colourfn), filepath.Join(savedir, pg.hocr), false)
-					if err != nil {
-						errc <- fmt.Errorf("Failed to add page %s to PDF: %s", pg.img, err)
-						return
-					}
-					err = os.Remove(filepath.Join(savedir, colourfn))
-					if err != nil {
-						errc <- err
-						return
-					}
+				err = fullsizepdf.AddLabelledPage(colourpath, filepath.Join(savedir, pg.hocr), false, pg.label)
+				if err != nil {
+					errc <- fmt.Errorf("Failed to add page %s to PDF: %s", pg.img, err)
+					return
+				}
+				err = os.Remove(colourpath)
+				if err != nil {
+					errc <- err
+					return
 				}
 			}
 
@@ -642,6 +973,73 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 		default:
 		}
 
+		if opts.Epub {
+			logger.Println("Creating EPUB")
+			fn, err = mkEpub(ctx, conn, savedir, bookname, meta, colourimgs, bestconfs, opts.EpubImgCutoff, logger)
+			if err != nil {
+				errc <- err
+				return
+			}
+			up <- fn
+		}
+
+		select {
+		case <-ctx.Done():
+			errc <- ctx.Err()
+			return
+		default:
+		}
+
+		if opts.BookHocr {
+			logger.Println("Creating book hOCR and words files")
+			fns, err := mkBookHocr(savedir, bookname, meta, pages)
+			if err != nil {
+				errc <- err
+				return
+			}
+			for _, fn := range fns {
+				up <- fn
+			}
+		}
+
+		if opts.IIIFBase != "" {
+			logger.Println("Creating IIIF manifest")
+			fn, err = mkIIIF(savedir, bookname, meta, pages, binimgs, colourfns, coloursizes, opts)
+			if err != nil {
+				errc <- err
+				return
+			}
+			up <- fn
+		}
+
+		if opts.Illustrations {
+			logger.Println("Extracting illustrations")
+			fns, err := mkIllustrations(ctx, conn, savedir, bookname, colourimgs, pages, logger)
+			if err != nil {
+				errc <- err
+				return
+			}
+			for _, fn := range fns {
+				up <- fn
+			}
+		}
+
+		logger.Println("Creating clean text")
+		fn = filepath.Join(savedir, bookname+".clean.txt")
+		err = ioutil.WriteFile(fn, []byte(bookpipeline.CleanText(pages, opts.CleanMinConf)), 0644)
+		if err != nil {
+			errc <- fmt.Errorf("Error creating file %s: %s", fn, err)
+			return
+		}
+		up <- fn
+
+		select {
+		case <-ctx.Done():
+			errc <- ctx.Err()
+			return
+		default:
+		}
+
 		logger.Println("Creating graph")
 		fn = filepath.Join(savedir, "graph.png")
 		f, err = os.Create(fn)
@@ -650,7 +1048,13 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			return
 		}
 		defer f.Close()
-		err = bookpipeline.Graph(bestconfs, filepath.Base(savedir), f)
+		graphconfs := make(map[string]*bookpipeline.Conf)
+		for name, c := range bestconfs {
+			if imageonly[name] == nil {
+				graphconfs[name] = c
+			}
+		}
+		err = bookpipeline.Graph(graphconfs, filepath.Base(savedir), f)
 		if err != nil {
 			_ = os.Remove(fn)
 		}
@@ -670,10 +1074,279 @@ func Analyse(conn Downloader, mkfullpdf bool) func(context.Context, chan string,
 			up <- fn
 		}
 
+		for _, c := range composites {
+			// copy the binarised image of the variant the composite is
+			// based on, so it can be found in the same way as for
+			// other pages
+			nosuffix := strings.TrimSuffix(filepath.Base(c), ".hocr")
+			img := strings.TrimSuffix(nosuffix, compositeSuffix) + ".png"
+			imgfn := filepath.Join(savedir, nosuffix+".png")
+			err = conn.Download(conn.WIPStorageId(), bookname+"/"+img, imgfn)
+			if err != nil {
+				errc <- fmt.Errorf("Failed to download %s to copy for composite page: %s", img, err)
+				return
+			}
+			up <- imgfn
+			up <- c
+		}
+
 		close(up)
 	}
 }
 
+// downloadColour downloads the colour image for a page, trying
+// a .png if the .jpg isn't found, and returns the local path. The
+// copy corrected by deskew is used in preference to the original.
+func downloadColour(conn Downloader, savedir string, bookname string, img string) (string, error) {
+	png := strings.Replace(img, ".jpg", ".png", 1)
+	var err error
+	for _, colourfn := range []string{deskewedName(img), img, deskewedName(png), png} {
+		fn := filepath.Join(savedir, colourfn)
+		err = conn.Download(conn.WIPStorageId(), bookname+"/"+colourfn, fn)
+		if err == nil {
+			return fn, nil
+		}
+		_ = os.Remove(fn)
+	}
+	return filepath.Join(savedir, png), err
+}
+
+// mkEpub creates an EPUB from the best hOCR of each page, in order,
+// using the colour image in place of the text for any page with
+// a confidence below imgcutoff. The path of the EPUB is returned.
+func mkEpub(ctx context.Context, conn Downloader, savedir string, bookname string, meta bookpipeline.Metadata, pgs []pageimg, bestconfs map[string]*bookpipeline.Conf, imgcutoff float64, logger *log.Logger) (string, error) {
+	confs := make(map[string]float64)
+	for _, c := range bestconfs {
+		confs[filepath.Base(c.Path)] = c.Conf
+	}
+
+	epub := new(bookpipeline.Epub)
+	err := epub.Setup(bookname, "")
+	if err != nil {
+		return "", fmt.Errorf("Failed to set up EPUB: %s", err)
+	}
+	epub.SetMetadata(meta)
+
+	for _, pg := range pgs {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		default:
+		}
+
+		if confs[pg.hocr] >= imgcutoff {
+			err = epub.AddLabelledPage("", filepath.Join(savedir, pg.hocr), false, pg.label)
+			if err != nil {
+				return "", fmt.Errorf("Failed to add page %s to EPUB: %s", pg.hocr, err)
+			}
+			continue
+		}
+
+		logger.Println("Downloading colour page to add to EPUB as an image", pg.img)
+		imgpath, err := downloadColour(conn, savedir, bookname, pg.img)
+		if err != nil {
+			logger.Println("Download failed; adding text instead", pg.img)
+			err = epub.AddLabelledPage("", filepath.Join(savedir, pg.hocr), false, pg.label)
+		} else {
+			err = epub.AddLabelledPage(imgpath, filepath.Join(savedir, pg.hocr), true, pg.label)
+			_ = os.Remove(imgpath)
+		}
+		if err != nil {
+			return "", fmt.Errorf("Failed to add page %s to EPUB: %s", pg.hocr, err)
+		}
+	}
+
+	fn := filepath.Join(savedir, bookname+".epub")
+	err = epub.Save(fn)
+	if err != nil {
+		return "", fmt.Errorf("Failed to save EPUB: %s", err)
+	}
+	return fn, nil
+}
+
+// scoreVariants sets the score of each variant of a page using
+// metric
+func scoreVariants(variants []*bookpipeline.Conf, metric bookpipeline.PageMetric) error {
+	var pages []bookpipeline.HocrPage
+	for _, v := range variants {
+		p, err := bookpipeline.ReadHocrPage(v.Path)
+		if err != nil {
+			return fmt.Errorf("Failed to read hOCR %s: %s", v.Path, err)
+		}
+		pages = append(pages, p)
+	}
+	for i, score := range metric.Score(pages) {
+		variants[i].Score = score
+	}
+	return nil
+}
+
+// writeConf writes a line to the confidences file for a variant,
+// with its score as a third column if withscore is set
+func writeConf(w io.Writer, c *bookpipeline.Conf, withscore bool) error {
+	var err error
+	if withscore {
+		_, err = fmt.Fprintf(w, "%s\t%02.f\t%02.f\n", c.Path, c.Conf, c.Score)
+	} else {
+		_, err = fmt.Fprintf(w, "%s\t%02.f\n", c.Path, c.Conf)
+	}
+	return err
+}
+
+// mkComposite creates a composite hOCR page from every variant of a
+// page, based on the structure of the best variant, and returns its
+// confidence, and its score from metric if that is set.
+func mkComposite(variants []*bookpipeline.Conf, best *bookpipeline.Conf, metric bookpipeline.PageMetric) (*bookpipeline.Conf, error) {
+	var pages []bookpipeline.HocrPage
+	base := 0
+	for i, v := range variants {
+		p, err := bookpipeline.ReadHocrPage(v.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read hOCR %s: %s", v.Path, err)
+		}
+		pages = append(pages, p)
+		if v == best {
+			base = i
+		}
+	}
+
+	composite := bookpipeline.CompositePage(pages, base)
+
+	fn := strings.TrimSuffix(best.Path, ".hocr") + compositeSuffix + ".hocr"
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating file %s: %s", fn, err)
+	}
+	defer f.Close()
+	err = bookpipeline.WriteBookHocr(f, filepath.Base(fn), []bookpipeline.HocrPage{composite})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write composite hOCR %s: %s", fn, err)
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Error closing file %s: %s", fn, err)
+	}
+
+	score := composite.AvgConf()
+	if metric != nil {
+		scores := metric.Score(append(pages, composite))
+		score = scores[len(scores)-1]
+	}
+
+	return &bookpipeline.Conf{
+		Path:  fn,
+		Code:  strings.TrimSuffix(best.Code, ".hocr") + compositeSuffix + ".hocr",
+		Conf:  composite.AvgConf(),
+		Score: score,
+	}, nil
+}
+
+// readHocrPages reads the hOCR files at each path in pgs
+func readHocrPages(pgs []string) ([]bookpipeline.HocrPage, error) {
+	var pages []bookpipeline.HocrPage
+	for _, pg := range pgs {
+		p, err := bookpipeline.ReadHocrPage(pg)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read hOCR %s: %s", pg, err)
+		}
+		pages = append(pages, p)
+	}
+	return pages, nil
+}
+
+// imageSize returns the width and height of the image at path
+func imageSize(path string) (image.Point, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Point{}, fmt.Errorf("Failed to open image %s: %v", path, err)
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return image.Point{}, fmt.Errorf("Failed to decode image %s: %v", path, err)
+	}
+	return image.Point{X: cfg.Width, Y: cfg.Height}, nil
+}
+
+// mkIIIF creates a IIIF manifest of the book, showing the colour
+// image of each page where there is one, at the size given in
+// coloursizes, and the binarised one otherwise
+func mkIIIF(savedir string, bookname string, meta bookpipeline.Metadata, pages []bookpipeline.HocrPage, binimgs []pageimg, colourfns map[string]string, coloursizes map[string]image.Point, opts AnalyseOpts) (string, error) {
+	b := bookpipeline.IIIFBook{
+		Base:     iiifBookBase(opts.IIIFBase, bookname),
+		Title:    bookname,
+		Metadata: meta,
+		Pages:    pages,
+	}
+	if opts.IIIFSearch != "" {
+		b.Search = iiifBookBase(opts.IIIFSearch, bookname) + "/search"
+	}
+	for _, pg := range binimgs {
+		img := colourfns[pg.hocr]
+		if img == "" {
+			img = pg.img
+		}
+		b.Images = append(b.Images, img)
+		b.Sizes = append(b.Sizes, coloursizes[pg.hocr])
+	}
+
+	fn := filepath.Join(savedir, bookpipeline.IIIFManifestFile)
+	f, err := os.Create(fn)
+	if err != nil {
+		return "", fmt.Errorf("Error creating file %s: %s", fn, err)
+	}
+	defer f.Close()
+	err = bookpipeline.WriteIIIFManifest(f, b)
+	if err != nil {
+		return "", err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", fmt.Errorf("Error closing file %s: %s", fn, err)
+	}
+	return fn, nil
+}
+
+// mkBookHocr creates a single hOCR file containing every page,
+// described with the book's metadata, and a JSON-lines file of all
+// of its words. The paths of the two files are returned.
+func mkBookHocr(savedir string, bookname string, meta bookpipeline.Metadata, pages []bookpipeline.HocrPage) ([]string, error) {
+	hocrfn := filepath.Join(savedir, bookname+".hocr")
+	f, err := os.Create(hocrfn)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating file %s: %s", hocrfn, err)
+	}
+	defer f.Close()
+	if meta.Title == "" {
+		meta.Title = bookname
+	}
+	err = bookpipeline.WriteBookHocrWithMetadata(f, meta, pages)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write book hOCR: %s", err)
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Error closing file %s: %s", hocrfn, err)
+	}
+
+	wordsfn := filepath.Join(savedir, bookname+".words.jsonl")
+	f, err = os.Create(wordsfn)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating file %s: %s", wordsfn, err)
+	}
+	defer f.Close()
+	err = bookpipeline.WriteWordsJSONL(f, pages)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write words file: %s", err)
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Error closing file %s: %s", wordsfn, err)
+	}
+
+	return []string{hocrfn, wordsfn}, nil
+}
+
 func heartbeat(conn Queuer, t *time.Ticker, msg bookpipeline.Qmsg, queue string, msgc chan bookpipeline.Qmsg, errc chan error) {
 	currentmsg := msg
 	for range t.C {
@@ -702,7 +1375,7 @@ func heartbeat(conn Queuer, t *time.Ticker, msg bookpipeline.Qmsg, queue string,
 }
 
 // allOCRed checks whether all pages of a book have been OCRed.
-// This is determined by whether every _bin0.?.png file has a
+// This is determined by whether every _bin0.*.png file has a
 // corresponding .hocr file.
 func allOCRed(bookname string, conn Lister) bool {
 	objs, err := conn.ListObjects(conn.WIPStorageId(), bookname)
@@ -710,7 +1383,7 @@ func allOCRed(bookname string, conn Lister) bool {
 		return false
 	}
 
-	preprocessedPattern := regexp.MustCompile(`_bin[0-9].[0-9].png$`)
+	preprocessedPattern := regexp.MustCompile(`_bin[0-9]\.[0-9]+\.png$`)
 
 	atleastone := false
 	for _, png := range objs {
@@ -742,13 +1415,16 @@ func OcrPage(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, process
 	dl := make(chan string)
 	msgc := make(chan bookpipeline.Qmsg)
 	processc := make(chan string)
+	ocredc := make(chan string)
 	upc := make(chan string)
 	done := make(chan bool)
 	errc := make(chan error)
 
 	msgparts := strings.Split(msg.Body, " ")
 	bookname := filepath.Dir(msgparts[0])
+	var training string
 	if len(msgparts) > 1 && msgparts[1] != "" {
+		training = msgparts[1]
 		process = Ocr(msgparts[1], "")
 	}
 
@@ -763,7 +1439,8 @@ func OcrPage(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, process
 
 	// these functions will do their jobs when their channels have data
 	go download(ctx, dl, processc, conn, d, errc, conn.GetLogger())
-	go process(ctx, processc, upc, errc, conn.GetLogger())
+	go process(ctx, processc, ocredc, errc, conn.GetLogger())
+	go earlyExit(ctx, ocredc, upc, conn, bookname, training, errc, conn.GetLogger())
 	go up(ctx, upc, done, conn, bookname, errc, conn.GetLogger())
 
 	dl <- msgparts[0]
@@ -784,7 +1461,13 @@ func OcrPage(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, process
 
 	if allOCRed(bookname, conn) && toQueue != "" {
 		conn.Log("Sending", bookname, "to queue", toQueue)
-		err = conn.AddToQueue(toQueue, bookname)
+		// the training is passed on so that analysis can queue any
+		// further pages for OCR with the same training
+		qmsg := bookname
+		if len(msgparts) > 1 && msgparts[1] != "" {
+			qmsg += " " + msgparts[1]
+		}
+		err = conn.AddToQueue(toQueue, qmsg)
 		if err != nil {
 			t.Stop()
 			_ = os.RemoveAll(d)
@@ -849,7 +1532,9 @@ func ProcessBook(ctx context.Context, msg bookpipeline.Qmsg, conn Pipeliner, pro
 	go download(ctx, dl, processc, conn, d, errc, conn.GetLogger())
 	go process(ctx, processc, upc, errc, conn.GetLogger())
 	if toQueue == conn.OCRPageQueueId() {
-		go upAndQueue(ctx, upc, done, toQueue, conn, bookname, training, errc, conn.GetLogger())
+		// only binarised pages are queued for OCR, as other files
+		// such as analysis results or settings may also be uploaded
+		go upAndQueue(ctx, upc, done, toQueue, conn, bookname, training, binPattern, errc, conn.GetLogger())
 	} else {
 		go up(ctx, upc, done, conn, bookname, errc, conn.GetLogger())
 	}
@@ -6,6 +6,7 @@ package pipeline
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -100,7 +101,7 @@ func Test_download(t *testing.T) {
 				processchan := make(chan string)
 				errchan := make(chan error)
 
-				go download(dlchan, processchan, conn.c, tempDir, errchan, vlog)
+				go download(context.Background(), dlchan, processchan, conn.c, tempDir, errchan, vlog)
 
 				dlchan <- c.dl
 				close(dlchan)
@@ -213,7 +214,7 @@ func Test_up(t *testing.T) {
 				donechan := make(chan bool)
 				errchan := make(chan error)
 
-				go up(ulchan, donechan, conn.c, "pipelinetest", errchan, vlog)
+				go up(context.Background(), ulchan, donechan, conn.c, "pipelinetest", errchan, vlog)
 
 				ulchan <- filepath.Join(tempDir, c.ul)
 				close(ulchan)
@@ -336,7 +337,7 @@ func Test_upAndQueue(t *testing.T) {
 				donechan := make(chan bool)
 				errchan := make(chan error)
 
-				go upAndQueue(ulchan, donechan, queueurl, conn.c, "pipelinetest", "test", errchan, vlog)
+				go upAndQueue(context.Background(), ulchan, donechan, queueurl, conn.c, "pipelinetest", "test", nil, errchan, vlog)
 
 				ulchan <- filepath.Join(tempDir, c.ul)
 				close(ulchan)
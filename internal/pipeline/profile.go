@@ -0,0 +1,184 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"rescribe.xyz/preproc"
+)
+
+// PreprocProfile is a named set of parameters for binarising and
+// wiping pages, as different kinds of books such as newspapers and
+// manuscripts need different settings. See the preproc package for
+// details of each parameter.
+type PreprocProfile struct {
+	Name string
+
+	BinType  string // binarisation type, e.g. "binary"
+	BinWsize int    // binarisation window size, or 0 for automatic
+
+	// wiping window sizes, thresholds and minimum percentages of the
+	// page to keep, horizontally and vertically
+	HWsize   int
+	HThresh  float64
+	HMinPerc int
+	VWsize   int
+	VThresh  float64
+	VMinPerc int
+}
+
+// DefaultProfile is the name of the profile used if none is chosen
+const DefaultProfile = "default"
+
+// PreprocProfiles are the preprocessing profiles which can be chosen
+// for a book when it is uploaded
+var PreprocProfiles = map[string]PreprocProfile{
+	DefaultProfile: {
+		Name:     DefaultProfile,
+		BinType:  "binary",
+		HWsize:   5,
+		HThresh:  0.03,
+		HMinPerc: 30,
+		VWsize:   120,
+		VThresh:  0.005,
+		VMinPerc: 30,
+	},
+	// newspapers have many narrow columns filling most of the page,
+	// so a smaller vertical window is used, and more of the page is
+	// kept, so that outer columns aren't wiped as noise
+	"newspaper": {
+		Name:     "newspaper",
+		BinType:  "binary",
+		HWsize:   5,
+		HThresh:  0.03,
+		HMinPerc: 60,
+		VWsize:   60,
+		VThresh:  0.005,
+		VMinPerc: 60,
+	},
+	// manuscripts have faint, uneven writing, so lower wiping
+	// thresholds are used to avoid wiping light text
+	"manuscript": {
+		Name:     "manuscript",
+		BinType:  "binary",
+		HWsize:   10,
+		HThresh:  0.015,
+		HMinPerc: 30,
+		VWsize:   120,
+		VThresh:  0.0025,
+		VMinPerc: 30,
+	},
+}
+
+// ProfileFile is the name of the file a book's chosen preprocessing
+// profile is saved in when it is uploaded
+const ProfileFile = "profile.json"
+
+// ProfileNames returns the names of all preprocessing profiles
+func ProfileNames() []string {
+	var names []string
+	for n := range PreprocProfiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UploadProfile saves the named preprocessing profile alongside a
+// book, so that it will be used when the book is preprocessed
+func UploadProfile(name string, bookname string, conn Uploader) error {
+	p, ok := PreprocProfiles[name]
+	if !ok {
+		return fmt.Errorf("Unknown preprocessing profile %s", name)
+	}
+
+	dir, err := ioutil.TempDir("", "bookpipeline")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, ProfileFile)
+	err = writeJSON(fn, p)
+	if err != nil {
+		return err
+	}
+	err = conn.Upload(conn.WIPStorageId(), bookname+"/"+ProfileFile, fn)
+	if err != nil {
+		return fmt.Errorf("Failed to upload %s: %v", fn, err)
+	}
+	return nil
+}
+
+// bookProfile returns the preprocessing profile chosen for a book,
+// or the default profile if none was
+func bookProfile(conn Downloader, savedir string, logger *log.Logger) PreprocProfile {
+	p := PreprocProfiles[DefaultProfile]
+	bookname, err := filepath.Rel(os.TempDir(), savedir)
+	if err != nil {
+		logger.Println("Using default preprocessing profile, as the book name couldn't be found:", err)
+		return p
+	}
+	var chosen PreprocProfile
+	err = downloadJSON(conn, savedir, bookname, ProfileFile, &chosen)
+	if err != nil {
+		logger.Println("Using default preprocessing profile:", err)
+		return p
+	}
+	logger.Println("Using preprocessing profile", chosen.Name)
+	return chosen
+}
+
+// preProcMulti binarises, and optionally wipes, an image with each
+// of the thresholds, using the parameters of profile p. The preproc
+// package names each variant with its threshold to one decimal
+// place, so any finer thresholds, like 0.05, are done one at a time
+// first and renamed with thresholdName, so they aren't overwritten
+// by a threshold which rounds to the same name.
+func preProcMulti(path string, thresholds []float64, wipe bool, p PreprocProfile) ([]string, error) {
+	var done []string
+	var coarse []float64
+	for _, t := range thresholds {
+		if thresholdName(t) == fmt.Sprintf("%.1f", t) {
+			coarse = append(coarse, t)
+			continue
+		}
+		d, err := preproc.PreProcMulti(path, []float64{t}, p.BinType, p.BinWsize, wipe, p.HWsize, p.HMinPerc, p.VWsize, p.VMinPerc)
+		if err != nil {
+			return done, err
+		}
+		for _, fn := range d {
+			codestart := strings.LastIndex(fn, "_bin")
+			if codestart == -1 {
+				done = append(done, fn)
+				continue
+			}
+			newfn := fn[:codestart] + "_bin" + thresholdName(t) + filepath.Ext(fn)
+			err = os.Rename(fn, newfn)
+			if err != nil {
+				return done, fmt.Errorf("Error renaming %s to %s: %v", fn, newfn, err)
+			}
+			done = append(done, newfn)
+		}
+	}
+	if len(coarse) == 0 {
+		return done, nil
+	}
+	d, err := preproc.PreProcMulti(path, coarse, p.BinType, p.BinWsize, wipe, p.HWsize, p.HMinPerc, p.VWsize, p.VMinPerc)
+	return append(done, d...), err
+}
+
+// wipeFile wipes an already binarised image, using the parameters
+// of profile p
+func wipeFile(path string, outpath string, p PreprocProfile) error {
+	return preproc.WipeFile(path, outpath, p.HWsize, p.HThresh, p.HMinPerc, p.VWsize, p.VThresh, p.VMinPerc)
+}
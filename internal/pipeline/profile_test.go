@@ -0,0 +1,63 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"rescribe.xyz/bookpipeline"
+	"testing"
+)
+
+func Test_bookProfile(t *testing.T) {
+	var slog StrLog
+	vlog := log.New(&slog, "", 0)
+
+	conn := &bookpipeline.LocalConn{Logger: vlog}
+	err := conn.Init()
+	if err != nil {
+		t.Fatalf("Could not initialise local connection: %v", err)
+	}
+
+	cases := []struct {
+		book    string
+		profile string
+		want    string
+	}{
+		{"profiletest-newspaper", "newspaper", "newspaper"},
+		{"profiletest-none", "", DefaultProfile},
+	}
+
+	for _, c := range cases {
+		t.Run(c.book, func(t *testing.T) {
+			if c.profile != "" {
+				err := UploadProfile(c.profile, c.book, conn)
+				if err != nil {
+					t.Fatalf("Could not upload profile: %v\nLog: %s", err, slog.log)
+				}
+			}
+			savedir := filepath.Join(os.TempDir(), c.book)
+			err := os.MkdirAll(savedir, 0700)
+			if err != nil {
+				t.Fatalf("Could not create directory %s: %v", savedir, err)
+			}
+			defer os.RemoveAll(savedir)
+
+			p := bookProfile(conn, savedir, vlog)
+			if p.Name != c.want {
+				t.Fatalf("Expected profile %s, got %s\nLog: %s", c.want, p.Name, slog.log)
+			}
+			if p != PreprocProfiles[c.want] {
+				t.Fatalf("Profile %s differs from the one uploaded: %v", p.Name, p)
+			}
+		})
+	}
+
+	err = UploadProfile("nonexistent", "profiletest-bad", conn)
+	if err == nil {
+		t.Fatalf("Expected an error uploading an unknown profile")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	_ "image/png"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
@@ -42,46 +43,14 @@ func (f fileWalk) Walk(path string, info os.FileInfo, err error) error {
 	return nil
 }
 
-// CheckImages checks that all files with a ".jpg" or ".png" suffix
-// in a directory are images that can be decoded (skipping dotfiles)
+// CheckImages checks that all files with a ".jpg" or ".png" suffix,
+// or the suffix of one of the convertFormats, in a directory are
+// images that can be decoded (skipping dotfiles). Every page of a
+// multi-page TIFF is checked, and every image is checked rather than
+// stopping at the first which fails, with all failures listed in
+// the error.
 func CheckImages(ctx context.Context, dir string) error {
-	checker := make(fileWalk)
-	go func() {
-		_ = filepath.Walk(dir, checker.Walk)
-		close(checker)
-	}()
-
-	n := 0
-	for path := range checker {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-		suffix := filepath.Ext(path)
-		lsuffix := strings.ToLower(suffix)
-		if lsuffix == ".jpeg" {
-			lsuffix = ".jpg"
-		}
-		if lsuffix != ".jpg" && lsuffix != ".png" {
-			continue
-		}
-		f, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("Opening image %s failed: %v", path, err)
-		}
-		_, _, err = image.Decode(f)
-		if err != nil {
-			return fmt.Errorf("Decoding image %s failed: %v", path, err)
-		}
-		n++
-	}
-
-	if n == 0 {
-		return fmt.Errorf("No images found")
-	}
-
-	return nil
+	return walkImages(ctx, dir, func(string, int, image.Image) error { return nil })
 }
 
 // DetectQueueType returns which queue to use based on the whether
@@ -98,44 +67,109 @@ func DetectQueueType(dir string, conn Queuer, nowipe bool) string {
 // into conn.WIPStorageId(), prefixed with the given bookname and a
 // slash. It also appends all file names with sequential numbers, like
 // 0001, to ensure they are appropriately named for further processing
-// in the pipeline.
+// in the pipeline. The images are numbered in natural order of their
+// paths, so that "page2.jpg" comes before "page10.jpg", or in the
+// order given by an order file if there is one. Images in any of the
+// convertFormats are converted first, with each page of a multi-page
+// TIFF uploaded separately, and the conversions are listed in
+// ConversionsFile. The original file and label of every page uploaded
+// are listed in PagesFile.
 func UploadImages(ctx context.Context, dir string, bookname string, conn Uploader) error {
-	files, err := ioutil.ReadDir(dir)
+	order, _, err := imageOrder(dir)
+	if err != nil {
+		return err
+	}
+
+	convdir, err := ioutil.TempDir("", "bookpipeline")
 	if err != nil {
-		fmt.Errorf("Failed to read directory %s: %v", dir, err)
+		return fmt.Errorf("Error creating temporary directory: %v", err)
 	}
+	defer os.RemoveAll(convdir)
+	var conversions []Conversion
+	var pages []UploadedPage
 
 	filenum := 0
-	for _, file := range files {
+	for _, o := range order {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
 		}
-		if file.IsDir() {
-			continue
-		}
-		origsuffix := filepath.Ext(file.Name())
+		origname := path.Base(o.File)
+		origsuffix := filepath.Ext(origname)
 		lsuffix := strings.ToLower(origsuffix)
 		if lsuffix == ".jpeg" {
 			lsuffix = ".jpg"
 		}
-		if lsuffix != ".jpg" && lsuffix != ".png" {
-			continue
-		}
-		origname := file.Name()
 		origbase := strings.TrimSuffix(origname, origsuffix)
-		origpath := filepath.Join(dir, origname)
+		origpath := filepath.Join(dir, filepath.FromSlash(o.File))
 
 		safebase := strings.ReplaceAll(origbase, " ", "_")
+
+		if format, ok := convertFormats[lsuffix]; ok {
+			converted, err := convertImage(origpath, convdir)
+			if err != nil {
+				return err
+			}
+			for i, c := range converted {
+				ext := filepath.Ext(c)
+				newname := fmt.Sprintf("%s_%04d%s", safebase, filenum, ext)
+				err = conn.Upload(conn.WIPStorageId(), filepath.Join(bookname, newname), c)
+				if err != nil {
+					return fmt.Errorf("Failed to upload %s converted from %s: %v", c, origpath, err)
+				}
+				_ = os.Remove(c)
+				conv := Conversion{Original: o.File, Uploaded: newname, From: format, To: strings.TrimPrefix(ext, ".")}
+				pg := UploadedPage{Original: o.File, Uploaded: newname}
+				if len(converted) > 1 {
+					conv.Page = i + 1
+					pg.Page = i + 1
+				}
+				// the label is for the first page of a multi-page TIFF
+				if i == 0 {
+					pg.Label = o.Label
+				}
+				conversions = append(conversions, conv)
+				pages = append(pages, pg)
+				filenum++
+			}
+			continue
+		}
+
+		if lsuffix != ".jpg" && lsuffix != ".png" {
+			continue
+		}
 		newname := fmt.Sprintf("%s_%04d%s", safebase, filenum, lsuffix)
 		err = conn.Upload(conn.WIPStorageId(), filepath.Join(bookname, newname), origpath)
 		if err != nil {
 			return fmt.Errorf("Failed to upload %s: %v", origpath, err)
 		}
+		pages = append(pages, UploadedPage{Original: o.File, Uploaded: newname, Label: o.Label})
 
 		filenum++
 	}
 
+	if len(conversions) > 0 {
+		fn := filepath.Join(convdir, ConversionsFile)
+		err = writeJSON(fn, conversions)
+		if err != nil {
+			return err
+		}
+		err = conn.Upload(conn.WIPStorageId(), filepath.Join(bookname, ConversionsFile), fn)
+		if err != nil {
+			return fmt.Errorf("Failed to upload %s: %v", fn, err)
+		}
+	}
+
+	fn := filepath.Join(convdir, PagesFile)
+	err = writeJSON(fn, pages)
+	if err != nil {
+		return err
+	}
+	err = conn.Upload(conn.WIPStorageId(), filepath.Join(bookname, PagesFile), fn)
+	if err != nil {
+		return fmt.Errorf("Failed to upload %s: %v", fn, err)
+	}
+
 	return nil
 }
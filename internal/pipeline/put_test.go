@@ -5,6 +5,7 @@
 package pipeline
 
 import (
+	"context"
 	"errors"
 	"log"
 	"os"
@@ -31,7 +32,7 @@ func Test_CheckImages(t *testing.T) {
 				}
 			}
 
-			err := CheckImages(c.dir)
+			err := CheckImages(context.Background(), c.dir)
 			if err == nil && c.err != nil {
 				t.Fatalf("Expected error '%v', got no error", c.err)
 			}
@@ -71,7 +72,7 @@ func Test_UploadImages(t *testing.T) {
 			}
 			slog.log = ""
 
-			err = UploadImages("testdata/good", "good", conn.c)
+			err = UploadImages(context.Background(), "testdata/good", "good", conn.c)
 			if err != nil {
 				t.Fatalf("Error in UploadImages for %s: %v\nLog: %s", conn.name, err, slog.log)
 			}
@@ -0,0 +1,478 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// QualityLimits are the lowest acceptable values of each measure of
+// the quality of an image. Limits of zero aren't checked.
+type QualityLimits struct {
+	DPI         int     `json:"dpi"`         // resolution, for images which record it
+	Height      int     `json:"height"`      // height in pixels
+	BitDepth    int     `json:"bitdepth"`    // bits per sample
+	JpegQuality int     `json:"jpegquality"` // estimated JPEG quality, from 1 to 100
+	Sharpness   float64 `json:"sharpness"`   // see bookpipeline.Sharpness
+	Contrast    float64 `json:"contrast"`    // see bookpipeline.Contrast
+}
+
+// QualityThresholds are the limits below which an image is warned
+// about, and below which it blocks a book from being submitted
+type QualityThresholds struct {
+	Warn  QualityLimits `json:"warn"`
+	Block QualityLimits `json:"block"`
+}
+
+// DefaultQualityThresholds are the quality thresholds used unless
+// others are chosen. Only resolution and JPEG compression block a
+// book by default, as blank pages and plates can have legitimately
+// low sharpness and contrast.
+var DefaultQualityThresholds = QualityThresholds{
+	Warn: QualityLimits{
+		DPI:         300,
+		Height:      2000,
+		BitDepth:    8,
+		JpegQuality: 75,
+		Sharpness:   100,
+		Contrast:    0.35,
+	},
+	Block: QualityLimits{
+		DPI:         150,
+		Height:      1000,
+		JpegQuality: 40,
+	},
+}
+
+// ReadQualityThresholds reads quality thresholds from a JSON file.
+// Any limits which aren't set in the file are left as their default.
+func ReadQualityThresholds(path string) (QualityThresholds, error) {
+	t := DefaultQualityThresholds
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return t, fmt.Errorf("Error reading quality thresholds %s: %v", path, err)
+	}
+	err = json.Unmarshal(b, &t)
+	if err != nil {
+		return t, fmt.Errorf("Error parsing quality thresholds %s: %v", path, err)
+	}
+	return t, nil
+}
+
+// ImageQuality is the measured quality of an image, and any
+// problems found with it
+type ImageQuality struct {
+	Name        string   `json:"name"`
+	Page        int      `json:"page,omitempty"` // page of a multi-page TIFF, from 1
+	Width       int      `json:"width"`
+	Height      int      `json:"height"`
+	DPI         int      `json:"dpi,omitempty"` // 0 if not recorded
+	BitDepth    int      `json:"bitdepth"`
+	JpegQuality int      `json:"jpegquality,omitempty"` // 0 if not a JPEG
+	Sharpness   float64  `json:"sharpness"`
+	Contrast    float64  `json:"contrast"`
+	Warnings    []string `json:"warnings,omitempty"`
+	Blocks      []string `json:"blocks,omitempty"` // problems which block submission
+}
+
+// String describes the problems with an image
+func (q ImageQuality) String() string {
+	name := q.Name
+	if q.Page > 0 {
+		name = fmt.Sprintf("%s page %d", q.Name, q.Page)
+	}
+	return name + ": " + strings.Join(append(append([]string{}, q.Blocks...), q.Warnings...), "; ")
+}
+
+// qualityChecks returns a function for each measure of an image's
+// quality which describes the problem if it is below a limit
+func (q ImageQuality) qualityChecks() []func(QualityLimits) string {
+	return []func(QualityLimits) string{
+		// an image is only low resolution if neither its recorded
+		// resolution nor its height is high enough, as many cameras
+		// record a meaningless default resolution
+		func(l QualityLimits) string {
+			if l.DPI > 0 && q.DPI >= l.DPI || l.Height > 0 && q.Height >= l.Height {
+				return ""
+			}
+			if l.Height == 0 && (l.DPI == 0 || q.DPI == 0) {
+				return ""
+			}
+			if q.DPI > 0 {
+				return fmt.Sprintf("low resolution of %d dpi and %d pixels high", q.DPI, q.Height)
+			}
+			return fmt.Sprintf("low resolution of %d pixels high", q.Height)
+		},
+		func(l QualityLimits) string {
+			if q.BitDepth >= l.BitDepth {
+				return ""
+			}
+			return fmt.Sprintf("low bit depth of %d", q.BitDepth)
+		},
+		func(l QualityLimits) string {
+			if q.JpegQuality == 0 || q.JpegQuality >= l.JpegQuality {
+				return ""
+			}
+			return fmt.Sprintf("heavy JPEG compression, quality around %d", q.JpegQuality)
+		},
+		func(l QualityLimits) string {
+			if q.Sharpness >= l.Sharpness {
+				return ""
+			}
+			return fmt.Sprintf("blurred, sharpness %.1f", q.Sharpness)
+		},
+		func(l QualityLimits) string {
+			if q.Contrast >= l.Contrast {
+				return ""
+			}
+			return fmt.Sprintf("low contrast of %.2f", q.Contrast)
+		},
+	}
+}
+
+// check records the problems with an image's quality, as blocking
+// if they are below the Block limit, or otherwise as warnings
+func (q *ImageQuality) check(t QualityThresholds) {
+	for _, c := range q.qualityChecks() {
+		if p := c(t.Block); p != "" {
+			q.Blocks = append(q.Blocks, p)
+		} else if p := c(t.Warn); p != "" {
+			q.Warnings = append(q.Warnings, p)
+		}
+	}
+}
+
+// bitDepth returns the number of bits per sample of an image
+func bitDepth(img image.Image) int {
+	switch i := img.(type) {
+	case *image.Paletted:
+		n := 1
+		for 1<<n < len(i.Palette) {
+			n++
+		}
+		return n
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		return 16
+	}
+	if isBilevel(img) {
+		return 1
+	}
+	return 8
+}
+
+// ijgLuminance is the example JPEG luminance quantisation table,
+// which the IJG library and most others scale to set the quality
+var ijgLuminance = [64]int{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+// jpegSegments calls fn with the marker and contents of each segment
+// of a JPEG before its image data
+func jpegSegments(b []byte, fn func(marker byte, seg []byte)) {
+	if len(b) < 2 || b[0] != 0xFF || b[1] != 0xD8 {
+		return
+	}
+	for i := 2; i+4 <= len(b) && b[i] == 0xFF; {
+		marker := b[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return
+		}
+		l := int(binary.BigEndian.Uint16(b[i+2:]))
+		if l < 2 || i+2+l > len(b) {
+			return
+		}
+		fn(marker, b[i+4:i+2+l])
+		i += 2 + l
+	}
+}
+
+// jpegQualityEstimate estimates the quality a JPEG was saved with,
+// by comparing its luminance quantisation table to the scaled
+// tables the IJG library uses. It returns 0 if there is no table.
+func jpegQualityEstimate(b []byte) int {
+	sum := -1
+	jpegSegments(b, func(marker byte, seg []byte) {
+		if marker != 0xDB {
+			return
+		}
+		for j := 0; j < len(seg); {
+			precision, id := seg[j]>>4, seg[j]&0x0F
+			j++
+			size := 64 * int(precision+1)
+			if j+size > len(seg) {
+				return
+			}
+			if id == 0 {
+				sum = 0
+				for k := 0; k < 64; k++ {
+					if precision == 0 {
+						sum += int(seg[j+k])
+					} else {
+						sum += int(binary.BigEndian.Uint16(seg[j+k*2:]))
+					}
+				}
+			}
+			j += size
+		}
+	})
+	if sum < 0 {
+		return 0
+	}
+
+	var std int
+	for _, v := range ijgLuminance {
+		std += v
+	}
+	scale := float64(sum) * 100 / float64(std)
+	var q float64
+	if scale <= 100 {
+		q = (200 - scale) / 2
+	} else {
+		q = 5000 / scale
+	}
+	return int(math.Max(1, math.Min(100, math.Round(q))))
+}
+
+// tiffDPI returns the horizontal resolution recorded in an image
+// file directory of a TIFF, or of EXIF data, which is in the same
+// format, in dots per inch, or 0 if there is none
+func tiffDPI(b []byte, ifd uint32) int {
+	if len(b) < 8 {
+		return 0
+	}
+	order := binary.ByteOrder(binary.LittleEndian)
+	if string(b[0:2]) == "MM" {
+		order = binary.BigEndian
+	}
+	if int(ifd)+2 > len(b) {
+		return 0
+	}
+	n := int(order.Uint16(b[ifd:]))
+	var res float64
+	unit := uint16(2) // inches, the default
+	for i := 0; i < n; i++ {
+		e := int(ifd) + 2 + i*12
+		if e+12 > len(b) {
+			break
+		}
+		switch order.Uint16(b[e:]) {
+		case 282: // XResolution, a rational stored elsewhere
+			off := int(order.Uint32(b[e+8:]))
+			if off+8 > len(b) {
+				continue
+			}
+			num, den := order.Uint32(b[off:]), order.Uint32(b[off+4:])
+			if den > 0 {
+				res = float64(num) / float64(den)
+			}
+		case 296: // ResolutionUnit
+			unit = order.Uint16(b[e+8:])
+		}
+	}
+	switch unit {
+	case 2:
+		return int(math.Round(res))
+	case 3:
+		return int(math.Round(res * 2.54))
+	}
+	return 0
+}
+
+// jpegDPI returns the resolution recorded in a JPEG's JFIF or EXIF
+// header in dots per inch, or 0 if there is none
+func jpegDPI(b []byte) int {
+	dpi := 0
+	jpegSegments(b, func(marker byte, seg []byte) {
+		switch {
+		case dpi != 0:
+		case marker == 0xE0 && len(seg) >= 10 && string(seg[0:5]) == "JFIF\x00":
+			density := float64(binary.BigEndian.Uint16(seg[8:]))
+			switch seg[7] {
+			case 1:
+				dpi = int(density)
+			case 2:
+				dpi = int(math.Round(density * 2.54))
+			}
+		case marker == 0xE1 && len(seg) >= 14 && string(seg[0:6]) == "Exif\x00\x00":
+			tiff := seg[6:]
+			offsets, err := tiffPageOffsets(tiff)
+			if err == nil && len(offsets) > 0 {
+				dpi = tiffDPI(tiff, offsets[0])
+			}
+		}
+	})
+	return dpi
+}
+
+// pngDPI returns the resolution recorded in a PNG's pHYs chunk in
+// dots per inch, or 0 if there is none
+func pngDPI(b []byte) int {
+	for i := 8; i+8 <= len(b); {
+		l := int(binary.BigEndian.Uint32(b[i:]))
+		typ := string(b[i+4 : i+8])
+		if typ == "IDAT" || i+12+l > len(b) {
+			break
+		}
+		if typ == "pHYs" && l >= 9 && b[i+16] == 1 {
+			// pixels per metre
+			return int(math.Round(float64(binary.BigEndian.Uint32(b[i+8:])) * 0.0254))
+		}
+		i += 12 + l
+	}
+	return 0
+}
+
+// imageDPI returns the resolution recorded for a page of an image
+// file, or 0 if there is none
+func imageDPI(b []byte, page int) int {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xFF, 0xD8}):
+		return jpegDPI(b)
+	case bytes.HasPrefix(b, []byte("\x89PNG")):
+		return pngDPI(b)
+	case bytes.HasPrefix(b, []byte("II")) || bytes.HasPrefix(b, []byte("MM")):
+		offsets, err := tiffPageOffsets(b)
+		if err != nil || page < 1 || page > len(offsets) {
+			return 0
+		}
+		return tiffDPI(b, offsets[page-1])
+	}
+	return 0
+}
+
+// walkImages calls fn with each page of every image in a directory
+// which has a ".jpg" or ".png" suffix, or the suffix of one of the
+// convertFormats (skipping dotfiles). Every image is tried, and an
+// error listing all which couldn't be opened or decoded is returned.
+func walkImages(ctx context.Context, dir string, fn func(path string, page int, img image.Image) error) error {
+	checker := make(fileWalk)
+	go func() {
+		_ = filepath.Walk(dir, checker.Walk)
+		close(checker)
+	}()
+
+	n := 0
+	var errs []string
+	for path := range checker {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		lsuffix := strings.ToLower(filepath.Ext(path))
+		if lsuffix == ".jpeg" {
+			lsuffix = ".jpg"
+		}
+		if _, ok := convertFormats[lsuffix]; ok {
+			err := decodePages(path, func(page int, img image.Image) error {
+				return fn(path, page, img)
+			})
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("Decoding image %s failed: %v", path, err))
+			}
+			n++
+			continue
+		}
+		if lsuffix != ".jpg" && lsuffix != ".png" {
+			continue
+		}
+		n++
+		f, err := os.Open(path)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Opening image %s failed: %v", path, err))
+			continue
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Decoding image %s failed: %v", path, err))
+			continue
+		}
+		err = fn(path, 0, img)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	if n == 0 {
+		return fmt.Errorf("No images found")
+	}
+	return nil
+}
+
+// CheckImageQuality checks that all images in a directory can be
+// decoded, like CheckImages, and measures the quality of each, so
+// that scans which would produce poor OCR can be caught before the
+// book is processed. Problems are recorded for each image in the
+// returned report, according to the thresholds t. Every image is
+// checked, and the error lists all images which couldn't be decoded
+// or have problems which block submission.
+func CheckImageQuality(ctx context.Context, dir string, t QualityThresholds) ([]ImageQuality, error) {
+	var report []ImageQuality
+	var blocked []string
+	var lastpath string
+	var b []byte
+	err := walkImages(ctx, dir, func(path string, page int, img image.Image) error {
+		if path != lastpath {
+			var err error
+			b, err = ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("Opening image %s failed: %v", path, err)
+			}
+			lastpath = path
+		}
+
+		q := ImageQuality{
+			Name:      filepath.Base(path),
+			Page:      page,
+			Width:     img.Bounds().Dx(),
+			Height:    img.Bounds().Dy(),
+			DPI:       imageDPI(b, max(page, 1)),
+			BitDepth:  bitDepth(img),
+			Sharpness: bookpipeline.Sharpness(img),
+			Contrast:  bookpipeline.Contrast(img),
+		}
+		if bytes.HasPrefix(b, []byte{0xFF, 0xD8}) {
+			q.JpegQuality = jpegQualityEstimate(b)
+		}
+		q.check(t)
+		report = append(report, q)
+		if len(q.Blocks) > 0 {
+			blocked = append(blocked, q.String())
+		}
+		return nil
+	})
+
+	if len(blocked) > 0 {
+		msg := "Image quality too low to submit:\n" + strings.Join(blocked, "\n")
+		if err != nil {
+			msg = err.Error() + "\n" + msg
+		}
+		return report, fmt.Errorf("%s", msg)
+	}
+	return report, err
+}
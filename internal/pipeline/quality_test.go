@@ -0,0 +1,150 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// jfif returns a JPEG of an image with a JFIF header recording the
+// given resolution in dots per inch
+func jfif(img image.Image, quality int, dpi uint16) []byte {
+	var buf bytes.Buffer
+	_ = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	b := buf.Bytes()
+	app0 := []byte{0xFF, 0xE0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, 1, byte(dpi >> 8), byte(dpi), byte(dpi >> 8), byte(dpi), 0, 0}
+	return append(append(append([]byte{}, b[:2]...), app0...), b[2:]...)
+}
+
+func Test_jpegQualityEstimate(t *testing.T) {
+	img := textImage(200, 300, [][2]int{{20, 180}})
+	for _, q := range []int{20, 40, 60, 75, 90, 95} {
+		var buf bytes.Buffer
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: q})
+		if err != nil {
+			t.Fatalf("Could not encode JPEG: %v", err)
+		}
+		got := jpegQualityEstimate(buf.Bytes())
+		if got < q-2 || got > q+2 {
+			t.Errorf("Expected a quality around %d, got %d", q, got)
+		}
+	}
+	if got := jpegQualityEstimate([]byte("not a jpeg")); got != 0 {
+		t.Errorf("Expected no quality for a non-JPEG, got %d", got)
+	}
+}
+
+func Test_imageDPI(t *testing.T) {
+	img := textImage(100, 150, [][2]int{{10, 90}})
+	if got := imageDPI(jfif(img, 90, 400), 1); got != 400 {
+		t.Errorf("Expected 400 dpi from JFIF, got %d", got)
+	}
+
+	// an 8x1 PNG header followed by a pHYs chunk of 11811 pixels
+	// per metre, which is 300 dpi
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR\x00\x00\x00\x08\x00\x00\x00\x01\x08\x00\x00\x00\x00\x00\x00\x00\x00" +
+		"\x00\x00\x00\x09pHYs\x00\x00\x2e\x23\x00\x00\x2e\x23\x01\x00\x00\x00\x00")
+	if got := imageDPI(png, 1); got != 300 {
+		t.Errorf("Expected 300 dpi from PNG, got %d", got)
+	}
+
+	if got := imageDPI(greyTiff(10, 10, []uint8{128}), 1); got != 0 {
+		t.Errorf("Expected no resolution from TIFF without one, got %d", got)
+	}
+}
+
+func Test_bitDepth(t *testing.T) {
+	bilevel := image.NewGray(image.Rect(0, 0, 4, 4))
+	grey := image.NewGray(image.Rect(0, 0, 4, 4))
+	grey.SetGray(1, 1, color.Gray{128})
+	paletted := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White, color.Gray{128}})
+	cases := []struct {
+		name string
+		img  image.Image
+		want int
+	}{
+		{"bilevel", bilevel, 1},
+		{"grey", grey, 8},
+		{"paletted", paletted, 2},
+		{"grey16", image.NewGray16(image.Rect(0, 0, 4, 4)), 16},
+		{"rgba", image.NewRGBA(image.Rect(0, 0, 4, 4)), 8},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := bitDepth(c.img); got != c.want {
+				t.Errorf("Expected bit depth %d, got %d", c.want, got)
+			}
+		})
+	}
+}
+
+func Test_CheckImageQuality(t *testing.T) {
+	dir := t.TempDir()
+	good := textImage(1400, 2100, [][2]int{{100, 1300}})
+	small := textImage(400, 600, [][2]int{{40, 360}})
+	files := map[string][]byte{
+		"0001.jpg": jfif(good, 90, 300),
+		"0002.jpg": jfif(small, 90, 100),
+		"0003.jpg": jfif(good, 30, 300),
+		"0004.jpg": jfif(good, 60, 300),
+		"0005.png": []byte("not an image"),
+	}
+	for n, b := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, n), b, 0644)
+		if err != nil {
+			t.Fatalf("Could not write image: %v", err)
+		}
+	}
+
+	report, err := CheckImageQuality(context.Background(), dir, DefaultQualityThresholds)
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	for _, want := range []string{"Decoding image " + filepath.Join(dir, "0005.png") + " failed", "0002.jpg: low resolution", "0003.jpg: heavy JPEG compression"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain '%s', got '%v'", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "0001.jpg") || strings.Contains(err.Error(), "0004.jpg") {
+		t.Errorf("Expected only blocking problems in error, got '%v'", err)
+	}
+
+	if len(report) != 4 {
+		t.Fatalf("Expected a report of 4 images, got %d: %v", len(report), report)
+	}
+	for _, q := range report {
+		switch q.Name {
+		case "0001.jpg":
+			if len(q.Blocks) > 0 || len(q.Warnings) > 0 {
+				t.Errorf("Expected no problems with %s, got %v", q.Name, q)
+			}
+			if q.DPI != 300 || q.Height != 2100 || q.BitDepth != 8 {
+				t.Errorf("Unexpected measures of %s: %+v", q.Name, q)
+			}
+		case "0004.jpg":
+			if len(q.Blocks) > 0 || len(q.Warnings) != 1 {
+				t.Errorf("Expected one warning about %s, got %v", q.Name, q)
+			}
+		}
+	}
+
+	report, err = CheckImageQuality(context.Background(), dir, QualityThresholds{})
+	if err == nil || strings.Contains(err.Error(), "quality") {
+		t.Errorf("Expected only the decoding error without thresholds, got '%v'", err)
+	}
+	for _, q := range report {
+		if len(q.Blocks) > 0 || len(q.Warnings) > 0 {
+			t.Errorf("Expected no problems without thresholds, got %v", q)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// PreprocSettings are the settings a book was preprocessed with,
+// which are saved alongside it in PreprocSettingsFile so that later
+// stages can create more variants of pages in the same way
+type PreprocSettings struct {
+	Thresholds []float64 // in order of preference
+	Wipe       bool
+	// EarlyExit is the confidence above which no further threshold
+	// variants of a page are OCRed, or 0 to OCR every variant
+	EarlyExit float64
+	Profile   PreprocProfile
+}
+
+// profile returns the preprocessing profile in the settings, or the
+// default profile if there isn't one
+func (s PreprocSettings) profile() PreprocProfile {
+	if s.Profile.Name == "" {
+		return PreprocProfiles[DefaultProfile]
+	}
+	return s.Profile
+}
+
+// PreprocSettingsFile is the name of the file PreprocSettings are
+// saved in
+const PreprocSettingsFile = "preprocess.json"
+
+// writeJSON saves v as JSON to the file fn
+func writeJSON(fn string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return fmt.Errorf("Error encoding %s: %v", fn, err)
+	}
+	err = ioutil.WriteFile(fn, b, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing file %s: %v", fn, err)
+	}
+	return nil
+}
+
+// downloadJSON downloads a JSON file for a book and decodes it into v
+func downloadJSON(conn Downloader, savedir string, bookname string, name string, v interface{}) error {
+	fn := filepath.Join(savedir, name)
+	err := conn.Download(conn.WIPStorageId(), bookname+"/"+name, fn)
+	if err != nil {
+		return fmt.Errorf("Failed to download %s: %v", name, err)
+	}
+	defer os.Remove(fn)
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", fn, err)
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return fmt.Errorf("Failed to decode %s: %v", fn, err)
+	}
+	return nil
+}
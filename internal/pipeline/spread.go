@@ -0,0 +1,187 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rescribe.xyz/bookpipeline"
+)
+
+// SplitSpreads copies the images in a directory to a new temporary
+// directory, splitting any double page spreads into separate left
+// and right pages. The pages of a spread are named with an "a" and
+// "b" suffix, so that UploadImages numbers them in the right order,
+// and if there is an order file they take the place of the spread
+// in it, with its label kept for the left page. Images in formats
+// which are converted on upload are converted first, so that they
+// can be split too. Subdirectories are kept. The new directory and
+// the number of spreads split are returned, and the directory
+// should be removed once it is no longer needed.
+func SplitSpreads(ctx context.Context, dir string) (string, int, error) {
+	order, ordered, err := imageOrder(dir)
+	if err != nil {
+		return "", 0, err
+	}
+
+	outdir, err := ioutil.TempDir("", "bookpipeline")
+	if err != nil {
+		return "", 0, fmt.Errorf("Error creating temporary directory: %v", err)
+	}
+
+	n := 0
+	var neworder []PageOrder
+	for _, o := range order {
+		select {
+		case <-ctx.Done():
+			_ = os.RemoveAll(outdir)
+			return "", 0, ctx.Err()
+		default:
+		}
+		path := filepath.Join(dir, filepath.FromSlash(o.File))
+		outpath := filepath.Join(outdir, filepath.FromSlash(o.File))
+		err = os.MkdirAll(filepath.Dir(outpath), 0755)
+		if err != nil {
+			_ = os.RemoveAll(outdir)
+			return "", 0, fmt.Errorf("Failed to create directory %s: %v", filepath.Dir(outpath), err)
+		}
+
+		lsuffix := strings.ToLower(filepath.Ext(o.File))
+		if _, ok := convertFormats[lsuffix]; !ok {
+			split, err := splitSpread(path, filepath.Dir(outpath))
+			if err != nil {
+				_ = os.RemoveAll(outdir)
+				return "", 0, err
+			}
+			if split {
+				n++
+			}
+			neworder = append(neworder, splitOrder(o, o.File, split)...)
+			continue
+		}
+
+		// images which would be converted on upload are converted
+		// first, so that they can be split, with each page of a
+		// multi-page TIFF split separately
+		convdir, err := ioutil.TempDir("", "bookpipeline")
+		if err != nil {
+			_ = os.RemoveAll(outdir)
+			return "", 0, fmt.Errorf("Error creating temporary directory: %v", err)
+		}
+		fns, err := convertImage(path, convdir)
+		if err != nil {
+			_ = os.RemoveAll(convdir)
+			_ = os.RemoveAll(outdir)
+			return "", 0, err
+		}
+		for i, fn := range fns {
+			split, err := splitSpread(fn, filepath.Dir(outpath))
+			if err != nil {
+				_ = os.RemoveAll(convdir)
+				_ = os.RemoveAll(outdir)
+				return "", 0, err
+			}
+			if split {
+				n++
+			}
+			pg := o
+			if i > 0 {
+				pg.Label = ""
+			}
+			file := o.File[:strings.LastIndex(o.File, "/")+1] + filepath.Base(fn)
+			neworder = append(neworder, splitOrder(pg, file, split)...)
+		}
+		_ = os.RemoveAll(convdir)
+	}
+
+	if ordered {
+		err = writeOrderFile(outdir, neworder)
+		if err != nil {
+			_ = os.RemoveAll(outdir)
+			return "", 0, err
+		}
+	}
+
+	return outdir, n, nil
+}
+
+// splitOrder returns the order entries of the image named file which
+// was saved in place of the page o, which are its left and right
+// pages if it was split, with the label of o kept for the left page
+func splitOrder(o PageOrder, file string, split bool) []PageOrder {
+	if !split {
+		return []PageOrder{{File: file, Label: o.Label}}
+	}
+	ext := filepath.Ext(file)
+	base := strings.TrimSuffix(file, ext)
+	return []PageOrder{{File: base + "a" + ext, Label: o.Label}, {File: base + "b" + ext}}
+}
+
+// splitSpread saves the left and right pages of the image at path
+// in outdir if it is a double page spread, and otherwise copies it
+// there unchanged, returning whether it was split
+func splitSpread(path string, outdir string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("Failed to open image %s: %v", path, err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return false, fmt.Errorf("Failed to decode image %s: %v", path, err)
+	}
+
+	name := filepath.Base(path)
+	gutter, ok := bookpipeline.FindGutter(img)
+	if !ok {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return false, fmt.Errorf("Failed to read image %s: %v", path, err)
+		}
+		out, err := os.Create(filepath.Join(outdir, name))
+		if err != nil {
+			return false, fmt.Errorf("Failed to create file %s: %v", filepath.Join(outdir, name), err)
+		}
+		defer out.Close()
+		_, err = io.Copy(out, f)
+		if err != nil {
+			return false, fmt.Errorf("Failed to copy image %s: %v", path, err)
+		}
+		return false, out.Close()
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	left, right := bookpipeline.SplitSpread(img, gutter)
+	for _, pg := range []struct {
+		img    image.Image
+		suffix string
+	}{{left, "a"}, {right, "b"}} {
+		fn := filepath.Join(outdir, base+pg.suffix+ext)
+		out, err := os.Create(fn)
+		if err != nil {
+			return false, fmt.Errorf("Failed to create file %s: %v", fn, err)
+		}
+		if strings.ToLower(ext) == ".png" {
+			err = png.Encode(out, pg.img)
+		} else {
+			err = jpeg.Encode(out, pg.img, &jpeg.Options{Quality: 95})
+		}
+		out.Close()
+		if err != nil {
+			return false, fmt.Errorf("Failed to encode image %s: %v", fn, err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package pipeline
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+// textImage creates an image with lines of 'text' in each of the
+// column ranges given
+func textImage(w, h int, cols [][2]int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	for _, c := range cols {
+		for y := 50; y < h-50; y += 30 {
+			for x := c[0]; x < c[1]; x++ {
+				// vary the gaps between words on each line
+				if ((x+y*7)/15)%4 == 3 {
+					continue
+				}
+				for d := 0; d < 10; d++ {
+					img.Set(x, y+d, color.Black)
+				}
+			}
+		}
+	}
+	return img
+}
+
+func Test_SplitSpreads(t *testing.T) {
+	dir := t.TempDir()
+	imgs := []struct {
+		name string
+		img  image.Image
+	}{
+		{"01.png", textImage(600, 800, [][2]int{{50, 550}})},
+		{"02.png", textImage(1200, 800, [][2]int{{50, 550}, {650, 1150}})},
+		{"03.png", textImage(1200, 800, [][2]int{{50, 1150}})},
+	}
+	for _, i := range imgs {
+		f, err := os.Create(filepath.Join(dir, i.name))
+		if err != nil {
+			t.Fatalf("Could not create image: %v", err)
+		}
+		err = png.Encode(f, i.img)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Could not encode image: %v", err)
+		}
+	}
+
+	outdir, n, err := SplitSpreads(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("Error splitting spreads: %v", err)
+	}
+	defer os.RemoveAll(outdir)
+
+	if n != 1 {
+		t.Errorf("Expected 1 spread to be split, got %d", n)
+	}
+	files, err := ioutil.ReadDir(outdir)
+	if err != nil {
+		t.Fatalf("Could not read output directory: %v", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	expected := []string{"01.png", "02a.png", "02b.png", "03.png"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected files %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("Expected files %v, got %v", expected, names)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(outdir, "02a.png"))
+	if err != nil {
+		t.Fatalf("Could not open split page: %v", err)
+	}
+	defer f.Close()
+	cfg, err := png.DecodeConfig(f)
+	if err != nil {
+		t.Fatalf("Could not decode split page: %v", err)
+	}
+	if cfg.Width < 550 || cfg.Width > 650 {
+		t.Errorf("Expected left page to be split in the gutter, but it is %d wide", cfg.Width)
+	}
+}
+
+func Test_SplitSpreadsConverted(t *testing.T) {
+	dir := t.TempDir()
+	err := os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	for _, i := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"01.png", textImage(600, 800, [][2]int{{50, 550}})},
+		{"sub/02.tif", textImage(1200, 800, [][2]int{{50, 550}, {650, 1150}})},
+	} {
+		f, err := os.Create(filepath.Join(dir, filepath.FromSlash(i.name)))
+		if err != nil {
+			t.Fatalf("Could not create image: %v", err)
+		}
+		if filepath.Ext(i.name) == ".tif" {
+			err = tiff.Encode(f, i.img, nil)
+		} else {
+			err = png.Encode(f, i.img)
+		}
+		f.Close()
+		if err != nil {
+			t.Fatalf("Could not encode image: %v", err)
+		}
+	}
+	err = writeOrderFile(dir, []PageOrder{{File: "sub/02.tif", Label: "ii"}, {File: "01.png", Label: "iii"}})
+	if err != nil {
+		t.Fatalf("Could not write order file: %v", err)
+	}
+
+	outdir, n, err := SplitSpreads(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("Error splitting spreads: %v", err)
+	}
+	defer os.RemoveAll(outdir)
+
+	if n != 1 {
+		t.Errorf("Expected 1 spread to be split, got %d", n)
+	}
+	order, ordered, err := imageOrder(outdir)
+	if err != nil {
+		t.Fatalf("Error reading order of split pages: %v", err)
+	}
+	want := []PageOrder{{File: "sub/02a.jpg", Label: "ii"}, {File: "sub/02b.jpg"}, {File: "01.png", Label: "iii"}}
+	if !ordered || !reflect.DeepEqual(order, want) {
+		t.Errorf("Expected order %v, got %v", want, order)
+	}
+	if _, err := os.Stat(filepath.Join(outdir, "sub", "02.tif")); err == nil {
+		t.Errorf("Expected the unconverted image not to be kept")
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+// ManifestPage is the entry for a page in a book's Manifest
+type ManifestPage struct {
+	Name  string  `json:"name"`  // page name, e.g. 0001
+	Hocr  string  `json:"hocr"`  // best hOCR file of the page
+	Image string  `json:"image"` // binarised image of the page
+	Conf  float64 `json:"conf"`
+	// Label is the printed page label, such as "iv" or "12", if
+	// one was given when the book was uploaded or was detected
+	Label string `json:"label,omitempty"`
+	// ImageOnly is set for pages with no text, which are only
+	// included in outputs as images
+	ImageOnly bool `json:"imageOnly,omitempty"`
+	// Blank is set for pages found to be blank in preprocessing,
+	// which were not OCRed
+	Blank bool `json:"blank,omitempty"`
+}
+
+// Manifest lists every page of a processed book in order, with
+// details of how it was processed
+type Manifest struct {
+	Book     string         `json:"book"`
+	Metadata *Metadata      `json:"metadata,omitempty"`
+	Pages    []ManifestPage `json:"pages"`
+}
+
+// ManifestFile is the name of the file a book's Manifest is saved in
+const ManifestFile = "manifest.json"
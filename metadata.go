@@ -0,0 +1,71 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"strings"
+)
+
+// Metadata is the bibliographic description of a book, which is
+// saved alongside it in MetadataFile and included in its outputs
+type Metadata struct {
+	Title     string   `json:"title,omitempty"`
+	Authors   []string `json:"authors,omitempty"`
+	Year      string   `json:"year,omitempty"`      // year of publication
+	Publisher string   `json:"publisher,omitempty"` // printer or publisher
+	Place     string   `json:"place,omitempty"`     // place of publication
+	Language  string   `json:"language,omitempty"`  // language code, e.g. "en" or "la"
+	Shelfmark string   `json:"shelfmark,omitempty"` // shelfmark of the copy scanned
+	// GoogleBooksId is the id of the book in Google Books, if it
+	// came from there
+	GoogleBooksId string `json:"googleBooksId,omitempty"`
+}
+
+// MetadataFile is the name of the file a book's Metadata is saved in
+const MetadataFile = "metadata.json"
+
+// Empty returns whether no details of the book are known
+func (m Metadata) Empty() bool {
+	return m.Title == "" && len(m.Authors) == 0 && m.Year == "" && m.Publisher == "" &&
+		m.Place == "" && m.Language == "" && m.Shelfmark == "" && m.GoogleBooksId == ""
+}
+
+// Author returns the authors of the book, separated by semicolons
+func (m Metadata) Author() string {
+	return strings.Join(m.Authors, "; ")
+}
+
+// Imprint returns the place, publisher and year of publication of
+// the book in the usual form, like "London: J. Smith, 1742", leaving
+// out any which aren't known
+func (m Metadata) Imprint() string {
+	s := m.Place
+	if m.Publisher != "" {
+		if s != "" {
+			s += ": "
+		}
+		s += m.Publisher
+	}
+	if m.Year != "" {
+		if s != "" {
+			s += ", "
+		}
+		s += m.Year
+	}
+	return s
+}
+
+// Source returns the identifiers of the copy of the book which was
+// scanned, its shelfmark and Google Books id, separated by semicolons
+func (m Metadata) Source() string {
+	var s []string
+	if m.Shelfmark != "" {
+		s = append(s, m.Shelfmark)
+	}
+	if m.GoogleBooksId != "" {
+		s = append(s, "Google Books "+m.GoogleBooksId)
+	}
+	return strings.Join(s, "; ")
+}
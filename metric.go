@@ -0,0 +1,231 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// PageMetric scores each of the OCRed variants of a page, such as
+// those from different binarisation thresholds, from 0 to 100, so
+// that the best variant can be chosen. Higher scores are better.
+type PageMetric interface {
+	Score(variants []HocrPage) []float64
+	// String returns the name of the metric, as parsed by ParseMetric
+	String() string
+}
+
+// ConfMetric scores a variant by its average word confidence
+type ConfMetric struct{}
+
+func (m ConfMetric) Score(variants []HocrPage) []float64 {
+	scores := make([]float64, len(variants))
+	for i, v := range variants {
+		scores[i] = v.AvgConf()
+	}
+	return scores
+}
+
+func (m ConfMetric) String() string { return "conf" }
+
+// CharConfMetric scores a variant by its average character
+// confidence, using the hOCR's confidence of each character where
+// it is given. For words without character confidences, each of
+// their characters is taken to have the confidence of the word, so
+// that long words still count for more than short ones.
+type CharConfMetric struct{}
+
+func (m CharConfMetric) Score(variants []HocrPage) []float64 {
+	scores := make([]float64, len(variants))
+	for i, v := range variants {
+		var total, n float64
+		for _, w := range v.Words() {
+			if len(w.CharConfs) > 0 {
+				for _, c := range w.CharConfs {
+					total += c
+				}
+				n += float64(len(w.CharConfs))
+				continue
+			}
+			l := float64(len([]rune(w.Text)))
+			total += w.Conf * l
+			n += l
+		}
+		if n > 0 {
+			scores[i] = total / n
+		}
+	}
+	return scores
+}
+
+func (m CharConfMetric) String() string { return "charconf" }
+
+// WordCountMetric scores a variant by the number of words found in
+// it, as a proportion of the most found in any variant of the page,
+// so that variants which drop hard words entirely are penalised
+type WordCountMetric struct{}
+
+func (m WordCountMetric) Score(variants []HocrPage) []float64 {
+	scores := make([]float64, len(variants))
+	most := 0
+	for _, v := range variants {
+		most = max(most, len(v.Words()))
+	}
+	if most == 0 {
+		return scores
+	}
+	for i, v := range variants {
+		scores[i] = 100 * float64(len(v.Words())) / float64(most)
+	}
+	return scores
+}
+
+func (m WordCountMetric) String() string { return "words" }
+
+// DictMetric scores a variant by the proportion of its words which
+// are in a word list. Words without any letters, such as numbers,
+// are ignored.
+type DictMetric struct {
+	Words map[string]bool
+}
+
+// dictWord normalises a word for looking up in a word list, by
+// removing any surrounding punctuation and lowercasing it. An empty
+// string is returned if the word contains no letters.
+func dictWord(w string) string {
+	w = strings.TrimFunc(w, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if strings.IndexFunc(w, unicode.IsLetter) == -1 {
+		return ""
+	}
+	return strings.ToLower(w)
+}
+
+func (m DictMetric) Score(variants []HocrPage) []float64 {
+	scores := make([]float64, len(variants))
+	for i, v := range variants {
+		var hits, n int
+		for _, w := range v.Words() {
+			d := dictWord(w.Text)
+			if d == "" {
+				continue
+			}
+			n++
+			if m.Words[d] {
+				hits++
+			}
+		}
+		if n > 0 {
+			scores[i] = 100 * float64(hits) / float64(n)
+		}
+	}
+	return scores
+}
+
+func (m DictMetric) String() string { return "dict" }
+
+// CombinedMetric scores a variant by the weighted average of the
+// scores of several metrics
+type CombinedMetric struct {
+	Metrics []PageMetric
+	Weights []float64
+}
+
+func (m CombinedMetric) Score(variants []HocrPage) []float64 {
+	scores := make([]float64, len(variants))
+	var total float64
+	for i, metric := range m.Metrics {
+		total += m.Weights[i]
+		for j, s := range metric.Score(variants) {
+			scores[j] += s * m.Weights[i]
+		}
+	}
+	if total == 0 {
+		return scores
+	}
+	for i := range scores {
+		scores[i] /= total
+	}
+	return scores
+}
+
+func (m CombinedMetric) String() string {
+	var parts []string
+	for i, metric := range m.Metrics {
+		parts = append(parts, fmt.Sprintf("%s:%g", metric, m.Weights[i]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseMetric returns the metric named by s, which is one of conf,
+// charconf, words or dict, or a comma separated list of them with
+// weights to combine them, such as "charconf:2,words:1,dict:1". The
+// words are used as the word list for the dict metric.
+func ParseMetric(s string, words map[string]bool) (PageMetric, error) {
+	if !strings.Contains(s, ",") && !strings.Contains(s, ":") {
+		return namedMetric(s, words)
+	}
+
+	var c CombinedMetric
+	for _, part := range strings.Split(s, ",") {
+		name, weight, found := strings.Cut(strings.TrimSpace(part), ":")
+		w := 1.0
+		if found {
+			var err error
+			w, err = strconv.ParseFloat(weight, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing weight of metric %s: %v", name, err)
+			}
+		}
+		m, err := namedMetric(name, words)
+		if err != nil {
+			return nil, err
+		}
+		c.Metrics = append(c.Metrics, m)
+		c.Weights = append(c.Weights, w)
+	}
+	return c, nil
+}
+
+// namedMetric returns the single metric with the given name
+func namedMetric(name string, words map[string]bool) (PageMetric, error) {
+	switch name {
+	case "conf":
+		return ConfMetric{}, nil
+	case "charconf":
+		return CharConfMetric{}, nil
+	case "words":
+		return WordCountMetric{}, nil
+	case "dict":
+		if len(words) == 0 {
+			return nil, fmt.Errorf("The dict metric needs a word list")
+		}
+		return DictMetric{Words: words}, nil
+	}
+	return nil, fmt.Errorf("Unknown metric %s", name)
+}
+
+// ReadWordList reads a word list with one word per line, normalised
+// in the same way as words are by DictMetric
+func ReadWordList(r io.Reader) (map[string]bool, error) {
+	words := make(map[string]bool)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		w := dictWord(strings.TrimSpace(s.Text()))
+		if w != "" {
+			words[w] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return words, fmt.Errorf("Error reading word list: %v", err)
+	}
+	return words, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// metricPage returns a page with a line of words, with confidences
+// in the same order
+func metricPage(words string, confs ...float64) HocrPage {
+	var l HocrLine
+	for i, w := range strings.Fields(words) {
+		l.Words = append(l.Words, HocrWord{Text: w, Conf: confs[i]})
+	}
+	return HocrPage{Areas: []HocrArea{{Pars: []HocrPar{{Lines: []HocrLine{l}}}}}}
+}
+
+func TestPageMetrics(t *testing.T) {
+	variants := []HocrPage{
+		metricPage("the quick fox", 90, 60, 90),
+		metricPage("the qu1ck", 80, 100),
+		metricPage("12 Fox, the!", 50, 70, 70),
+		{},
+	}
+	dict := map[string]bool{"the": true, "quick": true, "fox": true}
+
+	cases := []struct {
+		metric PageMetric
+		want   []float64
+	}{
+		{ConfMetric{}, []float64{80, 90, 63.333333333333336, 0}},
+		{CharConfMetric{}, []float64{840.0 / 11, 92.5, 66, 0}},
+		{WordCountMetric{}, []float64{100, 200.0 / 3, 100, 0}},
+		{DictMetric{Words: dict}, []float64{100, 50, 100, 0}},
+		{CombinedMetric{Metrics: []PageMetric{ConfMetric{}, WordCountMetric{}}, Weights: []float64{3, 1}}, []float64{85, 84.16666666666667, 72.5, 0}},
+		{CombinedMetric{Metrics: []PageMetric{ConfMetric{}}, Weights: []float64{0}}, []float64{0, 0, 0, 0}},
+	}
+	for _, c := range cases {
+		t.Run(c.metric.String(), func(t *testing.T) {
+			got := c.metric.Score(variants)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Expected %v, got %v", c.want, got)
+			}
+		})
+	}
+
+	if s := (WordCountMetric{}).Score([]HocrPage{{}, {}}); !reflect.DeepEqual(s, []float64{0, 0}) {
+		t.Errorf("Expected pages without words to score 0, got %v", s)
+	}
+}
+
+func TestCharConfMetric(t *testing.T) {
+	// the same word, with one bad character or all of them bad
+	onebad := metricPage("quick", 60)
+	onebad.Areas[0].Pars[0].Lines[0].Words[0].CharConfs = []float64{95, 95, 95, 95, 20}
+	allbad := metricPage("quick", 60)
+	allbad.Areas[0].Pars[0].Lines[0].Words[0].CharConfs = []float64{60, 60, 60, 60, 60}
+	// words without character confidences count by their length
+	mixed := metricPage("the fox", 90, 0)
+	mixed.Areas[0].Pars[0].Lines[0].Words[1].CharConfs = []float64{30, 60, 90}
+
+	got := CharConfMetric{}.Score([]HocrPage{onebad, allbad, mixed})
+	want := []float64{80, 60, 75}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestParseMetric(t *testing.T) {
+	words := map[string]bool{"the": true}
+	cases := []struct {
+		s    string
+		want PageMetric
+		err  bool
+	}{
+		{"conf", ConfMetric{}, false},
+		{"charconf", CharConfMetric{}, false},
+		{"words", WordCountMetric{}, false},
+		{"dict", DictMetric{Words: words}, false},
+		{"charconf:2,words:1,dict:0.5", CombinedMetric{Metrics: []PageMetric{CharConfMetric{}, WordCountMetric{}, DictMetric{Words: words}}, Weights: []float64{2, 1, 0.5}}, false},
+		{"conf, words", CombinedMetric{Metrics: []PageMetric{ConfMetric{}, WordCountMetric{}}, Weights: []float64{1, 1}}, false},
+		{"conf:2", CombinedMetric{Metrics: []PageMetric{ConfMetric{}}, Weights: []float64{2}}, false},
+		{"unknown", nil, true},
+		{"conf:x", nil, true},
+		{"conf,unknown", nil, true},
+		{"", nil, true},
+	}
+	for _, c := range cases {
+		got, err := ParseMetric(c.s, words)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", c.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: expected %#v, got %#v", c.s, c.want, got)
+		}
+	}
+
+	_, err := ParseMetric("dict", nil)
+	if err == nil {
+		t.Errorf("Expected an error for the dict metric without a word list")
+	}
+	m, _ := ParseMetric("charconf:2,words:1", nil)
+	if m.String() != "charconf:2,words:1" {
+		t.Errorf("Expected metric to be named as it was parsed, got %s", m)
+	}
+}
+
+func TestReadWordList(t *testing.T) {
+	words, err := ReadWordList(strings.NewReader("The\n  quick  \n\n1742\n\"fox,\"\n"))
+	if err != nil {
+		t.Fatalf("Error reading word list: %v", err)
+	}
+	want := map[string]bool{"the": true, "quick": true, "fox": true}
+	if !reflect.DeepEqual(words, want) {
+		t.Errorf("Expected %v, got %v", want, words)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"html"
+	"strings"
+)
+
+const odtManifest = `<?xml version="1.0" encoding="UTF-8"?>
+<manifest:manifest xmlns:manifest="urn:oasis:names:tc:opendocument:xmlns:manifest:1.0" manifest:version="1.2">
+<manifest:file-entry manifest:full-path="/" manifest:media-type="application/vnd.oasis.opendocument.text"/>
+<manifest:file-entry manifest:full-path="content.xml" manifest:media-type="text/xml"/>
+</manifest:manifest>
+`
+
+const odtContentHead = `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:style="urn:oasis:names:tc:opendocument:xmlns:style:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0" xmlns:fo="urn:oasis:names:tc:opendocument:xmlns:xsl-fo-compatible:1.0" office:version="1.2">
+<office:automatic-styles>
+<style:style style:name="PageStart" style:family="paragraph"><style:paragraph-properties fo:break-before="page"/></style:style>
+<style:style style:name="LowConf" style:family="text"><style:text-properties fo:background-color="#ffff00"/></style:style>
+</office:automatic-styles>
+<office:body>
+<office:text>
+`
+
+// WriteOdt writes the text of a set of hOCR pages to an
+// OpenDocument Text file, with each hOCR paragraph as a paragraph
+// and a page break between pages. Words with a confidence lower
+// than highlight are highlighted; set highlight to 0 to disable
+// this.
+func WriteOdt(path string, pages []HocrPage, highlight float64) error {
+	var s strings.Builder
+	s.WriteString(odtContentHead)
+	for i, pg := range pages {
+		pagestart := i > 0
+		for _, par := range pg.Pars() {
+			runs := docRuns(par.DehyphenatedWords(), highlight)
+			if len(runs) == 0 {
+				continue
+			}
+			if pagestart {
+				s.WriteString("<text:p text:style-name=\"PageStart\">")
+				pagestart = false
+			} else {
+				s.WriteString("<text:p>")
+			}
+			for _, r := range runs {
+				t := html.EscapeString(r.text)
+				if r.highlight {
+					t = "<text:span text:style-name=\"LowConf\">" + t + "</text:span>"
+				}
+				s.WriteString(t)
+			}
+			s.WriteString("</text:p>\n")
+		}
+		if pagestart {
+			// keep empty pages as an empty paragraph
+			s.WriteString("<text:p text:style-name=\"PageStart\"/>\n")
+		}
+	}
+	s.WriteString("</office:text>\n</office:body>\n</office:document-content>\n")
+
+	files := []zipFile{
+		{"META-INF/manifest.xml", []byte(odtManifest)},
+		{"content.xml", []byte(s.String())},
+	}
+	return writeZip(path, "application/vnd.oasis.opendocument.text", files)
+}
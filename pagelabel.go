@@ -0,0 +1,176 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"strconv"
+	"strings"
+)
+
+// labelWindow is the number of pages either side of a page which
+// are checked for a page number which follows on from one found on
+// it, for the number to be trusted
+const labelWindow = 4
+
+// romanNumerals are the values of roman numerals, largest first,
+// including the subtractive pairs
+var romanNumerals = []struct {
+	n int
+	s string
+}{
+	{1000, "m"}, {900, "cm"}, {500, "d"}, {400, "cd"},
+	{100, "c"}, {90, "xc"}, {50, "l"}, {40, "xl"},
+	{10, "x"}, {9, "ix"}, {5, "v"}, {4, "iv"}, {1, "i"},
+}
+
+// ToRoman returns a number in lower case roman numerals
+func ToRoman(n int) string {
+	var b strings.Builder
+	for _, r := range romanNumerals {
+		for n >= r.n {
+			b.WriteString(r.s)
+			n -= r.n
+		}
+	}
+	return b.String()
+}
+
+// ParseRoman parses a number in roman numerals of either case,
+// only accepting the standard form, so that words like "mix" or
+// "civic" aren't taken as numbers
+func ParseRoman(s string) (int, bool) {
+	l := strings.ToLower(s)
+	n := 0
+	rest := l
+	for _, r := range romanNumerals {
+		for strings.HasPrefix(rest, r.s) {
+			n += r.n
+			rest = rest[len(r.s):]
+		}
+	}
+	if n == 0 || rest != "" || ToRoman(n) != l {
+		return 0, false
+	}
+	return n, true
+}
+
+// pageNumber is a printed page number found on a page
+type pageNumber struct {
+	n     int
+	roman bool
+	upper bool // roman numerals in upper case
+}
+
+// label formats a page number in the same style as p
+func (p pageNumber) label(n int) string {
+	if !p.roman {
+		return strconv.Itoa(n)
+	}
+	if p.upper {
+		return strings.ToUpper(ToRoman(n))
+	}
+	return ToRoman(n)
+}
+
+// parsePageNumber parses a word as an arabic or roman page number,
+// ignoring any surrounding punctuation
+func parsePageNumber(w string) (pageNumber, bool) {
+	w = strings.Trim(w, ".,;:-–—()[]|*")
+	if w == "" {
+		return pageNumber{}, false
+	}
+	if n, err := strconv.Atoi(w); err == nil && n > 0 && len(w) <= 4 {
+		return pageNumber{n: n}, true
+	}
+	if n, ok := ParseRoman(w); ok {
+		return pageNumber{n: n, roman: true, upper: strings.ToUpper(w) == w}, true
+	}
+	return pageNumber{}, false
+}
+
+// pageNumberCandidates returns the possible printed page numbers of
+// each page, from lines which are just a page number, and the first
+// and last words of running headers and footers
+func pageNumberCandidates(pages []HocrPage) [][]pageNumber {
+	cands := make([][]pageNumber, len(pages))
+	for _, r := range FindRunningLines(pages) {
+		words := strings.Fields(r.Text)
+		if len(words) == 0 {
+			continue
+		}
+		if r.Kind == PageNumber {
+			if p, ok := parsePageNumber(strings.Join(words, "")); ok {
+				cands[r.Page] = append(cands[r.Page], p)
+			}
+			continue
+		}
+		for _, w := range []string{words[0], words[len(words)-1]} {
+			if p, ok := parsePageNumber(w); ok {
+				cands[r.Page] = append(cands[r.Page], p)
+			}
+		}
+	}
+	return cands
+}
+
+// DetectPageLabels finds the printed page number of each page of a
+// book from its running headers and footers, returning the label of
+// each page, or "" if none was found. A number is only trusted if a
+// nearby page has a number which follows on from it, and the pages
+// between two trusted numbers which follow on from each other are
+// labelled too, so numbers which are missing or misread are filled
+// in, but unnumbered plates, which break the sequence, are not.
+func DetectPageLabels(pages []HocrPage) []string {
+	cands := pageNumberCandidates(pages)
+
+	anchors := make([]*pageNumber, len(pages))
+	for i, pgcands := range cands {
+		for c := range pgcands {
+			p := pgcands[c]
+			for j := max(0, i-labelWindow); j <= min(len(pages)-1, i+labelWindow) && anchors[i] == nil; j++ {
+				if j == i {
+					continue
+				}
+				for _, q := range cands[j] {
+					if q.roman == p.roman && q.n-p.n == j-i {
+						anchors[i] = &p
+						break
+					}
+				}
+			}
+			if anchors[i] != nil {
+				break
+			}
+		}
+	}
+
+	labels := make([]string, len(pages))
+	prev := -1
+	for i, a := range anchors {
+		if a == nil {
+			continue
+		}
+		labels[i] = a.label(a.n)
+		if prev >= 0 {
+			p := anchors[prev]
+			if p.roman == a.roman && a.n-p.n == i-prev {
+				for j := prev + 1; j < i; j++ {
+					labels[j] = p.label(p.n + j - prev)
+				}
+			}
+		}
+		prev = i
+	}
+	return labels
+}
+
+// pageLabel returns the label of a page, or if it has none its
+// index i counting from 1
+func pageLabel(pg HocrPage, i int) string {
+	if pg.Label != "" {
+		return pg.Label
+	}
+	return strconv.Itoa(i + 1)
+}
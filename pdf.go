@@ -15,6 +15,9 @@ import (
 	_ "image/png"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"strconv"
+	"unicode/utf16"
 
 	//"github.com/phpdave11/gofpdf"
 	"github.com/nickjwhite/gofpdf" // adds SetCellStretchToFit function
@@ -34,6 +37,9 @@ func pxToPt(i int) float64 {
 // Fpdf abstracts the gofpdf.Fpdf adding some useful methods
 type Fpdf struct {
 	fpdf *gofpdf.Fpdf
+	// labels are the printed page labels of each page, or "" for
+	// pages without one
+	labels []string
 }
 
 // Setup creates a new PDF with appropriate settings and fonts
@@ -58,12 +64,37 @@ func (p *Fpdf) Setup() error {
 
 	p.fpdf.SetFont("dejavu", "", 10)
 	p.fpdf.SetAutoPageBreak(false, float64(0))
+	p.labels = nil
 	return p.fpdf.Error()
 }
 
+// SetMetadata records the bibliographic details of a book in the
+// document information of the PDF
+func (p *Fpdf) SetMetadata(m Metadata) {
+	if m.Title != "" {
+		p.fpdf.SetTitle(m.Title, true)
+	}
+	if a := m.Author(); a != "" {
+		p.fpdf.SetAuthor(a, true)
+	}
+	if i := m.Imprint(); i != "" {
+		p.fpdf.SetSubject(i, true)
+	}
+	if s := m.Source(); s != "" {
+		p.fpdf.SetKeywords(s, true)
+	}
+}
+
 // AddPage adds a page to the pdf with an image and (invisible)
 // text from an hocr file
 func (p *Fpdf) AddPage(imgpath, hocrpath string, smaller bool) error {
+	return p.AddLabelledPage(imgpath, hocrpath, smaller, "")
+}
+
+// AddLabelledPage adds a page to the pdf in the same way as AddPage,
+// giving it a printed page label, like "iv" or "12", which PDF
+// readers show in place of the page's number
+func (p *Fpdf) AddLabelledPage(imgpath, hocrpath string, smaller bool, label string) error {
 	file, err := ioutil.ReadFile(hocrpath)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Could not read file %s: %v", hocrpath, err))
@@ -102,6 +133,7 @@ func (p *Fpdf) AddPage(imgpath, hocrpath string, smaller bool) error {
 	}
 
 	p.fpdf.AddPageFormat("P", gofpdf.SizeType{Wd: pxToPt(b.Dx()), Ht: pxToPt(b.Dy())})
+	p.labels = append(p.labels, label)
 
 	_ = p.fpdf.RegisterImageOptionsReader(imgpath, gofpdf.ImageOptions{ImageType: "jpeg"}, &buf)
 	p.fpdf.ImageOptions(imgpath, 0, 0, pxToPt(b.Dx()), pxToPt(b.Dy()), false, gofpdf.ImageOptions{}, 0, "")
@@ -136,5 +168,109 @@ func (p *Fpdf) AddPage(imgpath, hocrpath string, smaller bool) error {
 
 // Save saves the PDF to the file at path
 func (p *Fpdf) Save(path string) error {
-	return p.fpdf.OutputFileAndClose(path)
+	labelled := false
+	for _, l := range p.labels {
+		if l != "" {
+			labelled = true
+		}
+	}
+	if !labelled {
+		return p.fpdf.OutputFileAndClose(path)
+	}
+
+	var buf bytes.Buffer
+	err := p.fpdf.Output(&buf)
+	if err != nil {
+		return err
+	}
+	b, err := addPageLabels(buf.Bytes(), p.labels)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// pdfTextString encodes a string as a PDF text string, in UTF-16
+// so that any characters can be used
+func pdfTextString(s string) string {
+	var b bytes.Buffer
+	b.WriteString("<FEFF")
+	for _, c := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", c)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+var (
+	trailerSize = regexp.MustCompile(`/Size\s+(\d+)`)
+	trailerRoot = regexp.MustCompile(`/Root\s+(\d+)\s+0\s+R`)
+	trailerInfo = regexp.MustCompile(`/Info\s+(\d+)\s+0\s+R`)
+)
+
+// addPageLabels adds page labels to a PDF, as gofpdf can't. They are
+// added to the document catalog in an incremental update appended to
+// the PDF, so that nothing already written needs to change. Pages
+// without a label are labelled with their number.
+func addPageLabels(pdf []byte, labels []string) ([]byte, error) {
+	sx := bytes.LastIndex(pdf, []byte("startxref"))
+	tr := bytes.LastIndex(pdf, []byte("trailer"))
+	if sx == -1 || tr == -1 || tr > sx {
+		return pdf, errors.New("Could not find PDF trailer")
+	}
+	trailer := pdf[tr:sx]
+	f := bytes.Fields(pdf[sx+len("startxref"):])
+	if len(f) == 0 {
+		return pdf, errors.New("Could not find PDF startxref")
+	}
+	prev, err := strconv.Atoi(string(f[0]))
+	if err != nil {
+		return pdf, fmt.Errorf("Could not parse PDF startxref: %v", err)
+	}
+	size := trailerSize.FindSubmatch(trailer)
+	root := trailerRoot.FindSubmatch(trailer)
+	if size == nil || root == nil {
+		return pdf, errors.New("Could not find PDF catalog in trailer")
+	}
+
+	objstart := regexp.MustCompile(`(?m)^` + string(root[1]) + `\s+0\s+obj`).FindIndex(pdf)
+	if objstart == nil {
+		return pdf, errors.New("Could not find PDF catalog")
+	}
+	obj := pdf[objstart[1]:]
+	end := bytes.Index(obj, []byte("endobj"))
+	if end == -1 {
+		return pdf, errors.New("Could not find end of PDF catalog")
+	}
+	catalog := bytes.TrimSpace(obj[:end])
+	if !bytes.HasSuffix(catalog, []byte(">>")) {
+		return pdf, errors.New("Could not parse PDF catalog")
+	}
+	catalog = catalog[:len(catalog)-2]
+
+	var b bytes.Buffer
+	b.Write(pdf)
+	if !bytes.HasSuffix(pdf, []byte("\n")) {
+		b.WriteString("\n")
+	}
+	offset := b.Len()
+	fmt.Fprintf(&b, "%s 0 obj\n", root[1])
+	b.Write(catalog)
+	b.WriteString("\n/PageLabels << /Nums [")
+	for i, l := range labels {
+		if l == "" {
+			l = strconv.Itoa(i + 1)
+		}
+		fmt.Fprintf(&b, " %d << /P %s >>", i, pdfTextString(l))
+	}
+	b.WriteString(" ] >>\n>>\nendobj\n")
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 1\n0000000000 65535 f \n%s 1\n%010d 00000 n \n", root[1], offset)
+	fmt.Fprintf(&b, "trailer\n<<\n/Size %s\n/Root %s 0 R\n", size[1], root[1])
+	if info := trailerInfo.FindSubmatch(trailer); info != nil {
+		fmt.Fprintf(&b, "/Info %s 0 R\n", info[1])
+	}
+	fmt.Fprintf(&b, "/Prev %d\n>>\nstartxref\n%d\n%%%%EOF\n", prev, xref)
+	return b.Bytes(), nil
 }
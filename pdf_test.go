@@ -0,0 +1,107 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// startxrefs returns the offsets given by each startxref in a PDF
+func startxrefs(t *testing.T, b []byte) []int {
+	var offsets []int
+	for _, m := range regexp.MustCompile(`startxref\s+(\d+)`).FindAllSubmatch(b, -1) {
+		n, err := strconv.Atoi(string(m[1]))
+		if err != nil {
+			t.Fatalf("Could not parse startxref %s: %v", m[1], err)
+		}
+		offsets = append(offsets, n)
+	}
+	return offsets
+}
+
+func TestPdfPageLabels(t *testing.T) {
+	dir := t.TempDir()
+	hocrfn := writeTestHocr(t, dir, "0001.hocr", testHocr)
+	imgfn := filepath.Join(dir, "0001.png")
+	f, err := os.Create(imgfn)
+	if err != nil {
+		t.Fatalf("Could not create image: %v", err)
+	}
+	err = png.Encode(f, image.NewGray(image.Rect(0, 0, 100, 150)))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Could not encode image: %v", err)
+	}
+
+	p := new(Fpdf)
+	err = p.Setup()
+	if err != nil {
+		t.Fatalf("Error setting up PDF: %v", err)
+	}
+	for _, l := range []string{"iv", "", "plate"} {
+		err = p.AddLabelledPage(imgfn, hocrfn, false, l)
+		if err != nil {
+			t.Fatalf("Error adding page: %v", err)
+		}
+	}
+	fn := filepath.Join(dir, "book.pdf")
+	err = p.Save(fn)
+	if err != nil {
+		t.Fatalf("Error saving PDF: %v", err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Error reading PDF: %v", err)
+	}
+
+	// the original PDF is followed by the incremental update
+	xrefs := startxrefs(t, b)
+	if len(xrefs) != 2 {
+		t.Fatalf("Expected 2 startxrefs, got %v", xrefs)
+	}
+	for _, x := range xrefs {
+		if x >= len(b) || !bytes.HasPrefix(b[x:], []byte("xref")) {
+			t.Errorf("Expected startxref %d to point at an xref table", x)
+		}
+	}
+	update := b[xrefs[1]:]
+
+	m := regexp.MustCompile(`/Prev (\d+)`).FindSubmatch(update)
+	if m == nil || string(m[1]) != strconv.Itoa(xrefs[0]) {
+		t.Errorf("Expected /Prev to be the original startxref %d, got %s", xrefs[0], m)
+	}
+
+	// the xref entry of the catalog points at the new catalog object
+	m = regexp.MustCompile(`xref\n0 1\n0000000000 65535 f \n(\d+) 1\n(\d{10}) 00000 n \n`).FindSubmatch(update)
+	if m == nil {
+		t.Fatalf("Could not find xref entry for the catalog in %q", update)
+	}
+	offset, _ := strconv.Atoi(string(m[2]))
+	obj := string(m[1]) + " 0 obj"
+	if !bytes.HasPrefix(b[offset:], []byte(obj)) {
+		t.Errorf("Expected xref entry to point at %s, got %q", obj, b[offset:offset+len(obj)])
+	}
+	root := regexp.MustCompile(`/Root (\d+) 0 R`).FindSubmatch(update)
+	if root == nil || string(root[1]) != string(m[1]) {
+		t.Errorf("Expected the trailer's /Root to be object %s, got %s", m[1], root)
+	}
+
+	catalog := b[offset:xrefs[1]]
+	nums := "/PageLabels << /Nums [ 0 << /P " + pdfTextString("iv") + " >> 1 << /P " + pdfTextString("2") + " >> 2 << /P " + pdfTextString("plate") + " >> ] >>"
+	if !bytes.Contains(catalog, []byte(nums)) {
+		t.Errorf("Expected %s in catalog, got %s", nums, catalog)
+	}
+	if !bytes.Contains(catalog, []byte("/Type /Catalog")) {
+		t.Errorf("Expected the original catalog entries to be kept, got %s", catalog)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// hashDim is the width and height of the grid of grey levels an
+// image is reduced to for its PageHash, and hashFreqs is the number
+// of the lowest frequencies in each direction which are kept
+const (
+	hashDim   = 32
+	hashFreqs = 8
+)
+
+// PageHash is a perceptual hash of an image of a page, which differs
+// little between images of the same page, even if they are taken
+// with slightly different lighting or positioning, or saved in
+// different formats
+type PageHash uint64
+
+// PerceptualHash computes the DCT based perceptual hash of an image,
+// by shrinking it to a grid of average grey levels, and recording
+// whether each of the lowest frequencies of its discrete cosine
+// transform is above their median
+func PerceptualHash(img image.Image) PageHash {
+	b := img.Bounds()
+	var sums [hashDim][hashDim]float64
+	var counts [hashDim][hashDim]int
+	// sample at most around 256 points per cell, which is plenty for
+	// an average and much faster for large scans
+	stepx := max(1, b.Dx()/(hashDim*16))
+	stepy := max(1, b.Dy()/(hashDim*16))
+	for y := b.Min.Y; y < b.Max.Y; y += stepy {
+		cy := (y - b.Min.Y) * hashDim / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x += stepx {
+			cx := (x - b.Min.X) * hashDim / b.Dx()
+			sums[cy][cx] += float64(grey(img.At(x, y)))
+			counts[cy][cx]++
+		}
+	}
+	var grid [hashDim][hashDim]float64
+	for y := range grid {
+		for x := range grid[y] {
+			if counts[y][x] > 0 {
+				grid[y][x] = sums[y][x] / float64(counts[y][x])
+			}
+		}
+	}
+
+	var cos [hashFreqs][hashDim]float64
+	for u := range cos {
+		for x := range cos[u] {
+			cos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * hashDim))
+		}
+	}
+	var coefs []float64
+	for v := 0; v < hashFreqs; v++ {
+		for u := 0; u < hashFreqs; u++ {
+			var sum float64
+			for y := 0; y < hashDim; y++ {
+				for x := 0; x < hashDim; x++ {
+					sum += grid[y][x] * cos[u][x] * cos[v][y]
+				}
+			}
+			coefs = append(coefs, sum)
+		}
+	}
+
+	// the first coefficient is just the average brightness, so it is
+	// left out of the median
+	sorted := append([]float64{}, coefs[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash PageHash
+	for i, c := range coefs {
+		if c > median {
+			hash |= 1 << i
+		}
+	}
+	return hash
+}
+
+// Distance returns the number of bits which differ between two
+// hashes, which is small for images of the same page
+func (h PageHash) Distance(o PageHash) int {
+	return bits.OnesCount64(uint64(h ^ o))
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"image"
+	"math"
+)
+
+// sharpnessRows is the number of rows an image is shrunk to before
+// its sharpness is measured, so that the measure depends on how
+// blurred the page is rather than on the resolution of the scan
+const sharpnessRows = 1000
+
+// contrastSamples is roughly the number of pixels sampled when
+// measuring contrast, which is plenty for a histogram
+const contrastSamples = 1000000
+
+// Sharpness measures how sharp an image of a page is, as the
+// variance of the Laplacian of its grey levels, once it has been
+// shrunk to around sharpnessRows high. Blurred or out of focus scans
+// have few strong edges, so a low variance.
+func Sharpness(img image.Image) float64 {
+	b := img.Bounds()
+	step := max(1, b.Dy()/sharpnessRows)
+	w, h := b.Dx()/step, b.Dy()/step
+	if w < 3 || h < 3 {
+		return 0
+	}
+
+	g := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum float64
+			for sy := 0; sy < step; sy++ {
+				for sx := 0; sx < step; sx++ {
+					sum += float64(grey(img.At(b.Min.X+x*step+sx, b.Min.Y+y*step+sy)))
+				}
+			}
+			g[y*w+x] = sum / float64(step*step)
+		}
+	}
+
+	var sum, sumsq float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			l := 4*g[i] - g[i-1] - g[i+1] - g[i-w] - g[i+w]
+			sum += l
+			sumsq += l * l
+		}
+	}
+	n := float64((w - 2) * (h - 2))
+	mean := sum / n
+	return sumsq/n - mean*mean
+}
+
+// Contrast measures the contrast of an image of a page, as the
+// difference between its darkest and lightest grey levels, ignoring
+// the darkest and lightest 1% of pixels so that specks of dust and
+// glare don't count, from 0 for a flat image to 1 for black on white
+func Contrast(img image.Image) float64 {
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+	step := max(1, int(math.Sqrt(float64(b.Dx()*b.Dy())/contrastSamples)))
+
+	var hist [256]int
+	n := 0
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			hist[grey(img.At(x, y))]++
+			n++
+		}
+	}
+
+	cut := n / 100
+	lo, seen := 0, 0
+	for ; lo < 255; lo++ {
+		seen += hist[lo]
+		if seen > cut {
+			break
+		}
+	}
+	hi, seen := 255, 0
+	for ; hi > 0; hi-- {
+		seen += hist[hi]
+		if seen > cut {
+			break
+		}
+	}
+	if hi < lo {
+		return 0
+	}
+	return float64(hi-lo) / 255
+}
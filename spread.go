@@ -0,0 +1,106 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"image"
+	"image/draw"
+)
+
+// spreadMinAspect is the minimum ratio of width to height for an
+// image to be considered as possibly being a double page spread
+const spreadMinAspect = 1.1
+
+// spreadBand is the proportion of the width either side of the
+// centre of an image in which the gutter is looked for
+const spreadBand = 0.1
+
+// gutterMaxEdge is the maximum proportion of the average edge
+// strength of a column that the gutter may have, as a gutter,
+// whether it is a shadow or a light gap, has no text in it
+const gutterMaxEdge = 0.3
+
+// gutterWindow is the proportion of the width either side of each
+// column whose edge strengths are averaged, so that a narrow gap
+// between words which happen to line up isn't taken for the gutter
+const gutterWindow = 0.01
+
+// columnEdges returns the total vertical edge strength of each
+// column of an image, which is high for columns with text in them
+// and low for blank areas or even shadows
+func columnEdges(img image.Image) []float64 {
+	b := img.Bounds()
+	edges := make([]float64, b.Dx())
+	for x := b.Min.X; x < b.Max.X; x++ {
+		prev := int(grey(img.At(x, b.Min.Y)))
+		for y := b.Min.Y + 1; y < b.Max.Y; y++ {
+			g := int(grey(img.At(x, y)))
+			d := g - prev
+			if d < 0 {
+				d = -d
+			}
+			edges[x-b.Min.X] += float64(d)
+			prev = g
+		}
+	}
+	return edges
+}
+
+// FindGutter finds the gutter of an image of a double page spread,
+// returning its x position and whether the image looks like a
+// spread at all. Only images wider than they are tall are
+// considered, and the gutter is the column near the centre with
+// the least text in it, if it has much less than the average.
+func FindGutter(img image.Image) (int, bool) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if h == 0 || float64(w)/float64(h) < spreadMinAspect {
+		return 0, false
+	}
+
+	edges := columnEdges(img)
+	var total float64
+	for _, e := range edges {
+		total += e
+	}
+	avg := total / float64(len(edges))
+	if avg == 0 {
+		return 0, false
+	}
+
+	from := int(float64(w) * (0.5 - spreadBand))
+	to := int(float64(w) * (0.5 + spreadBand))
+	win := max(1, int(float64(w)*gutterWindow))
+	best := -1
+	var bestedge float64
+	for x := from; x <= to; x++ {
+		var sum float64
+		n := 0
+		for i := max(0, x-win); i <= min(w-1, x+win); i++ {
+			sum += edges[i]
+			n++
+		}
+		e := sum / float64(n)
+		if best == -1 || e < bestedge {
+			best, bestedge = x, e
+		}
+	}
+
+	if best == -1 || bestedge > avg*gutterMaxEdge {
+		return 0, false
+	}
+	return b.Min.X + best, true
+}
+
+// SplitSpread splits an image at the x position of its gutter into
+// the left and right pages
+func SplitSpread(img image.Image, gutter int) (image.Image, image.Image) {
+	b := img.Bounds()
+	left := image.NewRGBA(image.Rect(0, 0, gutter-b.Min.X, b.Dy()))
+	draw.Draw(left, left.Bounds(), img, b.Min, draw.Src)
+	right := image.NewRGBA(image.Rect(0, 0, b.Max.X-gutter, b.Dy()))
+	draw.Draw(right, right.Bounds(), img, image.Point{gutter, b.Min.Y}, draw.Src)
+	return left, right
+}
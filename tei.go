@@ -0,0 +1,202 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// MarkStyle is the way uncertain words are marked by MarkedText
+type MarkStyle int
+
+const (
+	// MarkBrackets surrounds uncertain words with square brackets
+	MarkBrackets MarkStyle = iota
+	// MarkUnclear surrounds uncertain words with TEI <unclear> tags
+	MarkUnclear
+)
+
+// markWord marks a word in the given style
+func markWord(w string, style MarkStyle) string {
+	if style == MarkUnclear {
+		return "<unclear>" + w + "</unclear>"
+	}
+	return "[" + w + "]"
+}
+
+// MarkedText returns the text of a set of hOCR pages with every word
+// with a confidence below conf marked in the given style. Words
+// hyphenated across lines are joined, each paragraph is on its own
+// line, and pages are separated by a blank line. With MarkUnclear
+// the text is escaped, so that it is valid TEI markup.
+func MarkedText(pages []HocrPage, conf float64, style MarkStyle) string {
+	var s strings.Builder
+	for i, pg := range pages {
+		if i > 0 {
+			s.WriteString("\n")
+		}
+		for _, par := range pg.Pars() {
+			words := par.DehyphenatedWords()
+			if len(words) == 0 {
+				continue
+			}
+			for j, w := range words {
+				if j > 0 {
+					s.WriteString(" ")
+				}
+				text := w.Text
+				if style == MarkUnclear {
+					text = html.EscapeString(text)
+				}
+				if w.Conf < conf {
+					s.WriteString(markWord(text, style))
+				} else {
+					s.WriteString(text)
+				}
+			}
+			s.WriteString("\n")
+		}
+	}
+	return s.String()
+}
+
+const teiHead = `<?xml version="1.0" encoding="UTF-8"?>
+<TEI xmlns="http://www.tei-c.org/ns/1.0">
+ <teiHeader>
+  <fileDesc>
+   <titleStmt>
+    <title>%s</title>
+%s   </titleStmt>
+   <publicationStmt>
+    <p>Transcribed by OCR with the Rescribe bookpipeline</p>
+   </publicationStmt>
+   <sourceDesc>
+%s   </sourceDesc>
+  </fileDesc>
+ </teiHeader>
+ <text>
+  <body>
+`
+
+// teiSourceDesc returns the contents of the sourceDesc of a TEI
+// header, which is a bibliographic description of the book if any
+// more than its title is known
+func teiSourceDesc(m Metadata) string {
+	e := html.EscapeString
+	if m.Author() == "" && m.Imprint() == "" && m.Source() == "" {
+		return fmt.Sprintf("    <p>Page images of %s</p>\n", e(m.Title))
+	}
+	var s strings.Builder
+	s.WriteString("    <bibl>\n")
+	fields := []struct{ tag, v string }{{"title", m.Title}}
+	for _, a := range m.Authors {
+		fields = append(fields, struct{ tag, v string }{"author", a})
+	}
+	fields = append(fields, []struct{ tag, v string }{
+		{"pubPlace", m.Place},
+		{"publisher", m.Publisher},
+		{"date", m.Year},
+		{"idno type=\"shelfmark\"", m.Shelfmark},
+		{"idno type=\"GoogleBooks\"", m.GoogleBooksId},
+	}...)
+	for _, f := range fields {
+		if f.v != "" {
+			fmt.Fprintf(&s, "     <%s>%s</%s>\n", f.tag, e(f.v), strings.Fields(f.tag)[0])
+		}
+	}
+	s.WriteString("    </bibl>\n")
+	return s.String()
+}
+
+// WriteTei writes a set of hOCR pages as a TEI Lite document. Each
+// page starts with a <pb/>, numbered with the page's label if it has
+// one, paragraphs and lines are kept with <p>
+// and <lb/>, running headers, footers and page numbers are marked
+// with <fw>, and words with a confidence below unclear are wrapped
+// in <unclear> tags.
+func WriteTei(w io.Writer, title string, pages []HocrPage, unclear float64) error {
+	return WriteTeiWithMetadata(w, Metadata{Title: title}, pages, unclear)
+}
+
+// WriteTeiWithMetadata writes a TEI Lite document in the same way as
+// WriteTei, describing the book in its header with the metadata m
+func WriteTeiWithMetadata(w io.Writer, m Metadata, pages []HocrPage, unclear float64) error {
+	bw := bufio.NewWriter(w)
+	e := html.EscapeString
+
+	fw := make(map[[2]int]string)
+	for _, r := range FindRunningLines(pages) {
+		switch r.Kind {
+		case RunningHeader:
+			fw[[2]int{r.Page, r.Line}] = "header"
+		case RunningFooter:
+			fw[[2]int{r.Page, r.Line}] = "footer"
+		case PageNumber:
+			fw[[2]int{r.Page, r.Line}] = "pageNum"
+		}
+	}
+
+	linetext := func(l HocrLine) string {
+		var words []string
+		for _, word := range l.Words {
+			if word.Conf < unclear {
+				words = append(words, "<unclear>"+e(word.Text)+"</unclear>")
+			} else {
+				words = append(words, e(word.Text))
+			}
+		}
+		return strings.Join(words, " ")
+	}
+
+	var authors strings.Builder
+	for _, a := range m.Authors {
+		fmt.Fprintf(&authors, "    <author>%s</author>\n", e(a))
+	}
+	fmt.Fprintf(bw, teiHead, e(m.Title), authors.String(), teiSourceDesc(m))
+	for i, pg := range pages {
+		fmt.Fprintf(bw, "   <pb n=\"%s\"/>\n", e(pageLabel(pg, i)))
+		n := 0
+		for _, par := range pg.Pars() {
+			open := false
+			hyphenated := false
+			for _, l := range par.Lines {
+				if len(l.Words) == 0 {
+					n++
+					continue
+				}
+				if t, ok := fw[[2]int{i, n}]; ok {
+					if open {
+						bw.WriteString("</p>\n")
+						open = false
+					}
+					fmt.Fprintf(bw, "   <fw type=\"%s\">%s</fw>\n", t, linetext(l))
+					n++
+					continue
+				}
+				if !open {
+					bw.WriteString("   <p>")
+					open = true
+				} else if hyphenated {
+					bw.WriteString("<lb break=\"no\"/>")
+				} else {
+					bw.WriteString("<lb/>")
+				}
+				bw.WriteString(linetext(l))
+				hyphenated = EndsHyphenated(l.Text())
+				n++
+			}
+			if open {
+				bw.WriteString("</p>\n")
+			}
+		}
+	}
+	bw.WriteString("  </body>\n </text>\n</TEI>\n")
+
+	return bw.Flush()
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMarkedText(t *testing.T) {
+	cases := []struct {
+		conf  float64
+		style MarkStyle
+		want  string
+	}{
+		{0, MarkBrackets, "Novum Organum sive\nindicia vera\n\n- Organum sive\nindicia vera\n"},
+		{50, MarkBrackets, "Novum [Organum] sive\nindicia vera\n\n[-] [Organum] sive\nindicia vera\n"},
+		{72, MarkUnclear, "Novum <unclear>Organum</unclear> sive\n<unclear>indicia</unclear> vera\n\n<unclear>-</unclear> <unclear>Organum</unclear> sive\n<unclear>indicia</unclear> vera\n"},
+		{100, MarkBrackets, "[Novum] [Organum] [sive]\n[indicia] [vera]\n\n[-] [Organum] [sive]\n[indicia] [vera]\n"},
+	}
+	pages := testPages(t)
+	pages[1].Pars()[0].Lines[0].Words[0].Conf = 10
+	for _, c := range cases {
+		if got := MarkedText(pages, c.conf, c.style); got != c.want {
+			t.Errorf("%.0f %d: expected %q, got %q", c.conf, c.style, c.want, got)
+		}
+	}
+
+	// text is only escaped when it is marked up as TEI
+	special := metricPage("a&b <c>", 40, 90)
+	for _, c := range []struct {
+		style MarkStyle
+		want  string
+	}{
+		{MarkBrackets, "[a&b] <c>\n"},
+		{MarkUnclear, "<unclear>a&amp;b</unclear> &lt;c&gt;\n"},
+	} {
+		if got := MarkedText([]HocrPage{special}, 50, c.style); got != c.want {
+			t.Errorf("%d: expected %q, got %q", c.style, c.want, got)
+		}
+	}
+}
+
+func TestWriteTei(t *testing.T) {
+	pages := append(parseTestHocr(t, testHocr), runningBook()[:3]...)
+	pages[0].Label = "a&b"
+
+	var b bytes.Buffer
+	err := WriteTei(&b, "Novum <Organum>", pages, 50)
+	if err != nil {
+		t.Fatalf("Error writing TEI: %v", err)
+	}
+	s := b.String()
+	for _, want := range []string{
+		"<title>Novum &lt;Organum&gt;</title>",
+		"<p>Page images of Novum &lt;Organum&gt;</p>",
+		"<pb n=\"a&amp;b\"/>\n   <p>Novum <unclear>Orga-</unclear><lb break=\"no\"/>num sive</p>\n   <p>indicia vera</p>\n",
+		"<pb n=\"2\"/>\n   <fw type=\"header\">NOVUM ORGANUM</fw>\n   <p>Of the interpretation</p>\n   <fw type=\"pageNum\">12</fw>\n",
+		"<p>of nature, conti-</p>",
+		"<fw type=\"pageNum\">[14]</fw>\n  </body>",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Expected %q in TEI", want)
+		}
+	}
+	if n := strings.Count(s, "<pb "); n != 4 {
+		t.Errorf("Expected 4 page breaks, got %d", n)
+	}
+
+	b.Reset()
+	m := Metadata{Title: "Novum Organum", Authors: []string{"Francis Bacon"}, Place: "London", Year: "1620", GoogleBooksId: "abc"}
+	err = WriteTeiWithMetadata(&b, m, pages[:1], 0)
+	if err != nil {
+		t.Fatalf("Error writing TEI: %v", err)
+	}
+	s = b.String()
+	for _, want := range []string{
+		"<author>Francis Bacon</author>\n   </titleStmt>",
+		"<bibl>\n     <title>Novum Organum</title>\n     <author>Francis Bacon</author>\n     <pubPlace>London</pubPlace>\n     <date>1620</date>\n     <idno type=\"GoogleBooks\">abc</idno>\n    </bibl>",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Expected %q in TEI", want)
+		}
+	}
+	if strings.Contains(s, "<unclear>") {
+		t.Errorf("Expected no unclear words with an unclear threshold of 0")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// docRun is a sequence of words which are either all highlighted
+// or all not highlighted
+type docRun struct {
+	text      string
+	highlight bool
+}
+
+// docRuns splits the words of a paragraph into runs, highlighting
+// any words with a confidence below highlight. If highlight is 0
+// no words are highlighted.
+func docRuns(words []HocrWord, highlight float64) []docRun {
+	var runs []docRun
+	for i, w := range words {
+		hl := w.Conf < highlight
+		if len(runs) > 0 && runs[len(runs)-1].highlight == hl {
+			runs[len(runs)-1].text += " " + w.Text
+			continue
+		}
+		t := w.Text
+		if i > 0 {
+			// spaces between runs go in the unhighlighted run
+			if hl {
+				runs[len(runs)-1].text += " "
+			} else {
+				t = " " + t
+			}
+		}
+		runs = append(runs, docRun{text: t, highlight: hl})
+	}
+	return runs
+}
+
+// zipFile is a file to be added to a zip archive
+type zipFile struct {
+	name string
+	data []byte
+}
+
+// writeZip writes a zip based document format to path. If mimetype
+// is set it is written uncompressed as the first file, as required
+// by the EPUB and OpenDocument formats.
+func writeZip(path string, mimetype string, files []zipFile) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Error creating file %s: %v", path, err)
+	}
+	defer f.Close()
+
+	z := zip.NewWriter(f)
+
+	if mimetype != "" {
+		w, err := z.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+		if err != nil {
+			return fmt.Errorf("Error writing mimetype to %s: %v", path, err)
+		}
+		_, err = w.Write([]byte(mimetype))
+		if err != nil {
+			return fmt.Errorf("Error writing mimetype to %s: %v", path, err)
+		}
+	}
+
+	for _, file := range files {
+		w, err := z.Create(file.name)
+		if err != nil {
+			return fmt.Errorf("Error writing %s to %s: %v", file.name, path, err)
+		}
+		_, err = w.Write(file.data)
+		if err != nil {
+			return fmt.Errorf("Error writing %s to %s: %v", file.name, path, err)
+		}
+	}
+
+	err = z.Close()
+	if err != nil {
+		return fmt.Errorf("Error finalising %s: %v", path, err)
+	}
+	return f.Close()
+}
+
+// mdSpecial matches characters which have a special meaning
+// anywhere in Markdown
+var mdSpecial = regexp.MustCompile("([\\\\`*_\\[\\]<>|])")
+
+// mdLineStart matches text which would be interpreted as a
+// heading, list or quote at the start of a Markdown paragraph
+var mdLineStart = regexp.MustCompile(`^([#>+-]|[0-9]+\.)`)
+
+// mdEscape escapes text so it is displayed as-is in Markdown
+func mdEscape(s string) string {
+	s = mdSpecial.ReplaceAllString(s, "\\$1")
+	if m := mdLineStart.FindString(s); m != "" {
+		s = m[:len(m)-1] + "\\" + m[len(m)-1:] + s[len(m):]
+	}
+	return s
+}
+
+// WriteMarkdown writes the text of a set of hOCR pages to a
+// Markdown file, with a blank line between paragraphs and a
+// comment marking the start of each page, with its label if it has
+// one. Words with a confidence
+// lower than highlight are wrapped in <mark> tags; set highlight
+// to 0 to disable this.
+func WriteMarkdown(path string, pages []HocrPage, highlight float64) error {
+	var s strings.Builder
+	for i, pg := range pages {
+		fmt.Fprintf(&s, "<!-- page %s -->\n\n", pageLabel(pg, i))
+		for _, par := range pg.Pars() {
+			runs := docRuns(par.DehyphenatedWords(), highlight)
+			if len(runs) == 0 {
+				continue
+			}
+			for j, r := range runs {
+				t := mdEscape(r.text)
+				if j > 0 {
+					// only the start of the paragraph needs its
+					// list and heading markers escaped
+					t = mdSpecial.ReplaceAllString(r.text, "\\$1")
+				}
+				if r.highlight {
+					t = "<mark>" + t + "</mark>"
+				}
+				s.WriteString(t)
+			}
+			s.WriteString("\n\n")
+		}
+	}
+
+	err := ioutil.WriteFile(path, []byte(s.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("Error creating Markdown file %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 Nick White.
+// Use of this source code is governed by the GPLv3
+// license that can be found in the LICENSE file.
+
+package bookpipeline
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDocRuns(t *testing.T) {
+	words := []HocrWord{{Text: "one", Conf: 90}, {Text: "two", Conf: 40}, {Text: "three", Conf: 30}, {Text: "four", Conf: 80}}
+	cases := []struct {
+		highlight float64
+		want      []docRun
+	}{
+		{0, []docRun{{"one two three four", false}}},
+		{50, []docRun{{"one ", false}, {"two three", true}, {" four", false}}},
+		{100, []docRun{{"one two three four", true}}},
+		{35, []docRun{{"one two ", false}, {"three", true}, {" four", false}}},
+	}
+	for _, c := range cases {
+		if got := docRuns(words, c.highlight); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%.0f: expected %+v, got %+v", c.highlight, c.want, got)
+		}
+	}
+	if got := docRuns(nil, 50); len(got) != 0 {
+		t.Errorf("Expected no runs for no words, got %+v", got)
+	}
+}
+
+func TestMdEscape(t *testing.T) {
+	cases := []struct {
+		s, want string
+	}{
+		{"plain text", "plain text"},
+		{"*bold* _it_", "\\*bold\\* \\_it\\_"},
+		{"<b>[x]|`y`\\", "\\<b\\>\\[x\\]\\|\\`y\\`\\\\"},
+		{"# heading", "\\# heading"},
+		{"- item", "\\- item"},
+		{"12. item", "12\\. item"},
+		{"a - b", "a - b"},
+		{"1742 was", "1742 was"},
+	}
+	for _, c := range cases {
+		if got := mdEscape(c.s); got != c.want {
+			t.Errorf("%q: expected %q, got %q", c.s, c.want, got)
+		}
+	}
+}
+
+// testPages returns two pages of hOCR, the second labelled and
+// starting with a paragraph which would be a Markdown list
+func testPages(t *testing.T) []HocrPage {
+	pages := parseTestHocr(t, testHocr)
+	pg2 := parseTestHocr(t, strings.Replace(testHocr, ">Novum<", ">-<", 1))[0]
+	pg2.Label = "iv"
+	return append(pages, pg2)
+}
+
+func TestWriteDocx(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "book.docx")
+	err := WriteDocx(fn, testPages(t), 50)
+	if err != nil {
+		t.Fatalf("Error writing DOCX: %v", err)
+	}
+	files, _ := readZip(t, fn)
+	for _, n := range []string{"[Content_Types].xml", "_rels/.rels"} {
+		if _, ok := files[n]; !ok {
+			t.Errorf("Expected %s in DOCX", n)
+		}
+	}
+	doc := files["word/document.xml"]
+	for _, s := range []string{
+		`<w:p><w:r><w:t xml:space="preserve">Novum </w:t></w:r><w:r><w:rPr><w:highlight w:val="yellow"/></w:rPr><w:t xml:space="preserve">Organum</w:t></w:r><w:r><w:t xml:space="preserve"> sive</w:t></w:r></w:p>`,
+		`<w:p><w:r><w:t xml:space="preserve">indicia vera</w:t></w:r></w:p>`,
+	} {
+		if !strings.Contains(doc, s) {
+			t.Errorf("Expected %s in document", s)
+		}
+	}
+	if n := strings.Count(doc, `<w:br w:type="page"/>`); n != 1 {
+		t.Errorf("Expected 1 page break, got %d", n)
+	}
+}
+
+func TestWriteOdt(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "book.odt")
+	pages := testPages(t)
+	pages = append(pages, HocrPage{})
+	err := WriteOdt(fn, pages, 50)
+	if err != nil {
+		t.Fatalf("Error writing ODT: %v", err)
+	}
+	files, names := readZip(t, fn)
+	if names[0] != "mimetype" || files["mimetype"] != "application/vnd.oasis.opendocument.text" {
+		t.Errorf("Expected mimetype first, got %s", names[0])
+	}
+	if _, ok := files["META-INF/manifest.xml"]; !ok {
+		t.Errorf("Expected manifest in ODT")
+	}
+	content := files["content.xml"]
+	for _, s := range []string{
+		"<text:p>Novum <text:span text:style-name=\"LowConf\">Organum</text:span> sive</text:p>\n<text:p>indicia vera</text:p>\n",
+		"<text:p text:style-name=\"PageStart\">- <text:span text:style-name=\"LowConf\">Organum</text:span> sive</text:p>\n",
+		"<text:p text:style-name=\"PageStart\"/>\n</office:text>",
+	} {
+		if !strings.Contains(content, s) {
+			t.Errorf("Expected %s in content", s)
+		}
+	}
+
+	fn = filepath.Join(dir, "nohighlight.odt")
+	err = WriteOdt(fn, pages, 0)
+	if err != nil {
+		t.Fatalf("Error writing ODT: %v", err)
+	}
+	files, _ = readZip(t, fn)
+	if strings.Contains(files["content.xml"], "<text:span") {
+		t.Errorf("Expected no highlighting with a highlight of 0")
+	}
+}
+
+func TestWriteMarkdown(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "book.md")
+	err := WriteMarkdown(fn, testPages(t), 50)
+	if err != nil {
+		t.Fatalf("Error writing Markdown: %v", err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Error reading Markdown: %v", err)
+	}
+	want := "<!-- page 1 -->\n\n" +
+		"Novum <mark>Organum</mark> sive\n\n" +
+		"indicia vera\n\n" +
+		"<!-- page iv -->\n\n" +
+		"\\- <mark>Organum</mark> sive\n\n" +
+		"indicia vera\n\n"
+	if string(b) != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, b)
+	}
+}